@@ -0,0 +1,26 @@
+//go:build linux
+
+package main
+
+import "golang.org/x/sys/unix"
+
+// pinThread binds the calling OS thread to the n-th CPU, modulo the number of CPUs the
+// process may run on, so that workers are spread over the allowed CPUs.
+func pinThread(n int) error {
+	var allowed unix.CPUSet
+	if err := unix.SchedGetaffinity(0, &allowed); err != nil {
+		return err
+	}
+	var cpus []int
+	for cpu := 0; cpu < len(allowed)*64; cpu++ {
+		if allowed.IsSet(cpu) {
+			cpus = append(cpus, cpu)
+		}
+	}
+	if len(cpus) == 0 {
+		return unix.EINVAL
+	}
+	var set unix.CPUSet
+	set.Set(cpus[n%len(cpus)])
+	return unix.SchedSetaffinity(0, &set)
+}
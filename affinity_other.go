@@ -0,0 +1,10 @@
+//go:build !linux
+
+package main
+
+import "errors"
+
+// pinThread is not supported on this platform.
+func pinThread(n int) error {
+	return errors.ErrUnsupported
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// --- ASN Counting ---
+// readRangeTable reads a table file with one entry per line, whose fields are separated
+// by commas or whitespace, and converts each line with parse. Surrounding quotes of a
+// field, empty lines and lines starting with # are ignored. A first line that parse
+// rejects is taken to be a header and skipped as well.
+func readRangeTable(name string, parse func(fields []string) (labeledRange, error)) (rangeTable, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var ranges []labeledRange
+	sc := bufio.NewScanner(f)
+	for line := 1; sc.Scan(); line++ {
+		text := strings.TrimSpace(sc.Text())
+		if text == "" || text[0] == '#' {
+			continue
+		}
+		var fields []string
+		if strings.Contains(text, ",") {
+			fields = strings.Split(text, ",")
+		} else {
+			fields = strings.Fields(text)
+		}
+		for i, field := range fields {
+			fields[i] = strings.Trim(strings.TrimSpace(field), `"`)
+		}
+		r, err := parse(fields)
+		if err != nil {
+			if line == 1 {
+				continue // A header.
+			}
+			return nil, fmt.Errorf("%s:%d: %w", name, line, err)
+		}
+		ranges = append(ranges, r)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	table, err := newRangeTable(ranges)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	return table, nil
+}
+
+// loadASNTable reads a prefix-to-ASN table with one `prefix asn` pair per line, as in
+// BGP dumps and the GeoLite2 ASN CSV. An "AS" before the number and further columns
+// are ignored.
+func loadASNTable(name string) (rangeTable, error) {
+	return readRangeTable(name, func(fields []string) (labeledRange, error) {
+		if len(fields) < 2 {
+			return labeledRange{}, fmt.Errorf("expected a prefix and an ASN")
+		}
+		r, err := parseCIDR(fields[0])
+		if err != nil {
+			return labeledRange{}, err
+		}
+		asn, err := strconv.ParseUint(strings.TrimPrefix(fields[1], "AS"), 10, 32)
+		if err != nil {
+			return labeledRange{}, fmt.Errorf("invalid ASN %q", fields[1])
+		}
+		return labeledRange{r, uint32(asn)}, nil
+	})
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// TestASNCounts writes a synthetic prefix-to-ASN table of nested prefixes around
+// addresses of the self-test dataset, counts the dataset with --asn-db and compares the
+// unique ASNs and unmatched addresses with a brute-force longest-prefix match.
+func TestASNCounts(t *testing.T) {
+	path, _, expected := selfTestDataset(t)
+	dir := t.TempDir()
+	rnd := rand.New(rand.NewSource(1))
+	ips := make([]uint32, 0, len(expected))
+	for ip := range expected {
+		ips = append(ips, ip)
+	}
+	slices.Sort(ips)
+	var b strings.Builder
+	b.WriteString("network,autonomous_system_number\n")
+	var prefixes []labeledRange
+	for i := 0; i < 200; i++ {
+		r, _ := parseCIDR(fmt.Sprintf("%s/%d", formatIP(ips[rnd.Intn(len(ips))]), 8+rnd.Intn(21)))
+		asn := uint32(rnd.Intn(1000))
+		prefixes = append(prefixes, labeledRange{r, asn})
+		fmt.Fprintf(&b, "%s,AS%d\n", r, asn)
+	}
+	table := filepath.Join(dir, "asn.csv")
+	if err := os.WriteFile(table, []byte(b.String()), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	asns := make(map[uint32]bool)
+	wantUnmatched := 0
+	for _, ip := range ips {
+		best, found := labeledRange{}, false
+		for _, p := range prefixes {
+			if p.start <= ip && ip <= p.end && (!found || p.size() <= best.size()) {
+				best, found = p, true
+			}
+		}
+		if found {
+			asns[best.label] = true
+		} else {
+			wantUnmatched++
+		}
+	}
+	res := countArgs(t, path, "--asn-db", table)
+	if res.ASNs != len(asns) || res.ASNUnmatched != wantUnmatched {
+		t.Fatalf("counted %d ASN(s) and %d unmatched address(es), expected %d and %d",
+			res.ASNs, res.ASNUnmatched, len(asns), wantUnmatched)
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"runtime"
+	"time"
+)
+
+// --- Worker Calibration ---
+const (
+	autoTuneBudget   = 2 * time.Second // Upper bound on the time spent calibrating.
+	autoTuneMaxShare = 4               // At most 1/autoTuneMaxShare of the input is used for calibrating.
+	autoTuneMaxTrial = 64 << 20        // Bytes processed per trial at most.
+)
+
+// autoTuneCandidates returns the worker counts tried by --auto-workers: the powers of
+// two below the number of CPUs, and the number of CPUs itself.
+func autoTuneCandidates() []int {
+	cpus := runtime.NumCPU()
+	var candidates []int
+	for n := 1; n < cpus; n *= 2 {
+		candidates = append(candidates, n)
+	}
+	return append(candidates, cpus)
+}
+
+// calibrateWorkers chooses the number of workers for --auto-workers by processing
+// consecutive newline-aligned slices from the start of data with each candidate count
+// in turn, calling trial for each, and timing them. The slices are part of the input
+// and are not processed again, so calibrating costs only the trials run with slow
+// counts. Each trial gets an equal share of at most a quarter of data, up to 64MiB;
+// trials stop once autoTuneBudget has passed or a count is slower than the one before.
+// Returns the offset in data up to which it was processed and the fastest count, or 0
+// if data is too small to calibrate.
+func calibrateWorkers(data []byte, trial func(data []byte, workers int) error) (int, int, error) {
+	candidates := autoTuneCandidates()
+	size := min(len(data)/autoTuneMaxShare/(len(candidates)+1), autoTuneMaxTrial)
+	if len(candidates) == 1 || size < ChunkMinSize {
+		return 0, 0, nil
+	}
+	start := time.Now()
+	base, best, bestRate, lastRate := 0, 0, 0.0, 0.0
+	// An untimed first slice takes the page faults of first touching the set and the
+	// mapping, which would otherwise make whichever count runs first look slow.
+	for i, workers := range append([]int{1}, candidates...) {
+		end := base + size
+		if nl := bytes.IndexByte(data[end:], '\n'); nl >= 0 {
+			end += nl + 1
+		} else {
+			end = len(data)
+		}
+		trialStart := time.Now()
+		if err := trial(data[base:end], workers); err != nil {
+			return base, 0, atOffset(err, int64(base))
+		}
+		if i == 0 {
+			base = end
+			continue
+		}
+		rate := float64(end-base) / time.Since(trialStart).Seconds()
+		fmt.Fprintf(diag, "Calibrating: %d worker(s) processed %d bytes at %.1f MiB/s\n", workers, end-base, rate/(1<<20))
+		base = end
+		if rate > bestRate {
+			best, bestRate = workers, rate
+		}
+		if rate < lastRate || time.Since(start) > autoTuneBudget || base == len(data) {
+			break
+		}
+		lastRate = rate
+	}
+	fmt.Fprintf(diag, "Calibrated in %v: using %d worker(s)\n", time.Since(start), best)
+	return base, best, nil
+}
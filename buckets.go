@@ -0,0 +1,146 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// --- Time Buckets ---
+// bucketSpec is the --bucket width of the time buckets of timestamped input, in the
+// --timezone location. A width below a day divides the day, and buckets are aligned to
+// local midnight; a width of whole days covers that many calendar days, aligned to a
+// fixed calendar (days counted from 1970-01-01). Both follow local time across DST
+// changes: an hourly bucket always holds an hour of elapsed time, so the day of a change
+// has 23 or 25 of them, and a daily bucket spans a calendar day of 23 to 25 hours.
+type bucketSpec struct {
+	every time.Duration // Width below a day, 0 for days.
+	days  int           // Calendar days per bucket, 0 for widths below a day.
+	loc   *time.Location
+}
+
+// parseBucket parses a --bucket width such as 15m, 1h, 1d or 7d in the location loc.
+// A width in hours that is a whole number of days, such as 48h, is taken as days.
+func parseBucket(s string, loc *time.Location) (bucketSpec, error) {
+	if n, ok := strings.CutSuffix(s, "d"); ok {
+		days, err := strconv.Atoi(n)
+		if err != nil || days < 1 {
+			return bucketSpec{}, fmt.Errorf("invalid --bucket %q", s)
+		}
+		return bucketSpec{days: days, loc: loc}, nil
+	}
+	every, err := time.ParseDuration(s)
+	if err != nil || every < time.Second {
+		return bucketSpec{}, fmt.Errorf("invalid --bucket %q, expected a width of at least 1s such as 1h or 1d", s)
+	}
+	const day = 24 * time.Hour
+	if every%day == 0 {
+		return bucketSpec{days: int(every / day), loc: loc}, nil
+	}
+	if every > day || day%every != 0 {
+		return bucketSpec{}, fmt.Errorf("--bucket %s must divide a day, or be a number of days", s)
+	}
+	return bucketSpec{every: every, loc: loc}, nil
+}
+
+// span returns the start and the end, exclusive, of the bucket holding the Unix second ts.
+func (b bucketSpec) span(ts int64) (start, end time.Time) {
+	t := time.Unix(ts, 0).In(b.loc)
+	y, m, d := t.Date()
+	if b.days > 0 {
+		// The number of the calendar day, the same in every location.
+		n := time.Date(y, m, d, 0, 0, 0, 0, time.UTC).Unix() / 86400
+		r := int(n % int64(b.days))
+		if r < 0 {
+			r += b.days // Days before 1970.
+		}
+		d -= r
+		return time.Date(y, m, d, 0, 0, 0, 0, b.loc), time.Date(y, m, d+b.days, 0, 0, 0, 0, b.loc)
+	}
+	midnight, next := time.Date(y, m, d, 0, 0, 0, 0, b.loc), time.Date(y, m, d+1, 0, 0, 0, 0, b.loc)
+	start = midnight.Add(t.Sub(midnight).Truncate(b.every))
+	end = start.Add(b.every)
+	if end.After(next) {
+		end = next // The last bucket of a day with 25 hours.
+	}
+	return start, end
+}
+
+// timeBuckets holds a sparse set per time bucket of timestamped input, for --bucket, so
+// that the unique addresses of every hour or day are counted alongside the total. Each
+// set takes roughly 40 bytes per address, as with --bitset sparse.
+type timeBuckets struct {
+	spec bucketSpec
+	mu   sync.Mutex
+	sets map[int64]*SparseSet // By the Unix second the bucket starts at.
+}
+
+func newTimeBuckets(spec bucketSpec) *timeBuckets {
+	return &timeBuckets{spec: spec, sets: make(map[int64]*SparseSet)}
+}
+
+// set returns the set of the bucket starting at start, creating it if needed.
+func (tb *timeBuckets) set(start int64) *SparseSet {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+	s, ok := tb.sets[start]
+	if !ok {
+		s = NewSparseSet()
+		tb.sets[start] = s
+	}
+	return s
+}
+
+// bucketCursor adds the records of one worker to their buckets. It keeps the span and the
+// set of the last bucket, so that runs of records in the same bucket, as in logs written
+// in time order, need neither a location lookup nor the lock of the buckets.
+type bucketCursor struct {
+	tb         *timeBuckets
+	start, end int64
+	set        *SparseSet
+}
+
+// add adds ip to the bucket holding the Unix second ts.
+func (c *bucketCursor) add(ts int64, ip uint32) {
+	if c.set == nil || ts < c.start || ts >= c.end {
+		start, end := c.tb.spec.span(ts)
+		c.start, c.end = start.Unix(), end.Unix()
+		c.set = c.tb.set(c.start)
+	}
+	c.set.Set(ip)
+}
+
+// BucketCount is the number of unique addresses of one time bucket, as reported for --bucket.
+type BucketCount struct {
+	Start  string `json:"start"` // Start of the bucket in RFC 3339 form, in the --timezone offset.
+	Unique int    `json:"unique"`
+}
+
+// counts returns the unique count of every bucket that has an address, in time order.
+func (tb *timeBuckets) counts() []BucketCount {
+	starts := make([]int64, 0, len(tb.sets))
+	for start := range tb.sets {
+		starts = append(starts, start)
+	}
+	slices.Sort(starts)
+	counts := make([]BucketCount, len(starts))
+	for i, start := range starts {
+		counts[i] = BucketCount{Start: time.Unix(start, 0).In(tb.spec.loc).Format(time.RFC3339), Unique: tb.sets[start].Count()}
+	}
+	return counts
+}
+
+// printBuckets reports the unique count of every --bucket and records them in res.
+func printBuckets(opts *options, res *Result) {
+	if opts.buckets == nil {
+		return
+	}
+	res.Buckets = opts.buckets.counts()
+	fmt.Fprintf(diag, "Unique addresses per bucket (%d bucket(s)):\n", len(res.Buckets))
+	for _, b := range res.Buckets {
+		fmt.Fprintf(diag, "%s %d\n", b.Start, b.Unique)
+	}
+}
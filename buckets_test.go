@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestBuckets checks the --bucket spans around the DST changes of America/New_York, where
+// the repeated hour of the fall change gets buckets of its own and the calendar days of
+// the changes last 23 and 25 hours, and the alignment of buckets of several days, before
+// 1970 as well. It then counts timestamped records of the fall change into hourly buckets.
+func TestBuckets(t *testing.T) {
+	ny, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Fatal(err)
+	}
+	at := func(s string) int64 {
+		t, _ := time.Parse(time.RFC3339, s)
+		return t.Unix()
+	}
+	hour, _ := parseBucket("1h", ny)
+	day, _ := parseBucket("1d", ny)
+	week, _ := parseBucket("168h", time.UTC)
+	for _, c := range []struct {
+		spec       bucketSpec
+		ts         string
+		start, end string
+	}{
+		{hour, "2024-11-03T05:30:00Z", "2024-11-03T01:00:00-04:00", "2024-11-03T01:00:00-05:00"},
+		{hour, "2024-11-03T06:30:00Z", "2024-11-03T01:00:00-05:00", "2024-11-03T02:00:00-05:00"},
+		{hour, "2024-03-10T07:10:00Z", "2024-03-10T03:00:00-04:00", "2024-03-10T04:00:00-04:00"},
+		{day, "2024-03-10T12:00:00Z", "2024-03-10T00:00:00-05:00", "2024-03-11T00:00:00-04:00"},
+		{day, "2024-11-04T04:59:59Z", "2024-11-03T00:00:00-04:00", "2024-11-04T00:00:00-05:00"},
+		{week, "1970-01-07T23:00:00Z", "1970-01-01T00:00:00Z", "1970-01-08T00:00:00Z"},
+		{week, "1969-12-31T23:59:59Z", "1969-12-25T00:00:00Z", "1970-01-01T00:00:00Z"},
+	} {
+		start, end := c.spec.span(at(c.ts))
+		if start.Format(time.RFC3339) != c.start || end.Format(time.RFC3339) != c.end {
+			t.Fatalf("bucket of %s is %s to %s, expected %s to %s", c.ts, start.Format(time.RFC3339), end.Format(time.RFC3339), c.start, c.end)
+		}
+	}
+	for _, bad := range []string{"7m", "25h", "0d", "500ms", "x"} {
+		if _, err := parseBucket(bad, ny); err == nil {
+			t.Fatalf("--bucket %s was accepted", bad)
+		}
+	}
+
+	// Hour h after midnight of the fall change has h+1 addresses.
+	var data strings.Builder
+	midnight := at("2024-11-03T04:00:00Z")
+	for h := range int64(4) {
+		for i := range h + 1 {
+			fmt.Fprintf(&data, "%d 10.0.%d.%d\n", midnight+h*3600+i*60, h, i)
+		}
+	}
+	buckets := newTimeBuckets(hour)
+	processDataTimed([]byte(data.String()), NewSparseSet(), 2, timeColumns{time: 0, ip: 1}, parseIPFast, parseEpoch, nil, nil, buckets, nil, false)
+	want := []BucketCount{
+		{"2024-11-03T00:00:00-04:00", 1}, {"2024-11-03T01:00:00-04:00", 2},
+		{"2024-11-03T01:00:00-05:00", 3}, {"2024-11-03T02:00:00-05:00", 4},
+	}
+	if got := buckets.counts(); !slices.Equal(got, want) {
+		t.Fatalf("counted %v, expected %v", got, want)
+	}
+}
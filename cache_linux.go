@@ -0,0 +1,15 @@
+//go:build linux
+
+package main
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// dropPageCache advises the kernel to evict the cached pages of the file.
+// Only clean pages that are not mapped can be dropped.
+func dropPageCache(file *os.File) error {
+	return unix.Fadvise(int(file.Fd()), 0, 0, unix.FADV_DONTNEED)
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"os"
+)
+
+// dropPageCache is not supported on this platform.
+func dropPageCache(file *os.File) error {
+	return errors.ErrUnsupported
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// --- Checkpoints ---
+// A checkpoint records how far a run over a single file got: a header line naming the
+// file, its size and the offset of the first line not processed yet, followed by the
+// bitset of the addresses up to there in the serialized bitset format.
+const checkpointMagic = "ipcounter-checkpoint 1"
+
+// checkpointWindow is the number of bytes processed between two chances to write a
+// checkpoint. The workers are idle while a checkpoint is written, so the bitset is not
+// modified while it is serialized.
+const checkpointWindow = 64 << 20
+
+// checkpoint is the header of a checkpoint file.
+type checkpoint struct {
+	file   string // Absolute path of the input file.
+	size   int64  // Size of the input file.
+	offset int64  // Start of the first line not processed yet.
+}
+
+// writeCheckpoint replaces the checkpoint file name with c and the addresses of set,
+// through a temporary file, so that an interruption while writing leaves the previous
+// checkpoint intact.
+func writeCheckpoint(name string, c checkpoint, set IPSet) error {
+	return writeFileAtomic(name, func(w io.Writer) error {
+		bw := bufio.NewWriter(w)
+		fmt.Fprintf(bw, "%s size=%d offset=%d file=%s\n", checkpointMagic, c.size, c.offset, c.file)
+		if _, err := bitSetOf(set).WriteTo(bw); err != nil {
+			return err
+		}
+		return bw.Flush()
+	})
+}
+
+// readCheckpoint reads the checkpoint file name and adds its addresses to set.
+func readCheckpoint(name string, set IPSet) (checkpoint, error) {
+	var c checkpoint
+	f, err := os.Open(name)
+	if err != nil {
+		return c, err
+	}
+	defer f.Close()
+	br := bufio.NewReader(f)
+	header, err := br.ReadString('\n')
+	if err != nil {
+		return c, fmt.Errorf("not a checkpoint: %w", err)
+	}
+	rest, ok := strings.CutPrefix(strings.TrimSuffix(header, "\n"), checkpointMagic+" ")
+	if !ok {
+		return c, errors.New("not a checkpoint")
+	}
+	size, rest, _ := strings.Cut(rest, " ")
+	offset, file, _ := strings.Cut(rest, " ")
+	if c.file, ok = strings.CutPrefix(file, "file="); !ok {
+		return c, errors.New("not a checkpoint")
+	}
+	if c.size, err = strconv.ParseInt(strings.TrimPrefix(size, "size="), 10, 64); err != nil {
+		return c, fmt.Errorf("bad size in checkpoint: %w", err)
+	}
+	if c.offset, err = strconv.ParseInt(strings.TrimPrefix(offset, "offset="), 10, 64); err != nil {
+		return c, fmt.Errorf("bad offset in checkpoint: %w", err)
+	}
+	if bs, ok := set.(*AtomicBitSet); ok {
+		return c, bs.orFrom(br, false)
+	}
+	saved, err := ReadBitSet(br)
+	if err != nil {
+		return c, err
+	}
+	saved.ForEach(set.Set)
+	return c, nil
+}
+
+// processCheckpointed processes the file of the given size into set with processRange,
+// in windows of checkpointWindow bytes aligned to lines, for --checkpoint. After a window,
+// a checkpoint is written once --checkpoint-interval has passed since the last one. With
+// --resume, processing starts from the offset of the checkpoint, after adding its
+// addresses to set; the file must have the same path and size as when it was written, and
+// the offset must start a line. Once the whole file is processed, the checkpoint is
+// removed.
+func processCheckpointed(file *os.File, size int64, set IPSet, opts *options, processRange func(start, end int64, final bool) (int64, error)) error {
+	path, err := filepath.Abs(file.Name())
+	if err != nil {
+		return err
+	}
+	c := checkpoint{file: path, size: size}
+	buf := make([]byte, 64*1024)
+	if opts.resume {
+		saved, err := readCheckpoint(opts.checkpoint, set)
+		if err != nil {
+			return fmt.Errorf("--resume: %s: %w", opts.checkpoint, err)
+		}
+		if saved.file != c.file || saved.size != c.size {
+			return fmt.Errorf("--resume: %s is a checkpoint of %s with %d bytes, not of %s with %d bytes", opts.checkpoint, saved.file, saved.size, c.file, c.size)
+		}
+		if saved.offset < 0 || saved.offset > size {
+			return fmt.Errorf("--resume: offset %d of %s is beyond the end of the file", saved.offset, opts.checkpoint)
+		}
+		if saved.offset > 0 {
+			if start, err := lineEndAfter(file, saved.offset, size, buf); err != nil {
+				return err
+			} else if start != saved.offset {
+				return fmt.Errorf("--resume: offset %d of %s does not start a line", saved.offset, opts.checkpoint)
+			}
+		}
+		c.offset = saved.offset
+		fmt.Fprintf(diag, "Resuming at byte %d of %d from %s\n", c.offset, size, opts.checkpoint)
+	}
+	last := time.Now()
+	for c.offset < size {
+		end, err := lineEndAfter(file, min(c.offset+checkpointWindow, size), size, buf)
+		if err != nil {
+			return err
+		}
+		if _, err := processRange(c.offset, end, true); err != nil {
+			return err
+		}
+		c.offset = end
+		if c.offset < size && time.Since(last) >= opts.checkpointInterval {
+			start := time.Now()
+			if err := writeCheckpoint(opts.checkpoint, c, set); err != nil {
+				return fmt.Errorf("error writing checkpoint %s: %w", opts.checkpoint, err)
+			}
+			fmt.Fprintf(diag, "Checkpoint at byte %d of %d written to %s in %v\n", c.offset, size, opts.checkpoint, time.Since(start))
+			last = time.Now()
+		}
+	}
+	if err := os.Remove(opts.checkpoint); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("error removing checkpoint %s: %w", opts.checkpoint, err)
+	}
+	return nil
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestCheckpoint writes a checkpoint of the self-test dataset that holds the addresses of
+// its first third and resumes from it: the run must count all of the addresses and remove
+// the checkpoint. A checkpoint whose offset is not at a line start, or that belongs to a
+// file of another size, must be refused.
+func TestCheckpoint(t *testing.T) {
+	out := diag
+	diag = io.Discard
+	t.Cleanup(func() { diag = out })
+	path, data, expected := selfTestDataset(t)
+	want := len(expected)
+	dir := t.TempDir()
+	name := filepath.Join(dir, "checkpoint")
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	third := len(data) / 3
+	third += bytes.IndexByte(data[third:], '\n') + 1
+	for _, c := range []checkpoint{
+		{file: abs, size: int64(len(data)), offset: int64(third) - 3},
+		{file: abs, size: int64(len(data)) + 1, offset: int64(third)},
+		{file: abs, size: int64(len(data)), offset: int64(third)},
+	} {
+		set := NewSparseSet()
+		if err := processData(data[:third], set, 1, &options{minRecordLen: MinIPLen}); err != nil {
+			t.Fatal(err)
+		}
+		if err := writeCheckpoint(name, c, set); err != nil {
+			t.Fatal(err)
+		}
+		opts, err := parseFlags([]string{"--checkpoint", name, "--resume", path})
+		if err != nil {
+			t.Fatal(err)
+		}
+		res, err := countUniqueIpInFile(path, opts)
+		if c.offset != int64(third) || c.size != int64(len(data)) {
+			if err == nil {
+				t.Fatalf("resumed from offset %d of a file of %d bytes, expected an error", c.offset, c.size)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.Unique != want {
+			t.Fatalf("resumed run counted %d, expected %d", res.Unique, want)
+		}
+		if _, err := os.Stat(name); !errors.Is(err, os.ErrNotExist) {
+			t.Fatalf("checkpoint not removed after the run: %v", err)
+		}
+	}
+}
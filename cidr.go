@@ -0,0 +1,185 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"math"
+	"math/bits"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// --- CIDR Ranges ---
+// ipRange is an inclusive range of IPv4 addresses.
+type ipRange struct {
+	start, end uint32
+}
+
+// size returns the number of addresses in the range.
+func (r ipRange) size() uint64 {
+	return uint64(r.end-r.start) + 1
+}
+
+// String returns the range in CIDR notation if it is an aligned prefix, or as "start-end" otherwise.
+func (r ipRange) String() string {
+	n := r.size()
+	if n&(n-1) == 0 && uint64(r.start)&(n-1) == 0 {
+		return fmt.Sprintf("%s/%d", formatIP(r.start), 32-bits.TrailingZeros64(n))
+	}
+	return formatIP(r.start) + "-" + formatIP(r.end)
+}
+
+// parseCIDR parses an IPv4 prefix in CIDR notation (e.g. "10.0.0.0/8") into the range it covers.
+// A bare address is treated as a /32. Host bits set in the address are ignored.
+func parseCIDR(s string) (ipRange, error) {
+	addr, prefix, hasPrefix := strings.Cut(strings.TrimSpace(s), "/")
+	ip, ok := parseIPFast([]byte(addr))
+	if !ok {
+		return ipRange{}, fmt.Errorf("invalid IPv4 address in %q", s)
+	}
+	prefixLen := 32
+	if hasPrefix {
+		n, err := strconv.Atoi(prefix)
+		if err != nil || n < 0 || n > 32 {
+			return ipRange{}, fmt.Errorf("invalid prefix length in %q", s)
+		}
+		prefixLen = n
+	}
+	mask := uint32(0)
+	if prefixLen > 0 {
+		mask = ^uint32(0) << (32 - prefixLen)
+	}
+	return ipRange{start: ip & mask, end: ip | ^mask}, nil
+}
+
+// rangeList is a sorted list of non-overlapping, non-adjacent ranges that supports
+// membership tests by binary search.
+type rangeList []ipRange
+
+// newRangeList sorts ranges and merges the overlapping and adjacent ones.
+func newRangeList(ranges []ipRange) rangeList {
+	sorted := slices.Clone(ranges)
+	slices.SortFunc(sorted, func(a, b ipRange) int { return cmp.Compare(a.start, b.start) })
+	var merged rangeList
+	for _, r := range sorted {
+		if n := len(merged); n > 0 && uint64(r.start) <= uint64(merged[n-1].end)+1 {
+			merged[n-1].end = max(merged[n-1].end, r.end)
+			continue
+		}
+		merged = append(merged, r)
+	}
+	return merged
+}
+
+// contains reports whether ip lies within one of the ranges.
+func (rl rangeList) contains(ip uint32) bool {
+	i, _ := slices.BinarySearchFunc(rl, ip, func(r ipRange, ip uint32) int {
+		if r.end < ip {
+			return -1
+		}
+		if r.start > ip {
+			return 1
+		}
+		return 0
+	})
+	return i < len(rl) && rl[i].start <= ip && ip <= rl[i].end
+}
+
+// labeledRange maps an inclusive range of addresses to a label, such as an ASN or the
+// index of a country code.
+type labeledRange struct {
+	ipRange
+	label uint32
+}
+
+// rangeTable is a sorted list of non-overlapping labeled ranges, each carrying the label
+// of the innermost range covering it, so that the labels of a set can be counted range
+// by range. It resolves a longest-prefix match for tables of CIDR prefixes.
+type rangeTable []labeledRange
+
+// newRangeTable flattens nested ranges into a rangeTable in which every address carries
+// the label of the innermost range containing it. Of identical ranges, the last wins.
+// Ranges that overlap without one containing the other are an error, as no range is
+// innermost for the addresses they share.
+func newRangeTable(ranges []labeledRange) (rangeTable, error) {
+	sorted := slices.Clone(ranges)
+	// Outer ranges sort before the ranges nested in them.
+	slices.SortStableFunc(sorted, func(a, b labeledRange) int {
+		return cmp.Or(cmp.Compare(a.start, b.start), cmp.Compare(b.end, a.end))
+	})
+	var table rangeTable
+	emit := func(from, to uint64, label uint32) {
+		if from > to {
+			return
+		}
+		if n := len(table); n > 0 && table[n-1].label == label && uint64(table[n-1].end)+1 == from {
+			table[n-1].end = uint32(to)
+			return
+		}
+		table = append(table, labeledRange{ipRange{uint32(from), uint32(to)}, label})
+	}
+	// open holds the ranges containing the cursor, innermost last.
+	var open []labeledRange
+	cursor := uint64(0)
+	closeUntil := func(limit uint64) {
+		for len(open) > 0 && uint64(open[len(open)-1].end) < limit {
+			top := open[len(open)-1]
+			emit(cursor, uint64(top.end), top.label)
+			cursor = max(cursor, uint64(top.end)+1)
+			open = open[:len(open)-1]
+		}
+	}
+	for _, r := range sorted {
+		closeUntil(uint64(r.start))
+		// The innermost open range contains the start of r, and must contain all of it.
+		if n := len(open); n > 0 && open[n-1].end < r.end {
+			return nil, fmt.Errorf("ranges %v and %v overlap without one containing the other", open[n-1].ipRange, r.ipRange)
+		}
+		if len(open) > 0 && uint64(r.start) > cursor {
+			emit(cursor, uint64(r.start)-1, open[len(open)-1].label)
+		}
+		cursor = uint64(r.start)
+		open = append(open, r)
+	}
+	closeUntil(math.MaxUint32 + 1)
+	return table, nil
+}
+
+// countLabels returns the number of addresses of set per label, omitting labels without
+// any, and the number of addresses that no range of the table covers. On a dense bitset it
+// works range by range over the set instead of address by address, so its cost depends on
+// the size of the table rather than on the number of addresses. Other sets count a range
+// in time linear in their size, so their addresses are walked once instead, alongside the
+// table.
+func (t rangeTable) countLabels(set IPSet) (counts map[uint32]int, unmatched int) {
+	counts = make(map[uint32]int)
+	if denseBitSetOf(set) == nil {
+		i := 0
+		set.ForEach(func(ip uint32) {
+			for i < len(t) && t[i].end < ip {
+				i++
+			}
+			if i < len(t) && t[i].start <= ip {
+				counts[t[i].label]++
+			} else {
+				unmatched++
+			}
+		})
+		return counts, unmatched
+	}
+	cursor := uint64(0)
+	for _, r := range t {
+		if uint64(r.start) > cursor {
+			unmatched += set.CountRange(uint32(cursor), r.start-1)
+		}
+		if n := set.CountRange(r.start, r.end); n > 0 {
+			counts[r.label] += n
+		}
+		cursor = uint64(r.end) + 1
+	}
+	if cursor <= math.MaxUint32 {
+		unmatched += set.CountRange(uint32(cursor), math.MaxUint32)
+	}
+	return counts, unmatched
+}
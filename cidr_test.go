@@ -0,0 +1,77 @@
+package main
+
+import (
+	"maps"
+	"math/rand"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// TestCountLabelsSets checks that the labels of a sparse set, whose addresses are walked,
+// are counted the same as those of a dense bitset, counted range by range.
+func TestCountLabelsSets(t *testing.T) {
+	table, err := newRangeTable([]labeledRange{
+		{ipRange{start: 10 << 24, end: 11<<24 - 1}, 1},
+		{ipRange{start: 10<<24 | 1<<16, end: 10<<24 | 2<<16 - 1}, 2},
+		{ipRange{start: 10<<24 | 1<<16 | 5<<8, end: 10<<24 | 1<<16 | 6<<8 - 1}, 3},
+		{ipRange{start: 192 << 24, end: 193<<24 - 1}, 2},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rnd := rand.New(rand.NewSource(1))
+	dense, sparse := NewAtomicBitSet(), NewSparseSet()
+	for range 50_000 {
+		ip := rnd.Uint32()
+		if rnd.Intn(2) == 0 {
+			ip = 10<<24 | ip&(1<<17-1)
+		}
+		dense.Set(ip)
+		sparse.Set(ip)
+	}
+	want, wantUnmatched := table.countLabels(dense)
+	got, unmatched := table.countLabels(sparse)
+	if !maps.Equal(got, want) || unmatched != wantUnmatched {
+		t.Errorf("sparse set: %v and %d unmatched, dense bitset: %v and %d", got, unmatched, want, wantUnmatched)
+	}
+	if len(want) != 3 || wantUnmatched == 0 {
+		t.Errorf("dense bitset: %v and %d unmatched, expected all labels and some unmatched", want, wantUnmatched)
+	}
+}
+
+// TestRangeOverlap builds range tables from nested and adjacent ranges, which must be
+// accepted, and from ranges that partly overlap, which must be rejected with an error
+// naming both of them.
+func TestRangeOverlap(t *testing.T) {
+	r := func(s string, label uint32) labeledRange {
+		from, to, ok := strings.Cut(s, "-")
+		if !ok {
+			p, _ := parseCIDR(s)
+			return labeledRange{p, label}
+		}
+		start, _ := parseIPFast([]byte(from))
+		end, _ := parseIPFast([]byte(to))
+		return labeledRange{ipRange{start, end}, label}
+	}
+	table, err := newRangeTable([]labeledRange{r("10.0.0.0/8", 1), r("10.1.0.0/16", 2), r("10.1.0.0/16", 3), r("11.0.0.0-11.0.0.9", 4), r("11.0.0.10-11.0.0.20", 5)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := rangeTable{
+		r("10.0.0.0-10.0.255.255", 1), r("10.1.0.0/16", 3), r("10.2.0.0-10.255.255.255", 1),
+		r("11.0.0.0-11.0.0.9", 4), r("11.0.0.10-11.0.0.20", 5),
+	}
+	if !slices.Equal(table, want) {
+		t.Fatalf("nested ranges: built %v, expected %v", table, want)
+	}
+	for _, c := range [][]labeledRange{
+		{r("10.0.0.0/16", 1), r("10.0.128.0-10.1.0.255", 2)},
+		{r("10.0.128.0-10.1.0.255", 2), r("10.0.0.0/8", 1), r("10.0.0.0/16", 3)},
+	} {
+		_, err := newRangeTable(c)
+		if err == nil || !strings.Contains(err.Error(), "10.0.0.0/16") || !strings.Contains(err.Error(), "10.0.128.0-10.1.0.255") {
+			t.Fatalf("partly overlapping ranges: returned %v, expected an error naming 10.0.0.0/16 and 10.0.128.0-10.1.0.255", err)
+		}
+	}
+}
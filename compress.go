@@ -0,0 +1,358 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"sync"
+	"time"
+)
+
+// --- Decompression ---
+// Codecs accepted by CountUniqueFromCompressed.
+const (
+	codecGzip = "gzip"
+	codecZstd = "zstd"
+)
+
+// newDecompressor returns a reader that decompresses r with the given codec. Concatenated
+// gzip members are read as one stream, as gzip(1) does. Zstandard is not supported, as the
+// standard library has no decoder for it.
+func newDecompressor(r io.Reader, codec string) (io.Reader, error) {
+	switch codec {
+	case codecGzip:
+		return gzip.NewReader(r)
+	case codecZstd:
+		return nil, fmt.Errorf("codec %q: %w", codec, errors.ErrUnsupported)
+	}
+	return nil, fmt.Errorf("unknown codec %q (want %s)", codec, codecGzip)
+}
+
+// processGzipFile decompresses the mapped gzip file data for --gunzip and processes its
+// contents into set, decoding the members on up to workers workers.
+func processGzipFile(data []byte, mapped bool, set IPSet, workers int, opts *options) error {
+	if !mapped {
+		return errors.New("--gunzip requires a file that can be memory-mapped")
+	}
+	start := time.Now()
+	parallel, err := processGzip(data, set, workers, opts)
+	if err == nil {
+		mode := "serially"
+		if parallel {
+			mode = "in parallel"
+		}
+		fmt.Fprintf(diag, "Decompressed %s in %v\n", mode, time.Since(start))
+	}
+	return err
+}
+
+// errMemberChain reports that the members decoded in parallel did not line up, because a
+// split point only looked like the start of a member.
+var errMemberChain = errors.New("gzip members do not line up")
+
+// gzipMemberStarts returns the offsets in data that look like the start of a gzip member:
+// the magic bytes and the deflate method, no reserved flags, extra flags of 0, 2 or 4 and
+// a known OS byte. Compressed data can contain such bytes by chance, so an offset is only
+// known to be a member start once the member before it has been decoded up to it.
+func gzipMemberStarts(data []byte) []int {
+	var starts []int
+	for i := 0; i+10 <= len(data); i++ {
+		if data[i] != 0x1f || data[i+1] != 0x8b || data[i+2] != 8 || data[i+3]&0xe0 != 0 {
+			continue
+		}
+		if xfl, os := data[i+8], data[i+9]; (xfl == 0 || xfl == 2 || xfl == 4) && (os <= 13 || os == 255) {
+			starts = append(starts, i)
+		}
+	}
+	return starts
+}
+
+// bgzfMemberStarts returns the offsets of the gzip members of data if it is in the BGZF
+// format written by bgzip, in which every member carries its own size in a BC extra
+// subfield. The members are then found by following those sizes, touching only their
+// headers, and there are no false starts. Reports false if any member lacks the subfield
+// or the sizes do not add up to the data.
+func bgzfMemberStarts(data []byte) ([]int, bool) {
+	var starts []int
+	for off := 0; off < len(data); {
+		size, ok := bgzfBlockSize(data[off:])
+		if !ok || size > len(data)-off {
+			return nil, false
+		}
+		starts = append(starts, off)
+		off += size
+	}
+	return starts, len(starts) > 0
+}
+
+// bgzfBlockSize returns the size of the BGZF member at the start of data, as recorded in
+// its BC extra subfield, and whether the member has one.
+func bgzfBlockSize(data []byte) (int, bool) {
+	if len(data) < 12 || data[0] != 0x1f || data[1] != 0x8b || data[2] != 8 || data[3]&4 == 0 {
+		return 0, false
+	}
+	xlen := int(binary.LittleEndian.Uint16(data[10:]))
+	extra := data[12:min(len(data), 12+xlen)]
+	for len(extra) >= 4 {
+		slen := int(binary.LittleEndian.Uint16(extra[2:]))
+		if extra[0] == 'B' && extra[1] == 'C' && slen == 2 && len(extra) >= 6 {
+			return int(binary.LittleEndian.Uint16(extra[4:])) + 1, true
+		}
+		extra = extra[min(len(extra), 4+slen):]
+	}
+	return 0, false
+}
+
+// memberRun is the outcome of decoding the members of one part of the data.
+type memberRun struct {
+	end       int    // Offset just past the last member decoded.
+	size      int64  // Bytes decoded.
+	lines     int64  // Newlines in the decoded data.
+	processed bool   // Whether any decoded data was processed.
+	newline   bool   // Whether the decoded data holds a newline.
+	head      []byte // The part's first line, which may continue the part before.
+	tail      []byte // The part's last line, which may continue in the part after.
+	err       error  // The first error decoding or processing the members.
+}
+
+// memberReader reads the decompressed members of one part of the data, starting at a
+// member start and ending after the first member that ends at or after stop.
+type memberReader struct {
+	zr   *gzip.Reader
+	br   *bytes.Reader
+	size int // Size of all of the data.
+	stop int
+}
+
+// end returns the offset just past the members read so far.
+func (mr *memberReader) end() int {
+	return mr.size - mr.br.Len()
+}
+
+func (mr *memberReader) Read(p []byte) (int, error) {
+	n, err := mr.zr.Read(p)
+	if err == io.EOF && mr.end() < mr.stop && mr.end() < mr.size {
+		if err = mr.zr.Reset(mr.br); err == nil {
+			mr.zr.Multistream(false)
+		}
+	}
+	return n, err
+}
+
+// decodeMembers decodes the gzip members of data from start to the first member ending
+// at or after stop and processes their contents into set. Unless first is set, the line
+// the part starts with is kept in head instead, as it may continue a line of the part
+// before; unless last is set, the line it ends with is kept in tail. They are kept whole,
+// as a record such as a JSON object may hold an address anywhere, up to the --read-buffer
+// size, the longest line the serial decoder processes whole. The location of an invalid
+// record error is relative to the decoded data of the part.
+func decodeMembers(data []byte, start, stop int, first, last bool, set IPSet, opts *options) memberRun {
+	run := memberRun{newline: first}
+	br := bytes.NewReader(data[start:])
+	// A bytes.Reader is an io.ByteReader, so the decoder reads no further than each member.
+	zr, err := gzip.NewReader(br)
+	if err != nil {
+		run.err = err
+		return run
+	}
+	zr.Multistream(false)
+	mr := &memberReader{zr: zr, br: br, size: len(data), stop: stop}
+	keep := func(line, b []byte) []byte { return appendLine(line, b, opts.readBufferSize()) }
+	var sl streamLines
+	run.size, run.err = readStream(mr, opts.readBufferSize(), nil, func(block []byte) error {
+		return sl.process(block, func(block []byte) error {
+			skip := 0
+			if !run.newline {
+				nl := bytes.IndexByte(block, '\n')
+				if nl < 0 {
+					run.head = keep(run.head, block)
+					return nil
+				}
+				run.head = keep(run.head, block[:nl])
+				block, skip = block[nl+1:], nl+1
+				run.newline = true
+			}
+			run.tail = nil
+			if nl := bytes.LastIndexByte(block, '\n'); !last && nl < len(block)-1 {
+				run.tail = keep(nil, block[nl+1:])
+				block = block[:nl+1]
+			}
+			if len(block) == 0 {
+				return nil
+			}
+			run.processed = true
+			return atOffset(processData(block, set, 1, opts), int64(skip))
+		})
+	})
+	run.lines = sl.lines
+	run.end = mr.end()
+	return run
+}
+
+// processGzip decompresses the gzip data and processes its contents into set. The data is
+// split at member starts into up to workers parts of similar size, whose members are
+// decoded in parallel, each part by one worker. The lines split between parts are joined
+// and processed once all parts are done. Where the parts turn out not to line up, the
+// members between them are decoded serially. Data of a single member is decoded serially
+// by one worker, with chunk workers. Data in
+// the BGZF format is split at the members its headers index instead of those found by
+// scanning. Returns whether the members were decoded in parallel.
+func processGzip(data []byte, set IPSet, workers int, opts *options) (bool, error) {
+	var splits []int
+	if workers > 1 {
+		starts, bgzf := bgzfMemberStarts(data)
+		if bgzf {
+			fmt.Fprintf(diag, "BGZF data: %d block(s)\n", len(starts))
+		} else {
+			starts = gzipMemberStarts(data)
+		}
+		for i := 0; i < workers && len(starts) > 0; i++ {
+			// The first start at or after the i-th equal share of the data.
+			j, _ := slices.BinarySearch(starts, len(data)*i/workers)
+			if j < len(starts) && (len(splits) == 0 || starts[j] > splits[len(splits)-1]) {
+				splits = append(splits, starts[j])
+			}
+		}
+	}
+	if len(splits) > 1 && splits[0] == 0 {
+		runs := make([]memberRun, len(splits))
+		var wg sync.WaitGroup
+		wg.Add(len(splits))
+		pool.grow(len(splits))
+		for i, start := range splits {
+			last := i == len(splits)-1
+			stop := len(data)
+			if !last {
+				stop = splits[i+1]
+			}
+			pool.Go(func() {
+				defer wg.Done()
+				runs[i] = decodeMembers(data, start, stop, i == 0, last, set, opts)
+			})
+		}
+		wg.Wait()
+		for _, run := range runs {
+			if errors.Is(run.err, errMaxUnique) {
+				return true, run.err
+			}
+		}
+		// The parts decoded real members if they follow on from the first one: a part
+		// that starts where one of them ended. A part that ends at a member start that is
+		// no split, as the split after its start was a false one, is followed by the
+		// members up to the next split, decoded here, so that no data is processed twice.
+		chain := []memberRun{runs[0]}
+		real := map[int]bool{0: true}
+		for last := runs[0]; last.err == nil && last.end < len(data); chain = append(chain, last) {
+			if k := slices.Index(splits, last.end); k >= 0 {
+				real[k] = true
+				last = runs[k]
+				continue
+			}
+			fmt.Fprintf(diag, "Warning: gzip member starts do not line up at offset %d; decoding up to the next split serially\n", last.end)
+			next, _ := slices.BinarySearch(splits, last.end)
+			stop := len(data)
+			if next < len(splits) {
+				stop = splits[next]
+			}
+			last = decodeMembers(data, last.end, stop, false, next == len(splits), set, opts)
+			if errors.Is(last.err, errMaxUnique) {
+				return true, last.err
+			}
+		}
+		// An error in a part of real members is an error in the data, after any in the
+		// lines split between the parts before it, which come first in the stream.
+		if k := len(chain) - 1; chain[k].err != nil {
+			before := append(chain[:k:k], memberRun{newline: chain[k].newline, head: chain[k].head})
+			if err := processSplitLines(before, false, set, opts); err != nil {
+				return true, err
+			}
+			return true, inStream(chain[k].err, chain[:k])
+		}
+		for k, run := range runs {
+			// Data decoded from a false member start may hold addresses that are not in
+			// the input. A false start fails in its header or deflate data long before
+			// a whole block is decoded, so this is not expected to happen.
+			if !real[k] && run.processed {
+				return true, fmt.Errorf("%w after decoding data from a false member start", errMemberChain)
+			}
+		}
+		return true, processSplitLines(chain, true, set, opts)
+	}
+	if workers > 1 {
+		fmt.Fprintln(diag, "The gzip data is a single member, which cannot be inflated in parallel; decoding serially. Compress it with bgzip, or as concatenated members, to decode it on several workers.")
+	}
+	r, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return false, err
+	}
+	var sl streamLines
+	_, err = readStream(r, opts.readBufferSize(), nil, func(block []byte) error {
+		return sl.process(block, func(block []byte) error {
+			return processData(block, set, opts.chunkWorkers(len(block)), opts)
+		})
+	})
+	return false, err
+}
+
+// inStream moves the location of an invalid record error or a worker panic error of a
+// part decoded by decodeMembers into the decoded data of all parts, given the parts
+// before it.
+func inStream(err error, before []memberRun) error {
+	var size, lines int64
+	for _, run := range before {
+		size += run.size
+		lines += run.lines
+	}
+	var re *invalidRecordError
+	if errors.As(err, &re) {
+		re.line += lines
+	}
+	return atOffset(err, size)
+}
+
+// appendLine appends b to the line, which is cut at limit bytes.
+func appendLine(line, b []byte, limit int) []byte {
+	return append(line, b[:max(0, min(len(b), limit-len(line)))]...)
+}
+
+// processSplitLines processes the lines split between the parts decoded by processGzip:
+// the tail of each part joined with the head of the next, or with all of the next part
+// if it holds no newline. A joined line is cut at the --read-buffer size. With final, the
+// last part ends the data, so a line it continues without a newline ends there.
+func processSplitLines(runs []memberRun, final bool, set IPSet, opts *options) error {
+	var line []byte
+	var offset, lines int64 // Of the part in the decoded data of all parts.
+	var start, number int64 // Offset and line number of the joined line.
+	process := func() error {
+		err := processData(line, set, 1, opts)
+		var re *invalidRecordError
+		if errors.As(err, &re) {
+			re.line = number
+		}
+		return atOffset(err, start)
+	}
+	for i, run := range runs {
+		if i > 0 {
+			line = appendLine(line, run.head, opts.readBufferSize())
+			if run.newline {
+				if err := process(); err != nil {
+					return err
+				}
+			}
+		}
+		if i == 0 || run.newline {
+			line = append(line[:0], run.tail...)
+			start, number = offset+run.size-int64(len(run.tail)), lines+run.lines+1
+		}
+		offset += run.size
+		lines += run.lines
+	}
+	if final && len(line) > 0 {
+		return process()
+	}
+	return nil
+}
@@ -0,0 +1,345 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// gzipMembers compresses data as concatenated gzip members, starting a new member after
+// every size bytes, and after size/2 bytes for the first member.
+func gzipMembers(t testing.TB, data []byte, size int) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	for i, n := 0, min(len(data), size/2); i < len(data); i, n = i+n, min(len(data)-i-n, size) {
+		zw := gzip.NewWriter(&buf)
+		zw.Write(data[i : i+n])
+		if err := zw.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return buf.Bytes()
+}
+
+// bgzfMembers compresses data as BGZF blocks, gzip members of size bytes of data each
+// that record their compressed size in a BC subfield, as bgzip writes them. The last block
+// is shorter, or empty if size divides the data.
+func bgzfMembers(t testing.TB, data []byte, size int) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	for i := 0; i <= len(data); i += size {
+		start := buf.Len()
+		zw, _ := gzip.NewWriterLevel(&buf, gzip.BestSpeed)
+		zw.Extra = []byte{'B', 'C', 2, 0, 0, 0}
+		zw.Write(data[i:min(len(data), i+size)])
+		if err := zw.Close(); err != nil {
+			t.Fatal(err)
+		}
+		binary.LittleEndian.PutUint16(buf.Bytes()[start+16:], uint16(buf.Len()-start-1))
+	}
+	return buf.Bytes()
+}
+
+// TestGzipStrictLine checks that --strict reports the line of the first invalid record
+// in the decompressed data of --gunzip, whether it lies within a member, in a line split
+// between members decoded by different workers, or after such lines.
+func TestGzipStrictLine(t *testing.T) {
+	out := diag
+	diag = io.Discard
+	t.Cleanup(func() { diag = out })
+	var long strings.Builder
+	for i := range 20_000 {
+		fmt.Fprintf(&long, "10.%d.%d.%d\n", i>>16, i>>8&255, i&255)
+	}
+	lines := strings.Split(long.String(), "\n")
+	withBad := func(line int) string {
+		return strings.Join(lines[:line-1], "\n") + "\nbad\n" + strings.Join(lines[line-1:], "\n")
+	}
+	// The first member ends within the "bad" of line 9000.
+	split := 2 * (len(strings.Join(lines[:8_999], "\n")) + 2)
+	dir := t.TempDir()
+	for _, tc := range []struct {
+		name   string
+		data   string
+		member int // Bytes per member.
+		line   int64
+	}{
+		{"single member", "1.2.3.4\n5.6.7.8\nbad\n9.9.9.9\n", 1 << 20, 3},
+		{"within a member", withBad(12_345), 4096, 12_345},
+		{"split between members", withBad(9_000), split, 9_000},
+		{"last line", long.String() + "bad", 5000, 20_001},
+	} {
+		path := filepath.Join(dir, "ips.gz")
+		if err := os.WriteFile(path, gzipMembers(t, []byte(tc.data), tc.member), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		for _, workers := range []string{"1", "2", "3", "8"} {
+			opts, err := parseFlags([]string{"--gunzip", "--strict", "--workers", workers, path})
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = countUniqueIpInFile(path, opts)
+			var re *invalidRecordError
+			if !errors.As(err, &re) || re.line != tc.line || re.record != "bad" {
+				t.Errorf("%s, %s worker(s): %v, expected %q at line %d", tc.name, workers, err, "bad", tc.line)
+			}
+		}
+	}
+}
+
+// TestGzipFalseSplit places a false member header, in a member stored without
+// compression, where processGzip splits the data between two workers, and checks that the
+// members after the part before it are decoded once, so that every record is counted
+// once, as by the serial decoder.
+func TestGzipFalseSplit(t *testing.T) {
+	out := diag
+	diag = io.Discard
+	t.Cleanup(func() { diag = out })
+	var data strings.Builder
+	for i := range 30_000 {
+		fmt.Fprintf(&data, "10.%d.%d.%d\n", i>>16, i>>8&255, i&255)
+	}
+	lines := []byte(data.String())
+	fake := "\x1f\x8b\x08\x00\x00\x00\x00\x00\x00\x03 not a member\n"
+	var buf bytes.Buffer
+	for i, part := range [][]byte{lines[:1000], slices.Concat(lines[1000:200_000], []byte(fake), lines[200_000:300_000]), lines[300_000:]} {
+		level := gzip.DefaultCompression
+		if i == 1 {
+			level = gzip.NoCompression
+		}
+		zw, _ := gzip.NewWriterLevel(&buf, level)
+		zw.Write(part)
+		if err := zw.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if fakeAt := bytes.Index(buf.Bytes(), []byte(fake)); fakeAt < buf.Len()/2 {
+		starts := gzipMemberStarts(buf.Bytes())
+		t.Fatalf("false header at %d of %d bytes, starts %v", fakeAt, buf.Len(), starts)
+	}
+	var want int64
+	var unique int
+	for _, workers := range []int{1, 2} {
+		opts := (&options{minRecordLen: MinIPLen}).withStats()
+		set := NewSparseSet()
+		if _, err := processGzip(buf.Bytes(), set, workers, opts); err != nil {
+			t.Fatalf("%d worker(s): %v", workers, err)
+		}
+		if workers == 1 {
+			want, unique = opts.stats.total.Load(), set.Count()
+		}
+		if got := opts.stats.total.Load(); got != want || set.Count() != unique {
+			t.Errorf("%d worker(s): %d record(s) and %d address(es), expected %d and %d", workers, got, set.Count(), want, unique)
+		}
+	}
+}
+
+// BenchmarkProcessGzip decodes the same members serially and on several workers, with
+// the decompressed size as the bytes processed.
+func BenchmarkProcessGzip(b *testing.B) {
+	out := diag
+	diag = io.Discard
+	b.Cleanup(func() { diag = out })
+	rnd := rand.New(rand.NewSource(1))
+	var data strings.Builder
+	for data.Len() < 16<<20 {
+		data.WriteString(formatIP(rnd.Uint32()) + "\n")
+	}
+	compressed := gzipMembers(b, []byte(data.String()), 1<<20)
+	set := NewAtomicBitSet()
+	for _, workers := range []int{1, 2, 4, 8} {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			b.SetBytes(int64(data.Len()))
+			for range b.N {
+				if _, err := processGzip(compressed, set, workers, &options{minRecordLen: MinIPLen}); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// countGzipWorkers counts the gzip data with processGzip and 1 to 8 workers, which must
+// each count want addresses.
+func countGzipWorkers(t *testing.T, data []byte, want int) {
+	t.Helper()
+	for workers := 1; workers <= 8; workers++ {
+		set := NewSparseSet()
+		if _, err := processGzip(data, set, workers, &options{minRecordLen: MinIPLen}); err != nil {
+			t.Fatalf("%d worker(s): %v", workers, err)
+		}
+		if set.Count() != want {
+			t.Fatalf("%d worker(s): counted %d, expected %d", workers, set.Count(), want)
+		}
+	}
+}
+
+// TestGzipMembers compresses the self-test dataset as several gzip members, one of them
+// stored without compression and holding a line that looks like a member header, and
+// checks that decoding the members in parallel counts the same addresses as the serial
+// decoder for any number of workers, whether or not a split falls on the false header. It
+// also checks the start of data compressed as many members of a few bytes, most of which
+// split a line or hold no newline at all.
+func TestGzipMembers(t *testing.T) {
+	_, data, expected := selfTestDataset(t)
+	want := len(expected)
+	fake := "\x1f\x8b\x08\x00\x00\x00\x00\x00\x00\x03 not a member\n"
+	third := len(data) / 3
+	for third < len(data) && data[third-1] != '\n' {
+		third++
+	}
+	var buf bytes.Buffer
+	middle := slices.Concat(data[third:third*3/2], []byte(fake), data[third*3/2:2*third])
+	for i, part := range [][]byte{data[:third], middle, data[2*third:]} {
+		level := gzip.DefaultCompression
+		if i == 1 {
+			level = gzip.NoCompression
+		}
+		zw, _ := gzip.NewWriterLevel(&buf, level)
+		zw.Write(part)
+		if err := zw.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if starts := gzipMemberStarts(buf.Bytes()); len(starts) < 4 {
+		t.Fatalf("found %d member start(s), expected 3 real ones and the false one", len(starts))
+	}
+	countGzipWorkers(t, buf.Bytes(), want)
+
+	head := data[:min(len(data), 20_000)]
+	small := NewSparseSet()
+	processData(head, small, 1, &options{minRecordLen: MinIPLen})
+	buf.Reset()
+	for i, n := 0, 0; i < len(head); i += n {
+		n = min(len(head)-i, []int{1, 2, 5, 9, 40}[i%5])
+		zw := gzip.NewWriter(&buf)
+		zw.Write(head[i : i+n])
+		if err := zw.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	countGzipWorkers(t, buf.Bytes(), small.Count())
+}
+
+// TestGzipLongRecords compresses JSON and --extract records far longer than an address
+// as gzip members that end within records, some of them within a member holding no
+// newline at all, and checks that every number of workers counts the addresses of the
+// records the serial decoder counts, so that the lines split between members are joined
+// whole.
+func TestGzipLongRecords(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	var jsonl, fields strings.Builder
+	for range 2000 {
+		ip := formatIP(rnd.Uint32())
+		pad := strings.Repeat("x", 20+rnd.Intn(400))
+		fmt.Fprintf(&jsonl, "{\"pad\":\"%s\",\"ip\":\"%s\"}\n", pad, ip)
+		fmt.Fprintf(&fields, "%s %s\n", pad, ip)
+	}
+	for _, tc := range []struct {
+		flag string
+		data string
+	}{{"--jsonl", jsonl.String()}, {"--extract", fields.String()}} {
+		opts, err := parseFlags([]string{tc.flag, os.DevNull})
+		if err != nil {
+			t.Fatal(err)
+		}
+		data := []byte(tc.data)
+		want := NewSparseSet()
+		if err := processData(data, want, 1, opts); err != nil {
+			t.Fatal(err)
+		}
+		var buf bytes.Buffer
+		for i, n := 0, 0; i < len(data); i += n {
+			n = min(len(data)-i, []int{5000, 30, 7000, 90, 11_000}[i%5])
+			zw := gzip.NewWriter(&buf)
+			zw.Write(data[i : i+n])
+			if err := zw.Close(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for workers := 1; workers <= 8; workers++ {
+			set := NewSparseSet()
+			if _, err := processGzip(buf.Bytes(), set, workers, opts); err != nil {
+				t.Fatalf("%s, %d worker(s): %v", tc.flag, workers, err)
+			}
+			if set.Count() != want.Count() {
+				t.Fatalf("%s, %d worker(s): counted %d, expected %d", tc.flag, workers, set.Count(), want.Count())
+			}
+		}
+	}
+}
+
+// TestBGZF compresses the self-test dataset in the BGZF format of bgzip, as blocks of at
+// most 4000 bytes followed by the empty end-of-file block, and checks that the blocks are
+// found from their headers and decoded in parallel to the same count. A plain
+// multi-member file must not be taken for BGZF.
+func TestBGZF(t *testing.T) {
+	out := diag
+	diag = io.Discard
+	t.Cleanup(func() { diag = out })
+	_, data, expected := selfTestDataset(t)
+	want := len(expected)
+	bgzf := bgzfMembers(t, data, 4000)
+	if starts, ok := bgzfMemberStarts(bgzf); !ok || len(starts) != len(data)/4000+1 {
+		t.Fatalf("found %d BGZF block(s), expected %d", len(starts), len(data)/4000+1)
+	}
+	countGzipWorkers(t, bgzf, want)
+	var buf bytes.Buffer
+	for range 2 {
+		zw := gzip.NewWriter(&buf)
+		zw.Write(data[:100])
+		zw.Close()
+	}
+	if _, ok := bgzfMemberStarts(buf.Bytes()); ok {
+		t.Fatal("plain gzip members taken for BGZF")
+	}
+}
+
+// BenchmarkBGZF finds the members of 16MB of addresses in BGZF blocks of 60000 bytes by
+// their recorded sizes and by scanning for headers, and decodes them serially and on
+// several workers next to the same data as a single gzip member, with the decompressed
+// size as the bytes processed.
+func BenchmarkBGZF(b *testing.B) {
+	out := diag
+	diag = io.Discard
+	b.Cleanup(func() { diag = out })
+	rnd := rand.New(rand.NewSource(1))
+	data := benchLines(16<<20, rnd.Uint32)
+	bgzf := bgzfMembers(b, data, 60000)
+	b.Run("starts/bgzf", func(b *testing.B) {
+		for range b.N {
+			bgzfMemberStarts(bgzf)
+		}
+	})
+	b.Run("starts/scan", func(b *testing.B) {
+		for range b.N {
+			gzipMemberStarts(bgzf)
+		}
+	})
+	single := gzipMembers(b, data, 2*len(data))
+	set := NewAtomicBitSet()
+	for _, input := range []struct {
+		name string
+		data []byte
+	}{{"bgzf", bgzf}, {"single", single}} {
+		for _, workers := range []int{1, 2, 4, 8} {
+			b.Run(fmt.Sprintf("decode/%s/workers=%d", input.name, workers), func(b *testing.B) {
+				b.SetBytes(int64(len(data)))
+				for range b.N {
+					if _, err := processGzip(input.data, set, workers, &options{minRecordLen: MinIPLen}); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+	}
+}
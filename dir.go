@@ -0,0 +1,289 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// --- Directory Processing ---
+// fileResult describes the outcome of processing a single file in directory mode.
+type fileResult struct {
+	name     string
+	size     int64
+	duration time.Duration
+	err      error
+
+	// Per-file counts, only filled in for --format csv.
+	unique         int
+	total, skipped int64
+
+	added int64 // Addresses the file added to the shared set first, with --new-per-file.
+}
+
+// teeSet adds every address that passes the filters of the shared set to a per-file
+// set as well. An address passed the filters if the shared set contains it after Set.
+type teeSet struct {
+	IPSet
+	file IPSet
+}
+
+// Set adds the address to the shared set and, if it was accepted, to the per-file set.
+func (ts *teeSet) Set(ip uint32) {
+	ts.IPSet.Set(ip)
+	if ts.IPSet.IsSet(ip) {
+		ts.file.Set(ip)
+	}
+}
+
+// newSetter is implemented by sets that can add an address and report atomically whether
+// it was new, which --new-per-file needs to attribute every address to exactly one file.
+type newSetter interface {
+	SetNew(ip uint32) bool
+}
+
+// setNew adds ip to set and reports whether set did not hold it yet. For a set that is not
+// a newSetter, the answer is only exact if no other goroutine adds the same address at the
+// same time; the options do not allow --new-per-file with such sets.
+func setNew(set IPSet, ip uint32) bool {
+	if ns, ok := set.(newSetter); ok {
+		return ns.SetNew(ip)
+	}
+	had := set.IsSet(ip)
+	set.Set(ip)
+	return !had && set.IsSet(ip)
+}
+
+// newCounter adds the addresses of one file to the shared set and counts those the set
+// did not hold yet, for --new-per-file. Across all files, these counts add up to the
+// size of the union, without a set per file.
+type newCounter struct {
+	IPSet
+	added atomic.Int64
+}
+
+// Set adds the address to the shared set and counts it if it was new.
+func (nc *newCounter) Set(ip uint32) {
+	if setNew(nc.IPSet, ip) {
+		nc.added.Add(1)
+	}
+}
+
+// addFileToResult processes a file like addFileToSet and describes the outcome. With
+// --format csv, the file's own addresses are also collected in a separate set of the
+// configured type to report its unique count, which needs the memory of one more set
+// per file worker. With --new-per-file, the addresses that were new to the shared set
+// are counted as well.
+func addFileToResult(fileName string, set IPSet, opts *options) (fr fileResult) {
+	start := time.Now()
+	fr = fileResult{name: fileName}
+	if opts.newPerFile {
+		nc := &newCounter{IPSet: set}
+		defer func() { fr.added = nc.added.Load() }()
+		set = nc
+	}
+	if opts.format != formatCSV {
+		fr.size, fr.err = addFileToSet(fileName, set, opts)
+		fr.err = ignoreMaxUnique(fr.err)
+		fr.duration = time.Since(start)
+		return fr
+	}
+	fileSet := baseSet(opts)
+	defer closeSet(fileSet)
+	fileOpts := opts.withStats()
+	fr.size, fr.err = addFileToSet(fileName, &teeSet{IPSet: set, file: fileSet}, fileOpts)
+	fr.err = ignoreMaxUnique(fr.err)
+	fr.duration = time.Since(start)
+	fr.unique = fileSet.Count()
+	fr.total = fileOpts.stats.total.Load()
+	fr.skipped = fr.total - fileOpts.stats.valid.Load()
+	return fr
+}
+
+// listFiles returns the paths of all regular files under dir, in lexical order.
+func listFiles(dir string) ([]string, error) {
+	var files []string
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.Type().IsRegular() {
+			files = append(files, path)
+		}
+		return nil
+	})
+	return files, err
+}
+
+// addFileToSet memory-maps a single file and adds every IPv4 address it contains to set,
+// reading it in blocks instead if it cannot be mapped. The file is unmapped and closed
+// before returning. Returns the size of the file in bytes.
+func addFileToSet(fileName string, set IPSet, opts *options) (int64, error) {
+	file, err := openInput(fileName)
+	if err != nil {
+		return 0, fmt.Errorf("%w: %w", ErrOpenFailed, err)
+	}
+	defer file.Close()
+
+	stat, err := file.Stat()
+	if err != nil {
+		return 0, fmt.Errorf("%w: %w", ErrStatFailed, err)
+	}
+	if stat.Size() == 0 || (opts.head != nil && opts.head.exhausted()) || (opts.maxUnique != nil && opts.maxUnique.done()) {
+		return 0, nil
+	}
+
+	mmapData, err := mapInput(file, stat.Size())
+	if err != nil {
+		// Fall back to positional reads, sampling only the first block.
+		sampled := false
+		_, err = readBlocks(file, 0, stat.Size(), true, opts.readBufferSize(), func(block []byte) error {
+			if !sampled {
+				sampled = true
+				if err := checkLooksLikeIPs(fileName, block, opts); err != nil {
+					return err
+				}
+			}
+			return processData(block, set, opts.chunkWorkers(len(block)), opts)
+		})
+		return stat.Size(), resolveLine(file, err)
+	}
+	defer unmapInput(mmapData)
+
+	if err := checkLooksLikeIPs(fileName, mmapData, opts); err != nil {
+		return 0, err
+	}
+	if err := processData(mmapData, set, opts.chunkWorkers(len(mmapData)), opts); err != nil {
+		return 0, resolveLine(file, err)
+	}
+	return stat.Size(), nil
+}
+
+// countUniqueIpInDir counts unique IPv4 addresses across all files under dir.
+// Files are processed by a bounded pool of --file-concurrency workers, so at most that many
+// files are open and memory-mapped at the same time. All files feed one shared set.
+func countUniqueIpInDir(dir string, opts *options) (Result, error) {
+	startTime := time.Now()
+	res := Result{Path: dir}
+	var meter *usageMeter
+	if opts.rusage {
+		meter = startUsage()
+	}
+
+	if opts.segmented() || opts.gunzip || opts.autoWorkers || opts.checkpoint != "" || opts.countContention || opts.trackTimes || opts.follow {
+		return res, errors.New("--chunks, --manifest, --byte-range, --gunzip, --auto-workers, --checkpoint, --count-contention, --track-times and --follow require a single input file")
+	}
+	files, err := listFiles(dir)
+	if err != nil {
+		return res, fmt.Errorf("error listing directory: %w", err)
+	}
+	if len(files) == 0 {
+		fmt.Fprintf(diag, "No files found in directory: %s\n", dir)
+		return res, fmt.Errorf("%w: %s", ErrNoValidIPs, dir)
+	}
+	workers := min(opts.fileConcurrency, len(files))
+	if opts.singleThread {
+		workers = 1
+	}
+	fmt.Fprintf(diag, "Processing %d file(s) from %s using %d file worker(s)\n", len(files), dir, workers)
+
+	set := newIPSet(opts)
+	defer closeSet(set)
+	if opts.pretouch {
+		if err := pretouchSet(set); err != nil {
+			return res, err
+		}
+	}
+	if p := opts.progress; p != nil {
+		for _, name := range files {
+			if fi, err := os.Stat(name); err == nil {
+				p.total.Add(fi.Size())
+			}
+		}
+	}
+	stopInterim := startProgress(set, opts)
+	defer stopInterim()
+	jobs := make(chan string)
+	results := make(chan fileResult)
+
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer wg.Done()
+			for name := range jobs {
+				results <- addFileToResult(name, set, opts)
+			}
+		}()
+	}
+	go func() {
+		for _, name := range files {
+			jobs <- name
+		}
+		close(jobs)
+	}()
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	// Report progress as files complete.
+	done, failed := 0, 0
+	for fr := range results {
+		done++
+		if fr.err != nil {
+			failed++
+			fmt.Fprintf(diag, "[%d/%d] %s: %v\n", done, len(files), fr.name, fr.err)
+			continue
+		}
+		if opts.newPerFile {
+			fmt.Fprintf(diag, "[%d/%d] %s: %d bytes in %v, %d new unique address(es)\n", done, len(files), fr.name, fr.size, fr.duration, fr.added)
+			res.NewPerFile = append(res.NewPerFile, FileNew{Path: fr.name, New: fr.added})
+		} else {
+			fmt.Fprintf(diag, "[%d/%d] %s: %d bytes in %v\n", done, len(files), fr.name, fr.size, fr.duration)
+		}
+		res.Bytes += fr.size
+		if opts.format == formatCSV {
+			res.Total += fr.total
+			res.Skipped += fr.skipped
+			res.Files = append(res.Files, Result{
+				Path: fr.name, Unique: fr.unique, Total: fr.total, Skipped: fr.skipped,
+				Bytes: fr.size, DurationMs: fr.duration.Milliseconds(),
+			})
+		}
+	}
+	// Files complete in any order; report them in the order they were listed.
+	slices.SortFunc(res.Files, func(a, b Result) int { return strings.Compare(a.Path, b.Path) })
+	slices.SortFunc(res.NewPerFile, func(a, b FileNew) int { return strings.Compare(a.Path, b.Path) })
+
+	stopInterim()
+	countSet(set, opts, &res)
+	res.DurationMs = time.Since(startTime).Milliseconds()
+	printHeadStatus(opts)
+	printMaxUnique(opts, &res)
+	printEstimate(set, &res)
+	fmt.Fprintf(diag, "Directory processed in %v\n", time.Since(startTime))
+	meter.report()
+	printRate(opts)
+	printMalformed(opts, &res)
+	printCIDRBlocks(opts)
+	printFlow(opts, &res)
+	printResultDetails(set, opts, &res)
+	if err := saveOutputs(set, opts); err != nil {
+		return res, err
+	}
+	if failed > 0 {
+		return res, fmt.Errorf("%d of %d file(s) failed", failed, len(files))
+	}
+	if res.Unique == 0 && !res.NotCounted {
+		return res, fmt.Errorf("%w: %s", ErrNoValidIPs, dir)
+	}
+	return res, nil
+}
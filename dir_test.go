@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestDirSingleFileFlags checks that a directory is rejected with the options that only
+// apply to a single input file, rather than counted without them.
+func TestDirSingleFileFlags(t *testing.T) {
+	out := diag
+	diag = io.Discard
+	t.Cleanup(func() { diag = out })
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "ips.txt"), []byte("1700000000 1.2.3.4\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	for _, args := range [][]string{
+		{"--track-times"},
+		{"--track-times", "--exclude-time", "0..1"},
+		{"--follow"},
+	} {
+		opts, err := parseFlags(append(args, dir))
+		if err != nil {
+			t.Fatalf("%v: %v", args, err)
+		}
+		if _, err := countUniqueIpInDir(dir, opts); err == nil {
+			t.Errorf("%v: directory accepted", args)
+		}
+	}
+}
+
+// TestNewPerFile splits the self-test dataset into three overlapping files of a
+// directory and counts it with --new-per-file, one file at a time and three at once. The new addresses must add up to the union, and one at a time, the
+// first file must contribute all of its own addresses.
+func TestNewPerFile(t *testing.T) {
+	out := diag
+	diag = io.Discard
+	t.Cleanup(func() { diag = out })
+	_, data, expected := selfTestDataset(t)
+	want := len(expected)
+	sub := t.TempDir()
+	third := len(data) / 3
+	third += bytes.IndexByte(data[third:], '\n') + 1
+	parts := [][]byte{data[:2*third], data[third:], data[:third]}
+	for i, part := range parts {
+		if err := os.WriteFile(filepath.Join(sub, fmt.Sprintf("%d.txt", i)), part, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	first := CountUniqueInBytes(parts[0], 1)
+	for _, concurrency := range []string{"1", "3"} {
+		opts, err := parseFlags([]string{"--new-per-file", "--file-concurrency", concurrency, sub})
+		if err != nil {
+			t.Fatal(err)
+		}
+		res, err := countUniqueIpInDir(sub, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var sum int64
+		for _, fn := range res.NewPerFile {
+			sum += fn.New
+		}
+		if res.Unique != want || sum != int64(want) || len(res.NewPerFile) != len(parts) {
+			t.Fatalf("%s at once: %d file(s) added %d new address(es), union %d, expected %d", concurrency, len(res.NewPerFile), sum, res.Unique, want)
+		}
+		if concurrency == "1" && res.NewPerFile[0].New != int64(first) {
+			t.Fatalf("first file added %d new address(es), expected all of its %d", res.NewPerFile[0].New, first)
+		}
+	}
+}
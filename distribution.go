@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"slices"
+	"sync"
+)
+
+// --- Distribution Statistics ---
+// countShards is the number of independently locked shards of an ipCounts.
+const countShards = 64
+
+// ipCounts counts the occurrences of every address for --distribution-stats. The counts
+// are spread over shards by a hash of the address, so that workers rarely wait for each
+// other's locks. Like ipTimes, its memory grows with the number of unique addresses, by
+// roughly 40 bytes per entry including map overhead.
+type ipCounts struct {
+	shards [countShards]struct {
+		mu     sync.Mutex
+		counts map[uint32]uint32
+	}
+}
+
+func newIPCounts() *ipCounts {
+	c := &ipCounts{}
+	for i := range c.shards {
+		c.shards[i].counts = make(map[uint32]uint32)
+	}
+	return c
+}
+
+// Add records one occurrence of ip.
+func (c *ipCounts) Add(ip uint32) {
+	h, _ := sketchHash(ip)
+	s := &c.shards[h%countShards]
+	s.mu.Lock()
+	s.counts[ip]++
+	s.mu.Unlock()
+}
+
+// Distribution describes how the records are spread over the unique addresses.
+type Distribution struct {
+	Records int64 `json:"records"` // Valid records counted.
+
+	// Gini coefficient of the per-address counts: 0 if every address occurs equally
+	// often, approaching 1 if a few addresses account for nearly all records.
+	Gini float64 `json:"gini"`
+
+	// Shares of the records held by the most frequent 1% and 10% of the addresses,
+	// rounded up to at least one address.
+	Top1Share  float64 `json:"top1_share"`
+	Top10Share float64 `json:"top10_share"`
+
+	// Shannon entropy of the address of a record in bits, and as a fraction of the
+	// maximum of log2(unique) reached by a uniform distribution.
+	EntropyBits       float64 `json:"entropy_bits"`
+	NormalizedEntropy float64 `json:"normalized_entropy"`
+}
+
+// distribution computes the statistics of the counts. It sorts all counts, which needs
+// 4 bytes per unique address on top of the maps.
+func (c *ipCounts) distribution() Distribution {
+	var counts []uint32
+	for i := range c.shards {
+		for _, n := range c.shards[i].counts {
+			counts = append(counts, n)
+		}
+	}
+	var d Distribution
+	if len(counts) == 0 {
+		return d
+	}
+	slices.Sort(counts)
+	n := float64(len(counts))
+	var weighted float64
+	for i, count := range counts {
+		d.Records += int64(count)
+		weighted += float64(i+1) * float64(count)
+	}
+	total := float64(d.Records)
+	d.Gini = 2*weighted/(n*total) - (n+1)/n
+	share := func(fraction float64) float64 {
+		top := int(math.Ceil(n * fraction))
+		var sum int64
+		for _, count := range counts[len(counts)-top:] {
+			sum += int64(count)
+		}
+		return float64(sum) / total
+	}
+	d.Top1Share, d.Top10Share = share(0.01), share(0.10)
+	for _, count := range counts {
+		p := float64(count) / total
+		d.EntropyBits -= p * math.Log2(p)
+	}
+	if len(counts) > 1 {
+		d.NormalizedEntropy = d.EntropyBits / math.Log2(n)
+	} else {
+		d.NormalizedEntropy = 1
+	}
+	return d
+}
+
+// printDistribution reports the distribution statistics for --distribution-stats and
+// records them in res.
+func printDistribution(opts *options, res *Result) {
+	if opts.counts == nil {
+		return
+	}
+	d := opts.counts.distribution()
+	res.Distribution = &d
+	fmt.Fprintf(diag, "Distribution of %d record(s): Gini %.4f, top 1%% share %.2f%%, top 10%% share %.2f%%\n",
+		d.Records, d.Gini, 100*d.Top1Share, 100*d.Top10Share)
+	fmt.Fprintf(diag, "Entropy: %.3f bits (%.1f%% of uniform)\n", d.EntropyBits, 100*d.NormalizedEntropy)
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"math"
+	"os"
+	"strings"
+	"testing"
+)
+
+// TestDistribution counts records with known per-address counts with
+// --distribution-stats and checks the statistics against values computed by hand.
+func TestDistribution(t *testing.T) {
+	data := strings.Repeat("9.9.9.9\n", 97) + "1.1.1.1\n2.2.2.2\n3.3.3.3\n"
+	opts, err := parseFlags([]string{"--distribution-stats", os.DevNull})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := processData([]byte(data), newIPSet(opts), 2, opts); err != nil {
+		t.Fatal(err)
+	}
+	got := opts.counts.distribution()
+	// Sorted counts 1, 1, 1, 97: Gini = 2*(1+2+3+4*97)/(4*100) - 5/4.
+	want := Distribution{Records: 100, Gini: 0.72, Top1Share: 0.97, Top10Share: 0.97}
+	if got.Records != want.Records || math.Abs(got.Gini-want.Gini) > 1e-9 ||
+		got.Top1Share != want.Top1Share || got.Top10Share != want.Top10Share {
+		t.Fatalf("got %+v, expected %+v", got, want)
+	}
+	uniform := newIPCounts()
+	for ip := range uint32(1000) {
+		uniform.Add(ip)
+		uniform.Add(ip)
+	}
+	if d := uniform.distribution(); math.Abs(d.Gini) > 1e-9 || math.Abs(d.NormalizedEntropy-1) > 1e-9 || d.Top10Share != 0.1 {
+		t.Fatalf("uniform counts: got %+v", d)
+	}
+}
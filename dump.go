@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"math/rand"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// --- Text Dump ---
+// Columns of a text dump, selected with --dump-columns.
+const (
+	dumpColumnIP    = "ip"    // Dotted-decimal address.
+	dumpColumnIndex = "index" // Numeric value of the address, its index in the bitset.
+	dumpColumnHex   = "hex"   // Numeric value as eight hexadecimal digits.
+)
+
+// Orders of a text dump, selected with --order.
+const (
+	orderAsc     = "asc"
+	orderDesc    = "desc"
+	orderShuffle = "shuffle"
+)
+
+// dumpOrder is the order in which a dump lists the addresses, with the seed of the
+// pseudo-random generator for orderShuffle.
+type dumpOrder struct {
+	order string
+	seed  int64
+}
+
+// forEach calls fn for every address of set in the order. Descending order walks a dense
+// bitset backwards; for other sets, and for a shuffle, the addresses are collected first,
+// which needs 4 bytes per address.
+func (o dumpOrder) forEach(set IPSet, fn func(ip uint32)) {
+	if o.order == orderAsc {
+		set.ForEach(fn)
+		return
+	}
+	base := set
+	for w, ok := base.(setWrapper); ok; w, ok = base.(setWrapper) {
+		base = w.unwrap()
+	}
+	if bs, ok := base.(*AtomicBitSet); ok && o.order == orderDesc {
+		bs.forEachDesc(fn)
+		return
+	}
+	ips := make([]uint32, 0, set.Count())
+	set.ForEach(func(ip uint32) { ips = append(ips, ip) })
+	if o.order == orderDesc {
+		slices.Reverse(ips)
+	} else {
+		rnd := rand.New(rand.NewSource(o.seed))
+		rnd.Shuffle(len(ips), func(i, j int) { ips[i], ips[j] = ips[j], ips[i] })
+	}
+	for _, ip := range ips {
+		fn(ip)
+	}
+}
+
+// parseDumpColumns parses a comma-separated list of dump columns.
+func parseDumpColumns(s string) ([]string, error) {
+	var cols []string
+	for _, col := range strings.Split(s, ",") {
+		col = strings.TrimSpace(col)
+		switch col {
+		case dumpColumnIP, dumpColumnIndex, dumpColumnHex:
+			cols = append(cols, col)
+		default:
+			return nil, fmt.Errorf("unknown column %q (want %s, %s or %s)", col, dumpColumnIP, dumpColumnIndex, dumpColumnHex)
+		}
+	}
+	return cols, nil
+}
+
+// appendIP appends the dotted-decimal form of ip to b.
+func appendIP(b []byte, ip uint32) []byte {
+	for shift := 24; shift >= 0; shift -= 8 {
+		b = strconv.AppendUint(b, uint64(byte(ip>>shift)), 10)
+		if shift > 0 {
+			b = append(b, '.')
+		}
+	}
+	return b
+}
+
+// writeDump writes every address of set to the named file in the given order, one per
+// line, with the given columns separated by commas.
+func writeDump(name string, set IPSet, cols []string, order dumpOrder) error {
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	_, err = writeDumpLines(f, set, cols, order, nil)
+	return err
+}
+
+// appendDump appends the addresses of set that the named file does not list yet, in the
+// given order, so that appending the addresses of each run keeps the file a union
+// without duplicates. The existing addresses are loaded into a set of the given type
+// first. The file is created if it does not exist. Returns the number of addresses added.
+func appendDump(name string, set IPSet, cols []string, order dumpOrder, bitSetType string) (int, error) {
+	var existing IPSet = NewAtomicBitSet()
+	if bitSetType == bitSetSparse {
+		existing = NewSparseSet()
+	}
+	endsLine, err := loadDump(name, existing)
+	if err != nil {
+		return 0, err
+	}
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return 0, err
+	}
+	if !endsLine {
+		if _, err := f.Write([]byte{'\n'}); err != nil {
+			f.Close()
+			return 0, err
+		}
+	}
+	return writeDumpLines(f, set, cols, order, existing.IsSet)
+}
+
+// loadDump adds the addresses listed in the named dump to set, taking the first column
+// of each line. A missing file is treated as empty. Reports whether the file is empty
+// or ends with a newline.
+func loadDump(name string, set IPSet) (bool, error) {
+	f, err := os.Open(name)
+	if errors.Is(err, fs.ErrNotExist) {
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+	endsLine := true
+	for line := 1; ; line++ {
+		text, err := r.ReadSlice('\n')
+		if len(text) > 0 {
+			endsLine = text[len(text)-1] == '\n'
+			addr, _, _ := bytes.Cut(bytes.TrimRight(text, "\r\n"), []byte{','})
+			if len(addr) > 0 {
+				ip, ok := parseIPFast(addr)
+				if !ok {
+					return false, fmt.Errorf("%s:%d: invalid address %q", name, line, addr)
+				}
+				set.Set(ip)
+			}
+		}
+		if err == io.EOF {
+			return endsLine, nil
+		}
+		if err != nil {
+			return false, err
+		}
+	}
+}
+
+// appendDumpLine appends the dump line of ip with the given columns to b.
+func appendDumpLine(b []byte, ip uint32, cols []string) []byte {
+	for i, col := range cols {
+		if i > 0 {
+			b = append(b, ',')
+		}
+		switch col {
+		case dumpColumnIP:
+			b = appendIP(b, ip)
+		case dumpColumnIndex:
+			b = strconv.AppendUint(b, uint64(ip), 10)
+		case dumpColumnHex:
+			b = fmt.Appendf(b, "%08x", ip)
+		}
+	}
+	return append(b, '\n')
+}
+
+// writeDumpLines writes the addresses of set to f in the given order, one per line with
+// the given columns, skipping those for which skip reports true, and closes f. Returns
+// the number of lines written.
+func writeDumpLines(f *os.File, set IPSet, cols []string, order dumpOrder, skip func(ip uint32) bool) (int, error) {
+	w := bufio.NewWriter(f)
+	var line []byte
+	n := 0
+	order.forEach(set, func(ip uint32) {
+		if skip != nil && skip(ip) {
+			return
+		}
+		n++
+		line = appendDumpLine(line[:0], ip, cols)
+		w.Write(line)
+	})
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return n, err
+	}
+	return n, f.Close()
+}
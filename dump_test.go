@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"cmp"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// TestDumpAnnotated dumps the self-test dataset with --dump-annotated and checks that every
+// line is an ip,index pair whose index is the value of the address, in strictly ascending
+// order, and that every address is listed.
+func TestDumpAnnotated(t *testing.T) {
+	path, _, expected := selfTestDataset(t)
+	dump := filepath.Join(t.TempDir(), "dump.csv")
+	countArgs(t, path, "--dump-annotated", "--dump", dump)
+	f, err := os.Open(dump)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	n := 0
+	prev := int64(-1)
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		n++
+		addr, index, ok := strings.Cut(sc.Text(), ",")
+		ip, valid := parseIPFast([]byte(addr))
+		value, err := strconv.ParseUint(index, 10, 32)
+		if !ok || !valid || err != nil || uint64(ip) != value || int64(ip) <= prev {
+			t.Fatalf("line %d: unexpected %q", n, sc.Text())
+		}
+		prev = int64(ip)
+	}
+	if err := sc.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if n != len(expected) {
+		t.Errorf("dumped %d line(s), expected %d", n, len(expected))
+	}
+}
+
+// TestDumpAppend appends the addresses of the self-test dataset to a master list twice,
+// which must leave the list unchanged the second time, and then those of a file with one
+// known and one new address, which must only add the new one.
+func TestDumpAppend(t *testing.T) {
+	path, _, expected := selfTestDataset(t)
+	dir := t.TempDir()
+	master := filepath.Join(dir, "master.txt")
+	var first []byte
+	for run := 1; run <= 2; run++ {
+		countArgs(t, path, "--dump-append", master)
+		listed, err := os.ReadFile(master)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n := bytes.Count(listed, []byte{'\n'}); n != len(expected) {
+			t.Fatalf("run %d: master list holds %d line(s), expected %d", run, n, len(expected))
+		}
+		if run == 2 && !bytes.Equal(listed, first) {
+			t.Fatal("appending the same addresses changed the master list")
+		}
+		first = listed
+	}
+	var known uint32
+	for known = range expected {
+		break
+	}
+	more := filepath.Join(dir, "more.txt")
+	if err := os.WriteFile(more, []byte(formatIP(known)+"\n255.255.255.254\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	countArgs(t, more, "--dump-append", master)
+	listed, err := os.ReadFile(master)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(listed, first) || string(listed[len(first):]) != "255.255.255.254\n" {
+		t.Errorf("appended %q, expected only the new address", listed[len(first):])
+	}
+}
+
+// TestDumpOrders writes the dump of the self-test dataset with each --order, using a dense
+// and a sparse set for desc, and checks that desc is the ascending dump reversed and that
+// a shuffle lists the same addresses in an order that only depends on the seed.
+func TestDumpOrders(t *testing.T) {
+	path, _, _ := selfTestDataset(t)
+	dir := t.TempDir()
+	dumps := make(map[string][]string)
+	for _, args := range [][]string{
+		{"--order", "asc"},
+		{"--order", "desc"},
+		{"--order", "desc", "--bitset", "sparse"},
+		{"--order", "shuffle", "--order-seed", "7"},
+		{"--order", "shuffle", "--order-seed", "7", "--bitset", "sparse"},
+	} {
+		name := filepath.Join(dir, "order.txt")
+		countArgs(t, path, append(args, "--dump", name)...)
+		data, err := os.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		dumps[strings.Join(args, " ")] = strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+	}
+	asc := dumps["--order asc"]
+	for key, lines := range dumps {
+		lines = slices.Clone(lines)
+		switch {
+		case strings.Contains(key, "desc"):
+			slices.Reverse(lines)
+		case strings.Contains(key, "shuffle"):
+			if len(lines) > 2 && slices.Equal(lines, asc) {
+				t.Fatalf("%s: addresses left in ascending order", key)
+			}
+			if !slices.Equal(lines, dumps["--order shuffle --order-seed 7"]) {
+				t.Fatalf("%s: not the order of the dense set with the same seed", key)
+			}
+			slices.SortFunc(lines, func(a, b string) int {
+				x, _ := parseIPFast([]byte(a))
+				y, _ := parseIPFast([]byte(b))
+				return cmp.Compare(x, y)
+			})
+		}
+		if !slices.Equal(lines, asc) {
+			t.Fatalf("%s: %d line(s) do not match the %d ascending one(s)", key, len(lines), len(asc))
+		}
+	}
+}
@@ -0,0 +1,21 @@
+package main
+
+import "errors"
+
+// --- Errors ---
+// Sentinel errors returned (wrapped) by the counting functions, so callers can
+// distinguish failure causes with errors.Is instead of matching message text.
+// The underlying cause, e.g. fs.ErrNotExist for a missing file, is wrapped as well.
+var (
+	ErrOpenFailed = errors.New("error opening file")
+	ErrStatFailed = errors.New("error getting file stats")
+	ErrMmapFailed = errors.New("mmap error")
+	ErrEmptyFile  = errors.New("empty file")
+	ErrNoValidIPs = errors.New("no valid IPv4 addresses found")
+	ErrNotIPData  = errors.New("input does not look like IPv4 data")
+	ErrLowMemory  = errors.New("not enough memory")
+
+	ErrWorkerPanic = errors.New("worker panicked")
+
+	ErrInvalidRecord = errors.New("invalid record")
+)
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// countFile counts the file at path with the default options and no diagnostics.
+func countFile(t *testing.T, path string) (Result, error) {
+	t.Helper()
+	out := diag
+	diag = io.Discard
+	t.Cleanup(func() { diag = out })
+	opts, err := parseFlags([]string{path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return countUniqueIpInFile(path, opts)
+}
+
+func TestSentinelErrors(t *testing.T) {
+	dir := t.TempDir()
+	empty := filepath.Join(dir, "empty.txt")
+	if err := os.WriteFile(empty, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		name string
+		path string
+		want error
+	}{
+		{"empty file", empty, ErrEmptyFile},
+		{"missing path", filepath.Join(dir, "missing.txt"), ErrOpenFailed},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := countFile(t, tc.path)
+			if !errors.Is(err, tc.want) {
+				t.Fatalf("got %v, want an error wrapping %v", err, tc.want)
+			}
+		})
+	}
+}
+
+func TestMapFailure(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ips.txt")
+	if err := os.WriteFile(path, []byte("1.2.3.4\n5.6.7.8\n1.2.3.4\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	cause := errors.New("injected mapping failure")
+	mapped := mapFile
+	mapFile = func(*os.File, int64) ([]byte, error) { return nil, cause }
+	t.Cleanup(func() { mapFile = mapped })
+
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	if _, err := mapInput(file, 24); !errors.Is(err, ErrMmapFailed) || !errors.Is(err, cause) {
+		t.Fatalf("mapInput: got %v, want an error wrapping %v and the cause", err, ErrMmapFailed)
+	}
+	// Counting falls back to positional reads.
+	res, err := countFile(t, path)
+	if err != nil || res.Unique != 2 {
+		t.Fatalf("counted %d with error %v, want 2 addresses read in blocks", res.Unique, err)
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"sync/atomic"
+)
+
+// --- CIDR Expansion ---
+// DefaultExpandCIDRMax is the default for --expand-cidr-max: the addresses of a /8.
+const DefaultExpandCIDRMax = 1 << 24
+
+// rangeSetter is implemented by sets that can add a whole range of addresses faster than
+// one at a time.
+type rangeSetter interface {
+	SetRange(start, end uint32)
+}
+
+// cidrBlocks expands the CIDR blocks of the input for --expand-cidr and counts them.
+type cidrBlocks struct {
+	max uint64 // Largest number of addresses a block may cover.
+
+	hosts    atomic.Int64 // Records that parsed as a single address.
+	blocks   atomic.Int64 // Records that parsed as a block and were expanded.
+	covered  atomic.Int64 // Addresses of the expanded blocks, duplicates included.
+	oversize atomic.Int64 // Blocks skipped for covering more than max addresses.
+}
+
+// block parses record as an address with parse followed by "/" and a prefix length,
+// and returns the range it covers. Host bits set in the address are ignored. ok is false
+// if record is not a block or covers more than the maximum number of addresses; the
+// latter is counted. A nil cidrBlocks parses no blocks.
+func (cb *cidrBlocks) block(record []byte, parse parseFunc) (r ipRange, ok bool) {
+	if cb == nil {
+		return ipRange{}, false
+	}
+	slash := bytes.IndexByte(record, '/')
+	if slash < 0 {
+		return ipRange{}, false
+	}
+	prefix := bytes.TrimRight(record[slash+1:], " \t\r")
+	if len(prefix) == 0 || len(prefix) > 2 {
+		return ipRange{}, false
+	}
+	n := 0
+	for _, c := range prefix {
+		if c < '0' || c > '9' {
+			return ipRange{}, false
+		}
+		n = n*10 + int(c-'0')
+	}
+	ip, ok := parse(record[:slash])
+	if !ok || n > 32 {
+		return ipRange{}, false
+	}
+	mask := uint32(0)
+	if n > 0 {
+		mask = ^uint32(0) << (32 - n)
+	}
+	r = ipRange{start: ip & mask, end: ip | ^mask}
+	if r.size() > cb.max {
+		cb.oversize.Add(1)
+		return ipRange{}, false
+	}
+	return r, true
+}
+
+// setRange adds every address of r to set, with SetRange if the set supports it. Wrapped
+// sets filter each address, so they are filled one address at a time.
+func setRange(set IPSet, r ipRange) {
+	if rs, ok := set.(rangeSetter); ok {
+		rs.SetRange(r.start, r.end)
+		return
+	}
+	for ip := uint64(r.start); ip <= uint64(r.end); ip++ {
+		set.Set(uint32(ip))
+	}
+}
+
+// printCIDRBlocks reports the host and block records for --expand-cidr.
+func printCIDRBlocks(opts *options) {
+	cb := opts.cidr
+	if cb == nil {
+		return
+	}
+	fmt.Fprintf(diag, "Host records: %d, CIDR blocks: %d covering %d address(es)\n",
+		cb.hosts.Load(), cb.blocks.Load(), cb.covered.Load())
+	if n := cb.oversize.Load(); n > 0 {
+		fmt.Fprintf(diag, "Skipped %d CIDR block(s) of more than %d addresses (see --expand-cidr-max)\n", n, cb.max)
+	}
+}
@@ -0,0 +1,27 @@
+package main
+
+import "testing"
+
+// TestCIDRExpansion counts a few CIDR blocks and host addresses with --expand-cidr in a
+// dense and a sparse set, and checks that a /24 adds exactly 256 addresses.
+func TestCIDRExpansion(t *testing.T) {
+	for _, tc := range []struct {
+		data string
+		want int
+	}{
+		{"10.0.0.0/24\n", 256},
+		{"10.0.0.0/24\n10.0.0.7\n10.0.0.255/24\n", 256},
+		{"10.0.0.128/25\n10.0.1.0\n10.1.2.3/30\n192.168.1.1/32\n", 128 + 1 + 4 + 1},
+		{"1.2.3.4\n5.0.0.0/7\n", 1},
+	} {
+		for _, set := range []IPSet{NewAtomicBitSet(), NewSparseSet()} {
+			opts := &options{minRecordLen: MinIPLen, cidr: &cidrBlocks{max: 1 << 16}}
+			if err := processData([]byte(tc.data), set, 1, opts); err != nil {
+				t.Fatal(err)
+			}
+			if set.Count() != tc.want {
+				t.Fatalf("%q in %T: counted %d unique, expected %d", tc.data, set, set.Count(), tc.want)
+			}
+		}
+	}
+}
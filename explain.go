@@ -0,0 +1,380 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// --- Execution Plan ---
+// explainPlan writes the plan of a run with opts to w for --explain: how the input is
+// read, the workers and chunk sizes, the set and the wrappers around it, an estimate of
+// the memory and the flags given. It reads the metadata of the input, but not its data.
+func explainPlan(w io.Writer, opts *options) error {
+	p := &plan{w: w}
+	switch {
+	case opts.merge:
+		p.line("Input", "merge of %d serialized bitset(s), each read in whole", len(opts.paths))
+		p.line("Set", "dense bitset, %s", formatBytes(denseBytes))
+		p.memory = denseBytes
+	case opts.intersect:
+		p.line("Input", "intersection of %d files, each counted into a set of its own", len(opts.paths))
+		p.explainSet(opts)
+		// The intersection so far and the set of the current file.
+		p.memory *= 2
+	default:
+		if err := p.explainInput(opts); err != nil {
+			return err
+		}
+		p.explainSet(opts)
+	}
+	p.explainRecords(opts)
+	p.explainOutput(opts)
+	p.line("Memory", "%s", p.memoryEstimate())
+	given := opts.given
+	if len(given) == 0 {
+		given = []string{"none"}
+	}
+	p.line("Flags", "%s", strings.Join(given, " "))
+	return p.err
+}
+
+// denseBytes is the size of the full dense bitset, one bit per IPv4 address.
+const denseBytes = 1 << 29
+
+// plan collects the lines of --explain and the memory they need.
+type plan struct {
+	w       io.Writer
+	memory  int64    // Bytes allocated up front: sets, sketches and prefix levels.
+	mapped  int64    // Bytes of input memory-mapped at once, backed by the page cache.
+	growing []string // Structures that grow with the number of addresses.
+	err     error
+}
+
+func (p *plan) line(key, format string, args ...any) {
+	if p.err == nil {
+		_, p.err = fmt.Fprintf(p.w, "%-9s %s\n", key+":", fmt.Sprintf(format, args...))
+	}
+}
+
+// explainInput describes how the input at opts.path is read and by how many workers.
+func (p *plan) explainInput(opts *options) error {
+	stat, err := os.Stat(opts.path)
+	if err != nil {
+		return err
+	}
+	var size int64
+	switch {
+	case stat.IsDir():
+		files, err := listFiles(opts.path)
+		if err != nil {
+			return fmt.Errorf("error listing directory: %w", err)
+		}
+		var largest int64
+		for _, name := range files {
+			if st, err := os.Stat(name); err == nil {
+				size += st.Size()
+				largest = max(largest, st.Size())
+			}
+		}
+		concurrency := min(opts.fileConcurrency, len(files))
+		if opts.singleThread {
+			concurrency = 1
+		}
+		p.line("Input", "directory of %d file(s), %s, up to %d open and memory-mapped at once", len(files), formatBytes(size), concurrency)
+		p.mapped = largest * int64(concurrency)
+		p.explainChunks(opts, largest, "per file, for the largest one")
+		if opts.newPerFile {
+			p.line("Files", "processed one at a time, in order, for --new-per-file")
+		}
+		return nil
+	case stat.Mode()&os.ModeNamedPipe != 0:
+		p.line("Input", "named pipe, read as a stream in blocks of %s", formatBytes(int64(opts.readBufferSize())))
+		if ll := opts.longLines; ll != nil {
+			p.line("Long lines", "records over %d bytes skipped up to their newline", ll.max)
+		}
+		p.explainChunks(opts, int64(opts.readBufferSize()), "per block")
+		return nil
+	}
+	size = stat.Size()
+	switch {
+	case opts.pcap:
+		p.line("Input", "packet capture of %s, counting the %s address of each IPv4 packet", formatBytes(size), opts.pcapField)
+		return nil
+	case opts.gunzip:
+		p.line("Input", "gzip file of %s, memory-mapped, its members decoded on up to %d worker(s)", formatBytes(size), opts.chunkWorkers(int(size)))
+		p.mapped = size
+		return nil
+	case !canMap:
+		p.line("Input", "file of %s, read in blocks of %s, as memory mapping is not available", formatBytes(size), formatBytes(int64(opts.readBufferSize())))
+		p.explainChunks(opts, int64(min(size, int64(opts.readBufferSize()))), "per block")
+		return nil
+	}
+	p.line("Input", "file of %s, memory-mapped", formatBytes(size))
+	p.mapped = size
+	switch {
+	case opts.follow:
+		p.line("Follow", "new data is processed every %v until the file has not grown for %v", opts.pollInterval, opts.stableFor)
+	case opts.byteRange != nil:
+		p.line("Range", "only the lines starting in bytes %d to %d", opts.byteRange.start, opts.byteRange.end)
+		size = min(size, opts.byteRange.end) - min(size, opts.byteRange.start)
+	case opts.segmented():
+		p.line("Segments", "segments of %s, each processed in whole", formatBytes(opts.segmentSize))
+		size = min(size, opts.segmentSize)
+	case opts.checkpoint != "":
+		resume := ""
+		if opts.resume {
+			resume = ", resuming from it"
+		}
+		p.line("Saves", "checkpoints to %s at most every %v%s, in windows of %s", opts.checkpoint, opts.checkpointInterval, resume, formatBytes(checkpointWindow))
+		size = min(size, checkpointWindow)
+	}
+	if opts.autoWorkers && size >= ChunkMinSize {
+		p.line("Workers", "chosen by timing slices of the file with 1, 2, 4, ... workers")
+		return nil
+	}
+	p.explainChunks(opts, size, "")
+	return nil
+}
+
+// explainChunks describes the chunk workers for data of the given size, processed as one
+// piece; what tells what the size applies to, if not the whole input.
+func (p *plan) explainChunks(opts *options, size int64, what string) {
+	workers := opts.chunkWorkers(int(size))
+	var why string
+	switch {
+	case opts.singleThread:
+		why = "--single-thread"
+	case size < ChunkMinSize:
+		why = fmt.Sprintf("below %s", formatBytes(ChunkMinSize))
+	case opts.workers > 0:
+		why = "--workers"
+	case opts.threadsPerCore > 0:
+		why = "--threads-per-core"
+	default:
+		why = "half the CPUs"
+	}
+	if what != "" {
+		why += ", " + what
+	}
+	p.line("Workers", "%d chunk worker(s) (%s), chunks of about %s", workers, why, formatBytes(size/int64(workers)))
+	if opts.plainStores && workers == 1 {
+		p.line("Stores", "plain stores to the dense bitset, for --plain-stores")
+	}
+	if opts.setBatch > 0 {
+		p.line("Stores", "batched per worker in %d (word, mask) slot(s), for --set-batch", opts.setBatch)
+	}
+	if opts.countContention {
+		p.line("Stores", "compare-and-swap loops counting their retries, for --count-contention")
+	}
+}
+
+// explainSet describes the set that newIPSet creates for opts and the wrappers around it.
+func (p *plan) explainSet(opts *options) {
+	switch {
+	case len(opts.subnets) == 1 && opts.bitSetType == bitSetDense:
+		bytes := int64(opts.subnets[0].size()+63) / 64 * 8
+		p.line("Set", "dense bitset of %s for %v only", formatBytes(bytes), opts.subnets[0])
+		p.memory += bytes
+	case opts.bitSetType == bitSetSparse && opts.spillAbove > 0:
+		p.line("Set", "sparse hash set, spilled to sorted runs on disk above %d address(es)", opts.spillAbove)
+		p.memory += opts.spillAbove * sparseEntryBytes
+	case opts.bitSetType == bitSetSparse && opts.memoryBudget > 0:
+		p.line("Set", "sparse hash set, estimated with a HyperLogLog above %s", formatBytes(opts.memoryBudget))
+		p.memory += opts.memoryBudget
+	case opts.bitSetType == bitSetSparse:
+		p.line("Set", "sparse hash set, about %d bytes per unique address", sparseEntryBytes)
+		p.growing = append(p.growing, fmt.Sprintf("about %d bytes per unique address", sparseEntryBytes))
+	default:
+		kind := "dense bitset"
+		if opts.hugePages {
+			kind += " on huge pages"
+		}
+		p.line("Set", "%s of %s", kind, formatBytes(denseBytes))
+		p.memory += denseBytes
+	}
+	var wrappers []string
+	for _, l := range opts.levels {
+		if l.set != nil {
+			p.memory += int64(len(l.set.bits)) * 8
+		}
+	}
+	if len(opts.levels) > 0 {
+		wrappers = append(wrappers, fmt.Sprintf("%d prefix level(s)", len(opts.levels)))
+	}
+	if s := opts.sketch; s != nil {
+		wrappers = append(wrappers, fmt.Sprintf("count-min sketch of %dx%d", s.depth, s.width))
+		p.memory += int64(len(s.counters)) * 4
+	}
+	if opts.counts != nil {
+		wrappers = append(wrappers, "per-address counts")
+		p.growing = append(p.growing, "about 40 bytes per unique address for the counts")
+	}
+	if len(opts.subnets) > 0 && !(len(opts.subnets) == 1 && opts.bitSetType == bitSetDense) {
+		wrappers = append(wrappers, fmt.Sprintf("filter to %d subnet(s)", len(opts.subnets)))
+	}
+	if opts.exclude != nil {
+		wrappers = append(wrappers, "excluded prefixes")
+	}
+	if len(wrappers) > 0 {
+		p.line("Also", "%s", strings.Join(wrappers, ", "))
+	}
+	if opts.noCount {
+		p.line("Count", "skipped, for --no-count")
+	} else if opts.bitSetType == bitSetDense {
+		workers := opts.countWorkers
+		if workers == 0 {
+			workers = defaultWorkers()
+		}
+		p.line("Count", "%d count worker(s) over the dense bitset", workers)
+	}
+}
+
+// explainRecords describes how the lines of the input are parsed.
+func (p *plan) explainRecords(opts *options) {
+	if opts.merge || opts.pcap {
+		return
+	}
+	var modes []string
+	add := func(on bool, mode string) {
+		if on {
+			modes = append(modes, mode)
+		}
+	}
+	add(opts.jsonl, fmt.Sprintf("JSON lines, address in %q", opts.ipField))
+	add(opts.whitespaceStream, "records separated by any whitespace")
+	add(opts.extract, "every field that is an address")
+	add(opts.proxyProtocol, "PROXY protocol source addresses")
+	add(opts.syslog && opts.syslogSDID == "", fmt.Sprintf("RFC 5424 syslog, address in %q of any element", opts.syslogParam))
+	add(opts.srcKey != "", fmt.Sprintf("source in the field after %q and destination after %q, counted apart and as their union", opts.srcKey, opts.dstKey))
+	add(opts.syslog && opts.syslogSDID != "", fmt.Sprintf("RFC 5424 syslog, address in %q of [%s]", opts.syslogParam, opts.syslogSDID))
+	add(opts.tolerantSpaces, "padded octets")
+	add(opts.stripPort, "ports stripped")
+	add(opts.textPrefixes != nil, fmt.Sprintf("%d text prefix(es)", len(opts.textPrefixes)))
+	add(opts.expandCIDR, "CIDR blocks expanded")
+	add(opts.trackTimes, "first and last seen times")
+	add(opts.strict, "strict")
+	add(opts.minValidRatio > 0, fmt.Sprintf("failing if less than %g of the first %s are valid", opts.minValidRatio, formatBytes(int64(opts.sampleBytes()))))
+	add(opts.skipRepeats, "repeated lines skipped")
+	add(opts.headCount > 0, fmt.Sprintf("first %d valid record(s)", opts.headCount))
+	add(opts.maxUnique != nil, "stopping above a unique count")
+	add(opts.rate != nil, "rate-limited")
+	if len(modes) == 0 {
+		modes = []string{"one address per line"}
+	}
+	if opts.trackTimes {
+		p.growing = append(p.growing, "two timestamps per unique address")
+	}
+	p.line("Records", "%s", strings.Join(modes, ", "))
+}
+
+// explainOutput describes the result and the files the run writes.
+func (p *plan) explainOutput(opts *options) {
+	out := []string{opts.format + " result on stdout"}
+	if opts.textfile != "" {
+		out[0] = opts.format + " result in " + opts.textfile
+	}
+	for _, f := range []struct{ what, name string }{
+		{"addresses", opts.dump},
+		{"address objects", opts.dumpNDJSON},
+		{"new addresses appended", opts.dumpAppend},
+		{"serialized bitset", opts.dumpBinary},
+		{"merged bitset", opts.out},
+		{"invalid lines", opts.invalidOut},
+		{"segment manifest", opts.manifest},
+		{"partition files", opts.partitionDir},
+		{"heatmap", opts.heatmap},
+	} {
+		if f.name != "" {
+			out = append(out, f.what+" in "+f.name)
+		}
+	}
+	p.line("Output", "%s", strings.Join(out, ", "))
+}
+
+// memoryEstimate returns the memory of the plan as text.
+func (p *plan) memoryEstimate() string {
+	var parts []string
+	if p.memory > 0 {
+		parts = append(parts, fmt.Sprintf("%s allocated up front, touched as addresses are added", formatBytes(p.memory)))
+	}
+	parts = append(parts, p.growing...)
+	if p.mapped > 0 {
+		parts = append(parts, fmt.Sprintf("up to %s of mapped input in the page cache", formatBytes(p.mapped)))
+	}
+	return strings.Join(parts, ", plus ")
+}
+
+// formatBytes returns n as a size in bytes, KiB, MiB or GiB.
+func formatBytes(n int64) string {
+	switch {
+	case n >= 1<<30:
+		return fmt.Sprintf("%.1fGiB", float64(n)/(1<<30))
+	case n >= 1<<20:
+		return fmt.Sprintf("%.1fMiB", float64(n)/(1<<20))
+	case n >= 1<<10:
+		return fmt.Sprintf("%.1fKiB", float64(n)/(1<<10))
+	}
+	return fmt.Sprintf("%d bytes", n)
+}
+
+// givenValue records the argument a flag was set with, as the values of flags defined
+// with fs.Func and fs.BoolFunc have no String of their own.
+type givenValue struct {
+	flag.Value
+	arg string
+}
+
+func (v *givenValue) Set(s string) error {
+	v.arg = s
+	return v.Value.Set(s)
+}
+
+func (v *givenValue) String() string {
+	if v == nil || v.Value == nil {
+		return ""
+	}
+	return v.Value.String()
+}
+
+func (v *givenValue) IsBoolFlag() bool {
+	b, ok := v.Value.(interface{ IsBoolFlag() bool })
+	return ok && b.IsBoolFlag()
+}
+
+// recordGiven wraps the values of all flags of fs so that givenFlags can list them.
+// PrintDefaults derives the type names and defaults it prints from the value types, so
+// the usage unwraps them again with unwrapGiven.
+func recordGiven(fs *flag.FlagSet) {
+	fs.VisitAll(func(f *flag.Flag) {
+		f.Value = &givenValue{Value: f.Value}
+	})
+}
+
+// unwrapGiven undoes recordGiven.
+func unwrapGiven(fs *flag.FlagSet) {
+	fs.VisitAll(func(f *flag.Flag) {
+		if v, ok := f.Value.(*givenValue); ok {
+			f.Value = v.Value
+		}
+	})
+}
+
+// givenFlags returns the flags set on the command line of fs or from the environment,
+// other than --explain, as --name=value, or --name for boolean flags set to true.
+func givenFlags(fs *flag.FlagSet) []string {
+	var given []string
+	fs.Visit(func(f *flag.Flag) {
+		v, ok := f.Value.(*givenValue)
+		switch {
+		case f.Name == "explain":
+		case ok && v.IsBoolFlag() && (v.arg == "true" || v.arg == ""):
+			given = append(given, "--"+f.Name)
+		case ok:
+			given = append(given, "--"+f.Name+"="+v.arg)
+		}
+	})
+	return given
+}
@@ -0,0 +1,25 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// TestExplain writes the plan for the self-test dataset with a few flags and checks that
+// it reflects them, including the values of flags without a String method of their own.
+func TestExplain(t *testing.T) {
+	path, _, _ := selfTestDataset(t)
+	opts, err := parseFlags([]string{"--explain", "--workers", "3", "--levels=24", "--bitset", "sparse", path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var plan strings.Builder
+	if err := explainPlan(&plan, opts); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"memory-mapped", "3 chunk worker(s)", "sparse hash set", "Flags:    --bitset=sparse --levels=24 --workers=3\n"} {
+		if !strings.Contains(plan.String(), want) {
+			t.Fatalf("plan does not mention %q:\n%s", want, plan.String())
+		}
+	}
+}
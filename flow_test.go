@@ -0,0 +1,58 @@
+package main
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+// TestFlowKeys processes firewall log lines with both, one or neither of the --src-key
+// and --dst-key fields, including keys that prefix each other and values that are not
+// addresses, and checks both directions, their union and the number of valid records.
+func TestFlowKeys(t *testing.T) {
+	data := strings.Join([]string{
+		`proto=tcp src=1.2.3.4 dst=5.6.7.8 spt=443`,
+		`dst=10.0.0.1:80 src=1.2.3.4:5000`,
+		`src=10.0.0.2`,
+		"\tdst=10.0.0.3\r",
+		`src=host.example dst=10.0.0.4`,
+		`srcip=10.0.0.5 xdst=10.0.0.6`,
+		`src= dst=`,
+		`no keys 10.0.0.7`,
+		`src=10.0.0.8 src=10.0.0.9 dst=5.6.7.8 dst=10.0.0.10`,
+		`ip=dst:10.0.0.11 ip=10.0.0.12`,
+	}, "\n")
+	for _, c := range []struct {
+		src, dst              string
+		wantSrc, wantDst, all []string
+		valid                 int64
+	}{
+		{"src=", "dst=",
+			[]string{"1.2.3.4", "10.0.0.2", "10.0.0.8"},
+			[]string{"5.6.7.8", "10.0.0.1", "10.0.0.3", "10.0.0.4"},
+			[]string{"1.2.3.4", "5.6.7.8", "10.0.0.1", "10.0.0.2", "10.0.0.3", "10.0.0.4", "10.0.0.8"}, 6},
+		{"ip=", "ip=dst:",
+			[]string{"10.0.0.12"}, []string{"10.0.0.11"}, []string{"10.0.0.11", "10.0.0.12"}, 1},
+	} {
+		flow := &flowCounts{srcKey: []byte(c.src), dstKey: []byte(c.dst), src: NewSparseSet(), dst: NewSparseSet()}
+		opts := &options{minRecordLen: MinIPLen, srcKey: c.src, dstKey: c.dst, flow: flow, stripPort: true, stats: &recordStats{}}
+		set := NewSparseSet()
+		if err := processData([]byte(data), set, 1, opts); err != nil {
+			t.Fatal(err)
+		}
+		for _, s := range []struct {
+			name string
+			set  IPSet
+			want []string
+		}{{"source", flow.src, c.wantSrc}, {"destination", flow.dst, c.wantDst}, {"union", set, c.all}} {
+			var got []string
+			s.set.ForEach(func(ip uint32) { got = append(got, formatIP(ip)) })
+			if !slices.Equal(got, s.want) {
+				t.Fatalf("--src-key %q --dst-key %q: %s counted %v, expected %v", c.src, c.dst, s.name, got, s.want)
+			}
+		}
+		if got := opts.stats.valid.Load(); got != c.valid {
+			t.Fatalf("--src-key %q --dst-key %q: %d valid record(s), expected %d", c.src, c.dst, got, c.valid)
+		}
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+)
+
+// --- Following Growing Files ---
+// followFile keeps processing data appended to file after offset, like `tail -f`,
+// printing the running unique count after each update. Only complete lines are
+// processed; a trailing partial line is picked up once its newline arrives.
+// It returns once the file has not grown for --stable-for, with the final offset.
+func followFile(file *os.File, offset int64, set IPSet, opts *options) (int64, error) {
+	fmt.Fprintf(diag, "Following %s from offset %d...\n", file.Name(), offset)
+	lastGrowth := time.Now()
+	size := offset
+	for {
+		stat, err := file.Stat()
+		if err != nil {
+			return offset, fmt.Errorf("%w: %w", ErrStatFailed, err)
+		}
+		if stat.Size() < offset {
+			return offset, fmt.Errorf("file %s was truncated while following", file.Name())
+		}
+		if stat.Size() == size {
+			if time.Since(lastGrowth) >= opts.stableFor {
+				fmt.Fprintf(diag, "No growth for %v, stopping\n", opts.stableFor)
+				return offset, nil
+			}
+			time.Sleep(opts.pollInterval)
+			continue
+		}
+		size = stat.Size()
+		lastGrowth = time.Now()
+
+		// Process the appended bytes block by block, up to the last complete line.
+		offset, err = readBlocks(file, offset, size, false, opts.readBufferSize(), func(block []byte) error {
+			return processData(block, set, opts.chunkWorkers(len(block)), opts)
+		})
+		if err != nil {
+			return offset, err
+		}
+		fmt.Fprintf(diag, "Offset %d: %d unique IPv4 address(es) so far\n", offset, set.Count())
+	}
+}
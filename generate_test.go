@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// generatedLineLen is the length of every line of a generated file, without its line
+// ending, so that the number of lines fixes the file size.
+const generatedLineLen = len("100.100.100.100")
+
+// generatedFile describes a synthetic file of fixed-length lines with a known number of
+// distinct addresses.
+type generatedFile struct {
+	lines   int  // Number of lines.
+	unique  int  // Distinct addresses among the lines, each on at least one line.
+	invalid int  // Percentage of lines that are not addresses.
+	crlf    bool // End lines with "\r\n" instead of "\n".
+}
+
+// String names the subtest of the file.
+func (g generatedFile) String() string {
+	ending := "LF"
+	if g.crlf {
+		ending = "CRLF"
+	}
+	return fmt.Sprintf("%d lines, %d unique, %d%% invalid, %s", g.lines, g.unique, g.invalid, ending)
+}
+
+// size returns the size of the file in bytes.
+func (g generatedFile) size() int {
+	if g.crlf {
+		return g.lines * (generatedLineLen + 2)
+	}
+	return g.lines * (generatedLineLen + 1)
+}
+
+// generateIPFile writes the file described by g to a temporary directory of the test and
+// returns its path. Every address has octets of three digits and every invalid line is as
+// long as an address, so all lines have the same length. The remaining lines repeat
+// addresses at random.
+func generateIPFile(t *testing.T, g generatedFile, rnd *rand.Rand) string {
+	t.Helper()
+	invalid := g.lines * g.invalid / 100
+	if g.unique+invalid > g.lines || (g.unique == 0 && invalid < g.lines) {
+		t.Fatalf("%v: too few lines", g)
+	}
+	seen := make(map[uint32]bool, g.unique)
+	addrs := make([]string, 0, g.unique)
+	for len(addrs) < g.unique {
+		var ip uint32
+		for i := 0; i < 4; i++ {
+			ip = ip<<8 | uint32(100+rnd.Intn(156))
+		}
+		if !seen[ip] {
+			seen[ip] = true
+			addrs = append(addrs, formatIP(ip))
+		}
+	}
+	lines := slices.Clone(addrs)
+	for range invalid {
+		addr := []byte("100.100.100.100")
+		if len(addrs) > 0 {
+			addr = []byte(addrs[rnd.Intn(len(addrs))])
+		}
+		// A letter, or an octet above 255.
+		if rnd.Intn(2) == 0 {
+			addr[rnd.Intn(len(addr))] = 'x'
+		} else {
+			addr[4*rnd.Intn(4)] = '3'
+		}
+		lines = append(lines, string(addr))
+	}
+	for len(lines) < g.lines {
+		lines = append(lines, addrs[rnd.Intn(len(addrs))])
+	}
+	rnd.Shuffle(len(lines), func(i, j int) { lines[i], lines[j] = lines[j], lines[i] })
+	ending := "\n"
+	if g.crlf {
+		ending = "\r\n"
+	}
+	path := filepath.Join(t.TempDir(), "generated.txt")
+	if err := os.WriteFile(path, []byte(strings.Join(lines, ending)+ending), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if fi, err := os.Stat(path); err != nil || fi.Size() != int64(g.size()) {
+		t.Fatalf("%v: unexpected size of %s (%v)", g, path, err)
+	}
+	return path
+}
+
+// TestCountGenerated counts generated files, with sizes just below, at and just above
+// ChunkMinSize, where counting switches to multiple workers, and well above it, with
+// several numbers of workers. Every count must be exactly the number of distinct
+// addresses. CRLF line endings are only accepted with --extract, which splits off the "\r".
+func TestCountGenerated(t *testing.T) {
+	out := diag
+	diag = io.Discard
+	t.Cleanup(func() { diag = out })
+	for _, g := range []generatedFile{
+		{lines: 1000, unique: 10, invalid: 5},
+		{lines: ChunkMinSize/(generatedLineLen+1) - 1, unique: 40_000, invalid: 3},
+		{lines: ChunkMinSize / (generatedLineLen + 1), unique: 65_536},
+		{lines: ChunkMinSize/(generatedLineLen+1) + 1, unique: 1, invalid: 50},
+		{lines: ChunkMinSize/(generatedLineLen+2) + 1, unique: 50_000, invalid: 10, crlf: true},
+		{lines: 3 * ChunkMinSize / (generatedLineLen + 1), unique: 150_000, invalid: 1},
+	} {
+		t.Run(g.String(), func(t *testing.T) {
+			path := generateIPFile(t, g, rand.New(rand.NewSource(1)))
+			for _, args := range [][]string{{"--single-thread"}, {"--workers", "2"}, {"--workers", "3"}, {"--workers", "8"}} {
+				if g.crlf {
+					args = append(args, "--extract")
+				}
+				opts, err := parseFlags(append(args, path))
+				if err != nil {
+					t.Fatal(err)
+				}
+				res, err := countUniqueIpInFile(path, opts)
+				if err != nil {
+					t.Fatalf("%s: %v", strings.Join(args, " "), err)
+				}
+				if res.Unique != g.unique {
+					t.Errorf("%s: counted %d, expected %d", strings.Join(args, " "), res.Unique, g.unique)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+)
+
+// --- Country Breakdown ---
+// geoTable maps address ranges to country codes.
+type geoTable struct {
+	ranges rangeTable
+	codes  []string // Country codes, indexed by the labels of ranges.
+}
+
+// CountryCount is the number of unique addresses of a country.
+type CountryCount struct {
+	Country string `json:"country"`
+	Unique  int    `json:"unique"`
+}
+
+// parseTableAddr parses an address given in dotted-decimal form or as its numeric value.
+func parseTableAddr(s string) (uint32, bool) {
+	if ip, ok := parseIPFast([]byte(s)); ok {
+		return ip, true
+	}
+	n, err := strconv.ParseUint(s, 10, 32)
+	return uint32(n), err == nil
+}
+
+// loadGeoTable reads an address-to-country table with either `prefix country` or
+// `start end country` per line, as in the GeoLite2 country CSV converted to two-letter
+// codes, the DB-IP lite CSV and the IP2Location lite CSV. Addresses may be dotted or
+// numeric, further columns are ignored, and a country of "-" marks an unassigned range.
+func loadGeoTable(name string) (*geoTable, error) {
+	t := &geoTable{}
+	index := make(map[string]uint32)
+	ranges, err := readRangeTable(name, func(fields []string) (labeledRange, error) {
+		var r ipRange
+		var country string
+		start, end, ok := uint32(0), uint32(0), false
+		if len(fields) >= 3 {
+			start, ok = parseTableAddr(fields[0])
+			if ok {
+				end, ok = parseTableAddr(fields[1])
+			}
+		}
+		switch {
+		case ok && start <= end:
+			r, country = ipRange{start, end}, fields[2]
+		case ok:
+			return labeledRange{}, fmt.Errorf("range %s-%s ends before it starts", fields[0], fields[1])
+		case len(fields) >= 2:
+			var err error
+			if r, err = parseCIDR(fields[0]); err != nil {
+				return labeledRange{}, err
+			}
+			country = fields[1]
+		default:
+			return labeledRange{}, errors.New("expected a prefix or range and a country")
+		}
+		if country == "" {
+			return labeledRange{}, errors.New("empty country")
+		}
+		label, known := index[country]
+		if !known {
+			label = uint32(len(t.codes))
+			index[country] = label
+			t.codes = append(t.codes, country)
+		}
+		return labeledRange{r, label}, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	// Unassigned ranges still shadow the ranges they are nested in, and count as unmapped.
+	for _, r := range ranges {
+		if t.codes[r.label] != "-" {
+			t.ranges = append(t.ranges, r)
+		}
+	}
+	return t, nil
+}
+
+// countCountries returns the unique addresses of set per country, by descending count,
+// and the number of addresses not mapped to any country.
+func (t *geoTable) countCountries(set IPSet) ([]CountryCount, int) {
+	counts, unmatched := t.ranges.countLabels(set)
+	countries := make([]CountryCount, 0, len(counts))
+	for label, n := range counts {
+		countries = append(countries, CountryCount{Country: t.codes[label], Unique: n})
+	}
+	slices.SortFunc(countries, func(a, b CountryCount) int {
+		return cmp.Or(cmp.Compare(b.Unique, a.Unique), cmp.Compare(a.Country, b.Country))
+	})
+	return countries, unmatched
+}
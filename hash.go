@@ -0,0 +1,57 @@
+package main
+
+import (
+	"encoding/binary"
+	"hash/maphash"
+)
+
+// --- Address Hashing ---
+// hashFunc maps an address to 64 bits whose top bits pick a shard of a SparseSet and a
+// register of a HyperLogLog.
+type hashFunc func(ip uint32) uint64
+
+// Hash functions accepted by --hash.
+const (
+	hashSplitmix = "splitmix"
+	hashFNV      = "fnv"
+	hashMaphash  = "maphash"
+	hashMult     = "mult"
+)
+
+// defaultHash is the hash used unless --hash selects another one.
+var defaultHash = newHash(hashSplitmix, 0)
+
+// newHash returns the named hash function, varied by seed:
+//   - splitmix, the default, is the splitmix64 finalizer, which spreads every input bit
+//     over all output bits, so sequential addresses and whole subnets are spread evenly.
+//   - fnv is 64-bit FNV-1a over the 4 address bytes. Its top bits depend mostly on the
+//     first bytes hashed, so addresses differing only in their last octet cluster.
+//   - maphash is the runtime's hash of hash/maphash, with a random seed per run, so
+//     results vary between runs and seed is ignored.
+//   - mult is the 32-bit multiplicative hash that SparseSet used to pick its shard. It is
+//     fast and spreads structured addresses over the shards, but its low bits are poor,
+//     which makes HyperLogLog estimates wrong.
+func newHash(name string, seed uint64) hashFunc {
+	switch name {
+	case hashFNV:
+		return func(ip uint32) uint64 {
+			h := uint64(14695981039346656037) ^ seed
+			for shift := 24; shift >= 0; shift -= 8 {
+				h = (h ^ uint64(byte(ip>>shift))) * 1099511628211
+			}
+			return h
+		}
+	case hashMaphash:
+		s := maphash.MakeSeed()
+		return func(ip uint32) uint64 {
+			var b [4]byte
+			binary.BigEndian.PutUint32(b[:], ip)
+			return maphash.Bytes(s, b[:])
+		}
+	case hashMult:
+		return func(ip uint32) uint64 {
+			return uint64((ip^uint32(seed))*2654435761) << 32
+		}
+	}
+	return func(ip uint32) uint64 { return mix64(uint64(ip) ^ seed) }
+}
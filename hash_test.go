@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"testing"
+)
+
+// TestHashSpread adds structured addresses, a run of 2^20 sequential ones and the first
+// host of 2^20 consecutive /24s, to a SparseSet and a HyperLogLog for each well-distributed
+// --hash, and checks that no shard holds more than 1.5 times its share and that the
+// estimate is within 3%.
+func TestHashSpread(t *testing.T) {
+	const n = 1 << 20
+	for _, name := range []string{hashSplitmix, hashMaphash} {
+		for _, stride := range []uint32{1, 256} {
+			hash := newHash(name, 0)
+			s, h := newSparseSetHash(hash), newHyperLogLogHash(hash)
+			for i := range uint32(n) {
+				ip := 10<<24 + i*stride + stride/256
+				s.add(ip)
+				h.Add(ip)
+			}
+			largest := 0
+			for i := range s.shards {
+				largest = max(largest, len(s.shards[i].ips))
+			}
+			if share := n / sparseShards; largest > share*3/2 {
+				t.Fatalf("%s, stride %d: largest shard holds %d addresses, expected about %d", name, stride, largest, share)
+			}
+			if got := h.Estimate(); math.Abs(float64(got-n)) > 0.03*n {
+				t.Fatalf("%s, stride %d: estimated %d, expected about %d", name, stride, got, n)
+			}
+		}
+	}
+}
+
+// BenchmarkHash adds the structured addresses of TestHashSpread to a SparseSet and a
+// HyperLogLog with each --hash, reporting the largest shard and the error of the estimate
+// next to the time.
+func BenchmarkHash(b *testing.B) {
+	const n = 1 << 20
+	for _, name := range []string{hashSplitmix, hashFNV, hashMaphash, hashMult} {
+		for _, stride := range []uint32{1, 256} {
+			b.Run(fmt.Sprintf("%s/stride=%d", name, stride), func(b *testing.B) {
+				hash := newHash(name, 0)
+				var s *SparseSet
+				var h *HyperLogLog
+				for range b.N {
+					s, h = newSparseSetHash(hash), newHyperLogLogHash(hash)
+					for i := range uint32(n) {
+						ip := 10<<24 + i*stride + stride/256
+						s.add(ip)
+						h.Add(ip)
+					}
+				}
+				largest := 0
+				for i := range s.shards {
+					largest = max(largest, len(s.shards[i].ips))
+				}
+				b.ReportMetric(float64(largest), "largest-shard")
+				b.ReportMetric(100*float64(h.Estimate()-n)/n, "estimate-%")
+			})
+		}
+	}
+}
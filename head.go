@@ -0,0 +1,45 @@
+package main
+
+import "sync/atomic"
+
+// --- Head Limit ---
+// headBatch is the number of records a worker claims from the shared budget at a time,
+// so that workers do not contend on the counter for every line.
+const headBatch = 4096
+
+// headLimit is a budget of valid records shared by all workers for --head.
+// Workers claim records in batches; the total claimed never exceeds the budget.
+type headLimit struct {
+	remaining atomic.Int64
+}
+
+// newHeadLimit creates a budget of n valid records.
+func newHeadLimit(n int64) *headLimit {
+	h := &headLimit{}
+	h.remaining.Store(n)
+	return h
+}
+
+// claim reserves up to n records from the budget and returns how many were granted.
+func (h *headLimit) claim(n int64) int64 {
+	for {
+		left := h.remaining.Load()
+		if left <= 0 {
+			return 0
+		}
+		granted := min(n, left)
+		if h.remaining.CompareAndSwap(left, left-granted) {
+			return granted
+		}
+	}
+}
+
+// release returns n unused records to the budget.
+func (h *headLimit) release(n int64) {
+	h.remaining.Add(n)
+}
+
+// exhausted reports whether the whole budget has been claimed.
+func (h *headLimit) exhausted() bool {
+	return h.remaining.Load() <= 0
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"bufio"
+	"image"
+	"image/color"
+	"image/png"
+	"math"
+	"math/bits"
+	"os"
+)
+
+// --- Heatmap ---
+// blockCounts returns the number of addresses of set in each block of the given prefix
+// length, indexed by the block's prefix. The words of a dense bitset are counted directly,
+// as blocks of at most /26 hold whole words; other sets are walked address by address.
+func blockCounts(set IPSet, prefix int) []uint32 {
+	counts := make([]uint32, 1<<prefix)
+	shift := 32 - prefix
+	switch s := set.(type) {
+	case *AtomicBitSet:
+		for i, w := range s.bits {
+			if w != 0 {
+				counts[uint64(i)*BucketSize>>shift] += uint32(bits.OnesCount64(w))
+			}
+		}
+	case setWrapper:
+		return blockCounts(s.unwrap(), prefix)
+	default:
+		set.ForEach(func(ip uint32) {
+			counts[ip>>shift]++
+		})
+	}
+	return counts
+}
+
+// writeHeatmap renders the address space coverage of set as a square grayscale PNG image
+// in the named file, for --heatmap. Each pixel is a block of the given even prefix length,
+// so /16 blocks make a 256×256 image: the first half of the prefix bits selects the row and
+// the second half the column, so for /16 the row is the first octet and the column the
+// second. The brightness grows with the logarithm of the block's address count, from black
+// for an empty block to white for a full one, so that sparsely used blocks stay visible.
+func writeHeatmap(name string, set IPSet, prefix int) error {
+	side := 1 << (prefix / 2)
+	img := image.NewGray(image.Rect(0, 0, side, side))
+	full := math.Log1p(float64(uint64(1) << (32 - prefix)))
+	for block, n := range blockCounts(set, prefix) {
+		if n > 0 {
+			level := 1 + math.Log1p(float64(n))/full*254
+			img.SetGray(block%side, block/side, color.Gray{Y: uint8(min(255, level))})
+		}
+	}
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	err = png.Encode(w, img)
+	if err == nil {
+		err = w.Flush()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/png"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestHeatmap renders a dense and a sparse set holding all of 10.1.0.0/16 and one address
+// of 192.168.0.0/16 as /16 heatmaps. Both images must be the same, with a white pixel for
+// the full block, a dark but not black one for the single address, and black ones
+// everywhere else.
+func TestHeatmap(t *testing.T) {
+	dir := t.TempDir()
+	dense, sparse := NewAtomicBitSet(), NewSparseSet()
+	dense.SetRange(0x0a010000, 0x0a01ffff)
+	for ip := uint32(0x0a010000); ip <= 0x0a01ffff; ip++ {
+		sparse.Set(ip)
+	}
+	dense.Set(0xc0a80101)
+	sparse.Set(0xc0a80101)
+	var images []*image.Gray
+	for i, set := range []IPSet{dense, sparse} {
+		name := filepath.Join(dir, fmt.Sprintf("heatmap-%d.png", i))
+		if err := writeHeatmap(name, set, 16); err != nil {
+			t.Fatal(err)
+		}
+		f, err := os.Open(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		img, err := png.Decode(f)
+		f.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		gray, ok := img.(*image.Gray)
+		if !ok || gray.Bounds() != image.Rect(0, 0, 256, 256) {
+			t.Fatalf("heatmap is a %T of %v, expected a 256x256 grayscale image", img, img.Bounds())
+		}
+		images = append(images, gray)
+	}
+	img := images[0]
+	if !bytes.Equal(img.Pix, images[1].Pix) {
+		t.Fatal("dense and sparse heatmaps differ")
+	}
+	lit := 0
+	for _, y := range img.Pix {
+		if y != 0 {
+			lit++
+		}
+	}
+	if full, one := img.GrayAt(1, 10).Y, img.GrayAt(168, 192).Y; full != 255 || one == 0 || one > 64 || lit != 2 {
+		t.Fatalf("heatmap has %d lit pixel(s), %d for the full /16 and %d for one address, expected 2, 255 and 1 to 64", lit, full, one)
+	}
+}
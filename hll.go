@@ -0,0 +1,207 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"math/bits"
+	"sync"
+	"sync/atomic"
+)
+
+// --- HyperLogLog ---
+// hllPrecision is the number of hash bits selecting a register of a HyperLogLog.
+const hllPrecision = 14
+
+// HyperLogLog estimates the number of distinct addresses added to it in 2^hllPrecision
+// registers (64KB), with a standard error of about 1.04/sqrt(2^hllPrecision), 0.81%,
+// regardless of how many addresses there are.
+type HyperLogLog struct {
+	hash      hashFunc
+	registers [1 << hllPrecision]atomic.Uint32 // Maximum rank seen per register.
+}
+
+// NewHyperLogLog creates an empty HyperLogLog.
+func NewHyperLogLog() *HyperLogLog {
+	return newHyperLogLogHash(defaultHash)
+}
+
+// newHyperLogLogHash creates an empty HyperLogLog that hashes addresses with hash, whose
+// bits must all be well distributed for the estimate to hold.
+func newHyperLogLogHash(hash hashFunc) *HyperLogLog {
+	return &HyperLogLog{hash: hash}
+}
+
+// Add records ip.
+func (h *HyperLogLog) Add(ip uint32) {
+	x := h.hash(ip)
+	r := &h.registers[x>>(64-hllPrecision)]
+	// The rank is the position of the first set bit after the register bits.
+	rank := uint32(bits.LeadingZeros64(x<<hllPrecision|1<<(hllPrecision-1))) + 1
+	for {
+		old := r.Load()
+		if rank <= old || r.CompareAndSwap(old, rank) {
+			return
+		}
+	}
+}
+
+// Estimate returns the estimated number of distinct addresses added, using linear
+// counting of the empty registers while the estimate is small.
+func (h *HyperLogLog) Estimate() int {
+	const m = float64(len(h.registers))
+	sum, zeros := 0.0, 0
+	for i := range h.registers {
+		r := h.registers[i].Load()
+		sum += math.Ldexp(1, -int(r))
+		if r == 0 {
+			zeros++
+		}
+	}
+	estimate := 0.7213 / (1 + 1.079/m) * m * m / sum
+	if estimate <= 2.5*m && zeros > 0 {
+		estimate = m * math.Log(m/float64(zeros))
+	}
+	return int(math.Round(estimate))
+}
+
+// --- Memory-Bounded Set ---
+// sparseEntryBytes is the memory assumed per address of a SparseSet for
+// --limit-unique-memory, at the upper end of its 20-40 bytes including map overhead.
+const sparseEntryBytes = 40
+
+// BudgetSet counts addresses exactly in a SparseSet until it holds more than limit of
+// them, then moves them into a HyperLogLog, frees the SparseSet and estimates the count
+// from there on, so its memory stays bounded. Once estimating, it no longer knows which
+// addresses it holds: IsSet and AnySetInRange report false, CountRange 0, and ForEach
+// calls fn for none.
+type BudgetSet struct {
+	limit int64
+	n     atomic.Int64 // Exact addresses added so far.
+
+	mu     sync.RWMutex // Held for writing while switching to the estimate.
+	exact  *SparseSet
+	sketch atomic.Pointer[HyperLogLog]
+}
+
+// NewBudgetSet creates an empty BudgetSet that counts up to limit addresses exactly.
+func NewBudgetSet(limit int64) *BudgetSet {
+	return newBudgetSetHash(limit, defaultHash)
+}
+
+// newBudgetSetHash creates an empty BudgetSet that hashes addresses with hash, both to
+// shard the exact set and for the HyperLogLog.
+func newBudgetSetHash(limit int64, hash hashFunc) *BudgetSet {
+	return &BudgetSet{limit: limit, exact: newSparseSetHash(hash)}
+}
+
+// Set adds the given IPv4 address to the set.
+func (s *BudgetSet) Set(ip uint32) {
+	if h := s.sketch.Load(); h != nil {
+		h.Add(ip)
+		return
+	}
+	s.mu.RLock()
+	if h := s.sketch.Load(); h != nil {
+		s.mu.RUnlock()
+		h.Add(ip)
+		return
+	}
+	added := s.exact.add(ip)
+	s.mu.RUnlock()
+	if added && s.n.Add(1) > s.limit {
+		s.degrade()
+	}
+}
+
+// degrade moves the exact addresses into a HyperLogLog, unless another Set already did.
+func (s *BudgetSet) degrade() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.sketch.Load() != nil {
+		return
+	}
+	h := newHyperLogLogHash(s.exact.hash)
+	s.exact.ForEach(h.Add)
+	s.sketch.Store(h)
+	s.exact = nil
+}
+
+// Estimated reports whether the set has exceeded its budget and Count is an estimate.
+func (s *BudgetSet) Estimated() bool {
+	return s.sketch.Load() != nil
+}
+
+// Count returns the number of unique IPv4 addresses, estimated once over the budget.
+func (s *BudgetSet) Count() int {
+	if h := s.sketch.Load(); h != nil {
+		return h.Estimate()
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if h := s.sketch.Load(); h != nil {
+		return h.Estimate()
+	}
+	return s.exact.Count()
+}
+
+// IsSet reports whether the given IPv4 address is in the set, or false once estimating.
+func (s *BudgetSet) IsSet(ip uint32) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.exact != nil && s.exact.IsSet(ip)
+}
+
+// CountRange returns the number of addresses in the inclusive range [start, end] that
+// are in the set, or 0 once estimating.
+func (s *BudgetSet) CountRange(start, end uint32) int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.exact == nil {
+		return 0
+	}
+	return s.exact.CountRange(start, end)
+}
+
+// AnySetInRange reports whether any address in the inclusive range [start, end] is in
+// the set, or false once estimating.
+func (s *BudgetSet) AnySetInRange(start, end uint32) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.exact != nil && s.exact.AnySetInRange(start, end)
+}
+
+// ForEach calls fn for every address in the set, in ascending order, or for none once
+// estimating.
+func (s *BudgetSet) ForEach(fn func(ip uint32)) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.exact != nil {
+		s.exact.ForEach(fn)
+	}
+}
+
+// budgetSetOf returns the BudgetSet underneath set, or nil if it has none.
+func budgetSetOf(set IPSet) *BudgetSet {
+	switch s := set.(type) {
+	case *BudgetSet:
+		return s
+	case setWrapper:
+		return budgetSetOf(s.unwrap())
+	}
+	return nil
+}
+
+// printEstimate reports whether the count of set is an estimate because the
+// --limit-unique-memory budget was exceeded, and if so marks res as estimated.
+func printEstimate(set IPSet, res *Result) {
+	bs := budgetSetOf(set)
+	if bs == nil {
+		return
+	}
+	if !bs.Estimated() {
+		fmt.Fprintf(diag, "Count is exact: %d address(es) stayed within the memory budget of %d\n", res.Unique, bs.limit)
+		return
+	}
+	res.Estimated = true
+	fmt.Fprintf(diag, "Count is estimated: more than %d address(es) exceeded the memory budget, so a HyperLogLog (standard error 0.81%%) took over\n", bs.limit)
+}
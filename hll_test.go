@@ -0,0 +1,37 @@
+package main
+
+import (
+	"math"
+	"sync"
+	"testing"
+)
+
+// TestBudgetSet adds addresses to a BudgetSet from several goroutines, and checks that
+// its count is exact while within the budget and within 3% (almost 4 standard errors)
+// once it estimates.
+func TestBudgetSet(t *testing.T) {
+	s := NewBudgetSet(10_000)
+	for ip := range uint32(10_000) {
+		s.Set(ip * 7)
+		s.Set(ip * 7)
+	}
+	if s.Estimated() || s.Count() != 10_000 || !s.IsSet(7) {
+		t.Fatalf("within the budget: estimated=%v, count %d, expected exactly 10000", s.Estimated(), s.Count())
+	}
+	const workers, each = 4, 250_000
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for w := range uint32(workers) {
+		go func() {
+			defer wg.Done()
+			for i := range uint32(each) {
+				s.Set(0x80000000 + w*each + i)
+			}
+		}()
+	}
+	wg.Wait()
+	want := 10_000 + workers*each
+	if got := s.Count(); !s.Estimated() || math.Abs(float64(got-want)) > 0.03*float64(want) {
+		t.Fatalf("over the budget: estimated=%v, count %d, expected about %d", s.Estimated(), got, want)
+	}
+}
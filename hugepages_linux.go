@@ -0,0 +1,30 @@
+//go:build linux
+
+package main
+
+import (
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// hugePageWords allocates n zeroed words backed by huge pages. It first asks for explicit
+// huge pages (MAP_HUGETLB), which must have been reserved through vm.nr_hugepages, and
+// otherwise maps normal anonymous memory and advises the kernel to back it with
+// transparent huge pages. Returns nil if neither mapping succeeds. The memory is never
+// unmapped, like the bitset it holds, which lives until the process exits.
+func hugePageWords(n int) []uint64 {
+	size := n * 8
+	mem, err := unix.Mmap(-1, 0, size, unix.PROT_READ|unix.PROT_WRITE, unix.MAP_PRIVATE|unix.MAP_ANONYMOUS|unix.MAP_HUGETLB)
+	if err != nil {
+		mem, err = unix.Mmap(-1, 0, size, unix.PROT_READ|unix.PROT_WRITE, unix.MAP_PRIVATE|unix.MAP_ANONYMOUS)
+		if err != nil {
+			return nil
+		}
+		if err := unix.Madvise(mem, unix.MADV_HUGEPAGE); err != nil {
+			unix.Munmap(mem)
+			return nil
+		}
+	}
+	return unsafe.Slice((*uint64)(unsafe.Pointer(&mem[0])), n)
+}
@@ -0,0 +1,8 @@
+//go:build !linux
+
+package main
+
+// hugePageWords is not supported on this platform.
+func hugePageWords(n int) []uint64 {
+	return nil
+}
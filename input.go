@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"time"
+)
+
+// --- Input Access ---
+const (
+	// maxMapSize is the largest file that is memory-mapped. On 32-bit platforms (e.g. 32-bit
+	// Windows) this is 1GB, as the address space cannot hold larger mappings; on 64-bit
+	// platforms it is effectively unlimited.
+	maxMapSize = math.MaxInt / 2
+	// readBlockSize is the default size of the blocks read when a file is not mapped, of
+	// the --read-buffer option.
+	readBlockSize = 4 * 1024 * 1024
+	// minReadBuffer is the smallest --read-buffer. A block must hold at least one line of
+	// the longest record.
+	minReadBuffer = 64 * 1024
+)
+
+// readBufferSize returns the size of the blocks read when the input is not mapped.
+func (opts *options) readBufferSize() int {
+	if opts.readBuffer > 0 {
+		return opts.readBuffer
+	}
+	return readBlockSize
+}
+
+// errTooLargeToMap is returned by mapInput for files larger than maxMapSize.
+var errTooLargeToMap = errors.New("file too large to map on this platform")
+
+// mapFile maps the files of mapInput; it is a variable so that tests can make mapping fail.
+var mapFile = mmapFile
+
+// mapInput memory-maps the whole file read-only with mapFile, wrapping a failure in
+// ErrMmapFailed. Callers fall back to positional reads when mapping fails.
+func mapInput(file *os.File, size int64) ([]byte, error) {
+	data, err := mapFile(file, size)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrMmapFailed, err)
+	}
+	return data, nil
+}
+
+// readBlocks reads the file from offset up to size using positional reads (pread) of
+// bufSize bytes, and calls fn with each block trimmed to its last complete line.
+// It is used when a file cannot be memory-mapped and for data appended in follow mode.
+// Offsets are 64-bit, so files larger than the address space are handled as well.
+// Returns the offset just past the last complete line passed to fn. A trailing line
+// without a newline is passed to fn as well if final is set, and otherwise left for
+// a later call once its newline has been written. Reading stops at the first error
+// returned by fn.
+func readBlocks(file *os.File, offset, size int64, final bool, bufSize int, fn func(block []byte) error) (int64, error) {
+	buf := make([]byte, bufSize)
+	for offset < size {
+		n, err := file.ReadAt(buf[:min(int64(len(buf)), size-offset)], offset)
+		if err != nil && err != io.EOF {
+			return offset, fmt.Errorf("error reading at offset %d: %w", offset, err)
+		}
+		end := bytes.LastIndexByte(buf[:n], '\n') + 1
+		if end == 0 {
+			if n < len(buf) && !final {
+				break // Wait for the rest of the line.
+			}
+			end = n // The final line, or one longer than a block that cannot be an address.
+			if n == len(buf) {
+				end = longLineEnd(buf[:n])
+			}
+		}
+		if err := fn(buf[:end]); err != nil {
+			return offset, atOffset(err, offset)
+		}
+		offset += int64(end)
+	}
+	return offset, nil
+}
+
+// longLineEnd returns where to end a block that holds no newline: just after its last
+// space or tab, so that the fields of a line longer than the block, as with --extract or
+// --whitespace-stream, are not cut in two. Without one, the whole block is used.
+func longLineEnd(block []byte) int {
+	if i := bytes.LastIndexAny(block, " \t\r"); i >= 0 {
+		return i + 1
+	}
+	return len(block)
+}
+
+// readStream reads r sequentially until EOF and calls fn with the complete lines of each
+// block of up to bufSize bytes, carrying a partial line over to the next block.
+// It is used for inputs that cannot be read by offset, such as named pipes. A final line
+// without a newline is passed to fn at EOF. If ll is not nil, lines longer than its
+// maximum are skipped rather than passed to fn. Returns the number of bytes read.
+func readStream(r io.Reader, bufSize int, ll *longLines, fn func(block []byte) error) (int64, error) {
+	buf := make([]byte, bufSize)
+	var offset int64 // Offset of buf[0] in the stream.
+	fill := 0
+	process := fn
+	if ll != nil {
+		skipping := false
+		process = func(block []byte) error { return ll.process(block, &skipping, fn) }
+	}
+	for {
+		n, err := r.Read(buf[fill:])
+		fill += n
+		if err != nil && err != io.EOF {
+			return offset + int64(fill), fmt.Errorf("error reading at offset %d: %w", offset+int64(fill), err)
+		}
+		end := bytes.LastIndexByte(buf[:fill], '\n') + 1
+		switch {
+		case err == io.EOF:
+			end = fill // The final line.
+		case ll != nil && fill-end > ll.max:
+			end = fill // The start of an over-long line, whose rest ll skips.
+		case end == 0 && fill == len(buf):
+			end = longLineEnd(buf) // A line longer than a block that cannot be an address.
+		}
+		if end > 0 {
+			if err := process(buf[:end]); err != nil {
+				return offset, atOffset(err, offset)
+			}
+			fill = copy(buf, buf[end:fill])
+			offset += int64(end)
+		}
+		if err == io.EOF {
+			return offset, nil
+		}
+	}
+}
+
+// stableReader reads from a named pipe until no data has arrived for stableFor, which ends
+// the stream with io.EOF.
+type stableReader struct {
+	file      *os.File
+	stableFor time.Duration
+	lastData  time.Time
+}
+
+func (sr *stableReader) Read(p []byte) (int, error) {
+	if err := sr.file.SetReadDeadline(sr.lastData.Add(sr.stableFor)); err != nil {
+		return 0, err
+	}
+	n, err := sr.file.Read(p)
+	if n > 0 {
+		sr.lastData = time.Now()
+	}
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		err = io.EOF
+	}
+	return n, err
+}
+
+// processPipe reads a named pipe until its writer closes it and calls fn with blocks of
+// complete lines. With --follow, the pipe is also held open for writing, so that it does
+// not reach EOF when a writer closes and the next writer's data is read as well, until no
+// data has arrived for --stable-for. Returns the number of bytes read.
+func processPipe(file *os.File, opts *options, fn func(block []byte) error) (int64, error) {
+	var r io.Reader = file
+	if opts.follow {
+		// Opening the write end does not block, as this process is already a reader.
+		keep, err := os.OpenFile(file.Name(), os.O_WRONLY, 0)
+		if err != nil {
+			return 0, fmt.Errorf("%w: %w", ErrOpenFailed, err)
+		}
+		defer keep.Close()
+		r = &stableReader{file: file, stableFor: opts.stableFor, lastData: time.Now()}
+		fmt.Fprintf(diag, "Reading named pipe %s until no data arrives for %v...\n", file.Name(), opts.stableFor)
+	} else {
+		fmt.Fprintf(diag, "Reading named pipe %s until its writer closes it...\n", file.Name())
+	}
+	return readStream(r, opts.readBufferSize(), opts.longLines, fn)
+}
@@ -0,0 +1,10 @@
+//go:build !windows
+
+package main
+
+import "os"
+
+// openInput opens the named file for reading.
+func openInput(name string) (*os.File, error) {
+	return os.Open(name)
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+// latencyReader delays every read from r by latency, like storage that is slow per request.
+type latencyReader struct {
+	r       io.Reader
+	latency time.Duration
+}
+
+func (lr *latencyReader) Read(p []byte) (int, error) {
+	time.Sleep(lr.latency)
+	return lr.r.Read(p)
+}
+
+// BenchmarkReadBuffer reads 16MB of addresses as a stream in blocks of several
+// --read-buffer sizes, from memory and with a delay of 1ms per read, and processes each
+// block on one worker.
+func BenchmarkReadBuffer(b *testing.B) {
+	rnd := rand.New(rand.NewSource(1))
+	data := benchLines(16<<20, rnd.Uint32)
+	set := NewAtomicBitSet()
+	opts := &options{minRecordLen: MinIPLen}
+	for _, latency := range []time.Duration{0, time.Millisecond} {
+		for _, size := range []int{minReadBuffer, 1 << 20, readBlockSize, 16 << 20} {
+			b.Run(fmt.Sprintf("latency=%v/size=%s", latency, formatBytes(int64(size))), func(b *testing.B) {
+				b.SetBytes(int64(len(data)))
+				for range b.N {
+					r := &latencyReader{bytes.NewReader(data), latency}
+					if _, err := readStream(r, size, nil, func(block []byte) error {
+						return processData(block, set, 1, opts)
+					}); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// --- Intersection ---
+// andWith clears the bits of bs that are not set in other, leaving the addresses in both.
+func (bs *AtomicBitSet) andWith(other *AtomicBitSet) {
+	for i := range bs.bits {
+		bs.bits[i] &= other.bits[i]
+	}
+}
+
+// countIntersection counts the addresses that are present in every one of files, for
+// --intersect. Each file is counted into a set of its own, which is then ANDed into the
+// intersection of the files before it, so at most two dense bitsets, 1GB, are held at
+// once. The intersection is what --dump and --dump-binary write, and the unique count
+// of each file is listed in the result's files.
+func countIntersection(files []string, opts *options) (Result, error) {
+	startTime := time.Now()
+	res := Result{Path: strings.Join(files, " ")}
+	var both *AtomicBitSet
+	for i, name := range files {
+		set := newIPSet(opts)
+		size, err := addFileToSet(name, set, opts)
+		if err != nil {
+			closeSet(set)
+			return res, fmt.Errorf("%s: %w", name, err)
+		}
+		bs := bitSetOf(set)
+		closeSet(set)
+		unique := bs.Count()
+		fmt.Fprintf(diag, "[%d/%d] %s: %d unique address(es)\n", i+1, len(files), name, unique)
+		res.Bytes += size
+		res.Files = append(res.Files, Result{Path: name, Unique: unique, Bytes: size})
+		if both == nil {
+			both = bs
+		} else {
+			both.andWith(bs)
+		}
+	}
+	res.Unique = both.Count()
+	res.DurationMs = time.Since(startTime).Milliseconds()
+	fmt.Fprintf(diag, "Addresses in all %d file(s): %d\n", len(files), res.Unique)
+	fmt.Fprintf(diag, "Intersected in %v\n", time.Since(startTime))
+	if err := saveOutputs(both, opts); err != nil {
+		return res, err
+	}
+	return res, nil
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// TestIntersect writes three files of random addresses from overlapping pools and checks
+// the --intersect count and dump of the first two and of all three against the addresses
+// they have in common.
+func TestIntersect(t *testing.T) {
+	out := diag
+	diag = io.Discard
+	t.Cleanup(func() { diag = out })
+	dir := t.TempDir()
+	rnd := rand.New(rand.NewSource(1))
+	var names []string
+	seen := make([]map[uint32]bool, 3)
+	for i := range seen {
+		seen[i] = make(map[uint32]bool)
+		var data strings.Builder
+		for range 20_000 {
+			ip := uint32(rnd.Intn(30_000)) + uint32(i)*5_000
+			seen[i][ip] = true
+			data.WriteString(formatIP(ip) + "\n")
+		}
+		data.WriteString("not an address\n")
+		names = append(names, filepath.Join(dir, fmt.Sprintf("intersect-%d.txt", i)))
+		if err := os.WriteFile(names[i], []byte(data.String()), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, n := range []int{2, 3} {
+		var want []string
+		for ip := range seen[0] {
+			if seen[1][ip] && (n == 2 || seen[2][ip]) {
+				want = append(want, formatIP(ip))
+			}
+		}
+		dump := filepath.Join(dir, "intersect.txt")
+		opts, err := parseFlags(append([]string{"--intersect", "--bitset", "sparse", "--dump", dump}, names[:n]...))
+		if err != nil {
+			t.Fatal(err)
+		}
+		res, err := countIntersection(opts.paths, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		listed, err := os.ReadFile(dump)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := strings.Fields(string(listed))
+		slices.Sort(got)
+		slices.Sort(want)
+		if res.Unique != len(want) || !slices.Equal(got, want) || res.Files[0].Unique != len(seen[0]) {
+			t.Fatalf("%d files: counted %d and dumped %d in common, expected %d", n, res.Unique, len(got), len(want))
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"bufio"
+	"os"
+	"sync"
+)
+
+// --- Invalid Line Output ---
+// invalidFlushSize is the number of bytes of invalid lines a worker buffers before
+// handing them to the shared writer, so the workers rarely contend on its lock.
+const invalidFlushSize = 64 << 10
+
+// invalidLines writes the non-empty lines that are not valid records to a file for
+// --invalid-out, so that they can be quarantined and inspected instead of aborting as
+// with --strict. Workers buffer their lines and write them in batches, so the lines of
+// one worker keep their order but the batches of different workers interleave.
+type invalidLines struct {
+	mu    sync.Mutex
+	file  *os.File
+	w     *bufio.Writer
+	lines int64 // Lines written so far.
+	err   error // First error writing the file.
+}
+
+// createInvalidLines creates the file name, truncating it if it exists, for the invalid lines.
+func createInvalidLines(name string) (*invalidLines, error) {
+	file, err := os.Create(name)
+	if err != nil {
+		return nil, err
+	}
+	return &invalidLines{file: file, w: bufio.NewWriter(file)}, nil
+}
+
+// write appends buf, which holds the given number of lines, each ending in a newline.
+func (il *invalidLines) write(buf []byte, lines int64) {
+	if len(buf) == 0 {
+		return
+	}
+	il.mu.Lock()
+	defer il.mu.Unlock()
+	if il.err != nil {
+		return
+	}
+	if _, il.err = il.w.Write(buf); il.err == nil {
+		il.lines += lines
+	}
+}
+
+// close flushes and closes the file and returns the first error writing it.
+func (il *invalidLines) close() error {
+	il.mu.Lock()
+	defer il.mu.Unlock()
+	if il.err == nil {
+		il.err = il.w.Flush()
+	}
+	if err := il.file.Close(); il.err == nil {
+		il.err = err
+	}
+	return il.err
+}
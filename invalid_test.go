@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// TestInvalidOut processes random lines, about a tenth of them invalid and some ending
+// in a carriage return, on 4 workers with --invalid-out, and checks that the file in dir
+// holds exactly the invalid lines, byte for byte, in any order.
+func TestInvalidOut(t *testing.T) {
+	dir := t.TempDir()
+	rnd := rand.New(rand.NewSource(1))
+	var data strings.Builder
+	var want []string
+	for i := range 100_000 {
+		line := fmt.Sprintf("%d.%d.%d.%d", rnd.Intn(256), rnd.Intn(256), rnd.Intn(256), rnd.Intn(256))
+		switch rnd.Intn(20) {
+		case 0:
+			line = fmt.Sprintf("garbage %d\r", i)
+			want = append(want, line)
+		case 1:
+			line += ".1"
+			want = append(want, line)
+		case 2:
+			line = " \t"
+			want = append(want, line)
+		case 3:
+			line = ""
+		}
+		data.WriteString(line)
+		data.WriteByte('\n')
+	}
+	name := filepath.Join(dir, "invalid.txt")
+	il, err := createInvalidLines(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := &options{minRecordLen: MinIPLen, invalidOut: name, invalid: il}
+	err = processData([]byte(data.String()), NewSparseSet(), 4, opts)
+	if cerr := il.close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	written, err := os.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := strings.Split(strings.TrimSuffix(string(written), "\n"), "\n")
+	slices.Sort(got)
+	slices.Sort(want)
+	if !slices.Equal(got, want) || il.lines != int64(len(want)) {
+		t.Fatalf("wrote %d invalid line(s) (%d counted), expected %d, or they differ", len(got), il.lines, len(want))
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+// --- JSON Lines Field Extraction ---
+// These helpers locate a field in a single-line JSON object by scanning its bytes, without
+// unmarshaling the whole object. String values containing escape sequences are returned
+// verbatim, which is fine for addresses: they never need escaping.
+
+// skipSpace returns the index of the first non-whitespace byte of b at or after i.
+func skipSpace(b []byte, i int) int {
+	for i < len(b) && (b[i] == ' ' || b[i] == '\t' || b[i] == '\r' || b[i] == '\n') {
+		i++
+	}
+	return i
+}
+
+// stringEnd returns the index of the quote closing the JSON string whose content starts at i,
+// or -1 if the string is not terminated.
+func stringEnd(b []byte, i int) int {
+	for ; i < len(b); i++ {
+		switch b[i] {
+		case '\\':
+			i++
+		case '"':
+			return i
+		}
+	}
+	return -1
+}
+
+// valueEnd returns the index just past the JSON value starting at i, or -1 if it is malformed.
+func valueEnd(b []byte, i int) int {
+	if i >= len(b) {
+		return -1
+	}
+	switch b[i] {
+	case '"':
+		if end := stringEnd(b, i+1); end >= 0 {
+			return end + 1
+		}
+		return -1
+	case '{', '[':
+		depth := 0
+		for ; i < len(b); i++ {
+			switch b[i] {
+			case '"':
+				if i = stringEnd(b, i+1); i < 0 {
+					return -1
+				}
+			case '{', '[':
+				depth++
+			case '}', ']':
+				if depth--; depth == 0 {
+					return i + 1
+				}
+			}
+		}
+		return -1
+	default:
+		for ; i < len(b); i++ {
+			switch b[i] {
+			case ',', '}', ']', ' ', '\t', '\r', '\n':
+				return i
+			}
+		}
+		return i
+	}
+}
+
+// objectField returns the raw value of the member key of the JSON object obj.
+// Members of nested objects are not considered.
+func objectField(obj []byte, key string) ([]byte, bool) {
+	i := skipSpace(obj, 0)
+	if i >= len(obj) || obj[i] != '{' {
+		return nil, false
+	}
+	for i = skipSpace(obj, i+1); i < len(obj) && obj[i] == '"'; i = skipSpace(obj, i+1) {
+		keyEnd := stringEnd(obj, i+1)
+		if keyEnd < 0 {
+			return nil, false
+		}
+		name := obj[i+1 : keyEnd]
+		i = skipSpace(obj, keyEnd+1)
+		if i >= len(obj) || obj[i] != ':' {
+			return nil, false
+		}
+		start := skipSpace(obj, i+1)
+		end := valueEnd(obj, start)
+		if end < 0 {
+			return nil, false
+		}
+		if string(name) == key {
+			return obj[start:end], true
+		}
+		if i = skipSpace(obj, end); i >= len(obj) || obj[i] != ',' {
+			return nil, false
+		}
+	}
+	return nil, false
+}
+
+// jsonString returns the content of the string found by following path through the nested
+// objects of line, e.g. ["request", "client_ip"]. Returns nil if the path does not exist
+// or does not end at a string.
+func jsonString(line []byte, path []string) []byte {
+	value := line
+	for _, key := range path {
+		var ok bool
+		if value, ok = objectField(value, key); !ok {
+			return nil
+		}
+	}
+	if len(value) < 2 || value[0] != '"' {
+		return nil
+	}
+	return value[1 : len(value)-1]
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+// TestJSONLFields counts JSON lines whose --ip-field is nested, missing, not a string or
+// only present in a nested object, and checks that only the lines holding the field at the
+// given path count, whatever the order and spacing of the members.
+func TestJSONLFields(t *testing.T) {
+	data := []byte(`{"ts":1,"request":{"client_ip":"1.1.1.1","port":443}}
+{ "request" : { "method":"GET", "client_ip" : "2.2.2.2" } , "ip":"9.9.9.9"}
+{"request":{"headers":{"x":"{\"client_ip\":\"8.8.8.8\"}"},"client_ip":"3.3.3.3"}}
+{"client_ip":"7.7.7.7","request":{}}
+{"request":{"inner":{"client_ip":"6.6.6.6"}}}
+{"request":{"client_ip":12345}}
+{"request":"client_ip"}
+{"request":{"client_ip":"not an address"}}
+{"request":{"client_ip":"5.5.5.5"
+not json 4.4.4.4
+`)
+	for _, tc := range []struct {
+		field string
+		want  []string
+	}{
+		{"request.client_ip", []string{"1.1.1.1", "2.2.2.2", "3.3.3.3"}},
+		{"client_ip", []string{"7.7.7.7"}},
+		{"ip", []string{"9.9.9.9"}},
+		{"missing", nil},
+	} {
+		opts, err := parseFlags([]string{"--jsonl", "--ip-field", tc.field, "ips.txt"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		set := NewSparseSet()
+		if err := processData(data, set, 1, opts); err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		set.ForEach(func(ip uint32) { got = append(got, formatIP(ip)) })
+		if !slices.Equal(got, tc.want) {
+			t.Errorf("--ip-field %s: counted %v, expected %v", tc.field, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"math/bits"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// --- Prefix Levels ---
+// prefixLevel counts the unique prefixes of one length. The prefix of an address is the
+// address shifted right by 32-length bits, so a /24 level needs 2^24 bits (2MB) and a /16
+// level 2^16 bits (8KB). The /32 level is the main set itself and has no bitset of its own.
+// Neither do the levels from /26 to /31 when the main set is a full dense bitset: their
+// blocks of 2 to 64 addresses lie within one word of it, so they are counted from the
+// main set at the end instead of from 128MB or more of bitset for /30 and /31.
+type prefixLevel struct {
+	length  int
+	set     *AtomicBitSet // nil for length 32 and for levels counted from the main set.
+	fromSet bool          // Counted from the main dense bitset with CountBlocks.
+}
+
+// minBlockLevel is the shortest prefix whose blocks fit in one word of a dense bitset.
+const minBlockLevel = 32 - 6
+
+// parseLevels parses a comma-separated list of prefix lengths from 1 to 32, such as
+// "32,24,16", into levels in the order given.
+func parseLevels(list string) ([]prefixLevel, error) {
+	var levels []prefixLevel
+	seen := make(map[int]bool)
+	for _, s := range strings.Split(list, ",") {
+		s = strings.TrimPrefix(strings.TrimSpace(s), "/")
+		length, err := strconv.Atoi(s)
+		if err != nil || length < 1 || length > 32 {
+			return nil, fmt.Errorf("invalid prefix length %q", s)
+		}
+		if seen[length] {
+			continue
+		}
+		seen[length] = true
+		levels = append(levels, prefixLevel{length: length})
+	}
+	return levels, nil
+}
+
+// allocLevels gives every level below /32 the bitset it is counted in, or, if denseSet is
+// set because the main set is a full dense bitset, marks those from /26 to /31 to be
+// counted from the main set instead.
+func allocLevels(levels []prefixLevel, denseSet bool) {
+	for i := range levels {
+		l := &levels[i]
+		switch {
+		case l.length == 32:
+		case denseSet && l.length >= minBlockLevel:
+			l.fromSet = true
+		default:
+			l.set = newAtomicBitSetSize(1 << l.length)
+		}
+	}
+}
+
+// Add sets the prefix of ip in the level's bitset. Short prefixes saturate quickly, so
+// the bit is tested first to avoid contended atomic writes to words that are already set.
+func (l prefixLevel) Add(ip uint32) {
+	prefix := ip >> (32 - l.length)
+	word, bit := &l.set.bits[prefix/BucketSize], uint64(1)<<(prefix%BucketSize)
+	if atomic.LoadUint64(word)&bit == 0 {
+		atomic.OrUint64(word, bit)
+	}
+}
+
+// LevelCount is the number of unique prefixes of one length, as reported for --levels.
+type LevelCount struct {
+	Prefix int `json:"prefix"`
+	Unique int `json:"unique"`
+}
+
+// countLevels returns the unique count of every level, where unique is the count of the
+// main set, i.e. the /32 level, and set the main set.
+func countLevels(levels []prefixLevel, set IPSet, unique int) []LevelCount {
+	counts := make([]LevelCount, len(levels))
+	for i, l := range levels {
+		counts[i] = LevelCount{Prefix: l.length, Unique: unique}
+		if l.set != nil {
+			counts[i].Unique = l.set.Count()
+		} else if l.fromSet {
+			counts[i].Unique = denseBitSetOf(set).CountBlocks(32 - l.length)
+		}
+	}
+	return counts
+}
+
+// CountBlocks returns the number of aligned blocks of 2^k addresses, for k from 0 to 6,
+// that hold at least one address, i.e. the unique /(32-k) prefixes. Each block is a run
+// of 2^k bits of one word: ORing the word with itself shifted right by 1, 2, 4 and so on
+// up to 2^(k-1) bits folds every block onto its lowest bit, and a mask keeps those bits.
+func (bs *AtomicBitSet) CountBlocks(k int) int {
+	// The lowest bit of every block: ^0 / (2^(2^k) - 1) is 0x5555... for k = 1, 0x1111...
+	// for k = 2 and so on; for k = 6 the shift yields 0, and the mask is 1.
+	mask := ^uint64(0) / (1<<(1<<k) - 1)
+	count := 0
+	for _, w := range bs.bits {
+		if w == 0 {
+			continue
+		}
+		for s := 1; s < 1<<k; s <<= 1 {
+			w |= w >> s
+		}
+		count += bits.OnesCount64(w & mask)
+	}
+	return count
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestLevels counts random addresses, clustered in a few /16s, with --levels over each set
+// type and checks the count of every level against the distinct prefixes of the addresses.
+// Levels given twice are counted once, and invalid lengths are rejected.
+func TestLevels(t *testing.T) {
+	out := diag
+	diag = io.Discard
+	t.Cleanup(func() { diag = out })
+	rnd := rand.New(rand.NewSource(1))
+	var data strings.Builder
+	var ips []uint32
+	for range 50_000 {
+		ip := rnd.Uint32()
+		if rnd.Intn(4) > 0 {
+			ip = []uint32{0x0a000000, 0xc0a80000, 0xac100000}[rnd.Intn(3)] | ip&0xffff
+		}
+		ips = append(ips, ip)
+		data.WriteString(formatIP(ip) + "\n")
+	}
+	path := filepath.Join(t.TempDir(), "ips.txt")
+	if err := os.WriteFile(path, []byte(data.String()), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	lengths := []int{32, 24, 16, 8, 30, 1}
+	for _, bitset := range []string{bitSetDense, bitSetSparse} {
+		opts, err := parseFlags([]string{"--levels", "32,24,16,8,24,/30,1", "--bitset", bitset, path})
+		if err != nil {
+			t.Fatal(err)
+		}
+		res, err := countUniqueIpInFile(path, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(res.Levels) != len(lengths) {
+			t.Fatalf("--bitset %s: counted %d level(s), expected %d", bitset, len(res.Levels), len(lengths))
+		}
+		for i, length := range lengths {
+			prefixes := make(map[uint32]bool)
+			for _, ip := range ips {
+				prefixes[ip>>(32-length)] = true
+			}
+			if got := res.Levels[i]; got.Prefix != length || got.Unique != len(prefixes) {
+				t.Errorf("--bitset %s: counted %+v, expected /%d with %d unique", bitset, got, length, len(prefixes))
+			}
+		}
+	}
+	for _, list := range []string{"0", "33", "24,x", ""} {
+		if _, err := parseLevels(list); err == nil {
+			t.Errorf("--levels %q accepted", list)
+		}
+	}
+}
+
+// TestBlockLevels adds random addresses, and pairs and quads on both sides of
+// block bounds, to a dense set and checks the /26 to /32 counts of CountBlocks against the
+// distinct prefixes of the addresses. The same levels, counted in bitsets of their own as
+// with a single --subnet, must agree.
+func TestBlockLevels(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	ips := []uint32{0, 1, 2, 3, 4, 63, 64, 0x0a000001, 0x0a000002, 0x0a000003, 0x0a000004, 0xfffffffe, 0xffffffff}
+	for range 20_000 {
+		ips = append(ips, 0x0a000000+uint32(rnd.Intn(1<<18)))
+	}
+	set := NewAtomicBitSet()
+	lengths := []int{32, 31, 30, 29, 28, 27, 26}
+	levels := make([]prefixLevel, len(lengths))
+	for i, length := range lengths {
+		levels[i].length = length
+	}
+	allocLevels(levels, false)
+	for _, ip := range ips {
+		set.Set(ip)
+		for _, l := range levels[1:] {
+			l.Add(ip)
+		}
+	}
+	for i, length := range lengths {
+		prefixes := make(map[uint32]bool)
+		for _, ip := range ips {
+			prefixes[ip>>(32-length)] = true
+		}
+		if got := set.CountBlocks(32 - length); got != len(prefixes) {
+			t.Fatalf("/%d: CountBlocks returned %d, expected %d", length, got, len(prefixes))
+		}
+		if i > 0 && levels[i].set.Count() != len(prefixes) {
+			t.Fatalf("/%d: the level's bitset counted %d, expected %d", length, levels[i].set.Count(), len(prefixes))
+		}
+	}
+	allocLevels(levels, true)
+	if !levels[1].fromSet || !levels[6].fromSet || levels[0].fromSet {
+		t.Fatal("the /26 to /31 levels of a dense set are not counted from it")
+	}
+}
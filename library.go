@@ -0,0 +1,52 @@
+package main
+
+import "bytes"
+
+// --- Library API ---
+// CountUniqueInBytes counts the unique IPv4 addresses in data, which holds one address per
+// line as in an input file. It runs the same chunking, parsing and counting as the file
+// path, but over a caller-provided slice, e.g. a region the caller has already mapped or
+// an in-memory fixture. If workers is less than 1, the default worker count is used.
+func CountUniqueInBytes(data []byte, workers int) int {
+	return CountUniqueInBytesWorkers(data, workers, 0)
+}
+
+// CountUniqueInBytesWorkers is CountUniqueInBytes with the number of goroutines counting
+// the bitset after the scan set separately, as the count phase scans all 512MB of the
+// bitset and may benefit from more parallelism than the scan. If countWorkers is less
+// than 1, the default of half the CPUs is used.
+func CountUniqueInBytesWorkers(data []byte, workers, countWorkers int) int {
+	if workers < 1 {
+		workers = defaultWorkers()
+	}
+	bitSet := NewAtomicBitSet()
+	bitSet.SetCountWorkers(countWorkers)
+	processData(data, bitSet, workers, &options{minRecordLen: MinIPLen})
+	return bitSet.Count()
+}
+
+// CountUniqueFromCompressed counts the unique IPv4 addresses in compressed data, which
+// decompresses to one address per line as in an input file. The only codec supported is
+// "gzip"; "zstd" returns an error wrapping errors.ErrUnsupported. The data is decompressed
+// and counted in blocks, so the decompressed form is never held in memory as a whole.
+// Concatenated gzip members are decoded in parallel.
+func CountUniqueFromCompressed(data []byte, codec string) (int, error) {
+	bitSet := NewAtomicBitSet()
+	opts := &options{minRecordLen: MinIPLen}
+	if codec == codecGzip {
+		if _, err := processGzip(data, bitSet, defaultWorkers(), opts); err != nil {
+			return 0, err
+		}
+		return bitSet.Count(), nil
+	}
+	r, err := newDecompressor(bytes.NewReader(data), codec)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := readStream(r, opts.readBufferSize(), nil, func(block []byte) error {
+		return processData(block, bitSet, opts.chunkWorkers(len(block)), opts)
+	}); err != nil {
+		return 0, err
+	}
+	return bitSet.Count(), nil
+}
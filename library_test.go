@@ -0,0 +1,33 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"testing"
+)
+
+// TestCountUniqueFromCompressed compresses the self-test dataset as two concatenated gzip
+// members, split in the middle of a line, and counts it with CountUniqueFromCompressed. A
+// zstd codec must be unsupported, and truncated data must fail.
+func TestCountUniqueFromCompressed(t *testing.T) {
+	_, data, expected := selfTestDataset(t)
+	var buf bytes.Buffer
+	for _, part := range [][]byte{data[:len(data)/2], data[len(data)/2:]} {
+		zw := gzip.NewWriter(&buf)
+		zw.Write(part)
+		if err := zw.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	got, err := CountUniqueFromCompressed(buf.Bytes(), codecGzip)
+	if err != nil || got != len(expected) {
+		t.Errorf("counted %d (%v), expected %d", got, err, len(expected))
+	}
+	if _, err := CountUniqueFromCompressed(buf.Bytes(), codecZstd); !errors.Is(err, errors.ErrUnsupported) {
+		t.Errorf("zstd: returned %v, expected an unsupported codec", err)
+	}
+	if _, err := CountUniqueFromCompressed(buf.Bytes()[:buf.Len()-100], codecGzip); err == nil {
+		t.Error("truncated data counted without an error")
+	}
+}
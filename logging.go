@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log/slog"
+	"strings"
+	"sync"
+)
+
+// --- Structured Logging ---
+// Log formats of --log-format. logPlain writes the messages as they are, like diag
+// without logging; the others use the slog text and JSON handlers.
+const (
+	logPlain = "plain"
+	logText  = "text"
+	logJSON  = "json"
+)
+
+// logLevels maps the --log-level names to their slog levels.
+var logLevels = map[string]slog.Level{
+	"debug": slog.LevelDebug,
+	"info":  slog.LevelInfo,
+	"warn":  slog.LevelWarn,
+	"error": slog.LevelError,
+}
+
+// newLogHandler returns the slog handler of the given --log-format writing records of
+// at least level to w.
+func newLogHandler(format string, level slog.Level, w io.Writer) slog.Handler {
+	opts := &slog.HandlerOptions{Level: level}
+	switch format {
+	case logText:
+		return slog.NewTextHandler(w, opts)
+	case logJSON:
+		return slog.NewJSONHandler(w, opts)
+	}
+	return &plainHandler{w: w, level: level}
+}
+
+// plainHandler writes the message of each record of at least its level on a line of its
+// own, without a time, level or attributes, for --log-level with the plain format.
+type plainHandler struct {
+	mu    sync.Mutex
+	w     io.Writer
+	level slog.Level
+}
+
+func (h *plainHandler) Enabled(_ context.Context, level slog.Level) bool { return level >= h.level }
+
+func (h *plainHandler) Handle(_ context.Context, r slog.Record) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	_, err := io.WriteString(h.w, r.Message+"\n")
+	return err
+}
+
+func (h *plainHandler) WithAttrs([]slog.Attr) slog.Handler { return h }
+func (h *plainHandler) WithGroup(string) slog.Handler      { return h }
+
+// logWriter turns the lines written to diag into slog records, one per line, so that
+// every diagnostic goes through the configured handler. Lines starting with "Error:" are
+// logged at the error level and those with "Warning:" at the warn level, without the
+// prefix; all other messages are progress and statistics, logged at the info level.
+// A line is logged once its newline is written.
+type logWriter struct {
+	mu     sync.Mutex
+	logger *slog.Logger
+	buf    []byte
+}
+
+// newLogWriter returns a writer logging its lines with h.
+func newLogWriter(h slog.Handler) *logWriter {
+	return &logWriter{logger: slog.New(h)}
+}
+
+func (lw *logWriter) Write(p []byte) (int, error) {
+	lw.mu.Lock()
+	defer lw.mu.Unlock()
+	lw.buf = append(lw.buf, p...)
+	for {
+		nl := bytes.IndexByte(lw.buf, '\n')
+		if nl < 0 {
+			break
+		}
+		lw.log(lw.buf[:nl])
+		lw.buf = lw.buf[nl+1:]
+	}
+	if len(lw.buf) == 0 {
+		lw.buf = nil
+	}
+	return len(p), nil
+}
+
+// logPrefixes maps the prefixes of diagnostic lines to the level they are logged at.
+var logPrefixes = []struct {
+	prefix string
+	level  slog.Level
+}{
+	{"Error: ", slog.LevelError},
+	{"Warning: ", slog.LevelWarn},
+	{"*** Warning: ", slog.LevelWarn},
+}
+
+// log logs one line at the level its prefix indicates.
+func (lw *logWriter) log(line []byte) {
+	level, msg := slog.LevelInfo, string(line)
+	for _, p := range logPrefixes {
+		if rest, ok := strings.CutPrefix(msg, p.prefix); ok {
+			level, msg = p.level, strings.TrimSuffix(rest, " ***")
+			break
+		}
+	}
+	lw.logger.Log(context.Background(), level, msg)
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"sync/atomic"
+)
+
+// --- Over-Long Records ---
+// longLines bounds the records of input read as a stream, for --max-line-length. A block
+// of a stream otherwise ends within a line longer than the read buffer, and the pieces of
+// the line are read as records of their own, one of which may happen to parse as an
+// address. Records longer than max are skipped up to their newline instead, and count as
+// invalid records.
+type longLines struct {
+	max     int          // Longest record kept, in bytes without its newline.
+	strict  bool         // Fail on the first over-long record, as with --strict.
+	skipped atomic.Int64 // Over-long records skipped so far.
+}
+
+// process calls fn with the runs of lines of block, from a stream, that are at most max
+// bytes long, skipping the others. A block may end within an over-long line, which sets
+// *skipping, so that the rest of the line is skipped at the start of the next block.
+// With strict, the first over-long record is returned as an *invalidRecordError.
+func (ll *longLines) process(block []byte, skipping *bool, fn func(block []byte) error) error {
+	start := 0
+	if *skipping {
+		nl := bytes.IndexByte(block, '\n')
+		if nl < 0 {
+			return nil
+		}
+		*skipping = false
+		start = nl + 1
+	}
+	// flush passes the lines from runStart up to end to fn.
+	runStart := start
+	flush := func(end int) error {
+		if runStart == end {
+			return nil
+		}
+		return atOffset(fn(block[runStart:end]), int64(runStart))
+	}
+	for lineStart := start; lineStart < len(block); {
+		lineEnd := bytes.IndexByte(block[lineStart:], '\n')
+		next := lineStart + lineEnd + 1
+		if lineEnd < 0 {
+			lineEnd, next = len(block)-lineStart, len(block)
+		}
+		if lineEnd > ll.max {
+			if err := flush(lineStart); err != nil {
+				return err
+			}
+			if ll.strict {
+				return newInvalidRecord(block, lineStart)
+			}
+			ll.skipped.Add(1)
+			*skipping = next == len(block) && block[len(block)-1] != '\n'
+			runStart = next
+		}
+		lineStart = next
+	}
+	return flush(len(block))
+}
+
+// printLongLines reports the over-long records skipped with --max-line-length, and counts
+// them as skipped records in res.
+func printLongLines(opts *options, res *Result) {
+	ll := opts.longLines
+	if ll == nil {
+		return
+	}
+	n := ll.skipped.Load()
+	res.Overlong = n
+	if opts.stats != nil {
+		res.Total += n
+		res.Skipped += n
+	}
+	fmt.Fprintf(diag, "Records longer than --max-line-length %d skipped: %d\n", ll.max, n)
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"math/rand"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// shortReader reads from r in reads of random sizes from 1 to max bytes.
+type shortReader struct {
+	r   io.Reader
+	rnd *rand.Rand
+	max int
+}
+
+func (sr *shortReader) Read(p []byte) (int, error) {
+	return sr.r.Read(p[:min(len(p), 1+sr.rnd.Intn(sr.max))])
+}
+
+// TestMaxLineLength reads a stream in short reads into 64-byte blocks with
+// --max-line-length 17, the longest address: a bracketed address of 17 bytes counts,
+// one of 18 with a carriage return is skipped, and so are lines longer than a block, one
+// more that ends the stream, whose pieces would otherwise be read as records. With
+// --strict, the first over-long record must be reported at its offset in the stream.
+func TestMaxLineLength(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	lines := []string{
+		"1.1.1.1",
+		"[100.100.100.100]",
+		"[100.100.100.101]\r",
+		strings.Repeat("x", 100) + "10.0.0.1",
+		"2.2.2.2",
+		strings.Repeat("x", 57) + "10.0.0.2",
+		"10.0.0.3",
+		strings.Repeat("1.2.3.4 ", 30),
+		"3.3.3.3",
+		"",
+		strings.Repeat("z", 90) + "4.4.4.4",
+	}
+	data := strings.Join(lines, "\n")
+	want := []string{"1.1.1.1", "2.2.2.2", "3.3.3.3", "10.0.0.3", "100.100.100.100"}
+	for range 20 {
+		ll := &longLines{max: MaxRecordLen}
+		set := NewSparseSet()
+		if _, err := readStream(&shortReader{strings.NewReader(data), r, 50}, 64, ll, func(block []byte) error {
+			return processData(block, set, 1, &options{minRecordLen: MinIPLen})
+		}); err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		set.ForEach(func(ip uint32) { got = append(got, formatIP(ip)) })
+		if !slices.Equal(got, want) || ll.skipped.Load() != 5 {
+			t.Fatalf("counted %v and skipped %d record(s), expected %v and 5", got, ll.skipped.Load(), want)
+		}
+	}
+	ll := &longLines{max: MaxRecordLen, strict: true}
+	_, err := readStream(&shortReader{strings.NewReader(data), r, 50}, 64, ll, func(block []byte) error {
+		return processData(block, NewSparseSet(), 1, &options{minRecordLen: MinIPLen})
+	})
+	var re *invalidRecordError
+	if at := int64(strings.Index(data, "[100.100.100.101]")); !errors.As(err, &re) || re.offset != at {
+		t.Fatalf("--strict: returned %v, expected an invalid record at offset %d", err, at)
+	}
+}
@@ -1,69 +1,213 @@
 package main
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
+	"io"
+	"log/slog"
 	"math/bits"
 	"os"
 	"runtime"
 	"sync"
 	"sync/atomic"
 	"time"
-
-	"github.com/edsrzf/mmap-go"
 )
 
 // --- Configuration Constants ---
 const (
-	MaxIPv4      = 1 << 32     // 4,294,967,296 possible IPv4 addresses
-	BucketSize   = 64          // One uint64 holds 64 bits
-	MinIPLen     = 7           // Minimal length of "x.x.x.x"
-	MaxIPLen     = 15          // Maximal length of "xxx.xxx.xxx.xxx"
-	ChunkMinSize = 1024 * 1024 // Minimum file size (~1MB) for using multiple workers
+	MaxIPv4      = 1 << 32      // 4,294,967,296 possible IPv4 addresses
+	BucketSize   = 64           // One uint64 holds 64 bits
+	MinIPLen     = 7            // Minimal length of "x.x.x.x"
+	MaxIPLen     = 15           // Maximal length of "xxx.xxx.xxx.xxx"
+	MaxRecordLen = MaxIPLen + 2 // Maximal length of a bracketed "[xxx.xxx.xxx.xxx]"
+	ChunkMinSize = 1024 * 1024  // Minimum file size (~1MB) for using multiple workers
 )
 
 // --- AtomicBitSet ---
 // AtomicBitSet stores unique IPv4 addresses using a bitset.
 type AtomicBitSet struct {
-	bits []uint64 // Each element is updated atomically.
+	bits         []uint64      // Each element is updated atomically, unless singleWriter is set.
+	countWorkers int           // Goroutines used by Count, 0 for the default.
+	singleWriter bool          // Only one goroutine calls Set, so plain stores suffice.
+	retries      *atomic.Int64 // Failed compare-and-swaps of Set, nil unless counted.
 }
 
 // NewAtomicBitSet creates a new AtomicBitSet covering all possible IPv4 addresses.
 func NewAtomicBitSet() *AtomicBitSet {
+	return newAtomicBitSetSize(MaxIPv4)
+}
+
+// newAtomicBitSetSize creates an AtomicBitSet covering the values [0, size).
+func newAtomicBitSetSize(size uint64) *AtomicBitSet {
 	// Each uint64 stores 64 bits.
 	return &AtomicBitSet{
-		bits: make([]uint64, MaxIPv4/BucketSize),
+		bits: make([]uint64, (size+BucketSize-1)/BucketSize),
+	}
+}
+
+// newHugePageBitSet creates an AtomicBitSet covering all possible IPv4 addresses whose
+// words are backed by huge pages, which reduces TLB misses for the random accesses of
+// Set. Falls back to a normal allocation if huge pages are unavailable.
+func newHugePageBitSet() *AtomicBitSet {
+	if words := hugePageWords(MaxIPv4 / BucketSize); words != nil {
+		return &AtomicBitSet{bits: words}
 	}
+	return NewAtomicBitSet()
 }
 
 // Set marks the bit corresponding to the given IPv4 address.
 func (bs *AtomicBitSet) Set(ip uint32) {
 	index := ip / BucketSize
 	bit := ip % BucketSize
+	if bs.singleWriter {
+		bs.bits[index] |= 1 << bit
+		return
+	}
+	if bs.retries != nil {
+		bs.setCAS(index, 1<<bit)
+		return
+	}
 	atomic.OrUint64(&bs.bits[index], 1<<bit)
 }
 
+// setCAS sets mask in the word at index with a compare-and-swap loop instead of an atomic
+// OR, counting each failed swap: every one means that another goroutine changed the word
+// between the load and the swap. A bit that is already set is not stored again.
+func (bs *AtomicBitSet) setCAS(index uint32, mask uint64) {
+	for {
+		old := atomic.LoadUint64(&bs.bits[index])
+		if old&mask != 0 || atomic.CompareAndSwapUint64(&bs.bits[index], old, old|mask) {
+			return
+		}
+		bs.retries.Add(1)
+	}
+}
+
+// SetAll marks the bits of all the given addresses. Consecutive addresses that fall in the
+// same 64-bit word are combined into a single atomic OR, which saves most of the atomic
+// operations of clustered input, such as addresses of a few subnets or from sorted logs.
+// ips is not modified; sorting it first, e.g. with slices.Sort, groups every word's
+// addresses together. It is safe to call concurrently with Set and other SetAll calls.
+func (bs *AtomicBitSet) SetAll(ips []uint32) {
+	for i := 0; i < len(ips); {
+		index := ips[i] / BucketSize
+		mask := uint64(1) << (ips[i] % BucketSize)
+		for i++; i < len(ips) && ips[i]/BucketSize == index; i++ {
+			mask |= 1 << (ips[i] % BucketSize)
+		}
+		atomic.OrUint64(&bs.bits[index], mask)
+	}
+}
+
+// SetNew marks the bit of the given IPv4 address like Set and reports whether it was not
+// set before. Of concurrent calls for the same address, exactly one reports it as new.
+func (bs *AtomicBitSet) SetNew(ip uint32) bool {
+	mask := uint64(1) << (ip % BucketSize)
+	return atomic.OrUint64(&bs.bits[ip/BucketSize], mask)&mask == 0
+}
+
+// SetRange marks the bits of all addresses in the inclusive range [start, end], a word
+// at a time.
+func (bs *AtomicBitSet) SetRange(start, end uint32) {
+	first, last := start/BucketSize, end/BucketSize
+	firstMask := ^uint64(0) << (start % BucketSize)
+	lastMask := ^uint64(0) >> (BucketSize - 1 - end%BucketSize)
+	if first == last {
+		atomic.OrUint64(&bs.bits[first], firstMask&lastMask)
+		return
+	}
+	atomic.OrUint64(&bs.bits[first], firstMask)
+	for i := first + 1; i < last; i++ {
+		atomic.StoreUint64(&bs.bits[i], ^uint64(0))
+	}
+	atomic.OrUint64(&bs.bits[last], lastMask)
+}
+
+// IsSet reports whether the bit corresponding to the given IPv4 address is set.
+// It is safe to call while other goroutines Set bits.
+func (bs *AtomicBitSet) IsSet(ip uint32) bool {
+	return atomic.LoadUint64(&bs.bits[ip/BucketSize])&(1<<(ip%BucketSize)) != 0
+}
+
+// SetCountWorkers sets the number of goroutines Count uses to scan the bitset. If n is
+// less than 1, the default of half the CPUs is used.
+func (bs *AtomicBitSet) SetCountWorkers(n int) {
+	bs.countWorkers = n
+}
+
+// SetSingleWriter declares whether only one goroutine adds addresses from now on. Set then
+// uses a plain OR instead of an atomic one, which is cheaper even without contention;
+// SetAll, SetNew and SetRange stay atomic. Concurrent Set calls with a single writer are a data
+// race, so it must only be set while a single worker processes the input.
+func (bs *AtomicBitSet) SetSingleWriter(single bool) {
+	bs.singleWriter = single
+}
+
+// CountRetries makes Set use a compare-and-swap loop and count how often a swap fails
+// because another goroutine set a bit of the same word at the same time, for measuring
+// contention; Retries returns the count. The loop is slower than the atomic OR Set uses
+// otherwise, so it is only meant for diagnostics. SetAll, SetNew and SetRange are not counted.
+func (bs *AtomicBitSet) CountRetries() {
+	bs.retries = new(atomic.Int64)
+}
+
+// Retries returns the number of failed compare-and-swaps of Set since CountRetries.
+func (bs *AtomicBitSet) Retries() int64 {
+	if bs.retries == nil {
+		return 0
+	}
+	return bs.retries.Load()
+}
+
 // Count returns the number of unique IPv4 addresses.
+// It may be called while other goroutines Set bits, e.g. for interim counts: the words are
+// then read without synchronization and the result is an estimate of the running count.
+// Such a read is a data race to the race detector; CountConcurrent avoids it.
 func (bs *AtomicBitSet) Count() int {
-	workers := runtime.NumCPU() / 2
+	return bs.count(false)
+}
+
+// CountConcurrent is Count for use while other goroutines Set bits. It reads each word
+// with an atomic load, which makes it slightly slower than Count but race-free, and
+// returns the running count at some point during its scan.
+func (bs *AtomicBitSet) CountConcurrent() int {
+	return bs.count(true)
+}
+
+// count scans the bitset with the count workers, loading the words atomically if atomicLoads is set.
+func (bs *AtomicBitSet) count(atomicLoads bool) int {
+	workers := defaultWorkers()
+	if bs.countWorkers > 0 {
+		workers = bs.countWorkers
+	}
+	workers = max(1, min(workers, len(bs.bits)))
 	countChan := make(chan int, workers)
 	chunkSize := len(bs.bits) / workers
 
 	var wg sync.WaitGroup
 	wg.Add(workers)
+	pool.grow(workers)
 	for i := 0; i < workers; i++ {
 		start := i * chunkSize
 		end := start + chunkSize
 		if i == workers-1 {
 			end = len(bs.bits) // Last worker processes the remaining elements.
 		}
-		go func(start, end int) {
+		pool.Go(func() {
 			defer wg.Done()
 			localCount := 0
-			for j := start; j < end; j++ {
-				localCount += bits.OnesCount64(bs.bits[j])
+			if atomicLoads {
+				for j := start; j < end; j++ {
+					localCount += bits.OnesCount64(atomic.LoadUint64(&bs.bits[j]))
+				}
+			} else {
+				for j := start; j < end; j++ {
+					localCount += bits.OnesCount64(bs.bits[j])
+				}
 			}
 			countChan <- localCount
-		}(start, end)
+		})
 	}
 	wg.Wait()
 	close(countChan)
@@ -75,148 +219,1206 @@ func (bs *AtomicBitSet) Count() int {
 	return total
 }
 
+// unionBlock is the number of words UnionCount ORs together at a time, small enough for
+// the block to stay in the CPU cache while every set is ORed into it.
+const unionBlock = 4096
+
+// UnionCount returns the number of addresses set in any of sets, without modifying them
+// or allocating a merged bitset. Each worker ORs the sets into a small block of words at
+// a time and counts its bits. Sets of different sizes are treated as if padded with zero
+// words, and no set may be modified while it runs.
+func UnionCount(sets ...*AtomicBitSet) int {
+	words := 0
+	for _, bs := range sets {
+		words = max(words, len(bs.bits))
+	}
+	if words == 0 {
+		return 0
+	}
+	workers := max(1, min(defaultWorkers(), (words+unionBlock-1)/unionBlock))
+	countChan := make(chan int, workers)
+	chunkSize := (words + workers - 1) / workers
+
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	pool.grow(workers)
+	for i := 0; i < workers; i++ {
+		start, end := i*chunkSize, min((i+1)*chunkSize, words)
+		pool.Go(func() {
+			defer wg.Done()
+			localCount := 0
+			var block [unionBlock]uint64
+			for from := start; from < end; from += unionBlock {
+				to := min(from+unionBlock, end)
+				union := block[:to-from]
+				clear(union)
+				for _, bs := range sets {
+					if from < len(bs.bits) {
+						for j, w := range bs.bits[from:min(to, len(bs.bits))] {
+							union[j] |= w
+						}
+					}
+				}
+				for _, w := range union {
+					localCount += bits.OnesCount64(w)
+				}
+			}
+			countChan <- localCount
+		})
+	}
+	wg.Wait()
+	close(countChan)
+
+	total := 0
+	for count := range countChan {
+		total += count
+	}
+	return total
+}
+
+// CountRange returns the number of set bits for addresses in the inclusive range [start, end].
+func (bs *AtomicBitSet) CountRange(start, end uint32) int {
+	first, last := start/BucketSize, end/BucketSize
+	firstMask := ^uint64(0) << (start % BucketSize)
+	lastMask := ^uint64(0) >> (BucketSize - 1 - end%BucketSize)
+	if first == last {
+		return bits.OnesCount64(bs.bits[first] & firstMask & lastMask)
+	}
+	count := bits.OnesCount64(bs.bits[first]&firstMask) + bits.OnesCount64(bs.bits[last]&lastMask)
+	for i := first + 1; i < last; i++ {
+		count += bits.OnesCount64(bs.bits[i])
+	}
+	return count
+}
+
+// AnySetInRange reports whether any bit for addresses in the inclusive range [start, end] is set.
+// Only the words covering the range are examined, and it returns on the first set bit found.
+func (bs *AtomicBitSet) AnySetInRange(start, end uint32) bool {
+	first, last := start/BucketSize, end/BucketSize
+	firstMask := ^uint64(0) << (start % BucketSize)
+	lastMask := ^uint64(0) >> (BucketSize - 1 - end%BucketSize)
+	if first == last {
+		return bs.bits[first]&firstMask&lastMask != 0
+	}
+	if bs.bits[first]&firstMask != 0 || bs.bits[last]&lastMask != 0 {
+		return true
+	}
+	for i := first + 1; i < last; i++ {
+		if bs.bits[i] != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// ForEach calls fn for every address in the set, in ascending order.
+func (bs *AtomicBitSet) ForEach(fn func(ip uint32)) {
+	for i, word := range bs.bits {
+		for ; word != 0; word &= word - 1 {
+			fn(uint32(i*BucketSize + bits.TrailingZeros64(word)))
+		}
+	}
+}
+
+// forEachDesc calls fn for every address in the set, in descending order.
+func (bs *AtomicBitSet) forEachDesc(fn func(ip uint32)) {
+	for i := len(bs.bits) - 1; i >= 0; i-- {
+		for word := bs.bits[i]; word != 0; {
+			top := BucketSize - 1 - bits.LeadingZeros64(word)
+			word &^= 1 << top
+			fn(uint32(i*BucketSize + top))
+		}
+	}
+}
+
+// --- IPSet ---
+// IPSet is a set of IPv4 addresses that is safe for concurrent use.
+// AtomicBitSet and SparseSet implement it.
+type IPSet interface {
+	// Set adds the address to the set.
+	Set(ip uint32)
+	// IsSet reports whether the address is in the set.
+	IsSet(ip uint32) bool
+	// Count returns the number of unique addresses in the set.
+	Count() int
+	// CountRange returns the number of addresses in the inclusive range [start, end] that are in the set.
+	CountRange(start, end uint32) int
+	// AnySetInRange reports whether any address in the inclusive range [start, end] is in the set.
+	AnySetInRange(start, end uint32) bool
+	// ForEach calls fn for every address in the set, in ascending order.
+	// It must not be called concurrently with Set.
+	ForEach(fn func(ip uint32))
+}
+
+// setWrapper is implemented by sets that add behavior on top of another IPSet.
+type setWrapper interface {
+	unwrap() IPSet
+}
+
+// Supported values of --bitset.
+const (
+	bitSetDense  = "dense"
+	bitSetSparse = "sparse"
+)
+
+// newIPSet creates an empty set of the type selected by --bitset. With --subnet, addresses
+// outside the given prefixes are skipped; a single dense prefix gets a right-sized bitset.
+// With --exclude-subnet, addresses within the excluded prefixes are skipped.
+func newIPSet(opts *options) IPSet {
+	set := baseSet(opts)
+	if accs := opts.accumulators(); len(accs) > 0 {
+		set = &dispatchSet{IPSet: set, accs: accs}
+	}
+	if len(opts.subnets) > 0 {
+		set = &filteredSet{IPSet: set, ranges: newRangeList(opts.subnets)}
+	}
+	if opts.exclude != nil {
+		set = &excludedSet{IPSet: set, ex: opts.exclude}
+	}
+	return set
+}
+
+// baseSet creates the empty set implementation selected by the options, without wrappers.
+func baseSet(opts *options) IPSet {
+	switch {
+	case len(opts.subnets) == 1 && opts.bitSetType == bitSetDense:
+		rs := NewRangeBitSet(opts.subnets[0])
+		rs.bits.SetCountWorkers(opts.countWorkers)
+		return rs
+	case opts.bitSetType == bitSetSparse && opts.spillAbove > 0:
+		s := newSpillSetHash(opts.spillAbove, opts.hash)
+		s.dir = opts.tmpDir
+		return s
+	case opts.bitSetType == bitSetSparse && opts.memoryBudget > 0:
+		return newBudgetSetHash(opts.memoryBudget/sparseEntryBytes, opts.hash)
+	case opts.bitSetType == bitSetSparse:
+		return newSparseSetHash(opts.hash)
+	}
+	bs := NewAtomicBitSet
+	if opts.hugePages {
+		bs = newHugePageBitSet
+	}
+	set := bs()
+	set.SetCountWorkers(opts.countWorkers)
+	return set
+}
+
+// accumulator receives every address that is added to the set, for the features that derive
+// more than the unique count from the records, such as --levels, --cms and
+// --distribution-stats.
+type accumulator interface {
+	Add(ip uint32)
+}
+
+// accumulators returns the accumulators enabled by the options.
+func (opts *options) accumulators() []accumulator {
+	var accs []accumulator
+	for _, l := range opts.levels {
+		if l.set != nil {
+			accs = append(accs, l)
+		}
+	}
+	if opts.sketch != nil {
+		accs = append(accs, opts.sketch)
+	}
+	if opts.counts != nil {
+		accs = append(accs, opts.counts)
+	}
+	return accs
+}
+
+// dispatchSet wraps an IPSet and routes every address added to it to all accumulators.
+// Each record is parsed once, and the filters of the outer wrappers (--subnet and
+// --exclude-subnet) are applied once, before the address reaches any accumulator.
+type dispatchSet struct {
+	IPSet
+	accs []accumulator
+}
+
+// Set adds the address to the underlying set and to every accumulator.
+func (ds *dispatchSet) Set(ip uint32) {
+	ds.IPSet.Set(ip)
+	for _, acc := range ds.accs {
+		acc.Add(ip)
+	}
+}
+
+// SetNew adds the address like Set and reports whether the underlying set did not hold it yet.
+func (ds *dispatchSet) SetNew(ip uint32) bool {
+	added := setNew(ds.IPSet, ip)
+	for _, acc := range ds.accs {
+		acc.Add(ip)
+	}
+	return added
+}
+
+func (ds *dispatchSet) unwrap() IPSet { return ds.IPSet }
+
+// closeSet releases the resources held by set beyond memory, such as the temporary
+// files of a SpillSet.
+func closeSet(set IPSet) {
+	switch s := set.(type) {
+	case io.Closer:
+		s.Close()
+	case setWrapper:
+		closeSet(s.unwrap())
+	}
+}
+
+// setSingleWriter declares the dense bitset underlying set, if any, to have a single writer.
+func setSingleWriter(set IPSet) {
+	if bs := denseBitSetOf(set); bs != nil {
+		bs.SetSingleWriter(true)
+	}
+}
+
+// denseBitSetOf returns the dense bitset underlying set, or nil if it is not dense.
+func denseBitSetOf(set IPSet) *AtomicBitSet {
+	switch s := set.(type) {
+	case *AtomicBitSet:
+		return s
+	case *RangeBitSet:
+		return s.bits
+	case setWrapper:
+		return denseBitSetOf(s.unwrap())
+	}
+	return nil
+}
+
+// bitSetOf returns set as a full-size AtomicBitSet, converting other set types if necessary.
+func bitSetOf(set IPSet) *AtomicBitSet {
+	switch s := set.(type) {
+	case *SparseSet:
+		return s.BitSet()
+	case *SpillSet:
+		return s.BitSet()
+	case *RangeBitSet:
+		return s.BitSet()
+	case setWrapper:
+		return bitSetOf(s.unwrap())
+	}
+	return set.(*AtomicBitSet)
+}
+
 // --- IP Parsing ---
 // parseIPFast parses an IPv4 address in the format "xxx.xxx.xxx.xxx" from a byte slice.
-// Returns the IPv4 address as a uint32 or false if the format is invalid.
+// Returns the IPv4 address as a uint32 or false if the format is invalid. Each octet must
+// have 1 to 3 digits, so a field that --extract takes from free text is bounded by its
+// octets as well as by the length check, and "0001.2.3.4" or "1..22.3" do not count.
+// An address in a matching pair of brackets, as in "[1.2.3.4]", is parsed without them.
 func parseIPFast(line []byte) (uint32, bool) {
+	line = stripBrackets(line)
 	if len(line) < MinIPLen || len(line) > MaxIPLen {
 		return 0, false
 	}
 
 	var ip, num uint32
-	dots := 0
+	dots, digits := 0, 0
 	for i := 0; i < len(line); i++ {
 		switch line[i] {
 		case '.':
-			if dots >= 3 || num > 255 {
+			if dots >= 3 || num > 255 || digits == 0 {
 				return 0, false
 			}
 			ip = (ip << 8) | num
 			num = 0
+			digits = 0
 			dots++
 		default:
-			if line[i] < '0' || line[i] > '9' {
+			// A fourth digit makes the octet invalid, however short the token is.
+			if line[i] < '0' || line[i] > '9' || digits == 3 {
 				return 0, false
 			}
 			num = num*10 + uint32(line[i]-'0')
+			digits++
 		}
 	}
-	if dots != 3 || num > 255 {
+	if dots != 3 || num > 255 || digits == 0 {
 		return 0, false
 	}
 	ip = (ip << 8) | num
 	return ip, true
 }
 
+// stripBrackets removes a leading '[' and a trailing ']' from line if it has both, the
+// form some logs use for consistency with IPv6 addresses such as "[::1]".
+func stripBrackets(line []byte) []byte {
+	if len(line) >= 2 && line[0] == '[' && line[len(line)-1] == ']' {
+		return line[1 : len(line)-1]
+	}
+	return line
+}
+
+// formatIP returns the dotted-decimal representation of an IPv4 address.
+func formatIP(ip uint32) string {
+	return fmt.Sprintf("%d.%d.%d.%d", byte(ip>>24), byte(ip>>16), byte(ip>>8), byte(ip))
+}
+
 // --- Chunk Processing ---
+// zeroRunEnd checks whether the line starting at lineStart begins with a zero byte, as the
+// holes of sparse files do. Such a line cannot hold an address, so the caller can jump past
+// it with a single fast IndexByte scan instead of stepping through it byte by byte.
+// Returns the index of the newline ending the line (or endChunk if there is none),
+// or lineStart itself if the line does not begin with a zero byte.
+func zeroRunEnd(data []byte, lineStart, endChunk int) int {
+	if lineStart >= endChunk || data[lineStart] != 0 {
+		return lineStart
+	}
+	if n := bytes.IndexByte(data[lineStart:endChunk], '\n'); n >= 0 {
+		return lineStart + n
+	}
+	return endChunk
+}
+
+// skipAfterNewline returns how many bytes after lineStart can be passed over without
+// checking for a newline: up to skip, which is derived from the minimum record length,
+// but never past the next newline or endChunk, so short and empty lines are still seen.
+func skipAfterNewline(data []byte, lineStart, endChunk, skip int) int {
+	end := min(lineStart+skip, endChunk)
+	if end <= lineStart {
+		return 0
+	}
+	if n := bytes.IndexByte(data[lineStart:end], '\n'); n >= 0 {
+		return n
+	}
+	return end - lineStart
+}
+
 // processChunk processes a section of the memory-mapped file data from startChunk to endChunk,
-// parsing each line as an IPv4 address and setting its bit in the global bitset.
-func processChunk(data []byte, startChunk, endChunk int, bitSet *AtomicBitSet, wg *sync.WaitGroup) {
+// parsing each line as an IPv4 address and adding it to the shared set. A final line without
+// a trailing newline is processed as well. With repeats, a line that is byte-identical to the
+// line before it is passed over without parsing it or setting its address again, which saves
+// the atomic operations of the runs of duplicates in sorted input; the result is the same.
+func processChunk(data []byte, startChunk, endChunk, skip int, repeats bool, bitSet IPSet, batchSize int, wg *sync.WaitGroup) {
 	defer wg.Done()
+	var batch *setBatch
+	if bs, ok := bitSet.(*AtomicBitSet); ok && batchSize > 0 {
+		batch = newSetBatch(bs, batchSize)
+		defer batch.flush()
+	}
 	var ip uint32
 	var ok bool
+	var prev []byte
 	lineStart := startChunk
-	for i := startChunk; i < endChunk; i++ {
+	for i := zeroRunEnd(data, startChunk, endChunk); i < endChunk; i++ {
 		if data[i] == '\n' {
 			if lineStart < i {
-				if ip, ok = parseIPFast(data[lineStart:i]); ok {
+				if line := data[lineStart:i]; !repeats || !bytes.Equal(line, prev) {
+					if ip, ok = parseIPFast(line); !ok {
+					} else if batch != nil {
+						batch.add(ip)
+					} else {
+						bitSet.Set(ip)
+					}
+					prev = line
+				}
+			}
+			lineStart = i + 1
+			if next := zeroRunEnd(data, lineStart, endChunk); next != lineStart {
+				i = next - 1
+				continue
+			}
+			// Skip the bytes that are part of any record to speed up processing.
+			i += skipAfterNewline(data, lineStart, endChunk, skip)
+		}
+	}
+	if lineStart < endChunk {
+		if ip, ok = parseIPFast(data[lineStart:endChunk]); !ok {
+		} else if batch != nil {
+			batch.add(ip)
+		} else {
+			bitSet.Set(ip)
+		}
+	}
+}
+
+// setBatch collects the bits a worker sets in a dense bitset, for --set-batch, as pending
+// (word, mask) pairs in a direct-mapped table indexed by the low bits of the word index.
+// An address whose word is pending only adds its bit to the mask; one whose slot holds
+// another word first applies that word's mask with a single atomic OR. Addresses that
+// keep returning to the same few words, as in clustered input, thus share one atomic
+// operation per word, while scattered ones cost one each as before. The pending masks are
+// applied when the chunk ends.
+type setBatch struct {
+	bs    *AtomicBitSet
+	words []uint32 // Word index of each slot.
+	masks []uint64 // Pending bits of each slot's word, 0 if the slot is free.
+}
+
+// newSetBatch creates a batch for bs with size slots, rounded up to a power of two.
+func newSetBatch(bs *AtomicBitSet, size int) *setBatch {
+	n := 1
+	for n < size {
+		n <<= 1
+	}
+	return &setBatch{bs: bs, words: make([]uint32, n), masks: make([]uint64, n)}
+}
+
+// add adds ip to the pending mask of its word.
+func (b *setBatch) add(ip uint32) {
+	word, bit := ip/BucketSize, uint64(1)<<(ip%BucketSize)
+	slot := word & uint32(len(b.words)-1)
+	if b.words[slot] != word {
+		if b.masks[slot] != 0 {
+			atomic.OrUint64(&b.bs.bits[b.words[slot]], b.masks[slot])
+		}
+		b.words[slot], b.masks[slot] = word, 0
+	}
+	b.masks[slot] |= bit
+}
+
+// flush applies the pending masks to the bitset and frees the slots.
+func (b *setBatch) flush() {
+	for slot, mask := range b.masks {
+		if mask != 0 {
+			atomic.OrUint64(&b.bs.bits[b.words[slot]], mask)
+			b.masks[slot] = 0
+		}
+	}
+}
+
+// defaultWorkers returns the default number of goroutines used for parallel work:
+// half of the available CPUs, but never less than one.
+func defaultWorkers() int {
+	return max(1, runtime.NumCPU()/2)
+}
+
+// chunkWorkers returns the number of chunk workers used for data of the given size.
+func (opts *options) chunkWorkers(size int) int {
+	if size < ChunkMinSize || opts.singleThread {
+		return 1
+	}
+	if opts.workers > 0 {
+		return opts.workers
+	}
+	if opts.threadsPerCore > 0 {
+		// Oversubscribed workers are clamped so that every chunk keeps at least ChunkMinSize bytes.
+		n := int(float64(runtime.NumCPU()) * opts.threadsPerCore)
+		return max(1, min(n, size/ChunkMinSize))
+	}
+	return defaultWorkers()
+}
+
+// recordConfig describes how processChunkWith handles the lines of a chunk.
+type recordConfig struct {
+	parse   parseFunc    // Parses a line into an address.
+	strict  bool         // Stop at the first non-empty line that does not parse.
+	extract bool         // Count every whitespace-separated field that parses, not the line.
+	stats   *recordStats // Record counters, nil if records are not counted.
+	skip    int          // Bytes skipped after a newline when no newline is among them.
+	head    *headLimit   // Shared budget of valid records, nil if unlimited.
+
+	malformed *malformedTokens // Counts the lines that do not parse, nil if not counted.
+	invalid   *invalidLines    // Writes the lines that do not parse, nil if not written.
+	cidr      *cidrBlocks      // Expands the records that are CIDR blocks, nil if not expanded.
+
+	whitespace bool        // Records end at any whitespace, not only a newline (--whitespace-stream).
+	flow       *flowCounts // Counts the source and destination keys of each line, nil if not given.
+}
+
+// recordStats counts the records of one input, for the per-file rows of --format csv.
+type recordStats struct {
+	total atomic.Int64 // Non-empty lines.
+	valid atomic.Int64 // Lines that parsed as an address.
+}
+
+// withStats returns a copy of the options that counts records in fresh recordStats.
+func (opts *options) withStats() *options {
+	o := *opts
+	o.stats = &recordStats{}
+	return &o
+}
+
+// processChunkWith is the general variant of processChunk: each line is parsed with rc.parse,
+// and if rc.head is not nil, processing stops as soon as its shared budget of valid records
+// is used up. With rc.strict, processing stops at the first invalid line, whose offset is
+// stored in bad; bad is left unchanged otherwise.
+func processChunkWith(data []byte, startChunk, endChunk int, bitSet IPSet, rc *recordConfig, bad *int, wg *sync.WaitGroup) {
+	defer wg.Done()
+	parse, head := rc.parse, rc.head
+	var ip uint32
+	var ok bool
+	var granted, total, valid int64
+	var hosts, blocks, covered int64
+	if rc.stats != nil {
+		defer func() {
+			rc.stats.total.Add(total)
+			rc.stats.valid.Add(valid)
+		}()
+	}
+	if rc.cidr != nil {
+		defer func() {
+			rc.cidr.hosts.Add(hosts)
+			rc.cidr.blocks.Add(blocks)
+			rc.cidr.covered.Add(covered)
+		}()
+	}
+	var invalid []byte
+	var invalidCount int64
+	if rc.invalid != nil {
+		defer func() { rc.invalid.write(invalid, invalidCount) }()
+	}
+	// reject records a non-empty line that is not a valid record.
+	reject := func(line []byte) {
+		if rc.malformed != nil {
+			rc.malformed.add(line)
+		}
+		if rc.invalid != nil {
+			invalid = append(append(invalid, line...), '\n')
+			if invalidCount++; len(invalid) >= invalidFlushSize {
+				rc.invalid.write(invalid, invalidCount)
+				invalid, invalidCount = invalid[:0], 0
+			}
+		}
+	}
+	// expand adds the block r, which counts as one record.
+	expand := func(r ipRange) {
+		blocks++
+		covered += int64(r.size())
+		setRange(bitSet, r)
+	}
+	// take reserves one record from the head budget and reports whether any was left.
+	take := func() bool {
+		if head == nil {
+			return true
+		}
+		if granted == 0 {
+			if granted = head.claim(headBatch); granted == 0 {
+				return false
+			}
+		}
+		granted--
+		return true
+	}
+	ws := rc.whitespace
+	lineStart := startChunk
+	for i := zeroRunEnd(data, startChunk, endChunk); i <= endChunk; i++ {
+		if i == endChunk || data[i] == '\n' || (ws && isFieldSpace(data[i])) {
+			if lineStart < i {
+				total++
+				line := data[lineStart:i]
+				if rc.flow != nil {
+					// A line is a record if either key holds an address.
+					if rec, ok := rc.flow.parse(line, parse); ok {
+						valid++
+						if !take() {
+							return
+						}
+						hosts += rc.flow.add(rec, bitSet)
+					} else if rc.strict {
+						*bad = lineStart
+						break
+					} else {
+						reject(line)
+					}
+				} else if rc.extract {
+					// Every whitespace-separated field that is an address counts.
+					found := false
+					for field, rest := nextField(line); field != nil; field, rest = nextField(rest) {
+						if ip, ok = parse(field); ok {
+							if !take() {
+								return
+							}
+							found = true
+							hosts++
+							bitSet.Set(ip)
+						} else if r, ok := rc.cidr.block(field, parse); ok {
+							if !take() {
+								return
+							}
+							found = true
+							expand(r)
+						}
+					}
+					if found {
+						valid++
+					} else {
+						reject(line)
+					}
+				} else if ip, ok = parse(line); ok {
+					valid++
+					if !take() {
+						return
+					}
+					hosts++
 					bitSet.Set(ip)
+				} else if r, ok := rc.cidr.block(line, parse); ok {
+					valid++
+					if !take() {
+						return
+					}
+					expand(r)
+				} else if rc.strict {
+					*bad = lineStart
+					break
+				} else {
+					reject(line)
 				}
 			}
 			lineStart = i + 1
-			// Skip a few bytes to speed up processing
-			i += 6
+			if ws {
+				continue // A zero run or skip could pass over the next separator.
+			}
+			if next := zeroRunEnd(data, lineStart, endChunk); next != lineStart {
+				i = next - 1
+				continue
+			}
+			// Skip the bytes that are part of any record to speed up processing.
+			i += skipAfterNewline(data, lineStart, endChunk, rc.skip)
+		}
+	}
+	// Let workers that are still running use what this one did not need.
+	if granted > 0 {
+		head.release(granted)
+	}
+}
+
+// chunk is a half-open byte range [start, end) of the input assigned to one worker.
+type chunk struct {
+	start, end int
+}
+
+// endsRecord reports whether c ends a record: a newline, or with whitespace, as for
+// --whitespace-stream, also a space, tab or carriage return.
+func endsRecord(c byte, whitespace bool) bool {
+	return c == '\n' || (whitespace && isFieldSpace(c))
+}
+
+// splitChunks divides data into the given number of chunks, with boundaries aligned
+// so that every chunk except possibly the last one ends right after a newline, or any
+// whitespace if whitespace is set. A record therefore belongs to exactly one chunk.
+// With fewer bytes than workers, the leading chunks may be empty.
+func splitChunks(data []byte, workers int, whitespace bool) []chunk {
+	chunks := make([]chunk, 0, workers)
+	start := 0
+	for i := 0; i < workers; i++ {
+		end := (len(data) * (i + 1)) / workers
+
+		// Adjust the chunk boundaries to align with newline characters.
+		if i > 0 {
+			for start > 0 && start < len(data) && !endsRecord(data[start-1], whitespace) {
+				start++
+			}
+		}
+		if i < workers-1 && end < len(data) {
+			for end > 0 && end < len(data) && !endsRecord(data[end-1], whitespace) {
+				end++
+			}
+		} else {
+			end = len(data)
+		}
+		chunks = append(chunks, chunk{start: start, end: end})
+		start = end
+	}
+	return chunks
+}
+
+// processData divides data into newline-aligned chunks, processes them concurrently
+// on the given number of pool workers, and waits for all of them to finish. A single
+// chunk is processed on the calling goroutine.
+// Without record-level options the specialized processChunk is used. With --rate,
+// the data is processed in windows, sleeping as needed between them. With --max-unique,
+// errMaxUnique is returned once the set holds more than that many addresses. With
+// --strict, an *invalidRecordError for the first invalid line in data is returned.
+func processData(data []byte, bitSet IPSet, workers int, opts *options) error {
+	rc, ws := opts.records(), opts.whitespaceStream
+	return limitWindows(data, opts.maxUnique, bitSet, ws, func(data []byte) error {
+		return throttle(data, opts.rate, ws, func(data []byte) error {
+			return trackWindows(data, opts.progress, ws, func(data []byte) error {
+				return processWindow(data, bitSet, workers, rc, opts)
+			})
+		})
+	})
+}
+
+// processWindow processes a window of data for processData. With --safe-mode, a panic
+// of a worker is returned as a *workerPanicError for its chunk.
+func processWindow(data []byte, bitSet IPSet, workers int, rc *recordConfig, opts *options) error {
+	var wg sync.WaitGroup
+	chunks := splitChunks(data, workers, opts.whitespaceStream)
+	wg.Add(len(chunks))
+	bad := make([]int, len(chunks))
+	panics := make([]error, len(chunks))
+	pool.grow(len(chunks))
+	for i, c := range chunks {
+		bad[i] = -1
+		run := func(wg *sync.WaitGroup) {
+			processChunk(data, c.start, c.end, opts.minRecordLen-1, opts.skipRepeats, bitSet, opts.setBatch, wg)
+		}
+		if rc != nil {
+			run = func(wg *sync.WaitGroup) { processChunkWith(data, c.start, c.end, bitSet, rc, &bad[i], wg) }
+		}
+		task := func() { run(&wg) }
+		if opts.safeMode {
+			task = guardChunk(i, c, &panics[i], &wg, run)
+		}
+		if len(chunks) == 1 {
+			task()
+		} else {
+			pool.Go(task)
 		}
 	}
+	wg.Wait()
+	if err := firstPanic(panics); err != nil {
+		return err
+	}
+	// Chunks are in file order, so the first one with an invalid line has the first.
+	for _, offset := range bad {
+		if offset >= 0 {
+			return newInvalidRecord(data, offset)
+		}
+	}
+	return nil
 }
 
 // --- File Counting ---
 // countUniqueIpInFile opens, memory-maps, and processes the file to count unique IPv4 addresses.
-func countUniqueIpInFile(fileName string) (int, error) {
+func countUniqueIpInFile(fileName string, opts *options) (Result, error) {
 	startTime := time.Now()
+	res := Result{Path: fileName}
+	if opts.format == formatCSV {
+		opts = opts.withStats()
+	}
+	var meter *usageMeter
+	if opts.rusage {
+		meter = startUsage()
+	}
 
 	// Open the file.
-	fmt.Printf("Opening file %s...\n", fileName)
-	file, err := os.Open(fileName)
+	fmt.Fprintf(diag, "Opening file %s...\n", fileName)
+	file, err := openInput(fileName)
 	if err != nil {
-		return 0, fmt.Errorf("error opening file: %w", err)
+		return res, fmt.Errorf("%w: %w", ErrOpenFailed, err)
 	}
 	defer file.Close()
-	fmt.Println("File opened in", time.Since(startTime))
+	fmt.Fprintln(diag, "File opened in", time.Since(startTime))
 
 	// Get file stats.
 	stat, err := file.Stat()
 	if err != nil {
-		return 0, fmt.Errorf("error getting file stats: %w", err)
+		return res, fmt.Errorf("%w: %w", ErrStatFailed, err)
 	}
-	fmt.Printf("File size: %d bytes, stat time: %v\n", stat.Size(), time.Since(startTime))
+	res.Bytes = stat.Size()
+	fmt.Fprintf(diag, "File size: %d bytes, stat time: %v\n", stat.Size(), time.Since(startTime))
 
-	// Memory-map the file.
-	fmt.Println("Mapping file...")
-	mmapData, err := mmap.Map(file, mmap.RDONLY, 0)
-	if err != nil {
-		return 0, fmt.Errorf("mmap error: %w", err)
+	// Named pipes cannot be mapped or read by offset, so they are read as a stream.
+	pipe := stat.Mode()&os.ModeNamedPipe != 0
+	if pipe && (opts.warmup || opts.dropCache || opts.cacheCompare || opts.segmented() || opts.gunzip || opts.checkpoint != "") {
+		return res, errors.New("--warmup, --drop-cache, --cache-compare, --chunks, --manifest, --byte-range, --gunzip and --checkpoint cannot be used with a named pipe")
 	}
-	defer mmapData.Unmap()
-	fmt.Println("File mapped in", time.Since(startTime))
 
-	if len(mmapData) == 0 {
-		fmt.Printf("Empty file: %s\n", fileName)
-		return 0, nil
+	// Empty files cannot be memory-mapped; in follow mode, wait for data instead.
+	if stat.Size() == 0 && !opts.follow && !pipe {
+		return res, fmt.Errorf("%w: %s", ErrEmptyFile, fileName)
 	}
 
-	// Create an atomic bitset for unique IPv4 addresses.
-	bitSet := NewAtomicBitSet()
+	if err := prepareCache(file, opts); err != nil {
+		return res, err
+	}
+
+	// Memory-map the file, or fall back to positional reads if it cannot be mapped.
+	var mmapData []byte
+	mapped := false
+	if stat.Size() > 0 && !canMap {
+		fmt.Fprintln(diag, "Memory mapping is not available on this platform; reading the file in blocks")
+	} else if stat.Size() > 0 {
+		fmt.Fprintln(diag, "Mapping file...")
+		if mmapData, err = mapInput(file, stat.Size()); err != nil {
+			fmt.Fprintf(diag, "Warning: %v; reading the file in blocks instead\n", err)
+		} else {
+			defer unmapInput(mmapData)
+			mapped = true
+			fmt.Fprintln(diag, "File mapped in", time.Since(startTime))
+		}
+	}
+
+	// Create the set for unique IPv4 addresses.
+	set := newIPSet(opts)
+	defer closeSet(set)
+	if opts.pretouch {
+		if err := pretouchSet(set); err != nil {
+			return res, err
+		}
+	}
+	if bs := denseBitSetOf(set); bs != nil && opts.countContention {
+		bs.CountRetries()
+	}
 
 	// Determine the number of workers.
-	workers := runtime.NumCPU() / 2
-	if len(mmapData) < ChunkMinSize {
-		workers = 1
+	workers := opts.chunkWorkers(int(min(stat.Size(), int64(opts.readBufferSize()))))
+	if pipe {
+		workers = opts.chunkWorkers(opts.readBufferSize())
+	} else if mapped {
+		workers = opts.chunkWorkers(len(mmapData))
+	}
+	fmt.Fprintf(diag, "Processing file using %d worker(s)\n", workers)
+	// With a single worker for the whole run, the set has a single writer.
+	if opts.plainStores && workers == 1 {
+		setSingleWriter(set)
 	}
-	fmt.Printf("Processing file using %d worker(s)\n", workers)
 
-	var wg sync.WaitGroup
-	wg.Add(workers)
+	if p := opts.progress; p != nil && !pipe && !opts.follow {
+		p.total.Store(stat.Size())
+	}
+	stopInterim := startProgress(set, opts)
+	defer stopInterim()
 
-	// Divide the memory-mapped file into chunks for each worker.
-	start := 0
-	for i := 0; i < workers; i++ {
-		end := (len(mmapData) * (i + 1)) / workers
+	var times ipTimes
+	timedParse := opts.addrParser(parseIPFast)
+	process := func(data []byte) error {
+		if !opts.trackTimes {
+			return processData(data, set, opts.chunkWorkers(len(data)), opts)
+		}
+		return throttle(data, opts.rate, false, func(data []byte) error {
+			t, err := processDataTimed(data, set, opts.chunkWorkers(len(data)), opts.timeColumns, timedParse, opts.parseTime, opts.excludeTime, opts.roaming, opts.buckets, opts.sessions, opts.safeMode)
+			if err != nil {
+				return err
+			}
+			if times == nil {
+				times = t
+			} else {
+				times.merge(t)
+			}
+			if opts.progress != nil {
+				opts.progress.done.Add(int64(len(data)))
+			}
+			return nil
+		})
+	}
+	// check samples the start of the input; timestamped lines are not plain addresses,
+	// so the format check does not apply to them.
+	check := func(data []byte) error {
+		if opts.trackTimes {
+			return nil
+		}
+		return checkLooksLikeIPs(fileName, data, opts)
+	}
 
-		// Adjust the chunk boundaries to align with newline characters.
-		if i > 0 {
-			for start < len(mmapData) && mmapData[start-1] != '\n' {
-				start++
+	// processRange processes the bytes [start, end) of the file, from the mapping or in
+	// blocks. Only the first mapped range or block is sampled by the format check. Unless
+	// final is set, a trailing line without a newline is left unprocessed, as it may still
+	// be being written. Returns the end of the last complete line processed.
+	sampled := false
+	sampleAndProcess := func(data []byte) error {
+		if !sampled {
+			sampled = true
+			if err := check(data); err != nil {
+				return err
 			}
 		}
-		if i < workers-1 && end < len(mmapData) {
-			for end < len(mmapData) && mmapData[end-1] != '\n' {
-				end++
+		return process(data)
+	}
+	processRange := func(start, end int64, final bool) (int64, error) {
+		if mapped || stat.Size() == 0 {
+			data := mmapData[start:end]
+			next := start + int64(bytes.LastIndexByte(data, '\n')+1)
+			if !final {
+				data = mmapData[start:next]
+			}
+			return next, atOffset(sampleAndProcess(data), start)
+		}
+		return readBlocks(file, start, end, final, opts.readBufferSize(), sampleAndProcess)
+	}
+
+	// offset is the end of the last complete line processed.
+	var offset int64
+	if pipe {
+		res.Bytes, err = processPipe(file, opts, sampleAndProcess)
+	} else if opts.byteRange != nil {
+		err = processByteRange(file, stat.Size(), *opts.byteRange, processRange)
+	} else if opts.segmented() {
+		err = processSegments(file, stat.Size(), opts, processRange)
+	} else if opts.gunzip {
+		err = processGzipFile(mmapData, mapped, set, workers, opts)
+	} else if opts.checkpoint != "" {
+		err = processCheckpointed(file, stat.Size(), set, opts, processRange)
+	} else if opts.autoWorkers && mapped {
+		var calibrated, best int
+		calibrated, best, err = calibrateWorkers(mmapData, func(data []byte, workers int) error {
+			if !sampled {
+				sampled = true
+				if err := check(data); err != nil {
+					return err
+				}
+			}
+			return processData(data, set, workers, opts)
+		})
+		if best == 0 {
+			fmt.Fprintf(diag, "Too few CPUs or too little data to calibrate; using %d worker(s)\n", workers)
+		}
+		if best > 0 {
+			opts.workers = best
+		}
+		if err == nil {
+			offset, err = processRange(int64(calibrated), stat.Size(), true)
+		}
+	} else {
+		offset, err = processRange(0, stat.Size(), !opts.follow)
+	}
+	if err = ignoreMaxUnique(err); err != nil {
+		return res, resolveLine(file, err)
+	}
+	if opts.cacheCompare {
+		if mapped {
+			// The first pass ran with a cold cache; repeat it with the pages now cached.
+			coldTime := time.Since(startTime)
+			warmStart := time.Now()
+			if err := process(mmapData); err != nil {
+				return res, resolveLine(file, err)
 			}
+			fmt.Fprintf(diag, "Cold run: %v, warm run: %v\n", coldTime, time.Since(warmStart))
 		} else {
-			end = len(mmapData)
+			fmt.Fprintln(diag, "Warning: --cache-compare requires a memory-mapped file; skipped")
 		}
-		go processChunk(mmapData, start, end, bitSet, &wg)
-		start = end
 	}
+	if opts.follow && !pipe && (opts.maxUnique == nil || !opts.maxUnique.done()) {
+		if res.Bytes, err = followFile(file, offset, set, opts); ignoreMaxUnique(err) != nil {
+			return res, resolveLine(file, err)
+		}
+	}
+	stopInterim()
+	countSet(set, opts, &res)
+	res.DurationMs = time.Since(startTime).Milliseconds()
+	if opts.stats != nil {
+		res.Total = opts.stats.total.Load()
+		res.Skipped = res.Total - opts.stats.valid.Load()
+	}
+	printHeadStatus(opts)
+	printMaxUnique(opts, &res)
+	printEstimate(set, &res)
+	fmt.Fprintf(diag, "File processed in %v\n", time.Since(startTime))
+	meter.report()
+	printRate(opts)
+	if opts.trackTimes {
+		printTimes(times, opts.sessions, opts.timesIPs)
+	}
+	printSessions(opts, &res)
+	printLongLines(opts, &res)
+	printRoaming(opts, &res)
+	printBuckets(opts, &res)
+	printExcludedTimes(opts, &res)
+	printMalformed(opts, &res)
+	printCIDRBlocks(opts)
+	printFlow(opts, &res)
+	printResultDetails(set, opts, &res)
+	if bs := denseBitSetOf(set); bs != nil && opts.countContention {
+		fmt.Fprintf(diag, "Contended sets: %d compare-and-swap retries\n", bs.Retries())
+	}
+	if err := saveOutputs(set, opts); err != nil {
+		return res, err
+	}
+	if res.Unique == 0 && !res.NotCounted {
+		return res, fmt.Errorf("%w: %s", ErrNoValidIPs, fileName)
+	}
+	return res, nil
+}
 
-	wg.Wait()
-	uniqueCount := bitSet.Count()
-	fmt.Printf("File processed in %v\n", time.Since(startTime))
-	fmt.Printf("Unique IPv4 addresses: %d\n", uniqueCount)
-	return uniqueCount, nil
+// countSet counts the unique addresses of set into res, or with --no-count marks res
+// as not counted instead.
+func countSet(set IPSet, opts *options, res *Result) {
+	if opts.noCount {
+		res.NotCounted = true
+		fmt.Fprintln(diag, "Count skipped (--no-count)")
+		return
+	}
+	countStart := time.Now()
+	res.Unique = set.Count()
+	fmt.Fprintf(diag, "Counted in %v\n", time.Since(countStart))
+}
+
+// printHeadStatus reports whether processing stopped early because of --head.
+func printHeadStatus(opts *options) {
+	if opts.head != nil && opts.head.exhausted() {
+		fmt.Fprintf(diag, "Stopped after the first %d valid record(s)\n", opts.headCount)
+	}
+}
+
+// printResultDetails prints the optional reports derived from the final set
+// and records their outcome in res.
+func printResultDetails(set IPSet, opts *options, res *Result) {
+	if opts.complement != nil {
+		r := *opts.complement
+		seen := set.CountRange(r.start, r.end)
+		fmt.Fprintf(diag, "Range %s: %d seen, %d unseen of %d addresses\n", r, seen, r.size()-uint64(seen), r.size())
+	}
+	if opts.exclude != nil {
+		fmt.Fprintf(diag, "Excluded %d record(s) within %d excluded range(s)\n", opts.exclude.excluded.Load(), len(opts.exclude.ranges))
+	}
+	if opts.levels != nil {
+		res.Levels = countLevels(opts.levels, set, res.Unique)
+		for _, l := range res.Levels {
+			fmt.Fprintf(diag, "Unique /%d prefixes: %d\n", l.Prefix, l.Unique)
+		}
+	}
+	if opts.asns != nil {
+		var counts map[uint32]int
+		counts, res.ASNUnmatched = opts.asns.countLabels(set)
+		res.ASNs = len(counts)
+		fmt.Fprintf(diag, "Unique ASNs: %d\n", res.ASNs)
+		fmt.Fprintf(diag, "Addresses without an ASN: %d\n", res.ASNUnmatched)
+	}
+	if opts.geo != nil {
+		res.Countries, res.GeoUnmatched = opts.geo.countCountries(set)
+		for _, c := range res.Countries {
+			fmt.Fprintf(diag, "Country %s: %d\n", c.Country, c.Unique)
+		}
+		fmt.Fprintf(diag, "Addresses without a country: %d\n", res.GeoUnmatched)
+	}
+	if opts.sketch != nil {
+		printSketch(opts.sketch, set, opts.sketchQuery, opts.sketchTop)
+	}
+	printDistribution(opts, res)
+	if opts.query != nil {
+		res.Queries = make(map[string]bool, len(opts.query))
+		for _, ip := range opts.query {
+			present := set.IsSet(ip)
+			res.Queries[formatIP(ip)] = present
+			if present {
+				fmt.Fprintf(diag, "%s: present\n", formatIP(ip))
+			} else {
+				fmt.Fprintf(diag, "%s: absent\n", formatIP(ip))
+			}
+		}
+	}
+	if opts.contains != nil {
+		r := *opts.contains
+		found := set.AnySetInRange(r.start, r.end)
+		res.Contains = &found
+		if found {
+			fmt.Fprintf(diag, "Range %s: at least one address seen\n", r)
+		} else {
+			fmt.Fprintf(diag, "Range %s: no address seen\n", r)
+		}
+	}
+}
+
+// saveOutputs writes the optional output files derived from the final set.
+func saveOutputs(set IPSet, opts *options) error {
+	if opts.dumpBinary != "" {
+		if err := writeBitSetFile(opts.dumpBinary, bitSetOf(set)); err != nil {
+			return fmt.Errorf("error writing %s: %w", opts.dumpBinary, err)
+		}
+		fmt.Fprintf(diag, "Bitset written to %s\n", opts.dumpBinary)
+	}
+	if opts.dump != "" {
+		if err := writeDump(opts.dump, set, opts.dumpCols, opts.dumpOrder); err != nil {
+			return fmt.Errorf("error writing %s: %w", opts.dump, err)
+		}
+		fmt.Fprintf(diag, "Addresses written to %s\n", opts.dump)
+	}
+	if opts.dumpNDJSON != "" {
+		if err := writeDumpNDJSON(opts.dumpNDJSON, set, opts.dumpOrder); err != nil {
+			return fmt.Errorf("error writing %s: %w", opts.dumpNDJSON, err)
+		}
+		fmt.Fprintf(diag, "Address objects written to %s\n", opts.dumpNDJSON)
+	}
+	if opts.dumpAppend != "" {
+		added, err := appendDump(opts.dumpAppend, set, opts.dumpCols, opts.dumpOrder, opts.bitSetType)
+		if err != nil {
+			return fmt.Errorf("error appending to %s: %w", opts.dumpAppend, err)
+		}
+		fmt.Fprintf(diag, "%d new address(es) appended to %s\n", added, opts.dumpAppend)
+	}
+	if opts.partitionDir != "" {
+		files, err := writePartitions(opts.partitionDir, set, opts.partitionBy, opts.dumpCols, opts.dumpOrder)
+		if err != nil {
+			return fmt.Errorf("error writing partitions to %s: %w", opts.partitionDir, err)
+		}
+		fmt.Fprintf(diag, "Addresses written to %d /%d partition file(s) in %s\n", files, opts.partitionBy, opts.partitionDir)
+	}
+	if opts.heatmap != "" {
+		if err := writeHeatmap(opts.heatmap, set, opts.heatmapPrefix); err != nil {
+			return fmt.Errorf("error writing %s: %w", opts.heatmap, err)
+		}
+		side := 1 << (opts.heatmapPrefix / 2)
+		fmt.Fprintf(diag, "Heatmap of /%d blocks (%dx%d) written to %s\n", opts.heatmapPrefix, side, side, opts.heatmap)
+	}
+	return nil
 }
 
 func main() {
-	// Get filename from command-line arguments.
-	if len(os.Args) < 2 {
-		fmt.Println("Usage: go run main.go <filename>")
+	if len(os.Args) > 1 && os.Args[1] == "selftest" {
+		code := runSelfTest(os.Args[2:])
+		pool.close()
+		os.Exit(code)
+	}
+	opts, err := parseFlags(os.Args[1:])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
 		os.Exit(1)
 	}
-	fileName := os.Args[1]
-	_, err := countUniqueIpInFile(fileName)
+	if opts.format != formatText || opts.progress != nil || opts.logFormat != logPlain {
+		diag = os.Stderr
+	}
+	if opts.logFormat != logPlain || opts.logLevel != slog.LevelInfo {
+		diag = newLogWriter(newLogHandler(opts.logFormat, opts.logLevel, diag))
+	}
+	pool.pin = opts.pinCPUs
+	if opts.explain {
+		if err := explainPlan(os.Stdout, opts); err != nil {
+			fmt.Fprintln(os.Stderr, "Error:", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	var res Result
+	fileName := opts.path
+	stat, err := os.Stat(fileName)
+	if opts.merge {
+		res, err = mergeBitSetFiles(opts.paths, opts.out, opts.verifyCount, opts.noCount)
+	} else if opts.intersect {
+		res, err = countIntersection(opts.paths, opts)
+	} else if opts.pcap && err == nil && stat.IsDir() {
+		err = errors.New("--pcap requires a single capture file")
+	} else if opts.pcap {
+		res, err = countUniqueIpInPcap(fileName, opts)
+	} else if err == nil && stat.IsDir() {
+		res, err = countUniqueIpInDir(fileName, opts)
+	} else if opts.newPerFile {
+		err = errors.New("--new-per-file requires a directory")
+	} else {
+		res, err = countUniqueIpInFile(fileName, opts)
+	}
+	if il := opts.invalid; il != nil {
+		if cerr := il.close(); cerr != nil && err == nil {
+			err = fmt.Errorf("error writing %s: %w", opts.invalidOut, cerr)
+		} else if cerr == nil {
+			fmt.Fprintf(diag, "%d invalid line(s) written to %s\n", il.lines, opts.invalidOut)
+		}
+	}
+	res.Status = statusOf(res, err)
+	switch res.Status {
+	case StatusEmpty, StatusNoIPs:
+		// Not a failure: the input was read successfully but contains no addresses.
+		fmt.Fprintln(diag, "Warning:", err)
+	case StatusError:
+		fmt.Fprintln(diag, "Error:", err)
+		// Machine-readable output still reports the failure on stdout.
+		res.Error = err.Error()
+		if opts.progress != nil {
+			writeFinalStats(os.Stdout, res)
+		} else if opts.format == formatJSON || opts.format == formatMsgpack {
+			writeResult(os.Stdout, opts.format, res)
+		}
+		os.Exit(1)
+	}
+	pool.close()
+	if opts.progress != nil {
+		err = writeFinalStats(os.Stdout, res)
+	} else if opts.textfile != "" {
+		err = writeFileAtomic(opts.textfile, func(w io.Writer) error {
+			return writeResult(w, opts.format, res)
+		})
+	} else {
+		err = writeResult(os.Stdout, opts.format, res)
+	}
 	if err != nil {
-		fmt.Println("Error:", err)
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		os.Exit(1)
+	}
+	// With --contains, the exit status answers the question.
+	if res.Contains != nil && !*res.Contains {
 		os.Exit(1)
 	}
 }
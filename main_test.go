@@ -0,0 +1,475 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// TestCountConcurrentRace counts a dense set with interimCount's atomic loads while
+// workers add a known set of addresses to it, as --atomic-interim does. Every interim
+// count must lie between the counts before and after it and never decrease. Under
+// `go test -race` it also checks that the counts do not race with Set.
+func TestCountConcurrentRace(t *testing.T) {
+	const workers, perWorker = 4, 1 << 16
+	set := NewRangeBitSet(ipRange{start: 10 << 24, end: 10<<24 | 1<<20 - 1})
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for w := range uint32(workers) {
+		go func() {
+			defer wg.Done()
+			for i := range uint32(perWorker) {
+				set.Set(10<<24 + i*workers + w)
+			}
+		}()
+	}
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	last := 0
+	for running := true; running; {
+		select {
+		case <-done:
+			running = false
+		default:
+		}
+		count := interimCount(&dispatchSet{IPSet: set}, true)
+		if count < last || count > workers*perWorker {
+			wg.Wait()
+			t.Fatalf("interim count %d after %d, expected a non-decreasing count of at most %d", count, last, workers*perWorker)
+		}
+		last = count
+	}
+	if got := interimCount(set, true); got != workers*perWorker || set.Count() != got {
+		t.Errorf("counted %d atomically and %d after adding, expected %d", got, set.Count(), workers*perWorker)
+	}
+}
+
+// TestMinRecordLen counts addresses of every length from 7 to 15 bytes, each after short
+// and empty lines, with every --min-record-len from 1 to 15, on the plain and the record
+// path: the skip after a newline must never pass over the start of an address.
+func TestMinRecordLen(t *testing.T) {
+	var data strings.Builder
+	want := 0
+	for _, ip := range []string{"1.2.3.4", "1.2.3.45", "1.2.34.56", "1.23.45.67", "12.34.56.78",
+		"12.34.56.789", "123.45.67.89", "123.145.67.89", "123.145.167.89", "123.145.167.189"} {
+		for junk := range 7 {
+			data.WriteString(strings.Repeat("#", junk) + "\n" + ip + "\n")
+		}
+		if _, ok := parseIPFast([]byte(ip)); ok {
+			want++
+		}
+	}
+	for n := 1; n <= MaxIPLen; n++ {
+		for _, opts := range []options{{minRecordLen: n}, {minRecordLen: n, stripPort: true}} {
+			for workers := 1; workers <= 3; workers++ {
+				set := NewSparseSet()
+				if err := processData([]byte(data.String()), set, workers, &opts); err != nil {
+					t.Fatal(err)
+				}
+				if set.Count() != want {
+					t.Errorf("--min-record-len %d, --strip-port %v, %d worker(s): counted %d, expected %d",
+						n, opts.stripPort, workers, set.Count(), want)
+				}
+			}
+		}
+	}
+}
+
+// TestChunkBoundaries places an address at every position around the split points of 2
+// and 3 workers, so that the unaligned boundaries fall before, inside and right after it,
+// and checks that it belongs to exactly one chunk and is counted once. It also checks
+// inputs shorter than the number of workers.
+func TestChunkBoundaries(t *testing.T) {
+	const target = "10.20.30.40\n"
+	padding := strings.Repeat("1.1.1.1\n", 50)
+	for workers := 2; workers <= 3; workers++ {
+		for before := 0; before < 2*len(target); before++ {
+			for after := 0; after < 2*len(target); after++ {
+				data := []byte(padding + strings.Repeat("#", before) + "\n" + target +
+					strings.Repeat("#", after) + "\n" + padding)
+				start := len(padding) + before + 1
+				end := start + len(target)
+				owners := 0
+				for _, c := range splitChunks(data, workers, false) {
+					if c.start < end && start < c.end {
+						owners++
+					}
+				}
+				set := NewSparseSet()
+				if err := processData(data, set, workers, &options{minRecordLen: MinIPLen}); err != nil {
+					t.Fatal(err)
+				}
+				if owners != 1 || set.Count() != 2 {
+					t.Fatalf("%d worker(s), address at offset %d of %d: in %d chunk(s), counted %d unique, expected 1 chunk and 2",
+						workers, start, len(data), owners, set.Count())
+				}
+			}
+		}
+	}
+	for _, data := range []string{"", "\n", "x\n", "1.2.3.4", "1.2.3.4\n"} {
+		set := NewSparseSet()
+		if err := processData([]byte(data), set, 16, &options{minRecordLen: MinIPLen}); err != nil {
+			t.Fatal(err)
+		}
+		if want := strings.Count(data, "."); set.Count() != want/3 {
+			t.Fatalf("%q with 16 workers: counted %d unique, expected %d", data, set.Count(), want/3)
+		}
+	}
+}
+
+// TestSetAll adds random addresses, clustered in a /16 and a few of them repeated, to one
+// bitset with Set and to another with SetAll, as given and sorted, and checks that both
+// hold the same addresses.
+func TestSetAll(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	ips := make([]uint32, 50_000)
+	for i := range ips {
+		ips[i] = 0xc0a80000 + uint32(rnd.Intn(1<<16))
+	}
+	ips = append(ips, ips[:100]...)
+	want := NewAtomicBitSet()
+	for _, ip := range ips {
+		want.Set(ip)
+	}
+	for _, sorted := range []bool{false, true} {
+		if sorted {
+			slices.Sort(ips)
+		}
+		got := NewAtomicBitSet()
+		got.SetAll(ips)
+		if got.Count() != want.Count() {
+			t.Fatalf("sorted %v: SetAll counted %d, Set %d", sorted, got.Count(), want.Count())
+		}
+		for _, ip := range ips {
+			if !got.IsSet(ip) {
+				t.Fatalf("sorted %v: %s not set by SetAll", sorted, formatIP(ip))
+			}
+		}
+	}
+}
+
+// TestUnionCount fills three bitsets of different sizes with overlapping random
+// addresses and checks that UnionCount returns the size of their union, and that the
+// counts of the sets themselves are unchanged.
+func TestUnionCount(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	sets := []*AtomicBitSet{newAtomicBitSetSize(1 << 24), newAtomicBitSetSize(1 << 20), newAtomicBitSetSize(1<<24 + 64*unionBlock*3 + 5)}
+	union := make(map[uint32]bool)
+	counts := make([]int, len(sets))
+	for i, bs := range sets {
+		size := uint64(len(bs.bits)) * BucketSize
+		for range 20_000 {
+			ip := uint32(rnd.Int63n(int64(size)))
+			bs.Set(ip)
+			union[ip] = true
+		}
+		counts[i] = bs.Count()
+	}
+	if got := UnionCount(sets...); got != len(union) {
+		t.Fatalf("UnionCount returned %d, expected %d", got, len(union))
+	}
+	for i, bs := range sets {
+		if bs.Count() != counts[i] {
+			t.Fatalf("set %d changed from %d to %d address(es)", i, counts[i], bs.Count())
+		}
+	}
+	if got := UnionCount(sets[1]); got != counts[1] {
+		t.Fatalf("UnionCount of one set returned %d, expected %d", got, counts[1])
+	}
+	if got := UnionCount(); got != 0 {
+		t.Fatalf("UnionCount of no sets returned %d", got)
+	}
+}
+
+// TestContention sets the bits of a few shared words from several goroutines with
+// CountRetries, as --count-contention does, and checks that every bit is set. How many
+// swaps are retried depends on the scheduling, so only a single writer's zero is checked.
+func TestContention(t *testing.T) {
+	const workers, words = 4, 4
+	single := newAtomicBitSetSize(words * BucketSize)
+	single.CountRetries()
+	for ip := range uint32(words * BucketSize) {
+		single.Set(ip)
+	}
+	if single.Retries() != 0 {
+		t.Fatalf("a single writer retried %d swap(s)", single.Retries())
+	}
+	bs := newAtomicBitSetSize(words * BucketSize)
+	bs.CountRetries()
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for w := range uint32(workers) {
+		go func() {
+			defer wg.Done()
+			for ip := w; ip < words*BucketSize; ip += workers {
+				bs.Set(ip)
+			}
+		}()
+	}
+	wg.Wait()
+	if got := bs.Count(); got != words*BucketSize {
+		t.Fatalf("%d worker(s) set %d bit(s), expected %d", workers, got, words*BucketSize)
+	}
+}
+
+// TestSetBatch processes clustered and scattered addresses on 4 workers with --set-batch,
+// including slot counts that are not a power of two, and checks that the bitset equals
+// the one of the direct path, word for word.
+func TestSetBatch(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	var data strings.Builder
+	for i := range 200_000 {
+		ip := 0x0a000000 + uint32(rnd.Intn(1<<12))
+		if i%3 == 0 {
+			ip = rnd.Uint32()
+		}
+		data.WriteString(formatIP(ip) + "\n")
+	}
+	want := NewAtomicBitSet()
+	if err := processData([]byte(data.String()), want, 4, &options{minRecordLen: MinIPLen}); err != nil {
+		t.Fatal(err)
+	}
+	got := NewAtomicBitSet()
+	for _, size := range []int{1, 3, 64, 1000} {
+		clear(got.bits)
+		if err := processData([]byte(data.String()), got, 4, &options{minRecordLen: MinIPLen, setBatch: size}); err != nil {
+			t.Fatal(err)
+		}
+		if !slices.Equal(got.bits, want.bits) {
+			t.Fatalf("--set-batch %d: %d address(es), %d directly", size, got.Count(), want.Count())
+		}
+	}
+}
+
+// benchLines returns lines of the addresses returned by next, at least size bytes in all.
+func benchLines(size int, next func() uint32) []byte {
+	var data []byte
+	for len(data) < size {
+		data = append(data, formatIP(next())...)
+		data = append(data, '\n')
+	}
+	return data
+}
+
+// BenchmarkAccumulators processes random addresses on one worker into the dense bitset
+// alone and with the accumulators of --levels, --cms and --distribution-stats added one
+// after another, to compare the cost of routing every address to them with the base count.
+func BenchmarkAccumulators(b *testing.B) {
+	rnd := rand.New(rand.NewSource(1))
+	data := benchLines(16<<20, rnd.Uint32)
+	bs := NewAtomicBitSet()
+	for _, args := range [][]string{
+		nil,
+		{"--levels", "24,16"},
+		{"--levels", "24,16", "--cms"},
+		{"--levels", "24,16", "--cms", "--distribution-stats"},
+	} {
+		name := "base"
+		if args != nil {
+			name = strings.Join(args, " ")
+		}
+		b.Run(name, func(b *testing.B) {
+			opts, err := parseFlags(append(args, "ips.txt"))
+			if err != nil {
+				b.Fatal(err)
+			}
+			var set IPSet = bs
+			if accs := opts.accumulators(); len(accs) > 0 {
+				set = &dispatchSet{IPSet: bs, accs: accs}
+			}
+			b.SetBytes(int64(len(data)))
+			for range b.N {
+				if err := processData(data, set, 1, opts); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkHugePages sets 1M random addresses in a dense bitset in normal memory and in
+// one backed by huge pages, which is skipped where huge pages cannot be mapped.
+func BenchmarkHugePages(b *testing.B) {
+	rnd := rand.New(rand.NewSource(1))
+	ips := make([]uint32, 1<<20)
+	for i := range ips {
+		ips[i] = rnd.Uint32()
+	}
+	// The huge pages are never unmapped, so they are mapped once for all runs.
+	var huge *AtomicBitSet
+	if words := hugePageWords(MaxIPv4 / BucketSize); words != nil {
+		huge = &AtomicBitSet{bits: words}
+	}
+	for _, bs := range []*AtomicBitSet{NewAtomicBitSet(), huge} {
+		b.Run(fmt.Sprintf("hugepages=%v", bs == huge), func(b *testing.B) {
+			if bs == nil {
+				b.Skip("huge pages are not available")
+			}
+			for range b.N {
+				for _, ip := range ips {
+					bs.Set(ip)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkScanWorkers processes random addresses into the dense bitset on 1 to 8 workers,
+// the scan phase that --workers sizes.
+func BenchmarkScanWorkers(b *testing.B) {
+	rnd := rand.New(rand.NewSource(1))
+	data := benchLines(16<<20, rnd.Uint32)
+	set := NewAtomicBitSet()
+	for _, workers := range []int{1, 2, 4, 8} {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			b.SetBytes(int64(len(data)))
+			for range b.N {
+				if err := processData(data, set, workers, &options{minRecordLen: MinIPLen}); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkCountWorkers counts a dense bitset of 1M random addresses with 1 to 8 count
+// workers, the count phase that --count-workers sizes, with the bitset's size as the bytes
+// processed.
+func BenchmarkCountWorkers(b *testing.B) {
+	rnd := rand.New(rand.NewSource(1))
+	bs := NewAtomicBitSet()
+	for range 1 << 20 {
+		bs.Set(rnd.Uint32())
+	}
+	for _, workers := range []int{1, 2, 4, 8} {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			bs.SetCountWorkers(workers)
+			b.SetBytes(int64(len(bs.bits) * 8))
+			for range b.N {
+				bs.Count()
+			}
+		})
+	}
+}
+
+// BenchmarkSkipRepeats processes about 15MB of random addresses, each repeated on 30
+// lines, sorted and shuffled, on one worker with and without --skip-repeats.
+func BenchmarkSkipRepeats(b *testing.B) {
+	rnd := rand.New(rand.NewSource(1))
+	ips := make([]uint32, 35_000)
+	for i := range ips {
+		ips[i] = rnd.Uint32()
+	}
+	slices.Sort(ips)
+	var lines []string
+	for _, ip := range ips {
+		for range 30 {
+			lines = append(lines, formatIP(ip)+"\n")
+		}
+	}
+	sorted := []byte(strings.Join(lines, ""))
+	rnd.Shuffle(len(lines), func(i, j int) { lines[i], lines[j] = lines[j], lines[i] })
+	shuffled := []byte(strings.Join(lines, ""))
+	set := NewAtomicBitSet()
+	for _, input := range []struct {
+		name string
+		data []byte
+	}{{"sorted", sorted}, {"shuffled", shuffled}} {
+		for _, repeats := range []bool{false, true} {
+			b.Run(fmt.Sprintf("%s/skip-repeats=%v", input.name, repeats), func(b *testing.B) {
+				b.SetBytes(int64(len(input.data)))
+				for range b.N {
+					if err := processData(input.data, set, 1, &options{minRecordLen: MinIPLen, skipRepeats: repeats}); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+	}
+}
+
+// BenchmarkPlainStores sets 1M random addresses in a dense bitset from one goroutine with
+// atomic and with plain stores, spread over all addresses and within one /16, whose words
+// stay in the CPU cache. The bitset is shared, so after the first run its words are in
+// memory and the page faults of a fresh bitset are not measured.
+func BenchmarkPlainStores(b *testing.B) {
+	rnd := rand.New(rand.NewSource(1))
+	ips := make([]uint32, 1<<20)
+	for i := range ips {
+		ips[i] = rnd.Uint32()
+	}
+	bs := NewAtomicBitSet()
+	for _, mask := range []uint32{0xffffffff, 0xffff} {
+		for _, plain := range []bool{false, true} {
+			b.Run(fmt.Sprintf("mask=%#x/plain-stores=%v", mask, plain), func(b *testing.B) {
+				bs.SetSingleWriter(plain)
+				for range b.N {
+					for _, ip := range ips {
+						bs.Set(ip & mask)
+					}
+				}
+			})
+		}
+	}
+}
+
+// BenchmarkSetAll adds 1M addresses of a /16, unsorted and sorted, and 1M addresses spread
+// over the whole space to a dense bitset with SetAll and with a Set per address.
+func BenchmarkSetAll(b *testing.B) {
+	rnd := rand.New(rand.NewSource(1))
+	clustered := make([]uint32, 1<<20)
+	spread := make([]uint32, 1<<20)
+	for i := range clustered {
+		clustered[i] = 0xc0a80000 + uint32(rnd.Intn(1<<16))
+		spread[i] = rnd.Uint32()
+	}
+	sorted := slices.Sorted(slices.Values(clustered))
+	bs := NewAtomicBitSet()
+	for _, input := range []struct {
+		name string
+		ips  []uint32
+	}{{"unsorted", clustered}, {"sorted", sorted}, {"spread", spread}} {
+		b.Run(input.name+"/SetAll", func(b *testing.B) {
+			for range b.N {
+				bs.SetAll(input.ips)
+			}
+		})
+		b.Run(input.name+"/Set", func(b *testing.B) {
+			for range b.N {
+				for _, ip := range input.ips {
+					bs.Set(ip)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkSetBatch processes 16MB of addresses of one /20 in random order and of random
+// addresses on 4 workers, directly and with --set-batch tables of 1024 and 16384 slots.
+func BenchmarkSetBatch(b *testing.B) {
+	rnd := rand.New(rand.NewSource(1))
+	clustered := benchLines(16<<20, func() uint32 { return 0x0a000000 + uint32(rnd.Intn(1<<12)) })
+	spread := benchLines(16<<20, rnd.Uint32)
+	set := NewAtomicBitSet()
+	for _, input := range []struct {
+		name string
+		data []byte
+	}{{"clustered", clustered}, {"spread", spread}} {
+		for _, size := range []int{0, 1024, 16384} {
+			b.Run(fmt.Sprintf("%s/set-batch=%d", input.name, size), func(b *testing.B) {
+				b.SetBytes(int64(len(input.data)))
+				for range b.N {
+					if err := processData(input.data, set, 4, &options{minRecordLen: MinIPLen, setBatch: size}); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"fmt"
+	"slices"
+	"sync"
+)
+
+// --- Malformed Record Report ---
+// maxMalformedTokens is the number of distinct malformed tokens tracked by
+// --canonical-errors. Once it is reached, further distinct tokens are only counted in
+// total, while the tracked ones keep being counted exactly.
+const maxMalformedTokens = 10000
+
+// malformedTokens counts the distinct malformed records seen by the workers.
+type malformedTokens struct {
+	mu        sync.Mutex
+	counts    map[string]int64
+	total     int64 // All malformed records.
+	untracked int64 // Occurrences of tokens first seen after the cap was reached.
+}
+
+// TokenCount is a malformed token and the number of records it occurred in.
+type TokenCount struct {
+	Token string `json:"token"`
+	Count int64  `json:"count"`
+}
+
+func newMalformedTokens() *malformedTokens {
+	return &malformedTokens{counts: make(map[string]int64)}
+}
+
+// canonicalToken returns the form a malformed record is counted under: without the
+// surrounding spaces, tabs and carriage returns, and truncated to maxReportedRecord bytes,
+// so that variants of the same malformation count together.
+func canonicalToken(record []byte) []byte {
+	token := bytes.Trim(record, " \t\r")
+	if len(token) > maxReportedRecord {
+		token = token[:maxReportedRecord]
+	}
+	return token
+}
+
+// add counts a malformed record.
+func (m *malformedTokens) add(record []byte) {
+	token := canonicalToken(record)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.total++
+	if _, ok := m.counts[string(token)]; ok {
+		m.counts[string(token)]++
+	} else if len(m.counts) < maxMalformedTokens {
+		m.counts[string(token)] = 1
+	} else {
+		m.untracked++
+	}
+}
+
+// top returns the n most common tokens, by descending count.
+func (m *malformedTokens) top(n int) []TokenCount {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	tokens := make([]TokenCount, 0, len(m.counts))
+	for token, count := range m.counts {
+		tokens = append(tokens, TokenCount{token, count})
+	}
+	slices.SortFunc(tokens, func(a, b TokenCount) int {
+		return cmp.Or(cmp.Compare(b.Count, a.Count), cmp.Compare(a.Token, b.Token))
+	})
+	return tokens[:min(n, len(tokens))]
+}
+
+// printMalformed reports the most common malformed tokens for --canonical-errors and
+// records them in res.
+func printMalformed(opts *options, res *Result) {
+	m := opts.malformed
+	if m == nil {
+		return
+	}
+	res.Malformed = m.top(opts.malformedTop)
+	fmt.Fprintf(diag, "Malformed records: %d, %d distinct token(s)\n", m.total, len(m.counts))
+	for _, t := range res.Malformed {
+		fmt.Fprintf(diag, "%10d  %q\n", t.Count, t.Token)
+	}
+	if m.untracked > 0 {
+		fmt.Fprintf(diag, "%d malformed record(s) with tokens first seen after %d distinct ones were not tracked\n",
+			m.untracked, maxMalformedTokens)
+	}
+}
@@ -0,0 +1,32 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd || solaris || windows
+
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/edsrzf/mmap-go"
+)
+
+// canMap reports whether files can be memory-mapped on this platform.
+const canMap = true
+
+// mmapFile memory-maps the whole file read-only, for mapInput. The mapping must be
+// released with unmapInput before the file is closed, which Windows requires for the
+// file handle to be released cleanly.
+func mmapFile(file *os.File, size int64) ([]byte, error) {
+	if size > maxMapSize {
+		return nil, errTooLargeToMap
+	}
+	return mmap.Map(file, mmap.RDONLY, 0)
+}
+
+// unmapInput releases a mapping created by mapInput. A failure is only reported,
+// as all data has been processed by then.
+func unmapInput(data []byte) {
+	m := mmap.MMap(data)
+	if err := m.Unmap(); err != nil {
+		fmt.Fprintf(diag, "Warning: unmap failed: %v\n", err)
+	}
+}
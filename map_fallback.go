@@ -0,0 +1,20 @@
+//go:build !(darwin || dragonfly || freebsd || linux || netbsd || openbsd || solaris || windows)
+
+package main
+
+import (
+	"errors"
+	"os"
+)
+
+// canMap reports whether files can be memory-mapped on this platform. Without mmap
+// support (e.g. js/wasm, wasip1, aix), files are always read in blocks with readBlocks.
+const canMap = false
+
+// mmapFile always fails, as memory mapping is not available on this platform.
+func mmapFile(file *os.File, size int64) ([]byte, error) {
+	return nil, errors.ErrUnsupported
+}
+
+// unmapInput does nothing, as mapInput never returns a mapping.
+func unmapInput(data []byte) {}
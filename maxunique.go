@@ -0,0 +1,99 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// --- Early Exit on Unique Count ---
+// errMaxUnique is returned by processData once the set provably holds more addresses than
+// --max-unique. It stops processing like an error, but the callers treat it as a result.
+var errMaxUnique = errors.New("maximum unique count exceeded")
+
+// uniqueLimit decides when to count the set for --max-unique. Counting a dense set scans
+// all of its 512MB, so the set is only counted once enough input has been processed that
+// it could hold more than the threshold: every address takes at least MinIPLen bytes and
+// a delimiter. After a count, the next one waits for enough further input to make up the
+// difference, and for at least an eighth more input, so the number of counts stays
+// logarithmic in the input size.
+type uniqueLimit struct {
+	threshold int64
+	atomic    bool // Count with interimCount's atomic loads (--atomic-interim).
+
+	mu        sync.Mutex
+	processed int64 // Bytes processed so far.
+	next      int64 // Processed bytes at which to count next.
+	exceeded  bool
+}
+
+// newUniqueLimit creates a limit that is exceeded once the set holds more than threshold addresses.
+func newUniqueLimit(threshold int64) *uniqueLimit {
+	return &uniqueLimit{threshold: threshold, next: threshold * (MinIPLen + 1)}
+}
+
+// done reports whether the limit has been exceeded, so that no further input needs processing.
+func (l *uniqueLimit) done() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.exceeded
+}
+
+// observe records that n more bytes were added to set and counts the set if due.
+// Counting while other goroutines Set bits, as in directory mode, still gives a lower
+// bound, since bits are never cleared, so exceeding the threshold is always certain.
+func (l *uniqueLimit) observe(n int, set IPSet) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.exceeded {
+		return errMaxUnique
+	}
+	if l.processed += int64(n); l.processed < l.next {
+		return nil
+	}
+	count := int64(interimCount(set, l.atomic))
+	if count > l.threshold {
+		l.exceeded = true
+		return errMaxUnique
+	}
+	l.next = l.processed + max((l.threshold-count)*(MinIPLen+1), l.processed/8)
+	return nil
+}
+
+// limitWindows calls fn for record-aligned windows of data and observes each of them
+// with l, stopping with errMaxUnique once the limit is exceeded. Without a limit, fn is
+// called once with all of data.
+func limitWindows(data []byte, l *uniqueLimit, set IPSet, whitespace bool, fn func(window []byte) error) error {
+	if l == nil {
+		return fn(data)
+	}
+	for base := 0; base < len(data); {
+		end := windowEnd(data, base, whitespace)
+		if err := fn(data[base:end]); err != nil {
+			return atOffset(err, int64(base))
+		}
+		if err := l.observe(end-base, set); err != nil {
+			return err
+		}
+		base = end
+	}
+	return nil
+}
+
+// ignoreMaxUnique returns err, or nil if it is errMaxUnique, for callers that report
+// the early stop as part of the result.
+func ignoreMaxUnique(err error) error {
+	if errors.Is(err, errMaxUnique) {
+		return nil
+	}
+	return err
+}
+
+// printMaxUnique reports whether processing stopped early because of --max-unique,
+// and if so records the threshold in res.
+func printMaxUnique(opts *options, res *Result) {
+	if opts.maxUnique != nil && opts.maxUnique.done() {
+		res.Exceeds = opts.maxUnique.threshold
+		fmt.Fprintf(diag, "Stopped once more than %d unique address(es) were found\n", opts.maxUnique.threshold)
+	}
+}
@@ -0,0 +1,87 @@
+//go:build linux
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// availableMemory returns the memory that can still be allocated without swapping: the
+// MemAvailable of /proc/meminfo, or less if the process's memory cgroup (v2 or v1) has a
+// limit closer to its usage. ok is false if neither can be read.
+func availableMemory() (avail int64, ok bool) {
+	if data, err := os.ReadFile("/proc/meminfo"); err == nil {
+		for _, line := range bytes.Split(data, []byte("\n")) {
+			if rest, found := bytes.CutPrefix(line, []byte("MemAvailable:")); found {
+				kb, err := strconv.ParseInt(strings.TrimSuffix(strings.TrimSpace(string(rest)), " kB"), 10, 64)
+				if err == nil {
+					avail, ok = kb<<10, true
+				}
+			}
+		}
+	}
+	if limit, usage, found := cgroupMemory(); found && (!ok || limit-usage < avail) {
+		avail, ok = max(0, limit-usage), true
+	}
+	return avail, ok
+}
+
+// cgroupMemory returns the memory limit and usage of the cgroup of the process, from
+// memory.max and memory.current with cgroup v2, or memory.limit_in_bytes and
+// memory.usage_in_bytes with v1. found is false if there is no limit or it cannot be read.
+func cgroupMemory() (limit, usage int64, found bool) {
+	f, err := os.Open("/proc/self/cgroup")
+	if err != nil {
+		return 0, 0, false
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		// Lines are hierarchy-ID:controllers:path; v2 has an empty controller list.
+		fields := strings.SplitN(sc.Text(), ":", 3)
+		if len(fields) != 3 {
+			continue
+		}
+		var dir, limitFile, usageFile string
+		switch {
+		case fields[1] == "":
+			dir, limitFile, usageFile = "/sys/fs/cgroup", "memory.max", "memory.current"
+		case strings.Contains(","+fields[1]+",", ",memory,"):
+			dir, limitFile, usageFile = "/sys/fs/cgroup/memory", "memory.limit_in_bytes", "memory.usage_in_bytes"
+		default:
+			continue
+		}
+		// Inside a container the cgroup is often mounted as the root, so try that too.
+		for _, d := range []string{filepath.Join(dir, fields[2]), dir} {
+			limit, err1 := readCgroupValue(filepath.Join(d, limitFile))
+			usage, err2 := readCgroupValue(filepath.Join(d, usageFile))
+			if err1 == nil && err2 == nil {
+				// v1 reports no limit as a huge value and v2 as "max", read as -1.
+				if limit < 0 || limit >= 1<<62 {
+					break
+				}
+				return limit, usage, true
+			}
+		}
+	}
+	return 0, 0, false
+}
+
+// readCgroupValue reads a cgroup memory file holding a byte count, or "max" for none,
+// returned as -1.
+func readCgroupValue(name string) (int64, error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return 0, err
+	}
+	s := strings.TrimSpace(string(data))
+	if s == "max" {
+		return -1, nil
+	}
+	return strconv.ParseInt(s, 10, 64)
+}
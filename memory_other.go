@@ -0,0 +1,8 @@
+//go:build !linux
+
+package main
+
+// availableMemory is not supported on this platform.
+func availableMemory() (avail int64, ok bool) {
+	return 0, false
+}
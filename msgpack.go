@@ -0,0 +1,231 @@
+package main
+
+import (
+	"encoding/binary"
+	"io"
+	"math"
+	"slices"
+)
+
+// --- MessagePack Output ---
+// The MessagePack form of a Result is a map with the same keys as its JSON form, in the
+// same order, with the same fields omitted when empty. Integers use the smallest
+// MessagePack integer type that holds them. The schema only grows: keys are never renamed
+// or removed, and new keys are added at the end of their level.
+
+// msgpackWriter appends MessagePack-encoded values to a buffer.
+type msgpackWriter struct {
+	buf []byte
+}
+
+func (m *msgpackWriter) header(fix, fixMax byte, code8, code16, code32 byte, n int) {
+	switch {
+	case n <= int(fixMax):
+		m.buf = append(m.buf, fix|byte(n))
+	case code8 != 0 && n <= math.MaxUint8:
+		m.buf = append(m.buf, code8, byte(n))
+	case n <= math.MaxUint16:
+		m.buf = binary.BigEndian.AppendUint16(append(m.buf, code16), uint16(n))
+	default:
+		m.buf = binary.BigEndian.AppendUint32(append(m.buf, code32), uint32(n))
+	}
+}
+
+func (m *msgpackWriter) mapLen(n int)   { m.header(0x80, 15, 0, 0xde, 0xdf, n) }
+func (m *msgpackWriter) arrayLen(n int) { m.header(0x90, 15, 0, 0xdc, 0xdd, n) }
+
+func (m *msgpackWriter) str(s string) {
+	m.header(0xa0, 31, 0xd9, 0xda, 0xdb, len(s))
+	m.buf = append(m.buf, s...)
+}
+
+func (m *msgpackWriter) bool(b bool) {
+	if b {
+		m.buf = append(m.buf, 0xc3)
+	} else {
+		m.buf = append(m.buf, 0xc2)
+	}
+}
+
+func (m *msgpackWriter) float(v float64) {
+	m.buf = binary.BigEndian.AppendUint64(append(m.buf, 0xcb), math.Float64bits(v))
+}
+
+func (m *msgpackWriter) int(v int64) {
+	switch {
+	case v >= 0 && v <= 0x7f:
+		m.buf = append(m.buf, byte(v))
+	case v >= -32 && v < 0:
+		m.buf = append(m.buf, byte(v))
+	case v >= 0 && v <= math.MaxUint8:
+		m.buf = append(m.buf, 0xcc, byte(v))
+	case v >= 0 && v <= math.MaxUint16:
+		m.buf = binary.BigEndian.AppendUint16(append(m.buf, 0xcd), uint16(v))
+	case v >= 0 && v <= math.MaxUint32:
+		m.buf = binary.BigEndian.AppendUint32(append(m.buf, 0xce), uint32(v))
+	case v >= 0:
+		m.buf = binary.BigEndian.AppendUint64(append(m.buf, 0xcf), uint64(v))
+	case v >= math.MinInt8:
+		m.buf = append(m.buf, 0xd0, byte(v))
+	case v >= math.MinInt16:
+		m.buf = binary.BigEndian.AppendUint16(append(m.buf, 0xd1), uint16(v))
+	case v >= math.MinInt32:
+		m.buf = binary.BigEndian.AppendUint32(append(m.buf, 0xd2), uint32(v))
+	default:
+		m.buf = binary.BigEndian.AppendUint64(append(m.buf, 0xd3), uint64(v))
+	}
+}
+
+// msgpackField is a key of an encoded map and the function encoding its value.
+type msgpackField struct {
+	key string
+	put func()
+}
+
+func (m *msgpackWriter) fields(fields []msgpackField) {
+	m.mapLen(len(fields))
+	for _, f := range fields {
+		m.str(f.key)
+		f.put()
+	}
+}
+
+// result encodes res as a map with the keys of its JSON form.
+func (m *msgpackWriter) result(res Result) {
+	str := func(key, v string) msgpackField { return msgpackField{key, func() { m.str(v) }} }
+	num := func(key string, v int64) msgpackField { return msgpackField{key, func() { m.int(v) }} }
+
+	f := []msgpackField{str("status", string(res.Status))}
+	if res.Error != "" {
+		f = append(f, str("error", res.Error))
+	}
+	f = append(f, str("path", res.Path), num("unique", int64(res.Unique)))
+	if res.Exceeds != 0 {
+		f = append(f, num("exceeds", res.Exceeds))
+	}
+	if res.Estimated {
+		f = append(f, msgpackField{"estimated", func() { m.bool(true) }})
+	}
+	if res.NotCounted {
+		f = append(f, msgpackField{"not_counted", func() { m.bool(true) }})
+	}
+	f = append(f, num("bytes", res.Bytes), num("duration_ms", res.DurationMs))
+	if res.Contains != nil {
+		f = append(f, msgpackField{"contains", func() { m.bool(*res.Contains) }})
+	}
+	if len(res.Levels) > 0 {
+		f = append(f, msgpackField{"levels", func() {
+			m.arrayLen(len(res.Levels))
+			for _, l := range res.Levels {
+				m.fields([]msgpackField{num("prefix", int64(l.Prefix)), num("unique", int64(l.Unique))})
+			}
+		}})
+	}
+	if len(res.Buckets) > 0 {
+		f = append(f, msgpackField{"buckets", func() {
+			m.arrayLen(len(res.Buckets))
+			for _, b := range res.Buckets {
+				m.fields([]msgpackField{str("start", b.Start), num("unique", int64(b.Unique))})
+			}
+		}})
+	}
+	if len(res.Queries) > 0 {
+		f = append(f, msgpackField{"queries", func() {
+			// Keys are sorted, so that equal results encode to equal bytes.
+			keys := make([]string, 0, len(res.Queries))
+			for k := range res.Queries {
+				keys = append(keys, k)
+			}
+			slices.Sort(keys)
+			m.mapLen(len(keys))
+			for _, k := range keys {
+				m.str(k)
+				m.bool(res.Queries[k])
+			}
+		}})
+	}
+	if res.ASNs != 0 {
+		f = append(f, num("asns", int64(res.ASNs)))
+	}
+	if res.ASNUnmatched != 0 {
+		f = append(f, num("asn_unmatched", int64(res.ASNUnmatched)))
+	}
+	if len(res.Countries) > 0 {
+		f = append(f, msgpackField{"countries", func() {
+			m.arrayLen(len(res.Countries))
+			for _, c := range res.Countries {
+				m.fields([]msgpackField{str("country", c.Country), num("unique", int64(c.Unique))})
+			}
+		}})
+	}
+	if res.GeoUnmatched != 0 {
+		f = append(f, num("geo_unmatched", int64(res.GeoUnmatched)))
+	}
+	if len(res.Malformed) > 0 {
+		f = append(f, msgpackField{"malformed", func() {
+			m.arrayLen(len(res.Malformed))
+			for _, t := range res.Malformed {
+				m.fields([]msgpackField{str("token", t.Token), num("count", t.Count)})
+			}
+		}})
+	}
+	if d := res.Distribution; d != nil {
+		float := func(key string, v float64) msgpackField { return msgpackField{key, func() { m.float(v) }} }
+		f = append(f, msgpackField{"distribution", func() {
+			m.fields([]msgpackField{
+				num("records", d.Records), float("gini", d.Gini),
+				float("top1_share", d.Top1Share), float("top10_share", d.Top10Share),
+				float("entropy_bits", d.EntropyBits), float("normalized_entropy", d.NormalizedEntropy),
+			})
+		}})
+	}
+	if res.Roaming != 0 {
+		f = append(f, num("roaming", int64(res.Roaming)))
+	}
+	if res.Sources != 0 {
+		f = append(f, num("sources", int64(res.Sources)))
+	}
+	if res.Destinations != 0 {
+		f = append(f, num("destinations", int64(res.Destinations)))
+	}
+	if len(res.NewPerFile) > 0 {
+		f = append(f, msgpackField{"new_per_file", func() {
+			m.arrayLen(len(res.NewPerFile))
+			for _, fn := range res.NewPerFile {
+				m.fields([]msgpackField{str("path", fn.Path), num("new", fn.New)})
+			}
+		}})
+	}
+	if res.Excluded != 0 {
+		f = append(f, num("excluded", res.Excluded))
+	}
+	if res.Sessions != 0 {
+		f = append(f, num("sessions", res.Sessions))
+	}
+	if res.Overlong != 0 {
+		f = append(f, num("overlong", res.Overlong))
+	}
+	if res.Total != 0 {
+		f = append(f, num("total", res.Total))
+	}
+	if res.Skipped != 0 {
+		f = append(f, num("skipped", res.Skipped))
+	}
+	if len(res.Files) > 0 {
+		f = append(f, msgpackField{"files", func() {
+			m.arrayLen(len(res.Files))
+			for _, r := range res.Files {
+				m.result(r)
+			}
+		}})
+	}
+	m.fields(f)
+}
+
+// writeMsgpack writes res to w as a single MessagePack map.
+func writeMsgpack(w io.Writer, res Result) error {
+	var m msgpackWriter
+	m.result(res)
+	_, err := w.Write(m.buf)
+	return err
+}
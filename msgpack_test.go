@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"testing"
+)
+
+// errMsgpackShort is returned by decodeMsgpack for truncated input.
+var errMsgpackShort = errors.New("msgpack: unexpected end of data")
+
+// decodeMsgpack decodes the MessagePack value at the start of b, as written by
+// msgpackWriter, into the generic form encoding/json decodes to: maps to map[string]any,
+// arrays to []any, integers to float64. Returns the value and the remaining bytes.
+func decodeMsgpack(b []byte) (any, []byte, error) {
+	if len(b) == 0 {
+		return nil, b, errMsgpackShort
+	}
+	c, b := b[0], b[1:]
+	// length reads a big-endian length or integer of size bytes.
+	length := func(size int) (uint64, error) {
+		if len(b) < size {
+			return 0, errMsgpackShort
+		}
+		var v uint64
+		for _, x := range b[:size] {
+			v = v<<8 | uint64(x)
+		}
+		b = b[size:]
+		return v, nil
+	}
+	var n uint64
+	var err error
+	switch {
+	case c <= 0x7f:
+		return float64(c), b, nil
+	case c >= 0xe0:
+		return float64(int8(c)), b, nil
+	case c == 0xc0:
+		return nil, b, nil
+	case c == 0xc2, c == 0xc3:
+		return c == 0xc3, b, nil
+	case c == 0xcb:
+		n, err = length(8)
+		return math.Float64frombits(n), b, err
+	case c >= 0xcc && c <= 0xcf:
+		n, err = length(1 << (c - 0xcc))
+		return float64(n), b, err
+	case c >= 0xd0 && c <= 0xd3:
+		size := 1 << (c - 0xd0)
+		n, err = length(size)
+		shift := 64 - 8*size
+		return float64(int64(n<<shift) >> shift), b, err
+	case c&0xe0 == 0xa0, c >= 0xd9 && c <= 0xdb:
+		if n = uint64(c & 0x1f); c >= 0xd9 {
+			n, err = length(1 << (c - 0xd9))
+		}
+		if err == nil && uint64(len(b)) < n {
+			err = errMsgpackShort
+		}
+		if err != nil {
+			return nil, b, err
+		}
+		return string(b[:n]), b[n:], nil
+	case c&0xf0 == 0x90, c == 0xdc, c == 0xdd:
+		if n = uint64(c & 0x0f); c >= 0xdc {
+			n, err = length(2 << (c - 0xdc))
+		}
+		arr := []any{}
+		for i := uint64(0); err == nil && i < n; i++ {
+			var v any
+			if v, b, err = decodeMsgpack(b); err == nil {
+				arr = append(arr, v)
+			}
+		}
+		return arr, b, err
+	case c&0xf0 == 0x80, c == 0xde, c == 0xdf:
+		if n = uint64(c & 0x0f); c >= 0xde {
+			n, err = length(2 << (c - 0xde))
+		}
+		obj := map[string]any{}
+		for i := uint64(0); err == nil && i < n; i++ {
+			var k, v any
+			if k, b, err = decodeMsgpack(b); err != nil {
+				break
+			}
+			key, ok := k.(string)
+			if !ok {
+				return nil, b, fmt.Errorf("msgpack: map key %v is not a string", k)
+			}
+			if v, b, err = decodeMsgpack(b); err == nil {
+				obj[key] = v
+			}
+		}
+		return obj, b, err
+	}
+	return nil, b, fmt.Errorf("msgpack: unsupported type 0x%02x", c)
+}
+
+// TestMsgpackRoundTrip encodes a result of the self-test dataset with most fields set with
+// --format msgpack and json, decodes both into their generic form and checks that they are
+// equal, so the MessagePack form holds the same keys and values as the JSON form.
+func TestMsgpackRoundTrip(t *testing.T) {
+	path, _, _ := selfTestDataset(t)
+	res := countArgs(t, path, "--distribution-stats", "--levels", "24,16", "--query", "1.2.3.4,0.0.0.1", "--contains", "1.0.0.0/8")
+	res.Status = statusOf(res, nil)
+	var packed, encoded bytes.Buffer
+	if err := writeResult(&packed, formatMsgpack, res); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeResult(&encoded, formatJSON, res); err != nil {
+		t.Fatal(err)
+	}
+	got, rest, err := decodeMsgpack(packed.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rest) > 0 {
+		t.Fatalf("%d trailing byte(s) after the result", len(rest))
+	}
+	var want any
+	if err := json.Unmarshal(encoded.Bytes(), &want); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("decoded %v, expected %v", got, want)
+	}
+}
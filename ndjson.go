@@ -0,0 +1,59 @@
+package main
+
+import (
+	"bufio"
+	"os"
+	"strconv"
+)
+
+// --- NDJSON Dump ---
+// privateRanges are the private address blocks of RFC 1918.
+var privateRanges = []ipRange{
+	{start: 10 << 24, end: 10<<24 | 0xffffff},                   // 10.0.0.0/8
+	{start: 172<<24 | 16<<16, end: 172<<24 | 31<<16 | 0xffff},   // 172.16.0.0/12
+	{start: 192<<24 | 168<<16, end: 192<<24 | 168<<16 | 0xffff}, // 192.168.0.0/16
+}
+
+// isPrivate reports whether ip lies in a private block of RFC 1918.
+func isPrivate(ip uint32) bool {
+	for _, r := range privateRanges {
+		if ip >= r.start && ip <= r.end {
+			return true
+		}
+	}
+	return false
+}
+
+// appendNDJSONLine appends the JSON object describing ip, as in
+// {"ip":"1.2.3.4","int":16909060,"private":false,"octet1":1}, and a newline to b.
+func appendNDJSONLine(b []byte, ip uint32) []byte {
+	b = append(b, `{"ip":"`...)
+	b = appendIP(b, ip)
+	b = append(b, `","int":`...)
+	b = strconv.AppendUint(b, uint64(ip), 10)
+	b = append(b, `,"private":`...)
+	b = strconv.AppendBool(b, isPrivate(ip))
+	b = append(b, `,"octet1":`...)
+	b = strconv.AppendUint(b, uint64(ip>>24), 10)
+	return append(b, "}\n"...)
+}
+
+// writeDumpNDJSON writes one JSON object per address of set to the named file in the given
+// order, for --dump-ndjson, through a buffer as the set is walked.
+func writeDumpNDJSON(name string, set IPSet, order dumpOrder) error {
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	var line []byte
+	order.forEach(set, func(ip uint32) {
+		line = appendNDJSONLine(line[:0], ip)
+		w.Write(line)
+	})
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestDumpNDJSON writes a few known addresses, on both sides of the private blocks'
+// bounds, with --dump-ndjson and checks that each line decodes to the expected object,
+// with exactly the expected fields, in ascending order.
+func TestDumpNDJSON(t *testing.T) {
+	dir := t.TempDir()
+	type object struct {
+		IP      string `json:"ip"`
+		Int     uint32 `json:"int"`
+		Private bool   `json:"private"`
+		Octet1  int    `json:"octet1"`
+	}
+	want := []object{
+		{"0.0.0.0", 0, false, 0},
+		{"1.2.3.4", 16909060, false, 1},
+		{"10.0.0.0", 167772160, true, 10},
+		{"10.255.255.255", 184549375, true, 10},
+		{"11.0.0.0", 184549376, false, 11},
+		{"172.15.255.255", 2886729727, false, 172},
+		{"172.16.0.0", 2886729728, true, 172},
+		{"172.31.255.255", 2887778303, true, 172},
+		{"172.32.0.0", 2887778304, false, 172},
+		{"192.168.1.1", 3232235777, true, 192},
+		{"192.169.0.0", 3232301056, false, 192},
+		{"255.255.255.255", 4294967295, false, 255},
+	}
+	set := NewSparseSet()
+	for _, o := range want {
+		ip, _ := parseIPFast([]byte(o.IP))
+		set.Set(ip)
+	}
+	name := filepath.Join(dir, "dump.jsonl")
+	if err := writeDumpNDJSON(name, set, dumpOrder{order: orderAsc}); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+	if len(lines) != len(want) {
+		t.Fatalf("wrote %d line(s), expected %d", len(lines), len(want))
+	}
+	for i, line := range lines {
+		var fields map[string]any
+		if err := json.Unmarshal([]byte(line), &fields); err != nil || len(fields) != 4 {
+			t.Fatalf("line %q is not an object of 4 fields: %v", line, err)
+		}
+		var got object
+		if err := json.Unmarshal([]byte(line), &got); err != nil {
+			t.Fatal(err)
+		}
+		if got != want[i] {
+			t.Fatalf("line %d is %+v, expected %+v", i+1, got, want[i])
+		}
+	}
+}
@@ -0,0 +1,894 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"math"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// --- Command-Line Options ---
+// options holds the settings parsed from the command line.
+type options struct {
+	path            string     // Input file or directory.
+	paths           []string   // All positional arguments.
+	fileConcurrency int        // Maximum number of files open at once in directory mode.
+	newPerFile      bool       // Count the addresses each file adds to the union first, in directory mode.
+	singleThread    bool       // Process everything with a single worker.
+	autoWorkers     bool       // Choose the number of chunk workers by timing the start of the input.
+	workers         int        // Number of chunk workers for large files (0 = automatic).
+	threadsPerCore  float64    // Chunk workers per CPU (0 = the default of half a worker per CPU).
+	countWorkers    int        // Number of goroutines counting the dense bitset (0 = automatic).
+	bitSetType      string     // Set implementation: bitSetDense or bitSetSparse.
+	spillAbove      int64      // Spill a sparse set to disk above this many addresses (0 = never).
+	tmpDir          string     // Directory of scratch files such as spilled runs, empty for os.TempDir.
+	memoryBudget    int64      // Estimate with a HyperLogLog once a sparse set needs more bytes (0 = never).
+	hash            hashFunc   // Hash of the sparse set shards and the HyperLogLog.
+	hugePages       bool       // Back the dense bitset with huge pages where available.
+	pretouch        bool       // Check the available memory and fault in the dense bitset before reading.
+	safeMode        bool       // Recover from a panic of a chunk worker and return it as an error.
+	longLines       *longLines // Skips the over-long records of a stream with --max-line-length, nil if not given.
+	pinCPUs         bool       // Bind each worker to its own CPU where supported.
+	format          string     // Result output format: formatText, formatJSON, formatCSV, formatMsgpack or formatPrometheus.
+	textfile        string     // File to replace atomically with the prometheus result instead of stdout.
+	logFormat       string     // Diagnostics format: logPlain, logText or logJSON.
+	logLevel        slog.Level // Least level of the diagnostics written.
+	explain         bool       // Print the plan of the run instead of running it.
+	given           []string   // Flags set on the command line or from the environment, as --name=value.
+
+	headCount int64        // Stop after this many valid records (0 = no limit).
+	head      *headLimit   // Shared budget for headCount, nil if unlimited.
+	stats     *recordStats // Record counters of the current input, nil if not counted.
+	maxUnique *uniqueLimit // Stop once the set holds more addresses, nil if unlimited.
+
+	minRecordLen     int      // Minimum length of a record, used to skip bytes after a newline.
+	skipRepeats      bool     // Pass over lines identical to the line before them.
+	plainStores      bool     // Set bits without atomics when a single worker processes a file.
+	countContention  bool     // Set bits with compare-and-swap and count the retries.
+	setBatch         int      // Addresses each worker buffers before setting them in the dense bitset, 0 for none.
+	minValidRatio    float64  // Fail if a smaller share of the sampled lines is valid (0 = never).
+	validSample      int      // Bytes sampled for the format check (0 = sampleSize).
+	tolerantSpaces   bool     // Accept octets padded with spaces or tabs.
+	stripPort        bool     // Accept and ignore a trailing ":port" after the address.
+	extract          bool     // Count every whitespace-separated field that is an address.
+	whitespaceStream bool     // Records are separated by any whitespace, not only newlines.
+	textPrefixes     [][]byte // Only parse addresses starting with one of these, nil if not given.
+	strict           bool     // Fail on the first invalid line or input that does not look like IPv4 data.
+	jsonl            bool     // Input lines are JSON objects.
+	proxyProtocol    bool     // Count the source address of PROXY protocol header lines.
+	syslog           bool     // Input lines are RFC 5424 syslog messages.
+	syslogSDID       string   // SD-ID of the structured data element holding the address, empty for any.
+	syslogParam      string   // Name of the SD-PARAM holding the address.
+	srcKey, dstKey   string   // Prefixes of the fields holding the source and destination addresses, empty if not given.
+	pcap             bool     // The input is a pcap or pcapng packet capture.
+	pcapField        string   // Address of the IPv4 header counted with pcap: pcapFieldSrc, pcapFieldDst or pcapFieldBoth.
+	gunzip           bool     // The input file is gzip-compressed.
+	ipField          string   // Dotted path of the JSON field holding the address.
+
+	malformed    *malformedTokens // Counts the distinct malformed records, nil if not counted.
+	malformedTop int              // Number of most common malformed tokens to report.
+	invalidOut   string           // File to write the lines that are not valid records to.
+	invalid      *invalidLines    // Writes the invalid lines to invalidOut, nil if not written.
+
+	expandCIDR bool        // Count every address of the records that are CIDR blocks.
+	cidrMax    uint64      // Largest block --expand-cidr expands, in addresses.
+	cidr       *cidrBlocks // Expands and counts the CIDR blocks, nil if not expanded.
+
+	trackTimes  bool        // Track first/last seen timestamps per address.
+	timeColumns timeColumns // Field positions for timestamped input.
+	timesIPs    []uint32    // Addresses to report first/last seen for (all if empty).
+	parseTime   timeParser  // Parses the timestamp field in the --time-layout.
+
+	excludeTime *timeExclusion // Skips records in the --exclude-time range, nil if none.
+
+	roaming  *roamingTracker // Records the /24s each identifier was seen in, nil if not detected.
+	buckets  *timeBuckets    // Sets of the time buckets of --bucket, nil if not given.
+	sessions *ipSessions     // Sessions per address of --session-window, nil if not given.
+	flow     *flowCounts     // Sets of the source and destination addresses of --src-key and --dst-key, nil if not given.
+
+	subnets    []ipRange   // Only count addresses within these prefixes (all if empty).
+	exclude    *exclusions // Prefixes whose addresses are skipped, nil if none.
+	complement *ipRange    // Range to report seen/unseen address counts for.
+	contains   *ipRange    // Range to check for any seen address.
+	query      []uint32    // Addresses to report the presence of, nil if not given.
+	dumpBinary string      // File to write the serialized bitset to.
+	dump       string      // File to write the unique addresses to as text.
+	dumpNDJSON string      // File to write one JSON object per unique address to.
+	dumpAppend string      // Text dump to append the addresses it does not list yet to.
+	dumpCols   []string    // Columns of each line of the text dump.
+	dumpOrder  dumpOrder   // Order of the addresses in the text dump.
+
+	partitionBy  int    // Prefix length of the blocks the partitioned dump splits the addresses by.
+	partitionDir string // Directory to write one dump file per block to.
+
+	heatmap       string // PNG file to render the coverage of the address space to.
+	heatmapPrefix int    // Prefix length of the blocks the pixels of the heatmap stand for.
+
+	levels []prefixLevel // Prefix lengths to count unique prefixes of, nil if not given.
+	asns   rangeTable    // Prefix-to-ASN table to count unique ASNs with, nil if not given.
+	geo    *geoTable     // Address-to-country table for a country breakdown, nil if not given.
+
+	sketch      *CountMinSketch // Frequency sketch, nil unless --cms is given.
+	sketchQuery []uint32        // Addresses to report estimated frequencies for.
+	sketchTop   int             // Number of most frequent addresses to report.
+
+	counts *ipCounts // Per-address counts for --distribution-stats, nil if not given.
+
+	warmup       bool // Read the file into the page cache before timing.
+	dropCache    bool // Advise the kernel to drop the file's cached pages first.
+	cacheCompare bool // Time a cold run followed by a warm run.
+	rusage       bool // Report CPU time, page faults and I/O of the processing.
+
+	interval      time.Duration // Print interim unique counts this often (0 = never).
+	atomicInterim bool          // Read the set with atomic loads for interim counts.
+	rate          *rateLimiter  // Limits how fast input is consumed, nil if unlimited.
+	progress      *byteProgress // Counts the bytes processed for --json-stats-stream, nil if not streamed.
+
+	readBuffer  int    // Size of the blocks read when the input is not mapped (0 = default).
+	segmentSize int64  // Size of the fixed segments for chunks and manifest.
+	chunks      []int  // Indices of the segments to process, nil if not given.
+	manifest    string // File to write the segment manifest to.
+
+	byteRange *segment // Bytes of the file to process, before aligning to lines, nil if all.
+
+	follow       bool          // Keep processing data appended to the file.
+	pollInterval time.Duration // How often to check a followed file for growth.
+	stableFor    time.Duration // Stop following once the file has not grown for this long.
+
+	checkpoint         string        // File to save the offset and bitset of the run to, for --resume.
+	checkpointInterval time.Duration // Least time between two checkpoints.
+	resume             bool          // Continue from the checkpoint instead of the start of the file.
+
+	merge     bool   // Merge the serialized bitsets given as arguments.
+	intersect bool   // Count the addresses present in all the files given as arguments.
+	out       string // File to write the merged bitset to.
+
+	verifyCount bool // Check the count stored in each merged bitset against its payload.
+	noCount     bool // Skip the final count; only the serialized bitset is produced.
+}
+
+// parseFlags parses the command-line arguments into options.
+func parseFlags(args []string) (*options, error) {
+	opts := &options{}
+	var timesIPs, complement, contains, sketchQuery string
+	var useSketch bool
+	var sketchWidth, sketchDepth int
+
+	fs := flag.NewFlagSet("ipcounter", flag.ExitOnError)
+	fs.IntVar(&opts.fileConcurrency, "file-concurrency", defaultWorkers(), "maximum number of files open and mapped at once in directory mode")
+	fs.BoolVar(&opts.newPerFile, "new-per-file", false, "in directory mode, report how many addresses each file adds to the union that no file before it held")
+	fs.Func("workers", "number of chunk workers `N` for large files (default: half the CPUs)", func(s string) error {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 {
+			return errors.New("must be a positive integer")
+		}
+		opts.workers = n
+		return nil
+	})
+	fs.Func("threads-per-core", "number of chunk workers per CPU as a `factor`, e.g. 2.0 to oversubscribe I/O-bound input (default 0.5)", func(s string) error {
+		f, err := strconv.ParseFloat(s, 64)
+		if err != nil || !(f > 0) || math.IsInf(f, 1) {
+			return errors.New("must be a positive number")
+		}
+		opts.threadsPerCore = f
+		return nil
+	})
+	fs.Func("count-workers", "number of goroutines `N` counting the dense bitset after the scan (default: half the CPUs)", func(s string) error {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 {
+			return errors.New("must be a positive integer")
+		}
+		opts.countWorkers = n
+		return nil
+	})
+	opts.bitSetType = bitSetDense
+	fs.Func("bitset", "set implementation `type`: dense (fixed 512MB bitset) or sparse (hash set, for few unique addresses) (default dense)", choice(&opts.bitSetType, bitSetDense, bitSetSparse))
+	fs.Int64Var(&opts.spillAbove, "spill-above", 0, "with --bitset sparse, spill sorted runs to temporary files once `N` addresses are held in memory")
+	fs.StringVar(&opts.tmpDir, "tmpdir", "", "`directory` for scratch files such as the --spill-above runs (default $TMPDIR, or /tmp)")
+	var memoryBudget string
+	hashName, hashSeed := hashSplitmix, uint64(0)
+	fs.Func("hash", "with --bitset sparse, the `name` of the hash that shards the set and feeds --limit-unique-memory: splitmix, fnv, maphash or mult (default splitmix)", choice(&hashName, hashSplitmix, hashFNV, hashMaphash, hashMult))
+	fs.Uint64Var(&hashSeed, "hash-seed", 0, "seed mixed into the --hash function (not with maphash, whose seed is random per run)")
+	fs.StringVar(&memoryBudget, "limit-unique-memory", "", "with --bitset sparse, switch from exact counting to a HyperLogLog estimate once the set would need more than `size` (e.g. 256MiB)")
+	fs.BoolVar(&opts.pinCPUs, "pin-cpus", false, "lock each worker to an OS thread bound to its own CPU (Linux), for more stable benchmarks")
+	var maxLineLength int
+	fs.IntVar(&maxLineLength, "max-line-length", 0, "when reading a named pipe, skip records longer than this many `bytes` up to their newline and count them as invalid, instead of reading the pieces of a line longer than the read buffer as records")
+	fs.BoolVar(&opts.safeMode, "safe-mode", false, "recover from a panic of a worker, such as a parser bug, and fail with an error naming its chunk instead of crashing with a stack trace")
+	fs.BoolVar(&opts.pretouch, "pretouch", false, "before reading the input, check that the available memory holds the dense bitset and fault in all its pages, failing at startup instead of mid-scan")
+	fs.BoolVar(&opts.hugePages, "hugepages", false, "back the dense bitset with huge pages where available (Linux), falling back to normal memory")
+	opts.format = formatText
+	fs.Func("format", "result output `format`: text, json, csv, msgpack or prometheus (default text)", choice(&opts.format, formatText, formatJSON, formatCSV, formatMsgpack, formatPrometheus))
+	fs.StringVar(&opts.textfile, "textfile", "", "with --format prometheus, write the result to `file` through a temporary file and a rename instead of to stdout, for the node_exporter textfile collector")
+	opts.logFormat = logPlain
+	fs.Func("log-format", "diagnostics `format`: plain messages, or slog text or json records on stderr (default plain)", choice(&opts.logFormat, logPlain, logText, logJSON))
+	fs.Func("log-level", "least `level` of the diagnostics written: debug, info, warn or error (default info)", func(s string) error {
+		level, ok := logLevels[s]
+		if !ok {
+			return errors.New("must be one of debug, info, warn, error")
+		}
+		opts.logLevel = level
+		return nil
+	})
+	fs.BoolVar(&opts.singleThread, "single-thread", false, "process the input with a single worker")
+	fs.BoolVar(&opts.autoWorkers, "auto-workers", false, "choose the number of chunk workers by timing slices of the start of a mapped file with 1, 2, 4, ... workers (at most 2s)")
+	fs.Int64Var(&opts.headCount, "head", 0, "stop after `N` valid records (approximate with multiple workers)")
+	var maxUnique int64
+	fs.Int64Var(&maxUnique, "max-unique", 0, "stop early once more than `N` unique addresses are certain to be present, and report > N")
+	fs.IntVar(&opts.minRecordLen, "min-record-len", MinIPLen, "minimum record length in bytes; the scan for a line's end starts this far in, never past a newline")
+	fs.BoolVar(&opts.skipRepeats, "skip-repeats", false, "pass over lines that are byte-identical to the line before them without parsing them, for sorted input with many consecutive duplicates")
+	fs.BoolVar(&opts.plainStores, "plain-stores", false, "when a single worker processes a file, set the bits of the dense bitset with plain instead of atomic stores")
+	fs.IntVar(&opts.setBatch, "set-batch", 0, "collect the bits each worker sets in the dense bitset in a table of `N` slots indexed by the low bits of the word, applying each word's mask with one atomic OR when its slot is taken or the chunk ends (0 = off)")
+	fs.BoolVar(&opts.countContention, "count-contention", false, "set the bits of the dense bitset with compare-and-swap loops and report how often a swap had to be retried because another worker changed the same word (diagnostic, slower)")
+	fs.BoolVar(&opts.tolerantSpaces, "tolerant-spaces", false, "accept octets padded with spaces or tabs, e.g. \"1  .2  .3  .4 \" (slower)")
+	fs.BoolVar(&opts.stripPort, "strip-port", false, "accept addresses followed by a numeric port, e.g. 1.2.3.4:443, and ignore the port")
+	fs.Func("text-prefix", "only count addresses whose text starts with `prefix`, e.g. 10. (repeatable), skipping other lines before parsing", func(s string) error {
+		if s == "" {
+			return errors.New("must not be empty")
+		}
+		opts.textPrefixes = append(opts.textPrefixes, []byte(s))
+		return nil
+	})
+	fs.BoolVar(&opts.extract, "extract", false, "count every address among the fields of a line, separated by runs of spaces or tabs, instead of one address per line")
+	fs.BoolVar(&opts.whitespaceStream, "whitespace-stream", false, "treat every space, tab or newline as a record separator, for input with many addresses on one line")
+	fs.BoolVar(&opts.pcap, "pcap", false, "read the input as a pcap or pcapng packet capture and count the addresses of its IPv4 packets")
+	opts.pcapField = pcapFieldSrc
+	fs.Func("pcap-field", "address of each IPv4 packet counted with --pcap: `src`, dst or both (default src)", choice(&opts.pcapField, pcapFieldSrc, pcapFieldDst, pcapFieldBoth))
+	fs.BoolVar(&opts.proxyProtocol, "proxy-protocol", false, "count the source address of PROXY protocol (v1) header lines such as \"PROXY TCP4 1.2.3.4 5.6.7.8 1234 443\"; other lines are parsed as addresses")
+	fs.BoolVar(&opts.syslog, "syslog", false, "input lines are RFC 5424 syslog messages; count the address in the --syslog-param of their structured data")
+	fs.StringVar(&opts.syslogSDID, "syslog-sd-id", "origin", "SD-ID of the structured data `element` holding the address with --syslog, such as exampleSDID@32473; empty for any element")
+	fs.StringVar(&opts.syslogParam, "syslog-param", "ip", "`name` of the structured data parameter holding the address with --syslog")
+	fs.StringVar(&opts.srcKey, "src-key", "", "count the address after the `prefix`, such as src=, of the fields of each line as its source, alongside --dst-key; the unique count is the union of both")
+	fs.StringVar(&opts.dstKey, "dst-key", "", "count the address after the `prefix`, such as dst=, of the fields of each line as its destination, alongside --src-key")
+	fs.BoolVar(&opts.gunzip, "gunzip", false, "decompress a gzip input file, decoding concatenated members in parallel")
+	fs.BoolVar(&opts.jsonl, "jsonl", false, "input lines are JSON objects; count the address in --ip-field")
+	fs.StringVar(&opts.ipField, "ip-field", "ip", "JSON `field` holding the address; use dots for nested objects, e.g. request.client_ip")
+	fs.BoolVar(&opts.expandCIDR, "expand-cidr", false, "count every address of a record in CIDR notation, such as 10.0.0.0/24")
+	fs.Uint64Var(&opts.cidrMax, "expand-cidr-max", DefaultExpandCIDRMax, "skip CIDR blocks of more than `N` addresses with --expand-cidr")
+	fs.StringVar(&opts.invalidOut, "invalid-out", "", "write every non-empty line that is not a valid record to `file`, verbatim, instead of only skipping it")
+	fs.IntVar(&opts.malformedTop, "canonical-errors", 0, "report the `N` most common distinct malformed records, trimmed and truncated to 64 bytes (at most 10000 distinct ones are tracked)")
+	fs.Float64Var(&opts.minValidRatio, "min-valid-ratio", 0, "fail before the full scan if less than this `ratio` of the sampled lines at the start of the input are valid records, e.g. 0.9")
+	validSample := "64KiB"
+	fs.StringVar(&validSample, "valid-sample", validSample, "`size` of the start of the input sampled for --min-valid-ratio and the format check")
+	fs.BoolVar(&opts.strict, "strict", false, "fail on the first non-empty line that is not a valid record, and when the input does not look like IPv4 data")
+	fs.BoolVar(&opts.trackTimes, "track-times", false, "track first/last seen timestamps per address (input lines: timestamp ip)")
+	fs.IntVar(&opts.timeColumns.time, "time-column", 0, "zero-based whitespace-separated field holding the timestamp, in --time-layout")
+	fs.IntVar(&opts.timeColumns.ip, "ip-column", 1, "zero-based whitespace-separated field holding the IPv4 address (with --track-times)")
+	timeLayout := timeLayoutEpoch
+	fs.StringVar(&timeLayout, "time-layout", timeLayout, "`layout` of the timestamp field: epoch for integer seconds, or a Go time layout such as 2006-01-02T15:04:05Z07:00")
+	var excludeTime string
+	fs.StringVar(&excludeTime, "exclude-time", "", "with --track-times, skip the records with a timestamp in the inclusive `START..END` range, given in --time-layout")
+	var detectRoaming, roamingList bool
+	roamingColumn := -1
+	fs.BoolVar(&detectRoaming, "detect-roaming", false, "with --track-times, count the identifiers in --roaming-column seen with addresses of more than one /24")
+	fs.IntVar(&roamingColumn, "roaming-column", roamingColumn, "zero-based whitespace-separated field holding the identifier, such as a user or device ID, for --detect-roaming")
+	fs.BoolVar(&roamingList, "roaming-list", false, "list every identifier --detect-roaming finds with the /24 prefixes it was seen in")
+	var bucket, timezone string
+	fs.StringVar(&bucket, "bucket", "", "with --track-times, also count the unique addresses of every time bucket of this `width`, such as 1h or 1d, aligned to --timezone")
+	fs.StringVar(&timezone, "timezone", "", "time zone `name` of the --bucket bounds, such as America/New_York or Local (default UTC)")
+	var sessionWindow time.Duration
+	fs.DurationVar(&sessionWindow, "session-window", 0, "with --track-times, count the sessions of each address: a record more than this `duration`, such as 300s, after the previous one of its address begins a new session")
+	fs.StringVar(&timesIPs, "times-ips", "", "comma-separated addresses to report first/last seen for (default: all)")
+	fs.StringVar(&complement, "complement", "", "report how many addresses in this CIDR range were seen and not seen")
+	fs.BoolVar(&opts.warmup, "warmup", false, "read the file once into the page cache before timing")
+	fs.BoolVar(&opts.dropCache, "drop-cache", false, "advise the kernel to drop the file's cached pages before processing (Linux)")
+	fs.BoolVar(&opts.explain, "explain", false, "print how the input would be read and counted, with the workers, set and estimated memory, then exit without processing")
+	fs.BoolVar(&opts.rusage, "rusage", false, "report CPU time, page faults and block reads of the processing, from getrusage (Unix)")
+	fs.BoolVar(&opts.cacheCompare, "cache-compare", false, "drop the page cache, then report cold and warm processing times")
+	fs.Func("rate", "limit how fast input is consumed, in `bytes/s`, e.g. 200MiB/s", func(s string) error {
+		limit, err := parseRate(s)
+		if err != nil {
+			return err
+		}
+		opts.rate = newRateLimiter(limit)
+		return nil
+	})
+	fs.DurationVar(&opts.interval, "interval", 0, "print the running unique count this often while processing, e.g. 10s")
+	fs.BoolVar(&opts.atomicInterim, "atomic-interim", false, "take the --interval and --max-unique counts of a dense set with atomic loads, which is slightly slower but free of data races, e.g. under the race detector")
+	var statsStream bool
+	fs.BoolVar(&statsStream, "json-stats-stream", false, "write a JSON progress object to stdout every --interval, one per line, and a last one marked \"final\":true with the exact count, instead of the result")
+	readBuffer := "4MiB"
+	fs.StringVar(&readBuffer, "read-buffer", readBuffer, "`size` of the blocks read from named pipes, compressed input and files that are not memory-mapped, at least 64KiB")
+	segmentSize := "256MiB"
+	fs.StringVar(&segmentSize, "segment-size", segmentSize, "`size` of the fixed, newline-aligned segments used by --chunks and --manifest")
+	fs.Func("chunks", "only process the segments with these comma-separated zero-based `indices`, e.g. 3,7,9", func(s string) error {
+		var err error
+		opts.chunks, err = parseIndexList(s)
+		return err
+	})
+	fs.StringVar(&opts.manifest, "manifest", "", "write the segment manifest (index, start and end offset) to `file`")
+	fs.Func("byte-range", "only process the lines starting within `START:LEN` bytes of the file, e.g. 1GiB:1GiB, to split it between machines and --merge their --dump-binary outputs", func(s string) error {
+		var err error
+		opts.byteRange, err = parseByteRange(s)
+		return err
+	})
+	fs.BoolVar(&opts.follow, "follow", false, "after reaching the end, keep processing appended data until the file stops growing")
+	fs.DurationVar(&opts.pollInterval, "poll-interval", 500*time.Millisecond, "how often to check a followed file for new data")
+	fs.DurationVar(&opts.stableFor, "stable-for", 5*time.Second, "stop following once the file has not grown for this long")
+	fs.StringVar(&opts.checkpoint, "checkpoint", "", "periodically save the offset reached and the bitset of the run to `file`, removed once the file is done")
+	fs.DurationVar(&opts.checkpointInterval, "checkpoint-interval", 5*time.Minute, "least time between two --checkpoint saves")
+	fs.BoolVar(&opts.resume, "resume", false, "continue the run saved in the --checkpoint file from its offset")
+	fs.Func("subnet", "only count addresses within this CIDR `prefix` (repeatable); a single prefix right-sizes the bitset", func(s string) error {
+		r, err := parseCIDR(s)
+		if err != nil {
+			return err
+		}
+		opts.subnets = append(opts.subnets, r)
+		return nil
+	})
+	var excluded []ipRange
+	fs.Func("exclude-subnet", "skip addresses within this CIDR `prefix` (repeatable)", func(s string) error {
+		r, err := parseCIDR(s)
+		if err != nil {
+			return err
+		}
+		excluded = append(excluded, r)
+		return nil
+	})
+	fs.Func("query", "report whether each of these comma-separated `addresses` was seen", func(s string) error {
+		var err error
+		opts.query, err = parseIPList(s)
+		return err
+	})
+	fs.StringVar(&contains, "contains", "", "check whether any address in this CIDR range was seen; exit status 1 if none")
+	fs.Func("asn-db", "also count the unique ASNs of the addresses, using the prefix-to-ASN table in `file` (lines: prefix asn)", func(s string) error {
+		var err error
+		opts.asns, err = loadASNTable(s)
+		return err
+	})
+	fs.Func("geo-db", "also count the unique addresses per country, using the address-to-country table in `file` (lines: prefix country, or start end country)", func(s string) error {
+		var err error
+		opts.geo, err = loadGeoTable(s)
+		return err
+	})
+	fs.Func("levels", "also count unique prefixes of these comma-separated `lengths` in the same pass, e.g. 32,24,16", func(s string) error {
+		var err error
+		opts.levels, err = parseLevels(s)
+		return err
+	})
+	fs.BoolFunc("distribution-stats", "report how skewed the records are over the addresses (Gini coefficient, top 1%/10% share, entropy), counting every address exactly (about 40 bytes per unique address)", func(string) error {
+		opts.counts = newIPCounts()
+		return nil
+	})
+	fs.BoolVar(&useSketch, "cms", false, "estimate per-address frequencies with a Count-Min sketch")
+	fs.IntVar(&sketchWidth, "cms-width", 1<<20, "counters per Count-Min sketch row (error bound is e/width of all records)")
+	fs.IntVar(&sketchDepth, "cms-depth", 4, "Count-Min sketch rows (error bound holds with probability 1-e^-depth)")
+	fs.StringVar(&sketchQuery, "cms-query", "", "comma-separated addresses to report estimated frequencies for (with --cms)")
+	fs.IntVar(&opts.sketchTop, "cms-top", 0, "report the `K` most frequent addresses by estimate (with --cms)")
+	fs.StringVar(&opts.dumpBinary, "dump-binary", "", "write the serialized bitset to `file`")
+	fs.StringVar(&opts.dump, "dump", "", "write the unique addresses to `file` in ascending order, one per line")
+	fs.StringVar(&opts.dumpNDJSON, "dump-ndjson", "", "write one JSON object per unique address, with its numeric value, RFC 1918 private flag and first octet, to `file`")
+	fs.StringVar(&opts.dumpAppend, "dump-append", "", "append the unique addresses not yet listed in `file` to it, keeping it a union without duplicates")
+	opts.dumpCols = []string{dumpColumnIP}
+	fs.Func("dump-columns", "comma-separated `columns` of each --dump and --dump-append line: ip, index (numeric value) and hex (default ip)", func(s string) error {
+		var err error
+		opts.dumpCols, err = parseDumpColumns(s)
+		return err
+	})
+	opts.dumpOrder.order = orderAsc
+	fs.Func("order", "`order` of the --dump and --dump-append addresses: asc, desc or shuffle (default asc)", choice(&opts.dumpOrder.order, orderAsc, orderDesc, orderShuffle))
+	fs.Int64Var(&opts.dumpOrder.seed, "order-seed", 1, "`seed` of the pseudo-random order of --order shuffle")
+	fs.BoolFunc("dump-annotated", "write --dump and --dump-append lines as ip,index, the same as --dump-columns ip,index", func(string) error {
+		opts.dumpCols = []string{dumpColumnIP, dumpColumnIndex}
+		return nil
+	})
+	fs.IntVar(&opts.partitionBy, "partition-by", 0, "with --partition-dir, write the unique addresses to one file per block of this prefix `length`, from 1 to 16, e.g. 8 for a file per first octet")
+	fs.StringVar(&opts.partitionDir, "partition-dir", "", "`directory` to write the --partition-by files to, named after their block, such as 10.0.0.0_8.txt")
+	fs.StringVar(&opts.heatmap, "heatmap", "", "render how densely each block of the address space is populated as a grayscale PNG image to `file`")
+	fs.IntVar(&opts.heatmapPrefix, "heatmap-prefix", 16, "prefix `length` of the block each --heatmap pixel stands for, even, from 2 to 24; /16 makes a 256x256 image")
+	fs.BoolVar(&opts.merge, "merge", false, "merge the serialized bitsets given as arguments instead of counting")
+	fs.BoolVar(&opts.intersect, "intersect", false, "count the addresses present in every one of the files given as arguments, e.g. --intersect a.txt b.txt")
+	fs.StringVar(&opts.out, "out", "", "write the merged bitset to `file` (with --merge)")
+	fs.BoolVar(&opts.noCount, "no-count", false, "skip the final count, for runs that only write --dump-binary or --merge --out")
+	fs.BoolVar(&opts.verifyCount, "verify-count", false, "check the address count stored in each merged bitset against its payload (with --merge)")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: go run main.go [flags] <filename|directory>")
+		fmt.Fprintln(fs.Output(), "       go run main.go --merge [--out file] <bitset>...")
+		fmt.Fprintln(fs.Output(), "       go run main.go --intersect [--dump file] <filename> <filename>...")
+		unwrapGiven(fs)
+		fs.PrintDefaults()
+	}
+	recordGiven(fs)
+	// Flags may appear before, between, or after the positional arguments.
+	for {
+		if err := fs.Parse(args); err != nil {
+			return nil, err
+		}
+		rest := fs.Args()
+		if len(rest) == 0 {
+			break
+		}
+		if consumed := len(args) - len(rest); consumed > 0 && args[consumed-1] == "--" {
+			opts.paths = append(opts.paths, rest...)
+			break
+		}
+		opts.paths = append(opts.paths, rest[0])
+		args = rest[1:]
+	}
+	if err := applyEnvFallbacks(fs); err != nil {
+		return nil, err
+	}
+	opts.given = givenFlags(fs)
+	// A single dense --subnet gets a bitset of the prefix only, whose words are not
+	// aligned to the blocks of the /26 to /31 levels.
+	allocLevels(opts.levels, opts.bitSetType == bitSetDense && len(opts.subnets) != 1)
+
+	// Get filename from command-line arguments.
+	if len(opts.paths) < 1 {
+		fs.Usage()
+		return nil, errors.New("missing input file or directory")
+	}
+	opts.path = opts.paths[0]
+	if (opts.out != "" || opts.verifyCount) && !opts.merge {
+		return nil, errors.New("--out and --verify-count require --merge")
+	}
+	if opts.intersect && len(opts.paths) < 2 {
+		return nil, errors.New("--intersect requires at least two files")
+	}
+
+	if opts.fileConcurrency < 1 {
+		return nil, errors.New("--file-concurrency must be at least 1")
+	}
+	if opts.interval < 0 {
+		return nil, errors.New("--interval must not be negative")
+	}
+	if opts.atomicInterim && opts.interval == 0 && maxUnique == 0 {
+		return nil, errors.New("--atomic-interim requires --interval or --max-unique")
+	}
+	if statsStream {
+		if opts.interval == 0 || opts.format != formatText {
+			return nil, errors.New("--json-stats-stream requires --interval and cannot be combined with --format")
+		}
+		opts.progress = &byteProgress{}
+	}
+	bufSize, err := parseSize(readBuffer)
+	if err != nil {
+		return nil, fmt.Errorf("--read-buffer: %w", err)
+	}
+	if bufSize < minReadBuffer || bufSize > 1<<30 {
+		return nil, errors.New("--read-buffer must be from 64KiB to 1GiB")
+	}
+	opts.readBuffer = int(bufSize)
+	sample, err := parseSize(validSample)
+	if err != nil {
+		return nil, fmt.Errorf("--valid-sample: %w", err)
+	}
+	if sample < 1 || sample > 1<<30 {
+		return nil, errors.New("--valid-sample must be from 1 byte to 1GiB")
+	}
+	opts.validSample = int(sample)
+	if opts.minValidRatio < 0 || opts.minValidRatio > 1 {
+		return nil, errors.New("--min-valid-ratio must be from 0 to 1")
+	}
+	if opts.minValidRatio > 0 && (opts.trackTimes || opts.pcap || opts.merge) {
+		return nil, errors.New("--min-valid-ratio cannot be combined with --track-times, --pcap or --merge, whose input is not sampled")
+	}
+	size, err := parseSize(segmentSize)
+	if err != nil {
+		return nil, fmt.Errorf("--segment-size: %w", err)
+	}
+	if opts.segmentSize = int64(size); opts.segmentSize < 1 {
+		return nil, errors.New("--segment-size must be at least 1 byte")
+	}
+	if opts.gunzip && (opts.follow || opts.cacheCompare || opts.segmented() || opts.trackTimes) {
+		return nil, errors.New("--gunzip cannot be combined with --follow, --cache-compare, --chunks, --manifest, --byte-range or --track-times")
+	}
+	if opts.segmented() && (opts.follow || opts.cacheCompare) {
+		return nil, errors.New("--chunks, --manifest and --byte-range cannot be combined with --follow or --cache-compare")
+	}
+	if opts.byteRange != nil && (opts.chunks != nil || opts.manifest != "") {
+		return nil, errors.New("--byte-range cannot be combined with --chunks or --manifest")
+	}
+	if opts.cacheCompare && opts.warmup {
+		return nil, errors.New("--cache-compare cannot be combined with --warmup")
+	}
+	if opts.follow {
+		if opts.trackTimes {
+			return nil, errors.New("--follow cannot be combined with --track-times")
+		}
+		if opts.pollInterval <= 0 || opts.stableFor <= 0 {
+			return nil, errors.New("--poll-interval and --stable-for must be positive")
+		}
+	}
+	if opts.strict && opts.trackTimes {
+		return nil, errors.New("--strict cannot be combined with --track-times")
+	}
+	if opts.extract && (opts.strict || opts.jsonl || opts.tolerantSpaces) {
+		return nil, errors.New("--extract cannot be combined with --strict, --jsonl or --tolerant-spaces")
+	}
+	if opts.malformedTop < 0 {
+		return nil, errors.New("--canonical-errors must not be negative")
+	}
+	if opts.malformedTop > 0 {
+		if opts.strict || opts.trackTimes {
+			return nil, errors.New("--canonical-errors cannot be combined with --strict or --track-times")
+		}
+		opts.malformed = newMalformedTokens()
+	}
+	if opts.textfile != "" && opts.format != formatPrometheus {
+		return nil, errors.New("--textfile requires --format prometheus")
+	}
+	if opts.invalidOut != "" && (opts.strict || opts.trackTimes || opts.merge) {
+		return nil, errors.New("--invalid-out cannot be combined with --strict, --track-times or --merge")
+	}
+	if opts.expandCIDR {
+		if opts.trackTimes {
+			return nil, errors.New("--expand-cidr cannot be combined with --track-times")
+		}
+		opts.cidr = &cidrBlocks{max: opts.cidrMax}
+	}
+	if opts.proxyProtocol && (opts.jsonl || opts.tolerantSpaces || opts.extract || opts.trackTimes) {
+		return nil, errors.New("--proxy-protocol cannot be combined with --jsonl, --tolerant-spaces, --extract or --track-times")
+	}
+	if opts.syslog && (opts.jsonl || opts.tolerantSpaces || opts.extract || opts.proxyProtocol || opts.whitespaceStream || opts.trackTimes) {
+		return nil, errors.New("--syslog cannot be combined with --jsonl, --tolerant-spaces, --extract, --proxy-protocol, --whitespace-stream or --track-times")
+	}
+	if opts.syslog && opts.syslogParam == "" {
+		return nil, errors.New("--syslog-param must not be empty")
+	}
+	if opts.whitespaceStream && (opts.jsonl || opts.tolerantSpaces || opts.proxyProtocol || opts.trackTimes || opts.follow || opts.gunzip || opts.segmented()) {
+		return nil, errors.New("--whitespace-stream cannot be combined with --jsonl, --tolerant-spaces, --proxy-protocol, --track-times, --follow, --gunzip, --chunks or --manifest")
+	}
+	if (opts.srcKey == "") != (opts.dstKey == "") {
+		return nil, errors.New("--src-key and --dst-key must be given together")
+	}
+	if opts.srcKey != "" && opts.srcKey == opts.dstKey {
+		return nil, errors.New("--src-key and --dst-key must differ")
+	}
+	if opts.srcKey != "" && (opts.jsonl || opts.syslog || opts.tolerantSpaces || opts.extract || opts.proxyProtocol || opts.expandCIDR || opts.whitespaceStream || opts.trackTimes || opts.merge || opts.intersect) {
+		return nil, errors.New("--src-key and --dst-key cannot be combined with --jsonl, --syslog, --tolerant-spaces, --extract, --proxy-protocol, --expand-cidr, --whitespace-stream, --track-times, --merge or --intersect")
+	}
+	if opts.jsonl && opts.tolerantSpaces {
+		return nil, errors.New("--jsonl cannot be combined with --tolerant-spaces")
+	}
+	if opts.tmpDir != "" {
+		if err := checkScratchDir(opts.tmpDir); err != nil {
+			return nil, err
+		}
+	}
+	if opts.spillAbove < 0 {
+		return nil, errors.New("--spill-above must not be negative")
+	}
+	if opts.spillAbove > 0 && opts.bitSetType != bitSetSparse {
+		return nil, errors.New("--spill-above requires --bitset sparse")
+	}
+	if opts.minRecordLen < 1 {
+		return nil, errors.New("--min-record-len must be at least 1")
+	}
+	if opts.headCount < 0 {
+		return nil, errors.New("--head must not be negative")
+	}
+	if opts.headCount > 0 {
+		if opts.trackTimes {
+			return nil, errors.New("--head cannot be combined with --track-times")
+		}
+		opts.head = newHeadLimit(opts.headCount)
+	}
+	if maxUnique < 0 {
+		return nil, errors.New("--max-unique must not be negative")
+	}
+	if maxUnique > 0 {
+		if opts.trackTimes || opts.cacheCompare {
+			return nil, errors.New("--max-unique cannot be combined with --track-times or --cache-compare")
+		}
+		opts.maxUnique = newUniqueLimit(maxUnique)
+		opts.maxUnique.atomic = opts.atomicInterim
+	}
+	if opts.timeColumns.time < 0 || opts.timeColumns.ip < 0 {
+		return nil, errors.New("--time-column and --ip-column must not be negative")
+	}
+	if opts.timeColumns.time == opts.timeColumns.ip {
+		return nil, errors.New("--time-column and --ip-column must differ")
+	}
+	opts.parseTime = newTimeParser(timeLayout)
+	if excludeTime != "" {
+		if !opts.trackTimes {
+			return nil, errors.New("--exclude-time requires --track-times")
+		}
+		if opts.excludeTime, err = parseTimeExclusion(excludeTime, opts.parseTime); err != nil {
+			return nil, err
+		}
+	}
+	if detectRoaming {
+		if !opts.trackTimes || roamingColumn < 0 {
+			return nil, errors.New("--detect-roaming requires --track-times and --roaming-column")
+		}
+		if roamingColumn == opts.timeColumns.time || roamingColumn == opts.timeColumns.ip {
+			return nil, errors.New("--roaming-column must differ from --time-column and --ip-column")
+		}
+		opts.roaming = newRoamingTracker(roamingColumn, roamingList)
+	} else if roamingColumn >= 0 || roamingList {
+		return nil, errors.New("--roaming-column and --roaming-list require --detect-roaming")
+	}
+	if bucket != "" {
+		if !opts.trackTimes {
+			return nil, errors.New("--bucket requires --track-times")
+		}
+		loc, err := time.LoadLocation(timezone)
+		if err != nil {
+			return nil, fmt.Errorf("--timezone: %w", err)
+		}
+		spec, err := parseBucket(bucket, loc)
+		if err != nil {
+			return nil, err
+		}
+		opts.buckets = newTimeBuckets(spec)
+	} else if timezone != "" {
+		return nil, errors.New("--timezone requires --bucket")
+	}
+	if sessionWindow != 0 {
+		if !opts.trackTimes {
+			return nil, errors.New("--session-window requires --track-times")
+		}
+		if sessionWindow < time.Second || sessionWindow%time.Second != 0 {
+			return nil, errors.New("--session-window must be a whole number of seconds, at least 1s")
+		}
+		opts.sessions = newIPSessions(int64(sessionWindow / time.Second))
+	}
+	if timesIPs != "" {
+		ips, err := parseIPList(timesIPs)
+		if err != nil {
+			return nil, fmt.Errorf("--times-ips: %w", err)
+		}
+		opts.timesIPs = ips
+	}
+	if complement != "" {
+		r, err := parseCIDR(complement)
+		if err != nil {
+			return nil, fmt.Errorf("--complement: %w", err)
+		}
+		opts.complement = &r
+	}
+	if contains != "" {
+		r, err := parseCIDR(contains)
+		if err != nil {
+			return nil, fmt.Errorf("--contains: %w", err)
+		}
+		opts.contains = &r
+	}
+	if len(excluded) > 0 {
+		opts.exclude = &exclusions{ranges: newRangeList(excluded)}
+	}
+	if useSketch {
+		if sketchWidth < 1 || sketchDepth < 1 {
+			return nil, errors.New("--cms-width and --cms-depth must be positive")
+		}
+		if opts.sketchTop < 0 {
+			return nil, errors.New("--cms-top must not be negative")
+		}
+		if sketchQuery != "" {
+			ips, err := parseIPList(sketchQuery)
+			if err != nil {
+				return nil, fmt.Errorf("--cms-query: %w", err)
+			}
+			opts.sketchQuery = ips
+		}
+		opts.sketch = NewCountMinSketch(sketchWidth, sketchDepth)
+	} else if sketchQuery != "" || opts.sketchTop != 0 {
+		return nil, errors.New("--cms-query and --cms-top require --cms")
+	}
+	if opts.noCount {
+		if opts.dumpBinary == "" && opts.out == "" {
+			return nil, errors.New("--no-count requires --dump-binary, or --out with --merge")
+		}
+		if opts.levels != nil || opts.format == formatCSV || opts.memoryBudget > 0 {
+			return nil, errors.New("--no-count cannot be combined with --levels, --format csv or --limit-unique-memory")
+		}
+	}
+	if opts.threadsPerCore > 0 && (opts.workers > 0 || opts.singleThread) {
+		return nil, errors.New("--threads-per-core cannot be combined with --workers or --single-thread")
+	}
+	if opts.autoWorkers && (opts.workers > 0 || opts.threadsPerCore > 0 || opts.singleThread || opts.trackTimes || opts.follow || opts.gunzip || opts.segmented() || opts.pcap) {
+		return nil, errors.New("--auto-workers cannot be combined with --workers, --threads-per-core, --single-thread, --track-times, --follow, --gunzip, --chunks, --manifest, --byte-range or --pcap")
+	}
+	if opts.skipRepeats && (opts.records() != nil || opts.trackTimes || opts.pcap || opts.format == formatCSV) {
+		return nil, errors.New("--skip-repeats only applies to plain address lines and cannot be combined with record options such as --jsonl, --extract, --strict or --head, nor with --track-times, --pcap or --format csv")
+	}
+	if opts.pcap && (opts.records() != nil || opts.trackTimes || opts.follow || opts.gunzip || opts.segmented() ||
+		opts.maxUnique != nil || opts.rate != nil || opts.format == formatCSV) {
+		return nil, errors.New("--pcap cannot be combined with options that parse text records or read the input in windows, such as --jsonl, --extract, --strict, --head, --max-unique, --rate, --track-times, --follow, --gunzip, --chunks or --format csv")
+	}
+	opts.hash = newHash(hashName, hashSeed)
+	if opts.srcKey != "" {
+		opts.flow = newFlowCounts(opts.srcKey, opts.dstKey, opts)
+	}
+	if opts.bitSetType != bitSetSparse && (hashName != hashSplitmix || hashSeed != 0) {
+		return nil, errors.New("--hash and --hash-seed require --bitset sparse")
+	}
+	if hashName == hashMaphash && hashSeed != 0 {
+		return nil, errors.New("--hash-seed cannot be combined with --hash maphash")
+	}
+	if memoryBudget != "" {
+		budget, err := parseSize(memoryBudget)
+		if err != nil {
+			return nil, fmt.Errorf("--limit-unique-memory: %w", err)
+		}
+		if opts.memoryBudget = int64(budget); opts.memoryBudget < sparseEntryBytes {
+			return nil, fmt.Errorf("--limit-unique-memory must be at least %d bytes", sparseEntryBytes)
+		}
+		if opts.bitSetType != bitSetSparse || opts.spillAbove > 0 {
+			return nil, errors.New("--limit-unique-memory requires --bitset sparse and cannot be combined with --spill-above")
+		}
+		if opts.complement != nil || opts.contains != nil || opts.query != nil || opts.asns != nil || opts.geo != nil || opts.sketch != nil ||
+			opts.dump != "" || opts.dumpNDJSON != "" || opts.dumpAppend != "" || opts.dumpBinary != "" || opts.format == formatCSV {
+			return nil, errors.New("--limit-unique-memory cannot be combined with options that look up addresses in the final set: --complement, --contains, --query, --asn-db, --geo-db, --cms, --dump, --dump-ndjson, --dump-append, --dump-binary or --format csv")
+		}
+	}
+	// A followed file may grow enough for more workers, and calibrating and decompressing
+	// use several.
+	if opts.plainStores && (opts.follow || opts.autoWorkers || opts.gunzip || opts.atomicInterim) {
+		return nil, errors.New("--plain-stores cannot be combined with --follow, --auto-workers, --gunzip or --atomic-interim")
+	}
+	if opts.pretouch && (opts.bitSetType != bitSetDense || opts.merge || opts.intersect) {
+		return nil, errors.New("--pretouch requires the dense bitset, and cannot be combined with --merge or --intersect")
+	}
+	if maxLineLength != 0 {
+		if opts.whitespaceStream {
+			return nil, errors.New("--max-line-length cannot be combined with --whitespace-stream, whose lines may hold any number of records")
+		}
+		if maxLineLength < MaxRecordLen || maxLineLength >= opts.readBufferSize() {
+			return nil, fmt.Errorf("--max-line-length must be from %d to less than the --read-buffer of %d bytes", MaxRecordLen, opts.readBufferSize())
+		}
+		opts.longLines = &longLines{max: maxLineLength, strict: opts.strict}
+	}
+	if opts.setBatch < 0 {
+		return nil, errors.New("--set-batch must not be negative")
+	}
+	if opts.setBatch > 0 && (opts.plainStores || opts.countContention) {
+		return nil, errors.New("--set-batch cannot be combined with --plain-stores or --count-contention, which change how each address is set")
+	}
+	// The batch sets the bits of the dense bitset directly, past any wrapper of the set.
+	if opts.setBatch > 0 && (opts.bitSetType != bitSetDense || len(opts.subnets) > 0 || opts.exclude != nil || len(opts.accumulators()) > 0 ||
+		opts.records() != nil || opts.trackTimes || opts.pcap) {
+		return nil, errors.New("--set-batch only applies to plain records counted in the full dense bitset, and cannot be combined with --bitset sparse, --subnet, --exclude-subnet, --track-times, --pcap, record options such as --jsonl, or per-address statistics such as --levels")
+	}
+	if opts.countContention && (opts.bitSetType != bitSetDense || opts.plainStores || opts.merge || opts.intersect || opts.pcap) {
+		return nil, errors.New("--count-contention requires the dense bitset, counts a single text file, and cannot be combined with --plain-stores")
+	}
+	if opts.intersect && (opts.merge || opts.newPerFile || opts.trackTimes || opts.follow || opts.gunzip || opts.segmented() || opts.pcap ||
+		opts.head != nil || opts.maxUnique != nil || opts.interval > 0 || opts.noCount || opts.format == formatCSV || opts.levels != nil || len(opts.accumulators()) > 0) {
+		return nil, errors.New("--intersect only counts and dumps addresses, and cannot be combined with other modes, --head, --max-unique, --interval, --no-count, --format csv or per-address statistics such as --levels")
+	}
+	if opts.newPerFile && (opts.merge || opts.spillAbove > 0 || opts.memoryBudget > 0) {
+		return nil, errors.New("--new-per-file cannot be combined with --merge, --spill-above or --limit-unique-memory")
+	}
+	if opts.heatmapPrefix < 2 || opts.heatmapPrefix > 24 || opts.heatmapPrefix%2 != 0 {
+		return nil, errors.New("--heatmap-prefix must be an even number from 2 to 24")
+	}
+	if (opts.partitionBy != 0) != (opts.partitionDir != "") {
+		return nil, errors.New("--partition-by and --partition-dir must be given together")
+	}
+	if opts.partitionDir != "" && (opts.partitionBy < 1 || opts.partitionBy > 16 || opts.merge) {
+		return nil, errors.New("--partition-by must be from 1 to 16, and cannot be combined with --merge")
+	}
+	if opts.heatmap != "" && opts.merge {
+		return nil, errors.New("--heatmap cannot be combined with --merge")
+	}
+	if opts.dumpNDJSON != "" && opts.merge {
+		return nil, errors.New("--dump-ndjson cannot be combined with --merge")
+	}
+	if opts.resume && opts.checkpoint == "" {
+		return nil, errors.New("--resume requires --checkpoint")
+	}
+	if opts.checkpoint != "" {
+		if opts.checkpointInterval <= 0 {
+			return nil, errors.New("--checkpoint-interval must be positive")
+		}
+		// Only the bitset is saved, so everything else a run accumulates would restart.
+		if opts.bitSetType != bitSetDense || opts.merge || opts.intersect || opts.follow || opts.gunzip || opts.segmented() ||
+			opts.autoWorkers || opts.pcap || opts.trackTimes || opts.head != nil || opts.maxUnique != nil || opts.format == formatCSV ||
+			opts.malformed != nil || opts.invalidOut != "" || opts.cidr != nil || len(opts.accumulators()) > 0 || opts.cacheCompare {
+			return nil, errors.New("--checkpoint only saves the dense bitset, and cannot be combined with other modes, --bitset sparse, --follow, --gunzip, --chunks, --byte-range, --auto-workers, --track-times, --head, --max-unique, --cache-compare, --format csv or per-record statistics such as --levels or --invalid-out")
+		}
+	}
+	if opts.invalidOut != "" && !opts.explain {
+		if opts.invalid, err = createInvalidLines(opts.invalidOut); err != nil {
+			return nil, fmt.Errorf("--invalid-out: %w", err)
+		}
+	}
+	return opts, nil
+}
+
+// envFallbacks lists the environment variables consulted for flags that were not given
+// on the command line. Flags always take precedence.
+var envFallbacks = []struct {
+	flag, env string
+}{
+	{"workers", "IPCOUNTER_WORKERS"},
+	{"threads-per-core", "IPCOUNTER_THREADS_PER_CORE"},
+	{"count-workers", "IPCOUNTER_COUNT_WORKERS"},
+	{"bitset", "IPCOUNTER_BITSET"},
+	{"format", "IPCOUNTER_FORMAT"},
+}
+
+// applyEnvFallbacks sets every flag in envFallbacks that was not given on the command
+// line from its environment variable, validating the value like the flag itself.
+func applyEnvFallbacks(fs *flag.FlagSet) error {
+	given := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { given[f.Name] = true })
+	for _, fb := range envFallbacks {
+		if given[fb.flag] {
+			continue
+		}
+		value, ok := os.LookupEnv(fb.env)
+		if !ok {
+			continue
+		}
+		if err := fs.Set(fb.flag, value); err != nil {
+			return fmt.Errorf("invalid value %q for %s: %w", value, fb.env, err)
+		}
+	}
+	return nil
+}
+
+// choice returns a flag setter that stores the value in p if it is one of choices.
+func choice(p *string, choices ...string) func(string) error {
+	return func(s string) error {
+		if !slices.Contains(choices, s) {
+			return fmt.Errorf("must be one of %s", strings.Join(choices, ", "))
+		}
+		*p = s
+		return nil
+	}
+}
+
+// sizeUnits maps the lower-cased byte unit suffixes accepted by parseSize to their size.
+var sizeUnits = map[string]float64{
+	"": 1, "b": 1,
+	"k": 1e3, "kb": 1e3, "kib": 1 << 10,
+	"m": 1e6, "mb": 1e6, "mib": 1 << 20,
+	"g": 1e9, "gb": 1e9, "gib": 1 << 30,
+}
+
+// parseSize parses a byte size such as "256MiB", "50MB" or "1048576".
+func parseSize(s string) (float64, error) {
+	s = strings.TrimSpace(s)
+	i := strings.IndexFunc(s, func(c rune) bool { return (c < '0' || c > '9') && c != '.' })
+	if i < 0 {
+		i = len(s)
+	}
+	num, err := strconv.ParseFloat(s[:i], 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	unit, ok := sizeUnits[strings.ToLower(strings.TrimSpace(s[i:]))]
+	if !ok {
+		return 0, fmt.Errorf("invalid size unit in %q", s)
+	}
+	return num * unit, nil
+}
+
+// parseIndexList parses a comma-separated list of non-negative indices, returning them
+// sorted and without duplicates.
+func parseIndexList(list string) ([]int, error) {
+	var indices []int
+	for _, s := range strings.Split(list, ",") {
+		s = strings.TrimSpace(s)
+		i, err := strconv.Atoi(s)
+		if err != nil || i < 0 {
+			return nil, fmt.Errorf("invalid index %q", s)
+		}
+		indices = append(indices, i)
+	}
+	slices.Sort(indices)
+	return slices.Compact(indices), nil
+}
+
+// parseIPList parses a comma-separated list of IPv4 addresses.
+func parseIPList(list string) ([]uint32, error) {
+	var ips []uint32
+	for _, s := range strings.Split(list, ",") {
+		s = strings.TrimSpace(s)
+		ip, ok := parseIPFast([]byte(s))
+		if !ok {
+			return nil, fmt.Errorf("invalid IPv4 address %q", s)
+		}
+		ips = append(ips, ip)
+	}
+	return ips, nil
+}
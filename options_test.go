@@ -0,0 +1,28 @@
+package main
+
+import "testing"
+
+// TestSetBatchWrappedSet checks that --set-batch is rejected with the options that wrap
+// the dense bitset or count other than plain records, whose addresses the batch would
+// otherwise set directly or not at all.
+func TestSetBatchWrappedSet(t *testing.T) {
+	for _, args := range [][]string{
+		{"--bitset", "sparse"},
+		{"--subnet", "10.0.0.0/8"},
+		{"--exclude-subnet", "10.0.0.0/8"},
+		{"--levels", "32,24"},
+		{"--jsonl"},
+		{"--extract"},
+		{"--track-times"},
+	} {
+		if _, err := parseFlags(append(args, "--set-batch", "64", "ips.txt")); err == nil {
+			t.Errorf("%v: --set-batch accepted", args)
+		}
+		if _, err := parseFlags(append(args, "ips.txt")); err != nil {
+			t.Errorf("%v: %v", args, err)
+		}
+	}
+	if _, err := parseFlags([]string{"--set-batch", "64", "ips.txt"}); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"time"
+)
+
+// --- Output ---
+// Supported values of --format.
+const (
+	formatText       = "text"
+	formatJSON       = "json"
+	formatCSV        = "csv"
+	formatMsgpack    = "msgpack"
+	formatPrometheus = "prometheus"
+)
+
+// diag receives progress and diagnostic messages. It is stdout for text output and
+// stderr for the machine-readable formats, so that stdout carries only the result.
+var diag io.Writer = os.Stdout
+
+// Status classifies the outcome of a run, so that a zero count can be told apart from
+// an empty input and from a failure.
+type Status string
+
+const (
+	StatusOK    Status = "ok"     // The input held at least one valid address.
+	StatusEmpty Status = "empty"  // The input held no data at all.
+	StatusNoIPs Status = "no_ips" // The input held data, but no valid address.
+	StatusError Status = "error"  // Counting failed; see Result.Error.
+)
+
+// statusOf returns the status of a run that produced res and err. A directory whose
+// files are all empty counts as empty input.
+func statusOf(res Result, err error) Status {
+	switch {
+	case errors.Is(err, ErrEmptyFile), errors.Is(err, ErrNoValidIPs) && res.Bytes == 0:
+		return StatusEmpty
+	case errors.Is(err, ErrNoValidIPs):
+		return StatusNoIPs
+	case err != nil:
+		return StatusError
+	}
+	return StatusOK
+}
+
+// Result is the outcome of counting the unique addresses of a file or directory.
+type Result struct {
+	Status     Status          `json:"status"`
+	Error      string          `json:"error,omitempty"` // Message of the failure, for StatusError.
+	Path       string          `json:"path"`
+	Unique     int             `json:"unique"`
+	Exceeds    int64           `json:"exceeds,omitempty"`     // The --max-unique threshold, if processing stopped once it was exceeded.
+	Estimated  bool            `json:"estimated,omitempty"`   // Unique is a HyperLogLog estimate, once over the --limit-unique-memory budget.
+	NotCounted bool            `json:"not_counted,omitempty"` // The set was not counted with --no-count, so Unique is 0.
+	Bytes      int64           `json:"bytes"`
+	DurationMs int64           `json:"duration_ms"`
+	Contains   *bool           `json:"contains,omitempty"` // Outcome of --contains, if given.
+	Levels     []LevelCount    `json:"levels,omitempty"`   // Unique counts per --levels prefix length.
+	Buckets    []BucketCount   `json:"buckets,omitempty"`  // Unique counts per --bucket time bucket.
+	Queries    map[string]bool `json:"queries,omitempty"`  // Presence of each --query address.
+
+	// Unique ASNs with --asn-db, and the unique addresses no prefix of the table covers.
+	ASNs         int `json:"asns,omitempty"`
+	ASNUnmatched int `json:"asn_unmatched,omitempty"`
+
+	// Unique addresses per country with --geo-db, and those not mapped to any country.
+	Countries    []CountryCount `json:"countries,omitempty"`
+	GeoUnmatched int            `json:"geo_unmatched,omitempty"`
+
+	Malformed    []TokenCount  `json:"malformed,omitempty"`    // Most common malformed records with --canonical-errors.
+	Distribution *Distribution `json:"distribution,omitempty"` // Skew of the records over the addresses with --distribution-stats.
+	Roaming      int           `json:"roaming,omitempty"`      // Identifiers seen in more than one /24 with --detect-roaming.
+	Sources      int           `json:"sources,omitempty"`      // Unique source addresses with --src-key; Unique is the union.
+	Destinations int           `json:"destinations,omitempty"` // Unique destination addresses with --dst-key.
+	NewPerFile   []FileNew     `json:"new_per_file,omitempty"` // Addresses each file added to the union first, with --new-per-file.
+	Excluded     int64         `json:"excluded,omitempty"`     // Records skipped for a timestamp in the --exclude-time range.
+	Sessions     int64         `json:"sessions,omitempty"`     // Sessions of all addresses with --session-window.
+	Overlong     int64         `json:"overlong,omitempty"`     // Records skipped for exceeding --max-line-length.
+
+	// Record counts and per-file results, only filled in for --format csv.
+	Total   int64    `json:"total,omitempty"`   // Non-empty lines.
+	Skipped int64    `json:"skipped,omitempty"` // Non-empty lines that were not valid records.
+	Files   []Result `json:"files,omitempty"`   // Per-file results in directory mode.
+}
+
+// FileNew is the number of addresses a file of directory mode added to the union that
+// no file processed before it held.
+type FileNew struct {
+	Path string `json:"path"`
+	New  int64  `json:"new"`
+}
+
+// writeResult writes res to w in the given format.
+func writeResult(w io.Writer, format string, res Result) error {
+	switch format {
+	case formatJSON:
+		return json.NewEncoder(w).Encode(res)
+	case formatCSV:
+		return writeCSV(w, res)
+	case formatMsgpack:
+		return writeMsgpack(w, res)
+	case formatPrometheus:
+		return writePrometheus(w, res, time.Now())
+	default:
+		var err error
+		switch res.Status {
+		case StatusEmpty:
+			_, err = fmt.Fprintf(w, "Unique IPv4 addresses: %d (empty input)\n", res.Unique)
+		case StatusNoIPs:
+			_, err = fmt.Fprintf(w, "Unique IPv4 addresses: %d (no valid addresses in input)\n", res.Unique)
+		default:
+			if res.Exceeds > 0 {
+				_, err = fmt.Fprintf(w, "Unique IPv4 addresses: > %d\n", res.Exceeds)
+				break
+			}
+			if res.NotCounted {
+				_, err = fmt.Fprintln(w, "Unique IPv4 addresses: not counted (--no-count)")
+				break
+			}
+			if res.Estimated {
+				_, err = fmt.Fprintf(w, "Unique IPv4 addresses: ~%d (estimated)\n", res.Unique)
+				break
+			}
+			_, err = fmt.Fprintf(w, "Unique IPv4 addresses: %d\n", res.Unique)
+		}
+		return err
+	}
+}
+
+// writeCSV writes a header row and one row per file of res, followed by the row for
+// res itself, which holds the totals in directory mode. With --bucket, it writes a row
+// per time bucket instead.
+func writeCSV(w io.Writer, res Result) error {
+	cw := csv.NewWriter(w)
+	if res.Buckets != nil {
+		cw.Write([]string{"bucket", "unique"})
+		for _, b := range res.Buckets {
+			cw.Write([]string{b.Start, strconv.Itoa(b.Unique)})
+		}
+		cw.Flush()
+		return cw.Error()
+	}
+	cw.Write([]string{"file", "unique", "total", "skipped", "bytes", "duration_ms"})
+	for _, r := range append(res.Files, res) {
+		cw.Write([]string{
+			r.Path,
+			strconv.Itoa(r.Unique),
+			strconv.FormatInt(r.Total, 10),
+			strconv.FormatInt(r.Skipped, 10),
+			strconv.FormatInt(r.Bytes, 10),
+			strconv.FormatInt(r.DurationMs, 10),
+		})
+	}
+	cw.Flush()
+	return cw.Error()
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+)
+
+// --- Worker Panics ---
+// workerPanicError is the failure of a chunk whose worker panicked, recovered with
+// --safe-mode. Its byte range is relative to the data the chunk was split from until
+// atOffset moves it into the file's coordinates, like that of an invalidRecordError.
+type workerPanicError struct {
+	chunk      int   // Index of the chunk among those of its data.
+	start, end int64 // Byte range [start, end) of the chunk.
+	value      any   // Value the worker panicked with.
+}
+
+func (e *workerPanicError) Error() string {
+	return fmt.Sprintf("%v in chunk %d (bytes %d to %d): %v", ErrWorkerPanic, e.chunk, e.start, e.end, e.value)
+}
+
+func (e *workerPanicError) Unwrap() error {
+	return ErrWorkerPanic
+}
+
+// guardChunk returns a task that runs task for chunk i, c, of the data, recovering from a
+// panic of it into *err. task is given a WaitGroup of its own to mark done, and wg is only
+// marked done after the recovery, so that the error is stored once wg.Wait returns.
+func guardChunk(i int, c chunk, err *error, wg *sync.WaitGroup, task func(wg *sync.WaitGroup)) func() {
+	return func() {
+		defer wg.Done()
+		defer func() {
+			if v := recover(); v != nil {
+				*err = &workerPanicError{chunk: i, start: int64(c.start), end: int64(c.end), value: v}
+			}
+		}()
+		var own sync.WaitGroup
+		own.Add(1)
+		task(&own)
+	}
+}
+
+// firstPanic returns the first of the errors of guarded chunks in file order, or nil if
+// no worker panicked.
+func firstPanic(errs []error) error {
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
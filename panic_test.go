@@ -0,0 +1,52 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// TestSafeMode injects a panic into the parser of one line, processed on several
+// workers with --safe-mode, both as plain records and with --track-times. Each run must
+// return a *workerPanicError whose chunk holds the line, moved into the file's offsets by
+// atOffset, and the workers must go on to process data normally afterwards.
+func TestSafeMode(t *testing.T) {
+	var data strings.Builder
+	for i := range 4000 {
+		fmt.Fprintf(&data, "%d 10.0.%d.%d\n", 1_700_000_000+i, i/256, i%256)
+	}
+	lines := []byte(data.String())
+	target := []byte("10.0.9.9")
+	offset := bytes.Index(lines, target)
+	panicky := func(line []byte) (uint32, bool) {
+		if bytes.HasSuffix(line, target) {
+			panic("injected")
+		}
+		return parseIPFast(line)
+	}
+	// check checks the error of a run on data starting at base in the file.
+	check := func(name string, err error, base int) {
+		t.Helper()
+		var pe *workerPanicError
+		if !errors.As(atOffset(err, int64(base)), &pe) || !errors.Is(err, ErrWorkerPanic) {
+			t.Fatalf("%s: returned %v, expected a worker panic", name, err)
+		}
+		if pe.start > int64(base+offset) || pe.end <= int64(base+offset) || pe.value != "injected" {
+			t.Fatalf("%s: %v does not hold the line at offset %d", name, pe, base+offset)
+		}
+	}
+	opts := &options{minRecordLen: MinIPLen, safeMode: true}
+	rc := &recordConfig{parse: func(line []byte) (uint32, bool) { return panicky(field(line, 1)) }}
+	check("records", processWindow(lines, NewSparseSet(), 4, rc, opts), 1000)
+	_, err := processDataTimed(lines, NewSparseSet(), 3, timeColumns{time: 0, ip: 1}, panicky, parseEpoch, nil, nil, nil, nil, true)
+	check("--track-times", err, 0)
+	set := NewSparseSet()
+	if _, err := processDataTimed(lines, set, 4, timeColumns{time: 0, ip: 1}, parseIPFast, parseEpoch, nil, nil, nil, nil, true); err != nil {
+		t.Fatal(err)
+	}
+	if got := set.Count(); got != 4000 {
+		t.Fatalf("counted %d address(es) after the panics, expected 4000", got)
+	}
+}
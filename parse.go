@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+)
+
+// --- Alternative Parsers ---
+// parseFunc parses a single record into an IPv4 address.
+type parseFunc func(line []byte) (uint32, bool)
+
+// parser returns the record parser selected by the options.
+func (opts *options) parser() parseFunc {
+	switch {
+	case opts.jsonl:
+		field := strings.Split(opts.ipField, ".")
+		addr := opts.addrParser(parseIPFast)
+		return func(line []byte) (uint32, bool) {
+			return addr(jsonString(line, field))
+		}
+	case opts.syslog:
+		sdID, param := []byte(opts.syslogSDID), []byte(opts.syslogParam)
+		addr := opts.addrParser(parseIPFast)
+		return func(line []byte) (uint32, bool) {
+			value, ok := syslogParam(line, sdID, param)
+			if !ok {
+				return 0, false
+			}
+			return addr(value)
+		}
+	case opts.tolerantSpaces:
+		return opts.addrParser(parseIPTolerant)
+	case opts.proxyProtocol:
+		addr := opts.addrParser(parseIPFast)
+		return func(line []byte) (uint32, bool) {
+			if ip, isProxy, ok := proxySource(line, addr); isProxy {
+				return ip, ok
+			}
+			return addr(line)
+		}
+	}
+	// With --extract, the parser is applied to each field rather than the whole line.
+	return opts.addrParser(parseIPFast)
+}
+
+// addrParser returns parse, extended to accept a trailing ":port" with --strip-port and
+// to reject addresses not starting with any --text-prefix before parsing them. It applies
+// to the address itself, i.e. the extracted field for --jsonl.
+func (opts *options) addrParser(parse parseFunc) parseFunc {
+	if opts.stripPort {
+		base := parse
+		parse = func(addr []byte) (uint32, bool) {
+			addr, ok := stripPort(addr)
+			if !ok {
+				return 0, false
+			}
+			return base(addr)
+		}
+	}
+	if prefixes := opts.textPrefixes; len(prefixes) > 0 {
+		base := parse
+		parse = func(addr []byte) (uint32, bool) {
+			if !hasAnyPrefix(addr, prefixes) {
+				return 0, false
+			}
+			return base(addr)
+		}
+	}
+	return parse
+}
+
+// hasAnyPrefix reports whether b starts with any of prefixes.
+func hasAnyPrefix(b []byte, prefixes [][]byte) bool {
+	for _, p := range prefixes {
+		if bytes.HasPrefix(b, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// records returns the configuration for processChunkWith, or nil if no option requires
+// more than the specialized processChunk.
+func (opts *options) records() *recordConfig {
+	if opts.head == nil && !opts.tolerantSpaces && !opts.jsonl && !opts.stripPort && !opts.strict && opts.stats == nil && opts.textPrefixes == nil && !opts.extract && opts.malformed == nil && opts.invalidOut == "" && opts.cidr == nil && !opts.proxyProtocol && !opts.syslog && !opts.whitespaceStream && opts.srcKey == "" {
+		return nil
+	}
+	return &recordConfig{
+		parse: opts.parser(), strict: opts.strict, extract: opts.extract, stats: opts.stats,
+		malformed: opts.malformed, invalid: opts.invalid, cidr: opts.cidr, skip: opts.minRecordLen - 1, head: opts.head,
+		whitespace: opts.whitespaceStream, flow: opts.flow,
+	}
+}
+
+// stripPort removes a trailing ":port" from addr, as in "1.2.3.4:443". The port must be
+// a number from 0 to 65535; otherwise ok is false. An addr without a colon is returned as is.
+func stripPort(addr []byte) (rest []byte, ok bool) {
+	colon := bytes.LastIndexByte(addr, ':')
+	if colon < 0 {
+		return addr, true
+	}
+	if !validPort(addr[colon+1:]) {
+		return nil, false
+	}
+	return addr[:colon], true
+}
+
+// validPort reports whether port is a decimal number from 0 to 65535.
+func validPort(port []byte) bool {
+	if len(port) == 0 || len(port) > 5 {
+		return false
+	}
+	var num int
+	for _, c := range port {
+		if c < '0' || c > '9' {
+			return false
+		}
+		num = num*10 + int(c-'0')
+	}
+	return num <= 65535
+}
+
+// nextField returns the first field of b, where fields are separated by runs of spaces,
+// tabs or carriage returns, and the rest of b after it. field is nil if b has no more fields.
+func nextField(b []byte) (field, rest []byte) {
+	i := 0
+	for i < len(b) && isFieldSpace(b[i]) {
+		i++
+	}
+	if i == len(b) {
+		return nil, nil
+	}
+	start := i
+	for i < len(b) && !isFieldSpace(b[i]) {
+		i++
+	}
+	return b[start:i], b[i:]
+}
+
+// isPadding reports whether c may pad an octet in tolerant parsing.
+func isPadding(c byte) bool {
+	return c == ' ' || c == '\t'
+}
+
+// parseIPTolerant parses an IPv4 address whose octets may be padded with spaces or tabs,
+// such as "1  .2  .3  .4 ". Padding is allowed before and after each octet but not between
+// its digits. Each octet must have 1 to 3 digits and a value of at most 255. Like
+// parseIPFast, it accepts the address in a pair of brackets.
+func parseIPTolerant(line []byte) (uint32, bool) {
+	line = stripBrackets(line)
+	var ip uint32
+	i := 0
+	for octet := 0; octet < 4; octet++ {
+		for i < len(line) && isPadding(line[i]) {
+			i++
+		}
+		var num uint32
+		digits := 0
+		for i < len(line) && line[i] >= '0' && line[i] <= '9' {
+			num = num*10 + uint32(line[i]-'0')
+			digits++
+			i++
+		}
+		if digits == 0 || digits > 3 || num > 255 {
+			return 0, false
+		}
+		for i < len(line) && isPadding(line[i]) {
+			i++
+		}
+		if octet < 3 {
+			if i == len(line) || line[i] != '.' {
+				return 0, false
+			}
+			i++
+		}
+		ip = (ip << 8) | num
+	}
+	return ip, i == len(line)
+}
@@ -0,0 +1,375 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// trimOctetZeros removes the leading zeros of every octet of s if it has four dot-separated
+// octets of 1 to 3 digits, which parseIPFast accepts but netip.ParseAddr rejects.
+func trimOctetZeros(s string) (string, bool) {
+	octets := strings.Split(s, ".")
+	if len(octets) != 4 {
+		return s, false
+	}
+	for i, o := range octets {
+		if len(o) < 1 || len(o) > 3 || strings.Trim(o, "0123456789") != "" {
+			return s, false
+		}
+		if o = strings.TrimLeft(o, "0"); o == "" {
+			o = "0"
+		}
+		octets[i] = o
+	}
+	return strings.Join(octets, "."), true
+}
+
+// referenceParse parses an IPv4 address in dotted-decimal notation the slow way, as four
+// octets of 1 to 3 digits with values of at most 255.
+func referenceParse(s string) (uint32, bool) {
+	octets := strings.Split(s, ".")
+	if len(octets) != 4 {
+		return 0, false
+	}
+	var ip uint32
+	for _, o := range octets {
+		if len(o) == 0 || len(o) > 3 || strings.Trim(o, "0123456789") != "" {
+			return 0, false
+		}
+		n, _ := strconv.Atoi(o)
+		if n > 255 {
+			return 0, false
+		}
+		ip = ip<<8 | uint32(n)
+	}
+	return ip, true
+}
+
+// FuzzParseIPFast checks parseIPFast against netip.ParseAddr, in particular on long runs
+// of digits, which must not overflow an octet into a false address.
+func FuzzParseIPFast(f *testing.F) {
+	for _, seed := range []string{
+		"1.2.3.4", "255.255.255.255", "0.0.0.0", "[10.0.0.1]", "001.002.003.004",
+		"256.1.1.1", "1.2.3", "1.2.3.4.5", "1..2.3", "4294967297.1.1.1", "1.2.3.4294967296",
+		"99999999999999999999", "1.2.3.0004", "1.2.3.4\r", "::ffff:1.2.3.4", "",
+	} {
+		f.Add([]byte(seed))
+	}
+	f.Fuzz(func(t *testing.T, line []byte) {
+		ip, ok := parseIPFast(line)
+		s := string(stripBrackets(line))
+		if trimmed, dotted := trimOctetZeros(s); dotted {
+			s = trimmed
+		}
+		addr, err := netip.ParseAddr(s)
+		want := err == nil && addr.Is4()
+		if ok != want {
+			t.Fatalf("parseIPFast(%q) = %v, netip.ParseAddr(%q) = %v, %v", line, ok, s, addr, err)
+		}
+		if !ok {
+			return
+		}
+		if b := addr.As4(); ip != uint32(b[0])<<24|uint32(b[1])<<16|uint32(b[2])<<8|uint32(b[3]) {
+			t.Fatalf("parseIPFast(%q) = %s, expected %s", line, formatIP(ip), addr)
+		}
+	})
+}
+
+// TestParseIPTolerant checks that an address whose octets are padded with spaces and tabs
+// in various ways parses to the same address as the bare one, and that padding within an
+// octet, or octets that are not valid, are still rejected.
+func TestParseIPTolerant(t *testing.T) {
+	for _, line := range []string{
+		"1.2.3.4", "1  .2  .3  .4 ", " 1. 2. 3. 4", "1\t.2\t.3\t.4\t", "  1 .  2 .  3 .  4  ", "[1 .2 .3 .4 ]",
+	} {
+		if ip, ok := parseIPTolerant([]byte(line)); !ok || ip != 0x01020304 {
+			t.Errorf("parseIPTolerant(%q) = %s, %v, expected 1.2.3.4", line, formatIP(ip), ok)
+		}
+	}
+	for _, line := range []string{"1 0.2.3.4", "1.2.3", "256 .1.1.1", "1 . . 2.3.4", "1.2.3.4 x", "    ", "1. 2.3.4.5"} {
+		if ip, ok := parseIPTolerant([]byte(line)); ok {
+			t.Errorf("parseIPTolerant(%q) = %s, expected it to be rejected", line, formatIP(ip))
+		}
+	}
+	set := NewSparseSet()
+	data := []byte("1.2.3.4\n1  .2  .3  .4 \n10 .0 .0 .1\n10.0.0.1\n")
+	if err := processData(data, set, 1, &options{minRecordLen: MinIPLen, tolerantSpaces: true}); err != nil {
+		t.Fatal(err)
+	}
+	if set.Count() != 2 {
+		t.Errorf("--tolerant-spaces counted %d unique, expected 2", set.Count())
+	}
+}
+
+// TestStripPort checks that with --strip-port an address followed by a port counts as the
+// same unique address as the bare one, on its own, in brackets and with --jsonl, and that
+// ports which are not numbers from 0 to 65535 are rejected.
+func TestStripPort(t *testing.T) {
+	for _, tc := range []struct {
+		args []string
+		data string
+	}{
+		{nil, "1.2.3.4:443\n1.2.3.4\n1.2.3.4:0\n[1.2.3.4]:65535\n5.6.7.8:80\n"},
+		{[]string{"--jsonl"}, `{"ip":"1.2.3.4:443"}` + "\n" + `{"ip":"1.2.3.4"}` + "\n" + `{"ip":"5.6.7.8:8080"}` + "\n"},
+		{[]string{"--tolerant-spaces"}, "1 .2 .3 .4:443\n1.2.3.4\n5.6.7.8:1\n"},
+	} {
+		opts, err := parseFlags(append(tc.args, "--strip-port", "ips.txt"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		set := NewSparseSet()
+		if err := processData([]byte(tc.data), set, 1, opts); err != nil {
+			t.Fatal(err)
+		}
+		if set.Count() != 2 || !set.IsSet(0x01020304) || !set.IsSet(0x05060708) {
+			t.Errorf("%v: counted %d unique, expected 1.2.3.4 and 5.6.7.8", tc.args, set.Count())
+		}
+	}
+	for _, addr := range []string{"1.2.3.4:", "1.2.3.4:65536", "1.2.3.4:-1", "1.2.3.4:http", "1.2.3.4:44 3"} {
+		if ip, ok := stripPort([]byte(addr)); ok {
+			t.Errorf("stripPort(%q) = %q, expected the port to be rejected", addr, ip)
+		}
+	}
+}
+
+// TestTextPrefix checks that --text-prefix with prefixes that end at an octet boundary
+// counts the same addresses of the self-test dataset as the corresponding --subnet.
+func TestTextPrefix(t *testing.T) {
+	path, _, _ := selfTestDataset(t)
+	for _, pair := range [][2][]string{
+		{{"--text-prefix", "1."}, {"--subnet", "1.0.0.0/8"}},
+		{{"--text-prefix", "5.", "--text-prefix", "63."}, {"--subnet", "5.0.0.0/8", "--subnet", "63.0.0.0/8"}},
+		{{"--text-prefix", "7.7."}, {"--subnet", "7.7.0.0/16"}},
+	} {
+		got, want := countArgs(t, path, pair[0]...), countArgs(t, path, pair[1]...)
+		if got.Unique != want.Unique || want.Unique == 0 {
+			t.Errorf("%v counted %d, %v %d", pair[0], got.Unique, pair[1], want.Unique)
+		}
+	}
+}
+
+// TestExtractSeparators counts addresses among fields separated by tabs, runs of spaces and
+// mixed runs of both with --extract, around and between them, and checks that --strict
+// still rejects an address with surrounding whitespace.
+func TestExtractSeparators(t *testing.T) {
+	data := []byte("1.1.1.1\t2.2.2.2\n" +
+		"x    3.3.3.3     y\n" +
+		" \t 4.4.4.4\t \t\n" +
+		"5.5.5.5\t\t\t6.6.6.6  \r\n" +
+		"a\tb  c \t 7.7.7.7.7 8.8.8.8x 999.1.1.1\n" +
+		"9.9.9.9")
+	for workers := 1; workers <= 3; workers++ {
+		set := NewSparseSet()
+		if err := processData(data, set, workers, &options{minRecordLen: 1, extract: true}); err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		set.ForEach(func(ip uint32) { got = append(got, formatIP(ip)) })
+		want := []string{"1.1.1.1", "2.2.2.2", "3.3.3.3", "4.4.4.4", "5.5.5.5", "6.6.6.6", "9.9.9.9"}
+		if !slices.Equal(got, want) {
+			t.Errorf("%d worker(s): counted %v, expected %v", workers, got, want)
+		}
+	}
+	err := processData([]byte("1.1.1.1\n\t2.2.2.2\n"), NewSparseSet(), 1, &options{minRecordLen: MinIPLen, strict: true})
+	var re *invalidRecordError
+	if !errors.As(err, &re) || re.offset != 8 {
+		t.Errorf("--strict: returned %v, expected an invalid record at offset 8", err)
+	}
+}
+
+// TestDigitRuns counts random lines of fields made of digits and dots with --extract,
+// among them long digit runs and octets that would overflow 32 bits, and compares the
+// addresses found with referenceParse.
+func TestDigitRuns(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	var data strings.Builder
+	expected := make(map[uint32]bool)
+	for range 20_000 {
+		for range 1 + rnd.Intn(4) {
+			var field string
+			switch rnd.Intn(4) {
+			case 0:
+				field = strings.Repeat("9", 1+rnd.Intn(40))
+			case 1:
+				field = fmt.Sprintf("%d.%d.%d.%d", rnd.Intn(300), rnd.Intn(300), rnd.Intn(300), rnd.Intn(300))
+			case 2:
+				field = fmt.Sprintf("%d.%d.%d.%d", rnd.Intn(4), rnd.Intn(4), rnd.Intn(4), uint64(1<<32)+uint64(rnd.Intn(256)))
+			default:
+				b := make([]byte, 1+rnd.Intn(20))
+				for i := range b {
+					b[i] = "0123456789.."[rnd.Intn(12)]
+				}
+				field = string(b)
+			}
+			if ip, ok := referenceParse(field); ok {
+				expected[ip] = true
+			}
+			data.WriteString(field)
+			data.WriteByte(' ')
+		}
+		data.WriteByte('\n')
+	}
+	set := NewSparseSet()
+	if err := processData([]byte(data.String()), set, 3, &options{minRecordLen: 1, extract: true}); err != nil {
+		t.Fatal(err)
+	}
+	set.ForEach(func(ip uint32) {
+		if !expected[ip] {
+			t.Errorf("%s counted, but is not an address of the input", formatIP(ip))
+		}
+	})
+	if set.Count() != len(expected) {
+		t.Errorf("counted %d, expected %d", set.Count(), len(expected))
+	}
+}
+
+// TestWhitespaceStream counts a single huge line of addresses and invalid tokens separated
+// by runs of spaces and tabs with --whitespace-stream, on 1 to 8 workers and through
+// readStream with a buffer much smaller than the line, and compares the addresses found
+// with referenceParse.
+func TestWhitespaceStream(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	var data strings.Builder
+	expected := make(map[uint32]bool)
+	for range 50_000 {
+		field := fmt.Sprintf("%d.%d.%d.%d", rnd.Intn(260), rnd.Intn(256), rnd.Intn(256), rnd.Intn(256))
+		if rnd.Intn(10) == 0 {
+			field += "x"
+		}
+		if ip, ok := referenceParse(field); ok {
+			expected[ip] = true
+		}
+		data.WriteString(field)
+		data.WriteString([]string{" ", "  ", "\t", " \t "}[rnd.Intn(4)])
+	}
+	line := []byte(strings.TrimSpace(data.String()))
+	opts := &options{minRecordLen: MinIPLen, whitespaceStream: true}
+	compare := func(how string, set IPSet) {
+		t.Helper()
+		if set.Count() != len(expected) {
+			t.Fatalf("%s: counted %d, expected %d", how, set.Count(), len(expected))
+		}
+		for ip := range expected {
+			if !set.IsSet(ip) {
+				t.Fatalf("%s: %s not counted", how, formatIP(ip))
+			}
+		}
+	}
+	for workers := 1; workers <= 8; workers++ {
+		set := NewSparseSet()
+		if err := processData(line, set, workers, opts); err != nil {
+			t.Fatal(err)
+		}
+		compare(fmt.Sprintf("%d worker(s)", workers), set)
+	}
+	set := NewSparseSet()
+	if _, err := readStream(bytes.NewReader(line), 1000, nil, func(block []byte) error {
+		return processData(block, set, 2, opts)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	compare("read in blocks", set)
+}
+
+// TestBrackets counts random addresses written bare and in brackets, in the default,
+// --strict, --extract, --strip-port and --tolerant-spaces modes: the bracketed addresses
+// must count the same as the bare ones, and lines with only one of the brackets or with
+// two pairs of them must not count at all.
+func TestBrackets(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	var bare, bracketed []string
+	for range 20_000 {
+		ip := formatIP(rnd.Uint32())
+		bare = append(bare, ip)
+		bracketed = append(bracketed, "["+ip+"]")
+	}
+	invalid := []string{"[1.2.3.4", "1.2.3.4]", "[[1.2.3.4]]", "[]"}
+	for _, mode := range []struct {
+		name   string
+		opts   options
+		format string
+	}{
+		{"default", options{}, "%s\n"},
+		{"--strict", options{strict: true}, "%s\n"},
+		{"--extract", options{extract: true}, "client %s sent 200\n"},
+		{"--strip-port", options{stripPort: true}, "%s:8080\n"},
+		{"--tolerant-spaces", options{tolerantSpaces: true}, "%s\n"},
+	} {
+		opts := mode.opts
+		opts.minRecordLen = MinIPLen
+		count := func(records []string) (IPSet, error) {
+			var data strings.Builder
+			for _, r := range records {
+				fmt.Fprintf(&data, mode.format, r)
+			}
+			set := NewSparseSet()
+			return set, processData([]byte(data.String()), set, 3, &opts)
+		}
+		want, err := count(bare)
+		if err != nil {
+			t.Fatalf("%s: %v", mode.name, err)
+		}
+		got, err := count(bracketed)
+		if err != nil {
+			t.Fatalf("%s: %v", mode.name, err)
+		}
+		if got.Count() != want.Count() || want.Count() == 0 {
+			t.Fatalf("%s: counted %d bracketed addresses, expected %d", mode.name, got.Count(), want.Count())
+		}
+		if !opts.strict {
+			if set, err := count(invalid); err != nil || set.Count() != 0 {
+				t.Fatalf("%s: counted %d of the unmatched brackets, expected 0 (%v)", mode.name, set.Count(), err)
+			}
+		}
+	}
+}
+
+// TestOctetDigits checks that octets of more than 3 digits are rejected however short the
+// whole token is, by both address parsers and with --extract and --strip-port, while
+// octets of up to 3 digits, zero-padded or not, are accepted.
+func TestOctetDigits(t *testing.T) {
+	invalid := []string{"1234.1.1.1", "1.1234.1.1", "1.1.1234.1", "1.1.1.1234", "0001.2.3.4", "1.2.3.0255", "[1234.1.1.1]", "12345.1.1"}
+	valid := map[string]uint32{"001.002.003.004": 0x01020304, "255.255.255.255": 0xffffffff, "0.0.0.0": 0, "[010.0.0.1]": 0x0a000001}
+	for name, parse := range map[string]parseFunc{"parseIPFast": parseIPFast, "parseIPTolerant": parseIPTolerant} {
+		for _, s := range invalid {
+			if ip, ok := parse([]byte(s)); ok {
+				t.Fatalf("%s accepted %q as %s", name, s, formatIP(ip))
+			}
+		}
+		for s, want := range valid {
+			if ip, ok := parse([]byte(s)); !ok || ip != want {
+				t.Fatalf("%s parsed %q as %s, %v, expected %s", name, s, formatIP(ip), ok, formatIP(want))
+			}
+		}
+	}
+	if _, ok := parseIPTolerant([]byte(" 1234 .1.1.1")); ok {
+		t.Fatal("parseIPTolerant accepted a padded 4-digit octet")
+	}
+	for _, mode := range []struct {
+		name   string
+		opts   options
+		format string
+	}{
+		{"--extract", options{minRecordLen: 1, extract: true}, "from %s to\n"},
+		{"--strip-port", options{minRecordLen: 1, stripPort: true}, "%s:80\n"},
+	} {
+		var data strings.Builder
+		for _, s := range invalid {
+			fmt.Fprintf(&data, mode.format, s)
+		}
+		set := NewSparseSet()
+		if err := processData([]byte(data.String()), set, 1, &mode.opts); err != nil {
+			t.Fatal(err)
+		}
+		if set.Count() != 0 {
+			t.Fatalf("%s counted %d address(es) with over-long octets", mode.name, set.Count())
+		}
+	}
+}
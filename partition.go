@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bufio"
+	"cmp"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+)
+
+// --- Partitioned Dump ---
+// partitionFileName returns the name of the partition file of the block of the given
+// prefix length that holds ip, such as "10.0.0.0_8.txt".
+func partitionFileName(ip uint32, prefix int) string {
+	return fmt.Sprintf("%s_%d.txt", formatIP(ip&^(^uint32(0)>>prefix)), prefix)
+}
+
+// partitionWriter writes the dump lines of one partition file at a time.
+type partitionWriter struct {
+	dir    string
+	prefix int
+	cols   []string
+	file   *os.File
+	w      *bufio.Writer
+	block  uint32 // Prefix of the open file.
+	files  int    // Files written so far.
+	line   []byte
+	err    error // First error creating or writing a file.
+}
+
+// add writes ip to the file of its block, closing the file before it if that is another
+// block. The addresses of a block must be added one after the other.
+func (pw *partitionWriter) add(ip uint32) {
+	if pw.err != nil {
+		return
+	}
+	if block := ip >> (32 - pw.prefix); pw.file == nil || block != pw.block {
+		if pw.close(); pw.err != nil {
+			return
+		}
+		pw.file, pw.err = os.Create(filepath.Join(pw.dir, partitionFileName(ip, pw.prefix)))
+		if pw.err != nil {
+			pw.file = nil
+			return
+		}
+		pw.w = bufio.NewWriter(pw.file)
+		pw.block = block
+		pw.files++
+	}
+	pw.line = appendDumpLine(pw.line[:0], ip, pw.cols)
+	_, pw.err = pw.w.Write(pw.line)
+}
+
+// close flushes and closes the open file, if any, and returns the first error.
+func (pw *partitionWriter) close() error {
+	if pw.file == nil {
+		return pw.err
+	}
+	err := pw.w.Flush()
+	if cerr := pw.file.Close(); err == nil {
+		err = cerr
+	}
+	if pw.err == nil {
+		pw.err = err
+	}
+	pw.file = nil
+	return pw.err
+}
+
+// writePartitions writes the addresses of set to one file per block of the given prefix
+// length in dir, for --partition-by, with the dump columns and order of --dump. Blocks
+// without an address get no file. Ascending and descending dumps list every block's
+// addresses together, so only one file is open at a time; a shuffled dump is grouped by
+// block first, which keeps the shuffled order within each file. Returns the number of
+// files written.
+func writePartitions(dir string, set IPSet, prefix int, cols []string, order dumpOrder) (int, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return 0, err
+	}
+	pw := &partitionWriter{dir: dir, prefix: prefix, cols: cols}
+	if order.order == orderShuffle {
+		var ips []uint32
+		order.forEach(set, func(ip uint32) { ips = append(ips, ip) })
+		slices.SortStableFunc(ips, func(a, b uint32) int { return cmp.Compare(a>>(32-prefix), b>>(32-prefix)) })
+		for _, ip := range ips {
+			pw.add(ip)
+		}
+	} else {
+		order.forEach(set, pw.add)
+	}
+	return pw.files, pw.close()
+}
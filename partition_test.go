@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestPartitions writes random addresses clustered in a few /8s to /8 and /12 partition
+// files in subdirectories, in ascending, descending and shuffled order. Every address
+// must be listed once, in the file named after its block, and the files of the ascending
+// order must be sorted.
+func TestPartitions(t *testing.T) {
+	dir := t.TempDir()
+	rnd := rand.New(rand.NewSource(1))
+	set := NewSparseSet()
+	for range 20_000 {
+		set.Set(uint32(rnd.Intn(6))<<26 | uint32(rnd.Intn(1<<24)))
+	}
+	for i, tc := range []struct {
+		prefix int
+		order  string
+	}{{8, orderAsc}, {12, orderDesc}, {8, orderShuffle}} {
+		sub := filepath.Join(dir, fmt.Sprintf("partitions-%d", i))
+		files, err := writePartitions(sub, set, tc.prefix, []string{dumpColumnIP}, dumpOrder{order: tc.order, seed: 1})
+		if err != nil {
+			t.Fatal(err)
+		}
+		entries, err := os.ReadDir(sub)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) != files {
+			t.Fatalf("/%d %s: %d file(s) written, %d in the directory", tc.prefix, tc.order, files, len(entries))
+		}
+		seen := NewSparseSet()
+		for _, e := range entries {
+			data, err := os.ReadFile(filepath.Join(sub, e.Name()))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var prev uint32
+			for j, field := range strings.Fields(string(data)) {
+				ip, ok := parseIPFast([]byte(field))
+				if !ok || partitionFileName(ip, tc.prefix) != e.Name() || seen.IsSet(ip) {
+					t.Fatalf("/%d %s: %q listed in %s", tc.prefix, tc.order, field, e.Name())
+				}
+				if tc.order == orderAsc && j > 0 && ip <= prev {
+					t.Fatalf("/%d %s: %s out of order in %s", tc.prefix, tc.order, field, e.Name())
+				}
+				prev = ip
+				seen.Set(ip)
+			}
+		}
+		if seen.Count() != set.Count() {
+			t.Fatalf("/%d %s: %d address(es) listed, expected %d", tc.prefix, tc.order, seen.Count(), set.Count())
+		}
+	}
+}
@@ -0,0 +1,366 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// --- Packet Captures ---
+// Address fields counted by --pcap-field.
+const (
+	pcapFieldSrc  = "src"
+	pcapFieldDst  = "dst"
+	pcapFieldBoth = "both"
+)
+
+// Link-layer header types (LINKTYPE_* of the pcap and pcapng formats) that --pcap decodes.
+// Packets of other link types are counted as not IP.
+const (
+	linkNull     = 0   // BSD loopback: a 4-byte address family in host byte order.
+	linkEthernet = 1   // Ethernet II, with any number of 802.1Q/802.1ad tags.
+	linkRawDLT12 = 12  // Raw IP, as DLT_RAW on most platforms.
+	linkRawDLT14 = 14  // Raw IP, as DLT_RAW on OpenBSD.
+	linkRaw      = 101 // Raw IP.
+	linkLoop     = 108 // OpenBSD loopback: a 4-byte address family in network byte order.
+	linkSLL      = 113 // Linux cooked capture, with the protocol at offset 14 of 16 bytes.
+	linkIPv4     = 228 // Raw IPv4.
+	linkIPv6     = 229 // Raw IPv6.
+	linkSLL2     = 276 // Linux cooked capture v2, with the protocol at offset 0 of 20 bytes.
+)
+
+// Magic numbers of the capture formats.
+const (
+	pcapMagicMicro = 0xa1b2c3d4 // Classic pcap with microsecond timestamps.
+	pcapMagicNano  = 0xa1b23c4d // Classic pcap with nanosecond timestamps.
+	pcapngSHB      = 0x0a0d0d0a // Block type of a pcapng Section Header Block.
+	pcapngByteKey  = 0x1a2b3c4d // Byte-order magic of a Section Header Block.
+)
+
+// maxPacketLen bounds the captured length of a record, so a corrupt length is reported
+// instead of allocating gigabytes. Capture tools default to a snapshot length of 256KiB.
+const maxPacketLen = 16 << 20
+
+// errBadCapture is returned for input that is not a pcap or pcapng file, or is corrupt.
+var errBadCapture = errors.New("invalid packet capture")
+
+// pcapStats counts the packets of a capture by what was found in them.
+type pcapStats struct {
+	packets int64 // Packet records read.
+	ipv4    int64 // IPv4 packets, whose addresses were counted.
+	ipv6    int64 // IPv6 packets, which are not counted.
+	other   int64 // Packets of other protocols or link types, or too short for an IP header.
+}
+
+// pcapReader reads the packets of a classic pcap or a pcapng file.
+type pcapReader struct {
+	r      *bufio.Reader
+	order  binary.ByteOrder
+	ng     bool
+	links  []uint16 // Link type of each interface; the single one of a classic file.
+	buf    []byte
+	offset int64 // Offset of the next unread byte.
+}
+
+// newPcapReader reads the file header from r and returns a reader for its packets.
+func newPcapReader(r *bufio.Reader) (*pcapReader, error) {
+	pr := &pcapReader{r: r}
+	magic, err := pr.read(4)
+	if err != nil {
+		return nil, fmt.Errorf("%w: reading header: %w", errBadCapture, err)
+	}
+	switch {
+	case binary.LittleEndian.Uint32(magic) == pcapngSHB:
+		pr.ng = true
+		return pr, pr.section()
+	case binary.LittleEndian.Uint32(magic) == pcapMagicMicro, binary.LittleEndian.Uint32(magic) == pcapMagicNano:
+		pr.order = binary.LittleEndian
+	case binary.BigEndian.Uint32(magic) == pcapMagicMicro, binary.BigEndian.Uint32(magic) == pcapMagicNano:
+		pr.order = binary.BigEndian
+	default:
+		return nil, fmt.Errorf("%w: not a pcap or pcapng file", errBadCapture)
+	}
+	header, err := pr.read(20)
+	if err != nil {
+		return nil, fmt.Errorf("%w: reading header: %w", errBadCapture, err)
+	}
+	pr.links = []uint16{uint16(pr.order.Uint32(header[16:]))}
+	return pr, nil
+}
+
+// read returns the next n bytes, valid until the next call.
+func (pr *pcapReader) read(n int) ([]byte, error) {
+	if cap(pr.buf) < n {
+		pr.buf = make([]byte, n)
+	}
+	b := pr.buf[:n]
+	if _, err := io.ReadFull(pr.r, b); err != nil {
+		return nil, err
+	}
+	pr.offset += int64(n)
+	return b, nil
+}
+
+// section reads the rest of a pcapng Section Header Block, whose type has been read, and
+// starts a new section with its byte order and no interfaces.
+func (pr *pcapReader) section() error {
+	b, err := pr.read(8)
+	if err != nil {
+		return fmt.Errorf("%w: reading section header: %w", errBadCapture, err)
+	}
+	switch {
+	case binary.LittleEndian.Uint32(b[4:]) == pcapngByteKey:
+		pr.order = binary.LittleEndian
+	case binary.BigEndian.Uint32(b[4:]) == pcapngByteKey:
+		pr.order = binary.BigEndian
+	default:
+		return fmt.Errorf("%w: bad byte-order magic in section header", errBadCapture)
+	}
+	total := pr.order.Uint32(b)
+	if total < 28 || total%4 != 0 || total > maxPacketLen {
+		return fmt.Errorf("%w: section header of %d bytes", errBadCapture, total)
+	}
+	pr.links = pr.links[:0]
+	_, err = pr.read(int(total) - 12)
+	return err
+}
+
+// next returns the link type and captured bytes of the next packet, valid until the next
+// call, or io.EOF after the last one.
+func (pr *pcapReader) next() (uint16, []byte, error) {
+	if !pr.ng {
+		start := pr.offset
+		h, err := pr.read(16)
+		if err == io.EOF {
+			return 0, nil, io.EOF
+		} else if err != nil {
+			return 0, nil, fmt.Errorf("%w: record at offset %d: %w", errBadCapture, start, err)
+		}
+		n := pr.order.Uint32(h[8:])
+		if n > maxPacketLen {
+			return 0, nil, fmt.Errorf("%w: record at offset %d of %d bytes", errBadCapture, start, n)
+		}
+		data, err := pr.read(int(n))
+		if err != nil {
+			return 0, nil, fmt.Errorf("%w: record at offset %d: %w", errBadCapture, start, err)
+		}
+		return pr.links[0], data, nil
+	}
+	for {
+		start := pr.offset
+		h, err := pr.read(4)
+		if err == io.EOF {
+			return 0, nil, io.EOF
+		} else if err != nil {
+			return 0, nil, fmt.Errorf("%w: block at offset %d: %w", errBadCapture, start, err)
+		}
+		if binary.LittleEndian.Uint32(h) == pcapngSHB {
+			if err := pr.section(); err != nil {
+				return 0, nil, err
+			}
+			continue
+		}
+		blockType := pr.order.Uint32(h)
+		h, err = pr.read(4)
+		if err != nil {
+			return 0, nil, fmt.Errorf("%w: block at offset %d: %w", errBadCapture, start, err)
+		}
+		total := pr.order.Uint32(h)
+		if total < 12 || total%4 != 0 || total > maxPacketLen {
+			return 0, nil, fmt.Errorf("%w: block at offset %d of %d bytes", errBadCapture, start, total)
+		}
+		// The body is followed by a repetition of the total length.
+		b, err := pr.read(int(total) - 8)
+		if err != nil {
+			return 0, nil, fmt.Errorf("%w: block at offset %d: %w", errBadCapture, start, err)
+		}
+		body := b[:len(b)-4]
+		var iface uint32
+		var data []byte
+		switch blockType {
+		case 1: // Interface Description Block.
+			if len(body) < 2 {
+				return 0, nil, fmt.Errorf("%w: interface block at offset %d too short", errBadCapture, start)
+			}
+			pr.links = append(pr.links, pr.order.Uint16(body))
+			continue
+		case 6: // Enhanced Packet Block.
+			if len(body) < 20 {
+				return 0, nil, fmt.Errorf("%w: packet block at offset %d too short", errBadCapture, start)
+			}
+			iface = pr.order.Uint32(body)
+			data = body[20:min(len(body), 20+int(pr.order.Uint32(body[12:])))]
+		case 3: // Simple Packet Block, always of the first interface.
+			if len(body) < 4 {
+				return 0, nil, fmt.Errorf("%w: packet block at offset %d too short", errBadCapture, start)
+			}
+			data = body[4:min(len(body), 4+int(pr.order.Uint32(body)))]
+		case 2: // Obsolete Packet Block.
+			if len(body) < 20 {
+				return 0, nil, fmt.Errorf("%w: packet block at offset %d too short", errBadCapture, start)
+			}
+			iface = uint32(pr.order.Uint16(body))
+			data = body[20:min(len(body), 20+int(pr.order.Uint32(body[12:])))]
+		default:
+			continue // Statistics, name resolution and other blocks.
+		}
+		if int(iface) >= len(pr.links) {
+			return 0, nil, fmt.Errorf("%w: packet block at offset %d of undeclared interface %d", errBadCapture, start, iface)
+		}
+		return pr.links[iface], data, nil
+	}
+}
+
+// packetIP finds the IP header of a packet captured with the given link type. It returns
+// the IP version, 4 or 6, or 0 if the packet is not IP or too short, and for IPv4 the
+// source and destination addresses.
+func packetIP(link uint16, p []byte) (version int, src, dst uint32) {
+	etherType := -1 // Unknown: decide by the version nibble.
+	switch link {
+	case linkEthernet:
+		if len(p) < 14 {
+			return 0, 0, 0
+		}
+		etherType, p = int(binary.BigEndian.Uint16(p[12:])), p[14:]
+		// 802.1Q, 802.1ad and the older QinQ tag types.
+		for (etherType == 0x8100 || etherType == 0x88a8 || etherType == 0x9100) && len(p) >= 4 {
+			etherType, p = int(binary.BigEndian.Uint16(p[2:])), p[4:]
+		}
+	case linkSLL:
+		if len(p) < 16 {
+			return 0, 0, 0
+		}
+		etherType, p = int(binary.BigEndian.Uint16(p[14:])), p[16:]
+	case linkSLL2:
+		if len(p) < 20 {
+			return 0, 0, 0
+		}
+		etherType, p = int(binary.BigEndian.Uint16(p)), p[20:]
+	case linkNull, linkLoop:
+		if len(p) < 4 {
+			return 0, 0, 0
+		}
+		p = p[4:]
+	case linkRaw, linkRawDLT12, linkRawDLT14, linkIPv4, linkIPv6:
+	default:
+		return 0, 0, 0
+	}
+	if len(p) == 0 {
+		return 0, 0, 0
+	}
+	switch v := p[0] >> 4; {
+	case v == 4 && (etherType < 0 || etherType == 0x0800):
+		if len(p) < 20 || p[0]&0x0f < 5 {
+			return 0, 0, 0
+		}
+		return 4, binary.BigEndian.Uint32(p[12:]), binary.BigEndian.Uint32(p[16:])
+	case v == 6 && (etherType < 0 || etherType == 0x86dd) && len(p) >= 40:
+		return 6, 0, 0
+	}
+	return 0, 0, 0
+}
+
+// addPackets adds the --pcap-field addresses of the IPv4 packets read by pr to set.
+func addPackets(pr *pcapReader, set IPSet, field string, progress *byteProgress) (pcapStats, error) {
+	var st pcapStats
+	for {
+		before := pr.offset
+		link, data, err := pr.next()
+		if err == io.EOF {
+			return st, nil
+		} else if err != nil {
+			return st, err
+		}
+		if progress != nil {
+			progress.done.Add(pr.offset - before)
+		}
+		st.packets++
+		version, src, dst := packetIP(link, data)
+		switch version {
+		case 4:
+			st.ipv4++
+			if field != pcapFieldDst {
+				set.Set(src)
+			}
+			if field != pcapFieldSrc {
+				set.Set(dst)
+			}
+		case 6:
+			st.ipv6++
+		default:
+			st.other++
+		}
+	}
+}
+
+// countUniqueIpInPcap counts the unique addresses of the IPv4 packets in a pcap or pcapng
+// file for --pcap. The file is read sequentially on the calling goroutine.
+func countUniqueIpInPcap(fileName string, opts *options) (Result, error) {
+	startTime := time.Now()
+	res := Result{Path: fileName}
+	var meter *usageMeter
+	if opts.rusage {
+		meter = startUsage()
+	}
+
+	file, err := openInput(fileName)
+	if err != nil {
+		return res, fmt.Errorf("%w: %w", ErrOpenFailed, err)
+	}
+	defer file.Close()
+	stat, err := file.Stat()
+	if err != nil {
+		return res, fmt.Errorf("%w: %w", ErrStatFailed, err)
+	}
+	if stat.Size() == 0 {
+		return res, fmt.Errorf("%w: %s", ErrEmptyFile, fileName)
+	}
+	res.Bytes = stat.Size()
+
+	set := newIPSet(opts)
+	defer closeSet(set)
+	if opts.pretouch {
+		if err := pretouchSet(set); err != nil {
+			return res, err
+		}
+	}
+	if opts.progress != nil {
+		opts.progress.total.Add(stat.Size())
+	}
+	stopInterim := startProgress(set, opts)
+	defer stopInterim()
+	pr, err := newPcapReader(bufio.NewReaderSize(file, opts.readBufferSize()))
+	if err != nil {
+		return res, fmt.Errorf("%s: %w", fileName, err)
+	}
+	st, err := addPackets(pr, set, opts.pcapField, opts.progress)
+	if err != nil {
+		return res, fmt.Errorf("%s: %w", fileName, err)
+	}
+	stopInterim()
+	countSet(set, opts, &res)
+	res.DurationMs = time.Since(startTime).Milliseconds()
+	format := "pcap"
+	if pr.ng {
+		format = "pcapng"
+	}
+	fmt.Fprintf(diag, "Read %d packet(s) from %s (%s) in %v\n", st.packets, fileName, format, time.Since(startTime))
+	fmt.Fprintf(diag, "IPv4 packets: %d, counting %s addresses\n", st.ipv4, opts.pcapField)
+	if st.ipv6 > 0 {
+		fmt.Fprintf(diag, "IPv6 packets: %d, not counted (IPv4 only)\n", st.ipv6)
+	}
+	fmt.Fprintf(diag, "Other packets: %d\n", st.other)
+	meter.report()
+	printEstimate(set, &res)
+	printResultDetails(set, opts, &res)
+	if err := saveOutputs(set, opts); err != nil {
+		return res, err
+	}
+	if res.Unique == 0 && !res.NotCounted {
+		return res, fmt.Errorf("%w: %s", ErrNoValidIPs, fileName)
+	}
+	return res, nil
+}
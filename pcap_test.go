@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"slices"
+	"testing"
+)
+
+// ipv4Header returns a minimal IPv4 header from src to dst.
+func ipv4Header(src, dst uint32) []byte {
+	h := make([]byte, 20)
+	h[0] = 0x45
+	binary.BigEndian.PutUint32(h[12:], src)
+	binary.BigEndian.PutUint32(h[16:], dst)
+	return h
+}
+
+// ethernetFrame returns an Ethernet frame of payload with the given EtherType, behind
+// tags 802.1Q tags.
+func ethernetFrame(etherType uint16, tags int, payload []byte) []byte {
+	f := make([]byte, 12)
+	for range tags {
+		f = binary.BigEndian.AppendUint16(f, 0x8100)
+		f = binary.BigEndian.AppendUint16(f, 42)
+	}
+	f = binary.BigEndian.AppendUint16(f, etherType)
+	return append(f, payload...)
+}
+
+// pcapFile returns a classic pcap file of packets with the given link type.
+func pcapFile(order binary.AppendByteOrder, magic uint32, link uint32, packets ...[]byte) []byte {
+	b := order.AppendUint32(nil, magic)
+	b = order.AppendUint16(b, 2)
+	b = order.AppendUint16(b, 4)
+	b = append(b, make([]byte, 8)...)
+	b = order.AppendUint32(b, 65535)
+	b = order.AppendUint32(b, link)
+	for i, p := range packets {
+		b = order.AppendUint32(b, uint32(1700000000+i))
+		b = order.AppendUint32(b, 0)
+		b = order.AppendUint32(b, uint32(len(p)))
+		b = order.AppendUint32(b, uint32(len(p)))
+		b = append(b, p...)
+	}
+	return b
+}
+
+// pcapngBlock returns a pcapng block of the given type, padding body to 32 bits.
+func pcapngBlock(order binary.AppendByteOrder, blockType uint32, body []byte) []byte {
+	for len(body)%4 != 0 {
+		body = append(body, 0)
+	}
+	total := uint32(len(body) + 12)
+	b := order.AppendUint32(nil, blockType)
+	b = order.AppendUint32(b, total)
+	b = append(b, body...)
+	return order.AppendUint32(b, total)
+}
+
+// pcapngSection returns a pcapng section with one interface per link type, followed by
+// the given blocks.
+func pcapngSection(order binary.AppendByteOrder, links []uint16, blocks ...[]byte) []byte {
+	shb := order.AppendUint32(nil, pcapngByteKey)
+	shb = order.AppendUint16(shb, 1)
+	shb = order.AppendUint16(shb, 0)
+	shb = append(shb, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff) // Unknown section length.
+	b := pcapngBlock(order, pcapngSHB, shb)
+	for _, link := range links {
+		idb := order.AppendUint16(nil, link)
+		idb = append(idb, 0, 0)
+		idb = order.AppendUint32(idb, 65535)
+		b = append(b, pcapngBlock(order, 1, idb)...)
+	}
+	for _, block := range blocks {
+		b = append(b, block...)
+	}
+	return b
+}
+
+// enhancedPacket returns a pcapng Enhanced Packet Block of packet on interface iface.
+func enhancedPacket(order binary.AppendByteOrder, iface uint32, packet []byte) []byte {
+	body := order.AppendUint32(nil, iface)
+	body = append(body, make([]byte, 8)...)
+	body = order.AppendUint32(body, uint32(len(packet)))
+	body = order.AppendUint32(body, uint32(len(packet)))
+	return pcapngBlock(order, 6, append(body, packet...))
+}
+
+// TestPcap counts small pcap and pcapng fixtures with IPv4 packets over Ethernet with
+// and without VLAN tags, raw IP and Linux cooked captures, next to IPv6, ARP and truncated
+// packets, and checks the addresses counted for each --pcap-field.
+func TestPcap(t *testing.T) {
+	ip := func(s string) uint32 { v, _ := parseIPFast([]byte(s)); return v }
+	le, be := binary.LittleEndian, binary.BigEndian
+	ipv6 := append([]byte{0x60}, make([]byte, 39)...)
+	sll := append(append(make([]byte, 14), 0x08, 0x00), ipv4Header(ip("8.8.8.8"), ip("7.7.7.7"))...)
+	spbFrame := ethernetFrame(0x0800, 0, ipv4Header(ip("9.9.9.9"), ip("7.7.7.7")))
+	spb := append(le.AppendUint32(nil, uint32(len(spbFrame))), spbFrame...)
+	fixtures := []struct {
+		name              string
+		data              []byte
+		src, dst          []string
+		ipv4, ipv6, other int64
+	}{
+		{"pcap", pcapFile(le, pcapMagicMicro, linkEthernet,
+			ethernetFrame(0x0800, 0, ipv4Header(ip("1.1.1.1"), ip("2.2.2.2"))),
+			ethernetFrame(0x0800, 2, ipv4Header(ip("3.3.3.3"), ip("2.2.2.2"))),
+			ethernetFrame(0x86dd, 0, ipv6),
+			ethernetFrame(0x0806, 0, make([]byte, 28)),
+			ethernetFrame(0x0800, 0, ipv4Header(ip("9.9.9.9"), ip("9.9.9.9"))[:10]),
+		), []string{"1.1.1.1", "3.3.3.3"}, []string{"2.2.2.2"}, 2, 1, 2},
+		{"big-endian raw pcap", pcapFile(be, pcapMagicNano, linkRaw,
+			ipv4Header(ip("4.4.4.4"), ip("5.5.5.5")), ipv6,
+		), []string{"4.4.4.4"}, []string{"5.5.5.5"}, 1, 1, 0},
+		{"pcapng", append(pcapngSection(le, []uint16{linkEthernet, linkSLL},
+			enhancedPacket(le, 0, ethernetFrame(0x0800, 1, ipv4Header(ip("6.6.6.6"), ip("7.7.7.7")))),
+			pcapngBlock(le, 4, make([]byte, 4)),
+			enhancedPacket(le, 1, sll),
+			pcapngBlock(le, 3, spb),
+		), pcapngSection(be, []uint16{linkRaw},
+			enhancedPacket(be, 0, ipv4Header(ip("10.0.0.1"), ip("10.0.0.2"))),
+		)...), []string{"6.6.6.6", "8.8.8.8", "9.9.9.9", "10.0.0.1"}, []string{"7.7.7.7", "10.0.0.2"}, 4, 0, 0},
+	}
+	for _, f := range fixtures {
+		for _, field := range []string{pcapFieldSrc, pcapFieldDst, pcapFieldBoth} {
+			pr, err := newPcapReader(bufio.NewReader(bytes.NewReader(f.data)))
+			if err != nil {
+				t.Fatalf("%s: %v", f.name, err)
+			}
+			set := NewSparseSet()
+			st, err := addPackets(pr, set, field, nil)
+			if err != nil {
+				t.Fatalf("%s: %v", f.name, err)
+			}
+			want := map[string][]string{pcapFieldSrc: f.src, pcapFieldDst: f.dst, pcapFieldBoth: append(slices.Clone(f.src), f.dst...)}[field]
+			var got []string
+			set.ForEach(func(ip uint32) { got = append(got, formatIP(ip)) })
+			slices.Sort(want)
+			want = slices.Compact(want)
+			slices.Sort(got)
+			if !slices.Equal(got, want) {
+				t.Fatalf("%s, %s: counted %v, expected %v", f.name, field, got, want)
+			}
+			if st.ipv4 != f.ipv4 || st.ipv6 != f.ipv6 || st.other != f.other {
+				t.Fatalf("%s: %d IPv4, %d IPv6 and %d other packet(s), expected %d, %d and %d", f.name, st.ipv4, st.ipv6, st.other, f.ipv4, f.ipv6, f.other)
+			}
+		}
+	}
+	truncated := fixtures[0].data[:len(fixtures[0].data)-5]
+	pr, err := newPcapReader(bufio.NewReader(bytes.NewReader(truncated)))
+	if err == nil {
+		_, err = addPackets(pr, NewSparseSet(), pcapFieldSrc, nil)
+	}
+	if !errors.Is(err, errBadCapture) {
+		t.Fatalf("truncated capture: got %v, expected an invalid capture error", err)
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"runtime"
+	"sync"
+)
+
+// --- Worker Pool ---
+// workerPool runs tasks on a set of persistent goroutines, so that processing many small
+// files does not start and tear down goroutines for every chunk and every count. The pool
+// grows to the largest number of concurrent tasks requested and never shrinks. Tasks must
+// not submit further tasks and wait for them, as that could deadlock a full pool.
+type workerPool struct {
+	mu      sync.Mutex
+	tasks   chan func()
+	workers int
+	wg      sync.WaitGroup
+	closed  bool
+
+	// pin locks each worker to its own OS thread, bound to one CPU.
+	pin       bool
+	pinFailed sync.Once
+}
+
+// pool is the worker pool shared by chunk processing and counting.
+var pool = &workerPool{tasks: make(chan func())}
+
+// grow starts workers until the pool has at least n of them.
+func (p *workerPool) grow(n int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for ; p.workers < n && !p.closed; p.workers++ {
+		p.wg.Add(1)
+		go func(n int) {
+			defer p.wg.Done()
+			if p.pin {
+				p.pinWorker(n)
+			}
+			for task := range p.tasks {
+				task()
+			}
+		}(p.workers)
+	}
+}
+
+// pinWorker locks the calling worker to its OS thread and binds the thread to a CPU,
+// chosen round-robin by the worker number n. The thread stays locked even if binding
+// fails, and the first failure is reported.
+func (p *workerPool) pinWorker(n int) {
+	runtime.LockOSThread()
+	if err := pinThread(n); err != nil {
+		p.pinFailed.Do(func() {
+			fmt.Fprintf(diag, "Warning: cannot pin workers to CPUs: %v\n", err)
+		})
+	}
+}
+
+// Go runs task on a worker of the pool. Callers that submit n tasks to be run at the
+// same time must first call grow(n).
+func (p *workerPool) Go(task func()) {
+	p.tasks <- task
+}
+
+// close stops the workers once they have finished their current tasks and waits for them.
+func (p *workerPool) close() {
+	p.mu.Lock()
+	if !p.closed {
+		p.closed = true
+		close(p.tasks)
+	}
+	p.mu.Unlock()
+	p.wg.Wait()
+}
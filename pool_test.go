@@ -0,0 +1,39 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"sync"
+	"testing"
+)
+
+// BenchmarkWorkerPool processes 10,000 blocks of about 4KB, as from a directory of tiny
+// files, each split into chunks for 4 workers, once on the workers of the pool and once on
+// a goroutine started per chunk, as before the pool.
+func BenchmarkWorkerPool(b *testing.B) {
+	rnd := rand.New(rand.NewSource(1))
+	data := benchLines(4<<10, rnd.Uint32)
+	chunks := splitChunks(data, 4, false)
+	set := NewAtomicBitSet()
+	for _, usePool := range []bool{true, false} {
+		b.Run(fmt.Sprintf("pool=%v", usePool), func(b *testing.B) {
+			pool.grow(len(chunks))
+			b.SetBytes(10_000 * int64(len(data)))
+			for range b.N {
+				for range 10_000 {
+					var wg sync.WaitGroup
+					wg.Add(len(chunks))
+					for _, c := range chunks {
+						task := func() { processChunk(data, c.start, c.end, MinIPLen-1, false, set, 0, &wg) }
+						if usePool {
+							pool.Go(task)
+						} else {
+							go task()
+						}
+					}
+					wg.Wait()
+				}
+			}
+		})
+	}
+}
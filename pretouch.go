@@ -0,0 +1,34 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+)
+
+// --- Pre-Touching the Bitset ---
+// pretouchSet faults in every page of the dense bitset of set for --pretouch, so that a
+// machine without the memory for it fails at startup instead of after part of the scan:
+// the allocation only reserves address space, and the pages are faulted in as addresses
+// are set. The bitset's size is first compared with availableMemory, and an error
+// advising a smaller set is returned if it does not fit. The kernel may still kill the
+// process while it touches the pages, but then before any input is read. Sets without a
+// dense bitset are left alone.
+func pretouchSet(set IPSet) error {
+	bs := denseBitSetOf(set)
+	if bs == nil {
+		return nil
+	}
+	need := int64(len(bs.bits)) * 8
+	if avail, ok := availableMemory(); ok && need > avail {
+		return fmt.Errorf("%w: the dense bitset needs %s, but only %s is available; use --bitset sparse or --subnet, or free memory", ErrLowMemory, formatBytes(need), formatBytes(avail))
+	}
+	start := time.Now()
+	// One store per page; the bitset is still empty, so zero is what it holds.
+	step := max(1, os.Getpagesize()/8)
+	for i := 0; i < len(bs.bits); i += step {
+		bs.bits[i] = 0
+	}
+	fmt.Fprintf(diag, "Bitset of %s touched in %v\n", formatBytes(need), time.Since(start))
+	return nil
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"io"
+	"testing"
+)
+
+// TestPretouch pre-touches a small dense bitset, which must stay empty and count the
+// addresses set afterwards, and a sparse set, which it must leave alone. Where the
+// available memory can be read it must be positive.
+func TestPretouch(t *testing.T) {
+	out := diag
+	diag = io.Discard
+	t.Cleanup(func() { diag = out })
+	if avail, ok := availableMemory(); ok && avail <= 0 {
+		t.Fatalf("available memory read as %d byte(s)", avail)
+	}
+	bs := newAtomicBitSetSize(64 * BucketSize)
+	if err := pretouchSet(bs); err != nil {
+		t.Fatal(err)
+	}
+	if got := bs.Count(); got != 0 {
+		t.Fatalf("pre-touched bitset holds %d address(es)", got)
+	}
+	bs.Set(1)
+	bs.Set(64*BucketSize - 1)
+	if got := bs.Count(); got != 2 {
+		t.Fatalf("pre-touched bitset counted %d address(es), expected 2", got)
+	}
+	if err := pretouchSet(NewSparseSet()); err != nil {
+		t.Fatal(err)
+	}
+}
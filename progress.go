@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// --- Interim Counts ---
+// concurrentCounter is implemented by sets whose Count reads them without synchronization,
+// and which provide a race-free count for use while other goroutines Set addresses.
+type concurrentCounter interface {
+	CountConcurrent() int
+}
+
+// interimCount counts set while other goroutines may still be adding to it. With atomic,
+// a dense set is counted with atomic loads, so the count passes the race detector at a
+// small cost; the other sets synchronize their counts anyway.
+func interimCount(set IPSet, atomic bool) int {
+	if atomic {
+		switch s := set.(type) {
+		case concurrentCounter:
+			return s.CountConcurrent()
+		case setWrapper:
+			return interimCount(s.unwrap(), atomic)
+		}
+	}
+	return set.Count()
+}
+
+// startInterimCounts prints the running unique count of set every interval until the
+// returned stop function is called. The counts are taken while workers are still adding
+// addresses: each word of the bitset is read without synchronization unless atomic is
+// set, so a count reflects the set at some point during its own scan and may lag behind
+// the words that are being updated, but it never exceeds the final count. Calling stop
+// more than once is safe.
+func startInterimCounts(set IPSet, interval time.Duration, atomic bool) (stop func()) {
+	done := make(chan struct{})
+	finished := make(chan struct{})
+	startTime := time.Now()
+	go func() {
+		defer close(finished)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				fmt.Fprintf(diag, "[%v] running unique count: %d\n", time.Since(startTime).Round(time.Millisecond), interimCount(set, atomic))
+			}
+		}
+	}()
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			close(done)
+			<-finished
+		})
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// --- Prometheus Output ---
+// writePrometheus writes res in the Prometheus text exposition format, as a unique count
+// per input file with the time of the run. The textfile collector of node_exporter
+// rejects samples with timestamps, so the time is a gauge of its own instead.
+func writePrometheus(w io.Writer, res Result, now time.Time) error {
+	results := append([]Result{res}, res.Files...)
+	var b strings.Builder
+	b.WriteString("# HELP ipcounter_unique_total Unique IPv4 addresses in the input.\n")
+	b.WriteString("# TYPE ipcounter_unique_total gauge\n")
+	for _, r := range results {
+		fmt.Fprintf(&b, "ipcounter_unique_total{file=\"%s\"} %d\n", promLabel(r.Path), r.Unique)
+	}
+	b.WriteString("# HELP ipcounter_last_run_timestamp_seconds Time the count finished, in seconds since the epoch.\n")
+	b.WriteString("# TYPE ipcounter_last_run_timestamp_seconds gauge\n")
+	fmt.Fprintf(&b, "ipcounter_last_run_timestamp_seconds{file=\"%s\"} %.3f\n", promLabel(res.Path), float64(now.UnixMilli())/1000)
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// promLabel escapes s for use as a label value.
+func promLabel(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s)
+}
+
+// writeFileAtomic writes the output of write to name through a temporary file in the same
+// directory, renamed over name once complete, so that readers such as the textfile
+// collector see either the previous file or the new one, never a partial file. The
+// temporary name does not end in .prom, so the collector skips it. The temporary file is
+// a scratch file, removed on an error or interrupt, but stays out of --tmpdir, since a
+// rename only replaces name atomically within one file system.
+func writeFileAtomic(name string, write func(w io.Writer) error) error {
+	f, err := scratch.create(filepath.Dir(name), "."+filepath.Base(name)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	err = write(f)
+	if err == nil {
+		err = f.Chmod(0o644)
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, name)
+	}
+	if err != nil {
+		scratch.remove(f)
+	} else {
+		scratch.forget(f)
+	}
+	return err
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestTextfile writes two results with --format prometheus over the same --textfile in
+// an empty directory. The file must hold the second result, with its path escaped as
+// a label value, and no temporary file may be left beside it.
+func TestTextfile(t *testing.T) {
+	sub := t.TempDir()
+	name := filepath.Join(sub, "ipcounter.prom")
+	for i, path := range []string{"first", `C:\logs\"quoted".txt`} {
+		res := Result{Status: StatusOK, Path: path, Unique: 100 + i}
+		if err := writeFileAtomic(name, func(w io.Writer) error { return writeResult(w, formatPrometheus, res) }); err != nil {
+			t.Fatal(err)
+		}
+	}
+	data, err := os.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `ipcounter_unique_total{file="C:\\logs\\\"quoted\".txt"} 101` + "\n"
+	if !strings.Contains(string(data), want) || strings.Contains(string(data), "first") {
+		t.Fatalf("textfile holds %q, expected the line %q", data, want)
+	}
+	entries, err := os.ReadDir(sub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("%d file(s) left in the textfile directory, expected 1", len(entries))
+	}
+}
@@ -0,0 +1,32 @@
+package main
+
+import "bytes"
+
+// --- PROXY Protocol Headers ---
+// proxyPrefix starts every version 1 PROXY protocol header line.
+var proxyPrefix = []byte("PROXY ")
+
+// proxySource parses a version 1 PROXY protocol header line, such as
+// "PROXY TCP4 1.2.3.4 5.6.7.8 1234 443", and returns its source address, parsed with addr.
+// isProxy reports whether line starts with "PROXY ". ok is false for a header that is
+// malformed, has an invalid destination or port, or is not TCP4 (TCP6 and UNKNOWN).
+func proxySource(line []byte, addr parseFunc) (ip uint32, isProxy, ok bool) {
+	if !bytes.HasPrefix(line, proxyPrefix) {
+		return 0, false, false
+	}
+	var fields [6][]byte
+	rest := line
+	for i := range fields {
+		if fields[i], rest = nextField(rest); fields[i] == nil {
+			return 0, true, false
+		}
+	}
+	if extra, _ := nextField(rest); extra != nil || string(fields[1]) != "TCP4" {
+		return 0, true, false
+	}
+	if _, ok := parseIPFast(fields[3]); !ok || !validPort(fields[4]) || !validPort(fields[5]) {
+		return 0, true, false
+	}
+	ip, ok = addr(fields[2])
+	return ip, true, ok
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+// TestProxyProtocol counts valid and malformed PROXY protocol header lines, mixed with
+// plain addresses, with --proxy-protocol and checks that only the source addresses of the
+// valid TCP4 headers and the plain addresses count.
+func TestProxyProtocol(t *testing.T) {
+	data := strings.Join([]string{
+		"PROXY TCP4 1.2.3.4 5.6.7.8 1234 443\r",
+		"PROXY TCP4 1.2.3.4 9.9.9.9 4321 80",
+		"PROXY TCP4 10.0.0.1 5.6.7.8 65535 0",
+		"PROXY  TCP4\t10.0.0.2  5.6.7.8 1 2 ",
+		"7.7.7.7",
+		"PROXY TCP4 10.0.0.3 5.6.7.8 1234 65536",
+		"PROXY TCP4 10.0.0.4 5.6.7.8 1234",
+		"PROXY TCP4 10.0.0.5 5.6.7.8 1234 443 extra",
+		"PROXY TCP4 10.0.0.6 5.6.7.300 1234 443",
+		"PROXY TCP4 10.0.0.256 5.6.7.8 1234 443",
+		"PROXY TCP6 ::1 ::2 1234 443",
+		"PROXY UNKNOWN",
+		"PROXY tcp4 10.0.0.7 5.6.7.8 1234 443",
+		"PROXYTCP4 10.0.0.8 5.6.7.8 1234 443",
+	}, "\n")
+	set := NewSparseSet()
+	if err := processData([]byte(data), set, 1, &options{minRecordLen: MinIPLen, proxyProtocol: true}); err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	set.ForEach(func(ip uint32) { got = append(got, formatIP(ip)) })
+	if want := []string{"1.2.3.4", "7.7.7.7", "10.0.0.1", "10.0.0.2"}; !slices.Equal(got, want) {
+		t.Fatalf("counted %v, expected %v", got, want)
+	}
+}
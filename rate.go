@@ -0,0 +1,111 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// --- Rate Limiting ---
+// rateWindow is the number of bytes processed between rate limiter waits. It is also the
+// burst size of the limiter, so idle periods (e.g. while following) do not allow bursts
+// larger than this.
+const rateWindow = 4 * 1024 * 1024
+
+// parseRate parses a rate such as "200MiB/s", "50MB" or "1048576" into bytes per second.
+func parseRate(s string) (float64, error) {
+	rate, err := parseSize(strings.TrimSuffix(strings.TrimSpace(s), "/s"))
+	if err != nil {
+		return 0, err
+	}
+	if rate < 1 {
+		return 0, errors.New("rate must be at least 1 byte per second")
+	}
+	return rate, nil
+}
+
+// rateLimiter is a token bucket limiting how fast input bytes are consumed. It is shared by
+// all workers and files, so the limit applies to the process as a whole.
+type rateLimiter struct {
+	limit  float64 // Bytes per second.
+	mu     sync.Mutex
+	tokens float64   // Available bytes; negative while callers are waiting.
+	last   time.Time // Time of the last refill.
+	first  time.Time // Time of the first wait, for the effective rate.
+	total  int64     // Bytes consumed so far.
+}
+
+// newRateLimiter creates a limiter allowing limit bytes per second. The bucket starts
+// empty, so the limit also holds for inputs smaller than the burst size.
+func newRateLimiter(limit float64) *rateLimiter {
+	return &rateLimiter{limit: limit}
+}
+
+// wait takes n bytes from the bucket, sleeping until they are available.
+func (r *rateLimiter) wait(n int) {
+	r.mu.Lock()
+	now := time.Now()
+	if r.first.IsZero() {
+		r.first, r.last = now, now
+	}
+	r.tokens = min(r.tokens+now.Sub(r.last).Seconds()*r.limit, rateWindow)
+	r.last = now
+	r.tokens -= float64(n)
+	r.total += int64(n)
+	debt := r.tokens
+	r.mu.Unlock()
+	if debt < 0 {
+		time.Sleep(time.Duration(-debt / r.limit * float64(time.Second)))
+	}
+}
+
+// effective returns the bytes consumed so far and the rate achieved in bytes per second.
+func (r *rateLimiter) effective() (int64, float64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	elapsed := time.Since(r.first).Seconds()
+	if r.total == 0 || elapsed <= 0 {
+		return r.total, 0
+	}
+	return r.total, float64(r.total) / elapsed
+}
+
+// windowEnd returns the end of the window of data starting at base: about rateWindow
+// bytes, extended to the end of the record as splitChunks aligns it.
+func windowEnd(data []byte, base int, whitespace bool) int {
+	end := min(base+rateWindow, len(data))
+	for end < len(data) && !endsRecord(data[end-1], whitespace) {
+		end++
+	}
+	return end
+}
+
+// throttle calls fn with record-aligned windows of data of about rateWindow bytes,
+// waiting on r before each one, and stops at the first error returned by fn.
+// If r is nil, fn is called once with all of data.
+func throttle(data []byte, r *rateLimiter, whitespace bool, fn func(window []byte) error) error {
+	if r == nil {
+		return fn(data)
+	}
+	for base := 0; base < len(data); {
+		end := windowEnd(data, base, whitespace)
+		r.wait(end - base)
+		if err := fn(data[base:end]); err != nil {
+			return atOffset(err, int64(base))
+		}
+		base = end
+	}
+	return nil
+}
+
+// printRate reports the effective input rate achieved under --rate.
+func printRate(opts *options) {
+	if opts.rate == nil {
+		return
+	}
+	total, rate := opts.rate.effective()
+	fmt.Fprintf(diag, "Effective rate: %.1f MiB/s over %d bytes (limit %.1f MiB/s)\n",
+		rate/(1<<20), total, opts.rate.limit/(1<<20))
+}
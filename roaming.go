@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// --- Roaming Detection ---
+// maxRoamingPrefixes is the number of distinct /24 prefixes tracked per identifier by
+// --detect-roaming. Identifiers seen in more are reported with at least this many.
+const maxRoamingPrefixes = 8
+
+// roamingTracker records the distinct /24 prefixes of the addresses each identifier of
+// timestamped input was seen with, for --detect-roaming. An address always lies in exactly
+// one /24, so roaming is detected for the identifier in another column, such as a user or
+// device ID, that moves between addresses. Its memory grows with the number of
+// identifiers: the identifier itself plus roughly 80 bytes per entry, and 4 bytes per
+// prefix. The identifiers are spread over shards like the counts of ipCounts.
+type roamingTracker struct {
+	keyColumn int  // Zero-based field holding the identifier.
+	list      bool // Report every roaming identifier, not only their number.
+	shards    [countShards]struct {
+		mu       sync.Mutex
+		prefixes map[string][]uint32
+	}
+}
+
+func newRoamingTracker(keyColumn int, list bool) *roamingTracker {
+	rt := &roamingTracker{keyColumn: keyColumn, list: list}
+	for i := range rt.shards {
+		rt.shards[i].prefixes = make(map[string][]uint32)
+	}
+	return rt
+}
+
+// observe records that the identifier key was seen with ip.
+func (rt *roamingTracker) observe(key []byte, ip uint32) {
+	// FNV-1a, to pick the shard.
+	h := uint32(2166136261)
+	for _, c := range key {
+		h = (h ^ uint32(c)) * 16777619
+	}
+	s := &rt.shards[h%countShards]
+	prefix := ip >> 8
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	seen := s.prefixes[string(key)]
+	if len(seen) < maxRoamingPrefixes && !slices.Contains(seen, prefix) {
+		s.prefixes[string(key)] = append(seen, prefix)
+	}
+}
+
+// roamingKey is an identifier seen with addresses of more than one /24.
+type roamingKey struct {
+	key      string
+	prefixes []uint32 // The first distinct /24 prefixes seen, as address >> 8.
+}
+
+// roaming returns the identifiers seen with addresses of more than one /24, sorted, and
+// the number of identifiers tracked.
+func (rt *roamingTracker) roaming() (keys []roamingKey, tracked int) {
+	for i := range rt.shards {
+		for key, prefixes := range rt.shards[i].prefixes {
+			tracked++
+			if len(prefixes) > 1 {
+				keys = append(keys, roamingKey{key: key, prefixes: prefixes})
+			}
+		}
+	}
+	slices.SortFunc(keys, func(a, b roamingKey) int { return strings.Compare(a.key, b.key) })
+	return keys, tracked
+}
+
+// printRoaming reports the identifiers seen in more than one /24 for --detect-roaming,
+// listing them with --roaming-list, and records their number in res.
+func printRoaming(opts *options, res *Result) {
+	rt := opts.roaming
+	if rt == nil {
+		return
+	}
+	keys, tracked := rt.roaming()
+	res.Roaming = len(keys)
+	fmt.Fprintf(diag, "Identifiers seen in more than one /24: %d of %d\n", len(keys), tracked)
+	if !rt.list {
+		return
+	}
+	for _, k := range keys {
+		nets := make([]string, len(k.prefixes))
+		for i, p := range k.prefixes {
+			nets[i] = formatIP(p<<8) + "/24"
+		}
+		more := ""
+		if len(k.prefixes) == maxRoamingPrefixes {
+			more = " (tracking stopped here)"
+		}
+		fmt.Fprintf(diag, "%s: %s%s\n", k.key, strings.Join(nets, " "), more)
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// --- Resource Usage ---
+// usage is the resource usage of the process, as reported by getrusage.
+type usage struct {
+	user, system time.Duration // CPU time in user and kernel mode.
+	minorFaults  int64         // Page faults served without I/O, e.g. from the page cache.
+	majorFaults  int64         // Page faults that had to read from disk.
+	blockReads   int64         // Block input operations.
+	waits        int64         // Voluntary context switches, mostly waits for I/O.
+}
+
+// usageMeter measures the resource usage between its creation and report, for --rusage.
+type usageMeter struct {
+	start time.Time
+	base  usage
+}
+
+// startUsage starts measuring, or returns nil with a warning if the platform does not
+// report resource usage.
+func startUsage() *usageMeter {
+	base, err := readUsage()
+	if err != nil {
+		fmt.Fprintf(diag, "Warning: --rusage: %v\n", err)
+		return nil
+	}
+	return &usageMeter{start: time.Now(), base: base}
+}
+
+// report prints the usage since the meter started. The time not spent on a CPU is wall
+// time less CPU time, which with several workers underestimates the waiting, as their
+// CPU times add up.
+func (m *usageMeter) report() {
+	if m == nil {
+		return
+	}
+	now, err := readUsage()
+	if err != nil {
+		fmt.Fprintf(diag, "Warning: --rusage: %v\n", err)
+		return
+	}
+	wall := time.Since(m.start)
+	user, system := now.user-m.base.user, now.system-m.base.system
+	fmt.Fprintf(diag, "Resource usage: wall %v, user %v, system %v, off-CPU %v\n",
+		wall.Round(time.Millisecond), user.Round(time.Millisecond), system.Round(time.Millisecond),
+		max(0, wall-user-system).Round(time.Millisecond))
+	fmt.Fprintf(diag, "Page faults: %d minor, %d major; %d block read(s), %d voluntary context switch(es)\n",
+		now.minorFaults-m.base.minorFaults, now.majorFaults-m.base.majorFaults,
+		now.blockReads-m.base.blockReads, now.waits-m.base.waits)
+}
@@ -0,0 +1,10 @@
+//go:build !unix
+
+package main
+
+import "errors"
+
+// readUsage is not supported on this platform.
+func readUsage() (usage, error) {
+	return usage{}, errors.ErrUnsupported
+}
@@ -0,0 +1,25 @@
+//go:build unix
+
+package main
+
+import (
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// readUsage returns the resource usage of the process so far.
+func readUsage() (usage, error) {
+	var ru unix.Rusage
+	if err := unix.Getrusage(unix.RUSAGE_SELF, &ru); err != nil {
+		return usage{}, err
+	}
+	return usage{
+		user:        time.Duration(ru.Utime.Nano()),
+		system:      time.Duration(ru.Stime.Nano()),
+		minorFaults: int64(ru.Minflt),
+		majorFaults: int64(ru.Majflt),
+		blockReads:  int64(ru.Inblock),
+		waits:       int64(ru.Nvcsw),
+	}, nil
+}
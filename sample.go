@@ -0,0 +1,66 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// --- Input Sanity Check ---
+const (
+	sampleSize     = 64 * 1024 // Bytes at the start of the input sampled for the format check.
+	minValidRatio  = 0.01      // Below this share of valid sampled lines the input looks wrong.
+	minSampleLines = 10        // Fewer sampled lines than this are not judged.
+)
+
+// sampleBytes returns the number of bytes at the start of the input sampled for the format
+// check and --min-valid-ratio.
+func (opts *options) sampleBytes() int {
+	if opts.validSample > 0 {
+		return opts.validSample
+	}
+	return sampleSize
+}
+
+// sampleValidLines parses the complete lines within the first size bytes of data and
+// returns how many of the non-empty ones are valid addresses, and how many there are.
+func sampleValidLines(data []byte, size int, parse parseFunc) (valid, total int) {
+	sample := data[:min(len(data), size)]
+	for len(sample) > 0 {
+		end := bytes.IndexByte(sample, '\n')
+		if end < 0 {
+			if len(sample) < len(data) {
+				break // Partial line cut off by the sample size.
+			}
+			end = len(sample)
+		}
+		if line := sample[:end]; len(line) > 0 {
+			total++
+			if _, ok := parse(line); ok {
+				valid++
+			}
+		}
+		sample = sample[min(end+1, len(sample)):]
+	}
+	return valid, total
+}
+
+// checkLooksLikeIPs samples the start of data and warns if almost none of its lines are
+// valid addresses, which usually means a wrong path or format rather than a genuine 0.
+// With --strict, this is an error instead. With --min-valid-ratio, a sample with a smaller
+// share of valid lines is an error, so that a corrupted input fails before it is scanned.
+func checkLooksLikeIPs(name string, data []byte, opts *options) error {
+	valid, total := sampleValidLines(data, opts.sampleBytes(), opts.parser())
+	if r := opts.minValidRatio; r > 0 && total > 0 && float64(valid) < r*float64(total) {
+		return fmt.Errorf("%w: %s: %d of %d sampled lines are valid IPv4 addresses, a ratio of %.3f, below --min-valid-ratio %g",
+			ErrNotIPData, name, valid, total, float64(valid)/float64(total), r)
+	}
+	if total < minSampleLines || float64(valid) >= minValidRatio*float64(total) {
+		return nil
+	}
+	err := fmt.Errorf("%w: %s: only %d of %d sampled lines are valid IPv4 addresses", ErrNotIPData, name, valid, total)
+	if opts.strict {
+		return err
+	}
+	fmt.Fprintf(diag, "*** Warning: %v; the input may be in the wrong format ***\n", err)
+	return nil
+}
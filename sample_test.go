@@ -0,0 +1,45 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestMinValidRatio writes a file of which 4 in 5 lines are addresses and counts it with
+// --min-valid-ratio below and above that: the first run must count all of its addresses,
+// and the second fail before processing, reporting the ratio of its sample.
+func TestMinValidRatio(t *testing.T) {
+	out := diag
+	diag = io.Discard
+	t.Cleanup(func() { diag = out })
+	dir := t.TempDir()
+	var data strings.Builder
+	for i := range 10_000 {
+		if i%5 == 4 {
+			data.WriteString("garbage\n")
+		} else {
+			data.WriteString(formatIP(uint32(i)) + "\n")
+		}
+	}
+	path := filepath.Join(dir, "min-valid-ratio.txt")
+	if err := os.WriteFile(path, []byte(data.String()), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	for _, ratio := range []string{"0.7", "0.9"} {
+		opts, err := parseFlags([]string{"--min-valid-ratio", ratio, "--valid-sample", "1KiB", path})
+		if err != nil {
+			t.Fatal(err)
+		}
+		res, err := countUniqueIpInFile(path, opts)
+		if ratio == "0.7" && (err != nil || res.Unique != 8_000) {
+			t.Fatalf("--min-valid-ratio %s: counted %d, expected 8000 (%v)", ratio, res.Unique, err)
+		}
+		if ratio == "0.9" && (!errors.Is(err, ErrNotIPData) || !strings.Contains(err.Error(), "a ratio of 0.8")) {
+			t.Fatalf("--min-valid-ratio %s: got %v, expected an error with the ratio 0.8", ratio, err)
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+)
+
+// --- Scratch Files ---
+// scratchFiles tracks the temporary files of a run, such as the sorted runs of
+// --spill-above, so that they are removed however the run ends: callers remove them once
+// done or on an error, and an interrupt or termination signal removes those still
+// registered before exiting. The signals are only caught once a file has been created.
+type scratchFiles struct {
+	mu    sync.Mutex
+	files map[string]*os.File
+	watch sync.Once
+}
+
+// scratch holds the scratch files of the process.
+var scratch scratchFiles
+
+// create creates a new temporary file in dir, named after pattern as with os.CreateTemp,
+// and registers it. An empty dir is the default directory of os.TempDir.
+func (s *scratchFiles) create(dir, pattern string) (*os.File, error) {
+	s.watch.Do(s.watchSignals)
+	f, err := os.CreateTemp(dir, pattern)
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.files == nil {
+		s.files = make(map[string]*os.File)
+	}
+	s.files[f.Name()] = f
+	return f, nil
+}
+
+// remove closes and removes f and unregisters it.
+func (s *scratchFiles) remove(f *os.File) {
+	s.forget(f)
+	f.Close()
+	os.Remove(f.Name())
+}
+
+// forget unregisters f without removing it, for a file renamed to its final name.
+func (s *scratchFiles) forget(f *os.File) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.files, f.Name())
+}
+
+// removeAll closes and removes every registered file and returns their number.
+func (s *scratchFiles) removeAll() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := len(s.files)
+	for name, f := range s.files {
+		f.Close()
+		os.Remove(name)
+	}
+	clear(s.files)
+	return n
+}
+
+// watchSignals removes the registered files and exits when the process is interrupted
+// or asked to terminate.
+func (s *scratchFiles) watchSignals() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		n := s.removeAll()
+		fmt.Fprintf(diag, "Error: %v; %d scratch file(s) removed\n", sig, n)
+		os.Exit(1)
+	}()
+}
+
+// checkScratchDir checks that dir, given with --tmpdir, is an existing directory.
+func checkScratchDir(dir string) error {
+	stat, err := os.Stat(dir)
+	if err != nil {
+		return fmt.Errorf("--tmpdir: %w", err)
+	}
+	if !stat.IsDir() {
+		return fmt.Errorf("--tmpdir: %s is not a directory", dir)
+	}
+	return nil
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strings"
+)
+
+// --- Fixed Segments ---
+// segment is a half-open byte range [start, end) of the input file with a stable index.
+type segment struct {
+	start, end int64
+}
+
+// segmented reports whether the file is processed as fixed segments or as a --byte-range.
+func (opts *options) segmented() bool {
+	return opts.chunks != nil || opts.manifest != "" || opts.byteRange != nil
+}
+
+// fileSegments splits a file of the given size into segments of segSize bytes, with each
+// boundary moved forward to just after the next newline. The boundaries depend only on the
+// file contents and segSize, so segment i covers the same lines on every run. A line longer
+// than a segment leaves the following segment empty rather than shifting the indices.
+func fileSegments(file *os.File, size, segSize int64) ([]segment, error) {
+	n := (size + segSize - 1) / segSize
+	segs := make([]segment, n)
+	buf := make([]byte, 64*1024)
+	var start int64
+	for i := range segs {
+		end := size
+		if i < len(segs)-1 {
+			var err error
+			if end, err = lineEndAfter(file, max(start, int64(i+1)*segSize), size, buf); err != nil {
+				return nil, err
+			}
+		}
+		segs[i] = segment{start: start, end: end}
+		start = end
+	}
+	return segs, nil
+}
+
+// lineEndAfter returns the offset just after the first newline at or after offset-1,
+// i.e. offset itself if it already starts a line, or size if there is no such newline.
+func lineEndAfter(file *os.File, offset, size int64, buf []byte) (int64, error) {
+	for pos := offset - 1; pos < size; {
+		n, err := file.ReadAt(buf[:min(int64(len(buf)), size-pos)], pos)
+		if i := bytes.IndexByte(buf[:n], '\n'); i >= 0 {
+			return pos + int64(i) + 1, nil
+		}
+		if err != nil && err != io.EOF {
+			return 0, fmt.Errorf("error reading at offset %d: %w", pos, err)
+		}
+		pos += int64(n)
+	}
+	return size, nil
+}
+
+// parseByteRange parses a --byte-range of the form START:LEN, where both are sizes such
+// as 4096 or 1GiB, into the segment [START, START+LEN).
+func parseByteRange(s string) (*segment, error) {
+	from, length, ok := strings.Cut(s, ":")
+	if !ok {
+		return nil, errors.New("must be START:LEN")
+	}
+	start, err := parseSize(from)
+	if err != nil {
+		return nil, err
+	}
+	n, err := parseSize(length)
+	if err != nil {
+		return nil, err
+	}
+	if n < 1 || start+n > math.MaxInt64 {
+		return nil, errors.New("LEN must be positive and START+LEN must fit in a file offset")
+	}
+	return &segment{start: int64(start), end: int64(start + n)}, nil
+}
+
+// lineRange aligns r to lines of a file of the given size: it starts at the first line
+// that starts within r, passing over a partial first line unless r starts at 0, and ends
+// after the last such line, reading past r to complete it. The ranges of consecutive
+// byte ranges thus cover every line exactly once.
+func lineRange(file *os.File, size int64, r segment) (segment, error) {
+	buf := make([]byte, 64*1024)
+	var start int64
+	if r.start > 0 {
+		var err error
+		if start, err = lineEndAfter(file, min(r.start, size), size, buf); err != nil {
+			return segment{}, err
+		}
+	}
+	end, err := lineEndAfter(file, max(start, min(r.end, size)), size, buf)
+	if err != nil {
+		return segment{}, err
+	}
+	return segment{start: start, end: end}, nil
+}
+
+// processByteRange processes the lines starting within r of the file with processRange,
+// for --byte-range.
+func processByteRange(file *os.File, size int64, r segment, processRange func(start, end int64, final bool) (int64, error)) error {
+	lines, err := lineRange(file, size, r)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(diag, "Byte range %d-%d: lines at bytes %d-%d\n", r.start, r.end, lines.start, lines.end)
+	if lines.start == lines.end {
+		return nil
+	}
+	_, err = processRange(lines.start, lines.end, true)
+	return err
+}
+
+// writeManifest writes the segment manifest to name: a header with the input file, its size
+// and the segment size, followed by one "index start end" line per segment.
+func writeManifest(name, fileName string, size, segSize int64, segs []segment) error {
+	f, err := os.Create(name)
+	if err != nil {
+		return fmt.Errorf("error creating manifest: %w", err)
+	}
+	w := bufio.NewWriter(f)
+	fmt.Fprintf(w, "# file=%s size=%d segment-size=%d segments=%d\n", fileName, size, segSize, len(segs))
+	for i, s := range segs {
+		fmt.Fprintf(w, "%d\t%d\t%d\n", i, s.start, s.end)
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return fmt.Errorf("error writing manifest: %w", err)
+	}
+	return f.Close()
+}
+
+// processSegments splits the file into fixed segments, writes the manifest if --manifest is
+// given, and processes the segments selected by --chunks (all if none are selected) with
+// processRange. All selected indices are validated before anything is processed.
+func processSegments(file *os.File, size int64, opts *options, processRange func(start, end int64, final bool) (int64, error)) error {
+	segs, err := fileSegments(file, size, opts.segmentSize)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(diag, "File has %d segment(s) of up to %d bytes\n", len(segs), opts.segmentSize)
+	if opts.manifest != "" {
+		if err := writeManifest(opts.manifest, file.Name(), size, opts.segmentSize, segs); err != nil {
+			return err
+		}
+		fmt.Fprintf(diag, "Segment manifest written to %s\n", opts.manifest)
+	}
+	selected := opts.chunks
+	if selected == nil {
+		for i := range segs {
+			selected = append(selected, i)
+		}
+	}
+	for _, i := range selected {
+		if i >= len(segs) {
+			return fmt.Errorf("--chunks: segment %d out of range, the file has %d segment(s)", i, len(segs))
+		}
+	}
+	for _, i := range selected {
+		s := segs[i]
+		fmt.Fprintf(diag, "Segment %d: bytes %d-%d\n", i, s.start, s.end)
+		if _, err := processRange(s.start, s.end, true); err != nil {
+			return err
+		}
+	}
+	return nil
+}
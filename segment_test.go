@@ -0,0 +1,51 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestByteRanges counts the self-test dataset as consecutive --byte-range pieces that
+// start at 0, at a line start, on a newline, in the middle of a line, past the last
+// newline and past the end, and checks that the pieces together count the non-empty lines
+// of the whole file exactly once and dump all of the addresses.
+func TestByteRanges(t *testing.T) {
+	path, data, expected := selfTestDataset(t)
+	want := len(expected)
+	dir := t.TempDir()
+	whole := countArgs(t, path, "--bitset", "sparse", "--format", "csv")
+	mid := len(data) / 2
+	nl := mid + bytes.IndexByte(data[mid:], '\n')
+	last := bytes.LastIndexByte(data, '\n')
+	cuts := []int{0, len(data) / 5, nl, nl + 1, nl + 4, last + 1, len(data) + 10}
+	seen := make(map[string]bool)
+	var total int64
+	for i := range len(cuts) - 1 {
+		dump := filepath.Join(dir, fmt.Sprintf("range-%d.txt", i))
+		opts, err := parseFlags([]string{"--byte-range", fmt.Sprintf("%d:%d", cuts[i], cuts[i+1]-cuts[i]),
+			"--bitset", "sparse", "--format", "csv", "--dump", dump, path})
+		if err != nil {
+			t.Fatal(err)
+		}
+		res, err := countUniqueIpInFile(path, opts)
+		if err != nil && !errors.Is(err, ErrNoValidIPs) {
+			t.Fatalf("bytes %d-%d: %v", cuts[i], cuts[i+1], err)
+		}
+		total += res.Total
+		listed, err := os.ReadFile(dump)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, ip := range strings.Fields(string(listed)) {
+			seen[ip] = true
+		}
+	}
+	if total != whole.Total || len(seen) != want {
+		t.Fatalf("the ranges held %d line(s) and %d address(es), expected %d and %d", total, len(seen), whole.Total, want)
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// --- Self-Test ---
+// selfTestLines is the number of records in the synthetic dataset. It is large enough for
+// the file to exceed ChunkMinSize, so the multi-worker chunking is exercised.
+const selfTestLines = 200_000
+
+// selfTestJunk holds lines that are not valid records. Several are shorter than an address,
+// so a skip after the newline that crossed a delimiter would swallow the next address.
+var selfTestJunk = []string{
+	"", "", "x", "1.2", "1.2.3", "1.2.3.", "256.1.1.1", "1.2.3.4.5", "a.b.c.d",
+	"1.2.3.4x", " 1.2.3.4", "1.2.3.1000", "not an address at all",
+}
+
+// writeSelfTestData writes the synthetic dataset to w and returns the set of valid addresses
+// it contains. The data mixes valid addresses with junk lines, empty lines and runs of zero
+// bytes, and ends with an address that has no trailing newline.
+func writeSelfTestData(w io.Writer, rnd *rand.Rand) (map[uint32]bool, error) {
+	bw := bufio.NewWriter(w)
+	expected := make(map[uint32]bool)
+	var recent []uint32
+	for i := 0; i < selfTestLines; i++ {
+		switch n := rnd.Intn(100); {
+		case n < 10:
+			bw.WriteString(selfTestJunk[rnd.Intn(len(selfTestJunk))])
+			bw.WriteByte('\n')
+		case n < 11:
+			bw.Write(make([]byte, 1+rnd.Intn(64)))
+			bw.WriteByte('\n')
+		default:
+			var ip uint32
+			if n < 40 && len(recent) > 0 {
+				ip = recent[rnd.Intn(len(recent))] // A duplicate.
+			} else {
+				// Mix short and long octets, so that line lengths vary from 7 to 15 bytes.
+				ip = rnd.Uint32() & []uint32{0x07070707, 0x3f3f3f3f, 0xffffffff}[rnd.Intn(3)]
+				recent = append(recent, ip)
+			}
+			expected[ip] = true
+			bw.WriteString(formatIP(ip))
+			bw.WriteByte('\n')
+		}
+	}
+	last := rnd.Uint32()
+	expected[last] = true
+	bw.WriteString(formatIP(last))
+	return expected, bw.Flush()
+}
+
+// selfTestCases lists the option sets the dataset is counted with.
+var selfTestCases = [][]string{
+	{"--single-thread"},
+	{"--workers", "2"},
+	{"--workers", "3"},
+	{"--workers", "7"},
+	{"--workers", "4", "--min-record-len", "1"},
+	{"--workers", "4", "--min-record-len", "15"},
+	{"--workers", "5", "--tolerant-spaces"},
+	{"--workers", "4", "--strip-port"},
+	{"--workers", "3", "--bitset", "sparse"},
+	{"--workers", "3", "--bitset", "sparse", "--spill-above", "20000"},
+	{"--workers", "6", "--segment-size", "100000", "--manifest", os.DevNull},
+}
+
+// runSelfTest counts a synthetic dataset with known contents using each of selfTestCases,
+// plus the in-memory library path, and reports any discrepancy. It returns the exit status:
+// 0 if every case produced the expected count, 1 otherwise.
+func runSelfTest(args []string) int {
+	seed := int64(1)
+	if len(args) > 0 {
+		if _, err := fmt.Sscan(args[0], &seed); err != nil {
+			fmt.Fprintln(os.Stderr, "Usage: ipcounter selftest [seed]")
+			return 2
+		}
+	}
+	dir, err := os.MkdirTemp("", "ipcounter-selftest-*")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		return 1
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "ips.txt")
+	f, err := os.Create(path)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		return 1
+	}
+	expected, err := writeSelfTestData(f, rand.New(rand.NewSource(seed)))
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		return 1
+	}
+	want := len(expected)
+	fmt.Printf("Self-test dataset: %d lines, %d unique addresses (seed %d)\n", selfTestLines+1, want, seed)
+
+	// Progress messages of the individual runs would drown the report.
+	out := diag
+	diag = io.Discard
+	defer func() { diag = out }()
+
+	failed := 0
+	// cases counts the results as they are reported.
+	cases := 0
+	report := func(name string, got, want int, err error) {
+		cases++
+		switch {
+		case err != nil:
+			failed++
+			fmt.Printf("FAIL %s: %v\n", name, err)
+		case got != want:
+			failed++
+			fmt.Printf("FAIL %s: counted %d, expected %d\n", name, got, want)
+		default:
+			fmt.Printf("ok   %s\n", name)
+		}
+	}
+	count := func(args []string) (int, error) {
+		opts, err := parseFlags(append(args[:len(args):len(args)], path))
+		if err != nil {
+			return 0, err
+		}
+		res, err := countUniqueIpInFile(path, opts)
+		return res.Unique, err
+	}
+	for _, tc := range selfTestCases {
+		got, err := count(tc)
+		report(strings.Join(tc, " "), got, want, err)
+	}
+	data, err := os.ReadFile(path)
+	if err == nil {
+		report("CountUniqueInBytes", CountUniqueInBytes(data, 3), want, nil)
+		report("CountUniqueInBytesWorkers", CountUniqueInBytesWorkers(data, 2, 5), want, nil)
+	} else {
+		report("CountUniqueInBytes", 0, want, err)
+		report("CountUniqueInBytesWorkers", 0, want, err)
+	}
+
+	if failed > 0 {
+		fmt.Printf("Self-test FAILED: %d of %d case(s)\n", failed, cases)
+		return 1
+	}
+	fmt.Printf("Self-test passed: %d case(s)\n", cases)
+	return 0
+}
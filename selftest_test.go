@@ -0,0 +1,43 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// selfTestDataset writes the dataset of the self-test, with seed 1, to a temporary
+// directory of the test and returns its path, its contents and the valid addresses in it.
+func selfTestDataset(t *testing.T) (string, []byte, map[uint32]bool) {
+	t.Helper()
+	var buf bytes.Buffer
+	expected, err := writeSelfTestData(&buf, rand.New(rand.NewSource(1)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "ips.txt")
+	if err := os.WriteFile(path, buf.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path, buf.Bytes(), expected
+}
+
+// countArgs counts the file at path with args and no diagnostics.
+func countArgs(t *testing.T, path string, args ...string) Result {
+	t.Helper()
+	out := diag
+	diag = io.Discard
+	t.Cleanup(func() { diag = out })
+	opts, err := parseFlags(append(args, path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := countUniqueIpInFile(path, opts)
+	if err != nil {
+		t.Fatalf("%v: %v", args, err)
+	}
+	return res
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math/bits"
+	"os"
+	"time"
+)
+
+// --- Serialization ---
+// A serialized bitset consists of a fixed header followed by the bitset words in
+// little-endian order and a checksum of those words:
+//
+//	magic    [4]byte "IPBS"
+//	version  uint32
+//	words    uint64  number of uint64 words that follow
+//	count    uint64  number of set bits in the words
+//	payload  [words]uint64
+//	checksum uint32  CRC-32C (Castagnoli) of the payload bytes
+//
+// Version 1 files, whose 16-byte header ends after words and which have no checksum,
+// are still read, without either check.
+const (
+	bitSetMagic   = "IPBS"
+	bitSetVersion = 2
+	headerSizeV1  = 16      // Size of the version 1 header in bytes.
+	headerSize    = 24      // Size of the serialized header in bytes.
+	checksumSize  = 4       // Size of the checksum after the payload in bytes.
+	ioWords       = 1 << 17 // Words per read/write block (1MiB).
+)
+
+// crcTable is the CRC-32C table of the payload checksum, hardware accelerated on most CPUs.
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// ErrBadBitSetFile is returned when a serialized bitset has an invalid header or size,
+// or fails its checksum or count check.
+var ErrBadBitSetFile = errors.New("invalid serialized bitset")
+
+// WriteTo writes the serialized bitset to w. It implements io.WriterTo. The set must not
+// be modified while it is written, since the count in the header is taken beforehand.
+func (bs *AtomicBitSet) WriteTo(w io.Writer) (int64, error) {
+	written, _, err := bs.write(w, uint64(bs.Count()))
+	return written, err
+}
+
+// write writes the serialized bitset to w with count in the header, and returns the
+// number of bytes written and of set bits in the payload, counted as it is encoded.
+func (bs *AtomicBitSet) write(w io.Writer, count uint64) (int64, uint64, error) {
+	header := make([]byte, headerSize)
+	copy(header, bitSetMagic)
+	binary.LittleEndian.PutUint32(header[4:], bitSetVersion)
+	binary.LittleEndian.PutUint64(header[8:], uint64(len(bs.bits)))
+	binary.LittleEndian.PutUint64(header[16:], count)
+	n, err := w.Write(header)
+	written := int64(n)
+	if err != nil {
+		return written, 0, err
+	}
+
+	buf := make([]byte, ioWords*8)
+	crc, ones := uint32(0), uint64(0)
+	for start := 0; start < len(bs.bits); start += ioWords {
+		words := bs.bits[start:min(start+ioWords, len(bs.bits))]
+		for i, word := range words {
+			binary.LittleEndian.PutUint64(buf[i*8:], word)
+			ones += uint64(bits.OnesCount64(word))
+		}
+		block := buf[:len(words)*8]
+		crc = crc32.Update(crc, crcTable, block)
+		n, err := w.Write(block)
+		written += int64(n)
+		if err != nil {
+			return written, ones, err
+		}
+	}
+	n, err = w.Write(binary.LittleEndian.AppendUint32(nil, crc))
+	return written + int64(n), ones, err
+}
+
+// bitSetHeader is the part of a serialized bitset header needed to read the payload.
+type bitSetHeader struct {
+	version uint32
+	count   uint64 // Stored number of set bits, only for version 2 and later.
+}
+
+// readBitSetHeader reads and validates a serialized bitset header.
+func readBitSetHeader(r io.Reader) (bitSetHeader, error) {
+	header := make([]byte, headerSize)
+	if _, err := io.ReadFull(r, header[:headerSizeV1]); err != nil {
+		return bitSetHeader{}, fmt.Errorf("%w: reading header: %w", ErrBadBitSetFile, err)
+	}
+	if string(header[:4]) != bitSetMagic {
+		return bitSetHeader{}, fmt.Errorf("%w: bad magic", ErrBadBitSetFile)
+	}
+	h := bitSetHeader{version: binary.LittleEndian.Uint32(header[4:])}
+	if h.version != 1 && h.version != bitSetVersion {
+		return h, fmt.Errorf("%w: unsupported version %d", ErrBadBitSetFile, h.version)
+	}
+	if words := binary.LittleEndian.Uint64(header[8:]); words != MaxIPv4/BucketSize {
+		return h, fmt.Errorf("%w: unexpected size of %d words", ErrBadBitSetFile, words)
+	}
+	if h.version > 1 {
+		if _, err := io.ReadFull(r, header[headerSizeV1:]); err != nil {
+			return h, fmt.Errorf("%w: reading header: %w", ErrBadBitSetFile, err)
+		}
+		h.count = binary.LittleEndian.Uint64(header[headerSizeV1:])
+	}
+	return h, nil
+}
+
+// orFrom reads the payload of a serialized bitset from r block by block and ORs it
+// into bs, so that only one block of the input is held in memory at a time. The
+// checksum of the payload is always verified. With verifyCount, the set bits of the
+// payload are counted as it is read and compared with the count in the header, which
+// matches what Count would return on the stored bitset alone.
+func (bs *AtomicBitSet) orFrom(r io.Reader, verifyCount bool) error {
+	h, err := readBitSetHeader(r)
+	if err != nil {
+		return err
+	}
+	buf := make([]byte, ioWords*8)
+	crc, ones := uint32(0), uint64(0)
+	for start := 0; start < len(bs.bits); start += ioWords {
+		words := bs.bits[start:min(start+ioWords, len(bs.bits))]
+		block := buf[:len(words)*8]
+		if _, err := io.ReadFull(r, block); err != nil {
+			return fmt.Errorf("%w: reading payload: %w", ErrBadBitSetFile, err)
+		}
+		crc = crc32.Update(crc, crcTable, block)
+		for i := range words {
+			word := binary.LittleEndian.Uint64(buf[i*8:])
+			if verifyCount {
+				ones += uint64(bits.OnesCount64(word))
+			}
+			words[i] |= word
+		}
+	}
+	if h.version == 1 {
+		return nil
+	}
+	if _, err := io.ReadFull(r, buf[:checksumSize]); err != nil {
+		return fmt.Errorf("%w: reading checksum: %w", ErrBadBitSetFile, err)
+	}
+	if stored := binary.LittleEndian.Uint32(buf); stored != crc {
+		return fmt.Errorf("%w: payload checksum %08x does not match stored %08x", ErrBadBitSetFile, crc, stored)
+	}
+	if verifyCount && ones != h.count {
+		return fmt.Errorf("%w: payload holds %d addresses, but the header stores %d", ErrBadBitSetFile, ones, h.count)
+	}
+	return nil
+}
+
+// ReadBitSet reads a serialized bitset written by WriteTo, verifying its checksum.
+func ReadBitSet(r io.Reader) (*AtomicBitSet, error) {
+	bs := NewAtomicBitSet()
+	if err := bs.orFrom(r, false); err != nil {
+		return nil, err
+	}
+	return bs, nil
+}
+
+// ReadBitSetVerified is like ReadBitSet, but also checks that the count stored in the
+// header matches the number of addresses in the payload. The check costs a popcount
+// of each word as it is read, well below the cost of reading the 512MB.
+func ReadBitSetVerified(r io.Reader) (*AtomicBitSet, error) {
+	bs := NewAtomicBitSet()
+	if err := bs.orFrom(r, true); err != nil {
+		return nil, err
+	}
+	return bs, nil
+}
+
+// writeBitSetFile serializes bs to the named file. The count in the header is taken as
+// the words are encoded and filled in afterwards, so writing needs no separate Count pass.
+func writeBitSetFile(fileName string, bs *AtomicBitSet) error {
+	file, err := os.Create(fileName)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(file)
+	_, ones, err := bs.write(w, 0)
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		_, err = file.WriteAt(binary.LittleEndian.AppendUint64(nil, ones), 16)
+	}
+	if err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// orFile ORs the serialized bitset stored in the named file into bs, verifying the
+// stored count with verifyCount.
+func (bs *AtomicBitSet) orFile(fileName string, verifyCount bool) error {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrOpenFailed, err)
+	}
+	defer file.Close()
+	return bs.orFrom(bufio.NewReader(file), verifyCount)
+}
+
+// --- Merging ---
+// mergeBitSetFiles ORs the serialized bitsets in files into a single accumulator,
+// streaming each input so that only one full bitset is held in memory. If out is not
+// empty, the combined bitset is written there. With verifyCount, the count stored in each
+// input is checked against its payload. With noCount, the combined bitset is not counted.
+func mergeBitSetFiles(files []string, out string, verifyCount, noCount bool) (Result, error) {
+	startTime := time.Now()
+	res := Result{Path: out}
+
+	acc := NewAtomicBitSet()
+	for i, name := range files {
+		if err := acc.orFile(name, verifyCount); err != nil {
+			return res, fmt.Errorf("%s: %w", name, err)
+		}
+		fmt.Fprintf(diag, "[%d/%d] merged %s\n", i+1, len(files), name)
+		// An input of version 1 has a shorter header and no checksum.
+		fi, err := os.Stat(name)
+		if err != nil {
+			return res, fmt.Errorf("%s: %w", name, err)
+		}
+		res.Bytes += fi.Size()
+	}
+	if out != "" {
+		if err := writeBitSetFile(out, acc); err != nil {
+			return res, fmt.Errorf("error writing %s: %w", out, err)
+		}
+		fmt.Fprintf(diag, "Combined bitset written to %s\n", out)
+	}
+	if noCount {
+		res.NotCounted = true
+	} else {
+		res.Unique = acc.Count()
+	}
+	res.DurationMs = time.Since(startTime).Milliseconds()
+	fmt.Fprintf(diag, "Merged %d bitset(s) in %v\n", len(files), time.Since(startTime))
+	return res, nil
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestMergeBytes checks that merging counts the real size of each input, including a
+// version 1 input, which has a shorter header and no checksum.
+func TestMergeBytes(t *testing.T) {
+	out := diag
+	diag = io.Discard
+	t.Cleanup(func() { diag = out })
+	dir := t.TempDir()
+	v2 := filepath.Join(dir, "v2.bits")
+	bs := NewAtomicBitSet()
+	bs.Set(0x01020304)
+	if err := writeBitSetFile(v2, bs); err != nil {
+		t.Fatal(err)
+	}
+	// An empty version 1 bitset: the header, then a payload of zero words.
+	v1 := filepath.Join(dir, "v1.bits")
+	header := binary.LittleEndian.AppendUint32([]byte(bitSetMagic), 1)
+	header = binary.LittleEndian.AppendUint64(header, uint64(len(bs.bits)))
+	if err := os.WriteFile(v1, header, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(v1, headerSizeV1+int64(len(bs.bits))*8); err != nil {
+		t.Fatal(err)
+	}
+	res, err := mergeBitSetFiles([]string{v1, v2}, "", false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := int64(headerSizeV1+headerSize+checksumSize) + 2*int64(len(bs.bits))*8; res.Bytes != want || res.Unique != 1 {
+		t.Errorf("merged %d byte(s) and %d address(es), expected %d and 1", res.Bytes, res.Unique, want)
+	}
+}
+
+// flipReader flips the bits of mask in the byte at offset at of the stream it reads.
+type flipReader struct {
+	r     io.Reader
+	at, n int64
+	mask  byte
+}
+
+func (fr *flipReader) Read(p []byte) (int, error) {
+	n, err := fr.r.Read(p)
+	if i := fr.at - fr.n; i >= 0 && i < int64(n) {
+		p[i] ^= fr.mask
+	}
+	fr.n += int64(n)
+	return n, err
+}
+
+// TestBitSetChecks writes a serialized bitset and reads it back with ReadBitSetVerified,
+// intact, with a flipped payload bit, which the checksum must catch, and with a changed
+// count in the header, which only the count check catches.
+func TestBitSetChecks(t *testing.T) {
+	bs := NewAtomicBitSet()
+	for _, ip := range []uint32{0, 1, 0x01020304, 0xc0a80001, math.MaxUint32} {
+		bs.Set(ip)
+	}
+	read := func(at int64, mask byte, verify bool) (*AtomicBitSet, error) {
+		pr, pw := io.Pipe()
+		go func() {
+			_, err := bs.WriteTo(pw)
+			pw.CloseWithError(err)
+		}()
+		defer pr.Close()
+		r := &flipReader{r: bufio.NewReader(pr), at: at, mask: mask}
+		if verify {
+			return ReadBitSetVerified(r)
+		}
+		return ReadBitSet(r)
+	}
+	got, err := read(0, 0, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Count() != bs.Count() || !got.IsSet(0xc0a80001) {
+		t.Fatalf("read back %d addresses, expected %d", got.Count(), bs.Count())
+	}
+	got = nil
+	if _, err := read(headerSize+1000, 0x10, false); !errors.Is(err, ErrBadBitSetFile) {
+		t.Fatalf("flipped payload bit: got %v, expected a checksum error", err)
+	}
+	if _, err := read(16, 0x02, false); err != nil {
+		t.Fatalf("changed count without verification: %v", err)
+	}
+	if _, err := read(16, 0x02, true); !errors.Is(err, ErrBadBitSetFile) {
+		t.Fatalf("changed count: got %v, expected a count error", err)
+	}
+}
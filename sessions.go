@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// --- Sessions ---
+// session is the state of one address within a run of timestamped records in file order:
+// the timestamps of its first and last record, and the number of sessions it began.
+type session struct {
+	first, last int64
+	count       int64
+}
+
+// ipSessions counts the sessions of the addresses of timestamped input, for
+// --session-window: a record begins a new session of its address unless it comes at most
+// window seconds after the previous record of that address, so an address seen again
+// within the window continues its session. Records are taken in file order, and one
+// earlier than the previous record of its address continues its session, so the input
+// should be sorted by time. Each worker counts a run of records in a map of its own, of
+// up to about 140 bytes per address while it grows, and the runs are folded in file order.
+type ipSessions struct {
+	window int64 // Longest gap between the records of one session, in seconds.
+	ips    map[uint32]session
+}
+
+func newIPSessions(window int64) *ipSessions {
+	return &ipSessions{window: window, ips: make(map[uint32]session)}
+}
+
+// run returns an empty map with the same window, for the records of one worker.
+func (s *ipSessions) run() *ipSessions {
+	return newIPSessions(s.window)
+}
+
+// observe records that ip was seen at timestamp ts, after the records observed so far.
+func (s *ipSessions) observe(ip uint32, ts int64) {
+	cur, ok := s.ips[ip]
+	if !ok {
+		s.ips[ip] = session{first: ts, last: ts, count: 1}
+		return
+	}
+	if ts-cur.last > s.window {
+		cur.count++
+	}
+	cur.last = ts
+	s.ips[ip] = cur
+}
+
+// appendRun folds in the sessions of run, whose records follow all those observed so far.
+// The first record of an address in run continues its last session if within the window.
+func (s *ipSessions) appendRun(run *ipSessions) {
+	if len(s.ips) == 0 {
+		s.ips, run.ips = run.ips, s.ips
+		return
+	}
+	for ip, r := range run.ips {
+		cur, ok := s.ips[ip]
+		if !ok {
+			s.ips[ip] = r
+			continue
+		}
+		cur.count += r.count
+		if r.first-cur.last <= s.window {
+			cur.count--
+		}
+		cur.last = r.last
+		s.ips[ip] = cur
+	}
+}
+
+// total returns the number of sessions of all addresses.
+func (s *ipSessions) total() int64 {
+	var n int64
+	for _, cur := range s.ips {
+		n += cur.count
+	}
+	return n
+}
+
+// printSessions reports the sessions of --session-window and records their number in res.
+func printSessions(opts *options, res *Result) {
+	s := opts.sessions
+	if s == nil {
+		return
+	}
+	res.Sessions = s.total()
+	fmt.Fprintf(diag, "Sessions (--session-window %v): %d of %d address(es)\n", time.Duration(s.window)*time.Second, res.Sessions, len(s.ips))
+}
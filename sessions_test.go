@@ -0,0 +1,65 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+// TestSessions counts the sessions of --session-window around the window boundary, where
+// a gap of exactly the window continues a session and one second more begins another,
+// and of random time-ordered records with gaps next to the window. Every input is
+// processed on 1 to 4 workers and split into two calls, as windows of the input are, so
+// that sessions spanning the chunks of different workers are folded as well.
+func TestSessions(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	const window = 300
+	boundary := strings.Join([]string{
+		"1000 1.1.1.1", "1000 2.2.2.2", "1300 1.1.1.1", "1301 2.2.2.2",
+		"1600 1.1.1.1", "1901 1.1.1.1", "1901 1.1.1.1", "1902 3.3.3.3",
+	}, "\n") + "\n"
+	wantBoundary := map[uint32]int64{0x01010101: 2, 0x02020202: 2, 0x03030303: 1}
+
+	var random strings.Builder
+	wantRandom := make(map[uint32]int64)
+	last := make(map[uint32]int64)
+	ts := int64(1_700_000_000)
+	for range 5000 {
+		ip := uint32(10<<24 | r.Intn(200))
+		if prev, ok := last[ip]; ok {
+			// Land next to the window after the previous record of the address.
+			ts = max(ts, prev+window+int64(r.Intn(3))-1)
+		}
+		if prev, ok := last[ip]; !ok || ts-prev > window {
+			wantRandom[ip]++
+		}
+		last[ip] = ts
+		fmt.Fprintf(&random, "%d %s\n", ts, formatIP(ip))
+		ts += int64(r.Intn(2))
+	}
+
+	for _, c := range []struct {
+		name string
+		data string
+		want map[uint32]int64
+	}{{"boundary", boundary, wantBoundary}, {"random", random.String(), wantRandom}} {
+		for workers := 1; workers <= 4; workers++ {
+			data := []byte(c.data)
+			half := bytes.IndexByte(data[len(data)/2:], '\n') + len(data)/2 + 1
+			sessions := newIPSessions(window)
+			for _, part := range [][]byte{data[:half], data[half:]} {
+				processDataTimed(part, NewSparseSet(), workers, timeColumns{time: 0, ip: 1}, parseIPFast, parseEpoch, nil, nil, nil, sessions, false)
+			}
+			if len(sessions.ips) != len(c.want) {
+				t.Fatalf("%s on %d worker(s): %d address(es), expected %d", c.name, workers, len(sessions.ips), len(c.want))
+			}
+			for ip, want := range c.want {
+				if got := sessions.ips[ip].count; got != want {
+					t.Fatalf("%s on %d worker(s): %s has %d session(s), expected %d", c.name, workers, formatIP(ip), got, want)
+				}
+			}
+		}
+	}
+}
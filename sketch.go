@@ -0,0 +1,127 @@
+package main
+
+import (
+	"container/heap"
+	"fmt"
+	"math"
+	"sync/atomic"
+)
+
+// --- Count-Min Sketch ---
+// CountMinSketch estimates how often each address occurs using depth rows of width counters.
+// An estimate never undercounts; with probability at least 1-e^-depth it overcounts by at
+// most e/width times the total number of records. Memory is width*depth*4 bytes,
+// independent of the number of unique addresses.
+type CountMinSketch struct {
+	width    uint64
+	depth    int
+	counters []uint32 // depth rows of width counters, updated atomically.
+	total    atomic.Uint64
+}
+
+// NewCountMinSketch creates an empty sketch with the given number of counters per row and rows.
+func NewCountMinSketch(width, depth int) *CountMinSketch {
+	return &CountMinSketch{
+		width:    uint64(width),
+		depth:    depth,
+		counters: make([]uint32, width*depth),
+	}
+}
+
+// mix64 returns a 64-bit mix of x (the splitmix64 finalizer), whose bits are all
+// equally likely to be set.
+func mix64(x uint64) uint64 {
+	h := x + 0x9e3779b97f4a7c15
+	h = (h ^ (h >> 30)) * 0xbf58476d1ce4e5b9
+	h = (h ^ (h >> 27)) * 0x94d049bb133111eb
+	return h ^ h>>31
+}
+
+// sketchHash returns the two halves of a 64-bit mix of ip, from which the row indexes are
+// derived by double hashing.
+func sketchHash(ip uint32) (uint64, uint64) {
+	h := mix64(uint64(ip))
+	return h & 0xffffffff, h>>32 | 1
+}
+
+// Add records one occurrence of ip.
+func (s *CountMinSketch) Add(ip uint32) {
+	h1, h2 := sketchHash(ip)
+	for row := 0; row < s.depth; row++ {
+		i := uint64(row)*s.width + (h1+uint64(row)*h2)%s.width
+		atomic.AddUint32(&s.counters[i], 1)
+	}
+	s.total.Add(1)
+}
+
+// Estimate returns the estimated number of occurrences of ip. It is never less than the true count.
+func (s *CountMinSketch) Estimate(ip uint32) uint32 {
+	h1, h2 := sketchHash(ip)
+	estimate := uint32(math.MaxUint32)
+	for row := 0; row < s.depth; row++ {
+		i := uint64(row)*s.width + (h1+uint64(row)*h2)%s.width
+		estimate = min(estimate, atomic.LoadUint32(&s.counters[i]))
+	}
+	return estimate
+}
+
+// ErrorBound returns the additive overestimate bound e/width*total that holds
+// with probability 1-e^-depth.
+func (s *CountMinSketch) ErrorBound() float64 {
+	return math.E / float64(s.width) * float64(s.total.Load())
+}
+
+// ipFrequency is an address with its estimated number of occurrences.
+type ipFrequency struct {
+	ip    uint32
+	count uint32
+}
+
+// frequencyHeap is a min-heap of ipFrequency ordered by count.
+type frequencyHeap []ipFrequency
+
+func (h frequencyHeap) Len() int           { return len(h) }
+func (h frequencyHeap) Less(i, j int) bool { return h[i].count < h[j].count }
+func (h frequencyHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h *frequencyHeap) Push(x any)        { *h = append(*h, x.(ipFrequency)) }
+func (h *frequencyHeap) Pop() any {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
+
+// topK returns the k addresses of set with the highest estimated frequency, most frequent first.
+// The candidates are the exact unique addresses of the set, so only the counts are approximate.
+func (s *CountMinSketch) topK(set IPSet, k int) []ipFrequency {
+	h := make(frequencyHeap, 0, k+1)
+	set.ForEach(func(ip uint32) {
+		count := s.Estimate(ip)
+		if len(h) < k {
+			heap.Push(&h, ipFrequency{ip: ip, count: count})
+		} else if count > h[0].count {
+			h[0] = ipFrequency{ip: ip, count: count}
+			heap.Fix(&h, 0)
+		}
+	})
+	top := make([]ipFrequency, len(h))
+	for i := len(top) - 1; i >= 0; i-- {
+		top[i] = heap.Pop(&h).(ipFrequency)
+	}
+	return top
+}
+
+// printSketch prints the estimated frequencies of the queried addresses and the top-K addresses.
+func printSketch(s *CountMinSketch, set IPSet, query []uint32, k int) {
+	fmt.Fprintf(diag, "Count-Min sketch: %d records, estimates exceed true counts by at most %.1f with probability %.4f\n",
+		s.total.Load(), s.ErrorBound(), 1-math.Exp(-float64(s.depth)))
+	for _, ip := range query {
+		fmt.Fprintf(diag, "%s ~%d\n", formatIP(ip), s.Estimate(ip))
+	}
+	if k > 0 {
+		fmt.Fprintf(diag, "Top %d address(es) by estimated frequency:\n", k)
+		for _, f := range s.topK(set, k) {
+			fmt.Fprintf(diag, "%s ~%d\n", formatIP(f.ip), f.count)
+		}
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"slices"
+	"sync"
+)
+
+// --- SparseSet ---
+// sparseShards is the number of independently locked shards of a SparseSet.
+const sparseShards = 256
+
+// SparseSet stores unique IPv4 addresses in sharded hash sets. Its memory grows with the
+// number of unique addresses (roughly 20-40 bytes each) instead of the fixed 512MB of an
+// AtomicBitSet, which makes it the better choice when few distinct addresses are expected.
+type SparseSet struct {
+	hash   hashFunc // Picks the shard of an address by its top 8 bits.
+	shards [sparseShards]sparseShard
+}
+
+// sparseShard is one lock-protected part of a SparseSet.
+type sparseShard struct {
+	mu  sync.Mutex
+	ips map[uint32]struct{}
+}
+
+// NewSparseSet creates an empty SparseSet.
+func NewSparseSet() *SparseSet {
+	return newSparseSetHash(defaultHash)
+}
+
+// newSparseSetHash creates an empty SparseSet that spreads addresses over its shards with hash.
+func newSparseSetHash(hash hashFunc) *SparseSet {
+	s := &SparseSet{hash: hash}
+	for i := range s.shards {
+		s.shards[i].ips = make(map[uint32]struct{})
+	}
+	return s
+}
+
+// shard returns the shard responsible for ip. Addresses are spread with a hash so that
+// sequential addresses do not all land in the same shard.
+func (s *SparseSet) shard(ip uint32) *sparseShard {
+	return &s.shards[s.hash(ip)>>56]
+}
+
+// Set adds the given IPv4 address to the set.
+func (s *SparseSet) Set(ip uint32) {
+	s.add(ip)
+}
+
+// SetNew adds the given IPv4 address to the set and reports whether it was not yet present.
+func (s *SparseSet) SetNew(ip uint32) bool {
+	return s.add(ip)
+}
+
+// add adds the given IPv4 address to the set and reports whether it was not yet present.
+func (s *SparseSet) add(ip uint32) bool {
+	sh := s.shard(ip)
+	sh.mu.Lock()
+	n := len(sh.ips)
+	sh.ips[ip] = struct{}{}
+	added := len(sh.ips) > n
+	sh.mu.Unlock()
+	return added
+}
+
+// IsSet reports whether the given IPv4 address is in the set.
+func (s *SparseSet) IsSet(ip uint32) bool {
+	sh := s.shard(ip)
+	sh.mu.Lock()
+	_, ok := sh.ips[ip]
+	sh.mu.Unlock()
+	return ok
+}
+
+// Count returns the number of unique IPv4 addresses.
+func (s *SparseSet) Count() int {
+	total := 0
+	for i := range s.shards {
+		sh := &s.shards[i]
+		sh.mu.Lock()
+		total += len(sh.ips)
+		sh.mu.Unlock()
+	}
+	return total
+}
+
+// CountRange returns the number of addresses in the inclusive range [start, end] that are in the set.
+func (s *SparseSet) CountRange(start, end uint32) int {
+	count := 0
+	for i := range s.shards {
+		sh := &s.shards[i]
+		sh.mu.Lock()
+		for ip := range sh.ips {
+			if ip >= start && ip <= end {
+				count++
+			}
+		}
+		sh.mu.Unlock()
+	}
+	return count
+}
+
+// AnySetInRange reports whether any address in the inclusive range [start, end] is in the set.
+func (s *SparseSet) AnySetInRange(start, end uint32) bool {
+	for i := range s.shards {
+		sh := &s.shards[i]
+		sh.mu.Lock()
+		for ip := range sh.ips {
+			if ip >= start && ip <= end {
+				sh.mu.Unlock()
+				return true
+			}
+		}
+		sh.mu.Unlock()
+	}
+	return false
+}
+
+// ForEach calls fn for every address in the set, in ascending order.
+// The addresses are collected and sorted first, which needs 4 bytes per address.
+func (s *SparseSet) ForEach(fn func(ip uint32)) {
+	ips := make([]uint32, 0, s.Count())
+	for i := range s.shards {
+		sh := &s.shards[i]
+		sh.mu.Lock()
+		for ip := range sh.ips {
+			ips = append(ips, ip)
+		}
+		sh.mu.Unlock()
+	}
+	slices.Sort(ips)
+	for _, ip := range ips {
+		fn(ip)
+	}
+}
+
+// BitSet returns a dense AtomicBitSet holding the same addresses.
+func (s *SparseSet) BitSet() *AtomicBitSet {
+	bs := NewAtomicBitSet()
+	s.ForEach(bs.Set)
+	return bs
+}
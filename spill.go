@@ -0,0 +1,233 @@
+package main
+
+import (
+	"bufio"
+	"container/heap"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// --- Spilling Set ---
+// SpillSet is a SparseSet that bounds its memory by spilling to disk: once it holds limit
+// addresses, they are written to a temporary file as a sorted run and the in-memory set is
+// emptied. Queries merge the runs with the in-memory addresses, as in an external merge
+// sort, so counts stay exact however many distinct addresses the input has.
+type SpillSet struct {
+	mu    sync.RWMutex // Held shared by Set and exclusively while spilling or reading.
+	mem   *SparseSet
+	size  atomic.Int64 // Addresses in mem.
+	limit int64
+	dir   string     // Directory of the runs, empty for os.TempDir.
+	runs  []*os.File // Sorted runs of little-endian uint32 addresses.
+}
+
+// NewSpillSet creates an empty SpillSet that spills after limit addresses.
+func NewSpillSet(limit int64) *SpillSet {
+	return newSpillSetHash(limit, defaultHash)
+}
+
+// newSpillSetHash creates an empty SpillSet whose in-memory set shards addresses with hash.
+func newSpillSetHash(limit int64, hash hashFunc) *SpillSet {
+	return &SpillSet{mem: newSparseSetHash(hash), limit: limit}
+}
+
+// Set adds the given IPv4 address to the set, spilling the in-memory addresses first
+// if the limit has been reached.
+func (s *SpillSet) Set(ip uint32) {
+	s.mu.RLock()
+	added := s.mem.add(ip)
+	s.mu.RUnlock()
+	if added && s.size.Add(1) >= s.limit {
+		if err := s.spill(); err != nil {
+			// Spilling is what keeps memory bounded; counting on without it could exhaust it.
+			fmt.Fprintln(diag, "Error:", err)
+			scratch.removeAll()
+			os.Exit(1)
+		}
+	}
+}
+
+// spill writes the in-memory addresses to a new sorted run and empties the in-memory set.
+func (s *SpillSet) spill() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.size.Load() < s.limit {
+		return nil // Another goroutine spilled first.
+	}
+	f, err := scratch.create(s.dir, "ipcounter-run-*")
+	if err != nil {
+		return fmt.Errorf("error creating spill file: %w", err)
+	}
+	w := bufio.NewWriter(f)
+	var buf [4]byte
+	n := 0
+	s.mem.ForEach(func(ip uint32) {
+		binary.LittleEndian.PutUint32(buf[:], ip)
+		w.Write(buf[:])
+		n++
+	})
+	if err := w.Flush(); err != nil {
+		scratch.remove(f)
+		return fmt.Errorf("error writing spill file: %w", err)
+	}
+	s.runs = append(s.runs, f)
+	s.mem = newSparseSetHash(s.mem.hash)
+	s.size.Store(0)
+	fmt.Fprintf(diag, "Spilled %d address(es) to sorted run %d on disk\n", n, len(s.runs))
+	return nil
+}
+
+// Close removes the spilled runs. The set must not be used afterwards.
+func (s *SpillSet) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, f := range s.runs {
+		scratch.remove(f)
+	}
+	s.runs = nil
+	return nil
+}
+
+// runCursor reads the addresses of one sorted run, or of the sorted in-memory addresses.
+type runCursor struct {
+	r   *bufio.Reader // nil for the in-memory addresses.
+	mem []uint32
+	cur uint32
+}
+
+// next advances the cursor and reports whether an address was read.
+func (c *runCursor) next() bool {
+	if c.r == nil {
+		if len(c.mem) == 0 {
+			return false
+		}
+		c.cur, c.mem = c.mem[0], c.mem[1:]
+		return true
+	}
+	var buf [4]byte
+	if _, err := io.ReadFull(c.r, buf[:]); err != nil {
+		return false
+	}
+	c.cur = binary.LittleEndian.Uint32(buf[:])
+	return true
+}
+
+// cursorHeap is a min-heap of cursors ordered by their current address.
+type cursorHeap []*runCursor
+
+func (h cursorHeap) Len() int           { return len(h) }
+func (h cursorHeap) Less(i, j int) bool { return h[i].cur < h[j].cur }
+func (h cursorHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h *cursorHeap) Push(x any)        { *h = append(*h, x.(*runCursor)) }
+func (h *cursorHeap) Pop() any {
+	old := *h
+	c := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return c
+}
+
+// ForEach calls fn for every address in the set, in ascending order, by merging the runs
+// with the in-memory addresses. Addresses present in several runs are reported once.
+func (s *SpillSet) ForEach(fn func(ip uint32)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	mem := make([]uint32, 0, s.size.Load())
+	s.mem.ForEach(func(ip uint32) { mem = append(mem, ip) })
+	h := cursorHeap{}
+	if c := (&runCursor{mem: mem}); c.next() {
+		h = append(h, c)
+	}
+	for _, f := range s.runs {
+		c := &runCursor{r: bufio.NewReader(io.NewSectionReader(f, 0, 1<<62))}
+		if c.next() {
+			h = append(h, c)
+		}
+	}
+	heap.Init(&h)
+	first := true
+	var last uint32
+	for len(h) > 0 {
+		c := h[0]
+		if first || c.cur != last {
+			fn(c.cur)
+			first, last = false, c.cur
+		}
+		if c.next() {
+			heap.Fix(&h, 0)
+		} else {
+			heap.Pop(&h)
+		}
+	}
+}
+
+// runContains reports whether the sorted run f holds an address in [start, end],
+// using a binary search with positional reads.
+func runContains(f *os.File, start, end uint32) bool {
+	stat, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	var buf [4]byte
+	at := func(i int) uint32 {
+		if _, err := f.ReadAt(buf[:], int64(i)*4); err != nil {
+			return ^uint32(0)
+		}
+		return binary.LittleEndian.Uint32(buf[:])
+	}
+	n := int(stat.Size() / 4)
+	i := sort.Search(n, func(i int) bool { return at(i) >= start })
+	return i < n && at(i) <= end
+}
+
+// IsSet reports whether the given IPv4 address is in the set.
+func (s *SpillSet) IsSet(ip uint32) bool {
+	return s.AnySetInRange(ip, ip)
+}
+
+// AnySetInRange reports whether any address in the inclusive range [start, end] is in the set.
+func (s *SpillSet) AnySetInRange(start, end uint32) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.mem.AnySetInRange(start, end) {
+		return true
+	}
+	for _, f := range s.runs {
+		if runContains(f, start, end) {
+			return true
+		}
+	}
+	return false
+}
+
+// Count returns the number of unique IPv4 addresses.
+func (s *SpillSet) Count() int {
+	if len(s.runs) == 0 {
+		return int(s.size.Load())
+	}
+	count := 0
+	s.ForEach(func(uint32) { count++ })
+	return count
+}
+
+// CountRange returns the number of addresses in the inclusive range [start, end] that are in the set.
+func (s *SpillSet) CountRange(start, end uint32) int {
+	count := 0
+	s.ForEach(func(ip uint32) {
+		if ip >= start && ip <= end {
+			count++
+		}
+	})
+	return count
+}
+
+// BitSet returns a dense AtomicBitSet holding the same addresses.
+func (s *SpillSet) BitSet() *AtomicBitSet {
+	bs := NewAtomicBitSet()
+	s.ForEach(bs.Set)
+	return bs
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"io"
+	"os"
+	"testing"
+)
+
+// TestTmpDir counts addresses into a spilling set whose runs go to a scratch directory,
+// as with --tmpdir, and checks that the runs are created there and removed by Close, and
+// that removeAll removes the scratch files still registered.
+func TestTmpDir(t *testing.T) {
+	out := diag
+	diag = io.Discard
+	t.Cleanup(func() { diag = out })
+	tmp := t.TempDir()
+	count := func() int {
+		entries, _ := os.ReadDir(tmp)
+		return len(entries)
+	}
+	set := NewSpillSet(1000)
+	set.dir = tmp
+	for ip := range uint32(5500) {
+		set.Set(ip * 7)
+	}
+	if n := count(); n != 5 {
+		t.Fatalf("%d run(s) in --tmpdir, expected 5", n)
+	}
+	if got := set.Count(); got != 5500 {
+		t.Fatalf("counted %d address(es), expected 5500", got)
+	}
+	set.Close()
+	if n := count(); n != 0 {
+		t.Fatalf("%d run(s) left in --tmpdir after Close", n)
+	}
+	for range 3 {
+		if _, err := scratch.create(tmp, "left-*"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := scratch.removeAll(); n != 3 || count() != 0 {
+		t.Fatalf("removeAll removed %d of 3 file(s), %d left", n, count())
+	}
+}
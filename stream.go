@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"math"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// --- JSON Stats Stream ---
+// byteProgress counts the input bytes processed so far for --json-stats-stream.
+type byteProgress struct {
+	done  atomic.Int64
+	total atomic.Int64 // Size of all inputs, 0 if unknown (pipes and followed files).
+}
+
+// streamStats is one line of --json-stats-stream.
+type streamStats struct {
+	Final     bool     `json:"final"`
+	Bytes     int64    `json:"bytes"`
+	Total     int64    `json:"total,omitempty"`
+	Percent   *float64 `json:"percent,omitempty"`
+	Unique    int      `json:"unique"`
+	ElapsedMs int64    `json:"elapsed_ms"`
+	Status    Status   `json:"status,omitempty"`
+	Error     string   `json:"error,omitempty"`
+}
+
+// percent returns done as a percentage of total, rounded to a tenth, or nil if total is
+// unknown. It never exceeds 100, even if some input was processed twice.
+func percent(done, total int64) *float64 {
+	if total <= 0 {
+		return nil
+	}
+	p := min(100, math.Round(float64(done)*1000/float64(total))/10)
+	return &p
+}
+
+// trackWindows calls fn with record-aligned windows of data of about rateWindow bytes,
+// adding the size of each to p once it has been processed, and stops at the first error
+// returned by fn. If p is nil, fn is called once with all of data.
+func trackWindows(data []byte, p *byteProgress, whitespace bool, fn func(window []byte) error) error {
+	if p == nil {
+		return fn(data)
+	}
+	for base := 0; base < len(data); {
+		end := windowEnd(data, base, whitespace)
+		if err := fn(data[base:end]); err != nil {
+			return atOffset(err, int64(base))
+		}
+		p.done.Add(int64(end - base))
+		base = end
+	}
+	return nil
+}
+
+// startStatsStream writes a streamStats line with the bytes processed and the running
+// unique count of set to w every interval until the returned stop function is called.
+// The counts are taken like those of startInterimCounts. Calling stop more than once
+// is safe.
+func startStatsStream(w io.Writer, set IPSet, p *byteProgress, interval time.Duration, atomic bool) (stop func()) {
+	done := make(chan struct{})
+	finished := make(chan struct{})
+	startTime := time.Now()
+	enc := json.NewEncoder(w)
+	go func() {
+		defer close(finished)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				bytes, total := p.done.Load(), p.total.Load()
+				enc.Encode(streamStats{
+					Bytes: bytes, Total: total, Percent: percent(bytes, total),
+					Unique: interimCount(set, atomic), ElapsedMs: time.Since(startTime).Milliseconds(),
+				})
+			}
+		}
+	}()
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			close(done)
+			<-finished
+		})
+	}
+}
+
+// writeFinalStats writes the last line of --json-stats-stream, marked final, with the
+// exact unique count and the status of res.
+func writeFinalStats(w io.Writer, res Result) error {
+	final := streamStats{
+		Final: true, Bytes: res.Bytes, Unique: res.Unique, ElapsedMs: res.DurationMs,
+		Status: res.Status, Error: res.Error,
+	}
+	if res.Status != StatusError {
+		final.Total = res.Bytes
+		final.Percent = percent(res.Bytes, res.Bytes)
+	}
+	return json.NewEncoder(w).Encode(final)
+}
+
+// startProgress starts the periodic reports selected by --interval: a JSON stats line
+// on stdout with --json-stats-stream, and a running unique count otherwise.
+func startProgress(set IPSet, opts *options) (stop func()) {
+	if opts.interval <= 0 {
+		return func() {}
+	}
+	if opts.progress != nil {
+		return startStatsStream(os.Stdout, set, opts.progress, opts.interval, opts.atomicInterim)
+	}
+	return startInterimCounts(set, opts.interval, opts.atomicInterim)
+}
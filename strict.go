@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// --- Strict Parsing ---
+// maxReportedRecord is the number of bytes of an invalid record included in the error.
+const maxReportedRecord = 64
+
+// invalidRecordError locates the first invalid record found with --strict. Its offset is
+// relative to the data it was found in until atOffset moves it into the file's coordinates,
+// and its line number is filled in by resolveLine.
+type invalidRecordError struct {
+	offset int64  // Byte offset of the record.
+	line   int64  // One-based line number, 0 if not resolved.
+	record string // The record, truncated to maxReportedRecord bytes.
+}
+
+func (e *invalidRecordError) Error() string {
+	if e.line > 0 {
+		return fmt.Sprintf("%v at line %d: %q", ErrInvalidRecord, e.line, e.record)
+	}
+	return fmt.Sprintf("%v at byte offset %d: %q", ErrInvalidRecord, e.offset, e.record)
+}
+
+func (e *invalidRecordError) Unwrap() error {
+	return ErrInvalidRecord
+}
+
+// newInvalidRecord returns the error for the invalid record starting at offset in data.
+func newInvalidRecord(data []byte, offset int) error {
+	record := data[offset:]
+	if end := bytes.IndexByte(record, '\n'); end >= 0 {
+		record = record[:end]
+	}
+	if len(record) > maxReportedRecord {
+		record = record[:maxReportedRecord]
+	}
+	return &invalidRecordError{offset: int64(offset), record: string(record)}
+}
+
+// atOffset moves the location of an invalid record error or a worker panic error by base,
+// the offset of the data it was found in. Other errors are returned unchanged.
+func atOffset(err error, base int64) error {
+	var re *invalidRecordError
+	if errors.As(err, &re) {
+		re.offset += base
+	}
+	var pe *workerPanicError
+	if errors.As(err, &pe) {
+		pe.start += base
+		pe.end += base
+	}
+	return err
+}
+
+// streamLines counts the newlines of the blocks of a stream, to fill in the line number of
+// an invalid record error found in a block, as resolveLine does for a file.
+type streamLines struct {
+	lines int64 // Newlines in the blocks so far.
+}
+
+// process calls fn with block and fills in the line number of an invalid record error it
+// returns, whose offset is relative to block.
+func (sl *streamLines) process(block []byte, fn func(block []byte) error) error {
+	err := fn(block)
+	var re *invalidRecordError
+	if errors.As(err, &re) && re.line == 0 && re.offset >= 0 && re.offset <= int64(len(block)) {
+		re.line = sl.lines + int64(bytes.Count(block[:re.offset], []byte{'\n'})) + 1
+	}
+	sl.lines += int64(bytes.Count(block, []byte{'\n'}))
+	return err
+}
+
+// resolveLine fills in the line number of an invalid record error by counting the
+// newlines in file before the record. Other errors are returned unchanged.
+func resolveLine(file *os.File, err error) error {
+	var re *invalidRecordError
+	if !errors.As(err, &re) || re.line > 0 {
+		return err
+	}
+	lines := int64(1)
+	if _, countErr := readBlocks(file, 0, re.offset, true, readBlockSize, func(block []byte) error {
+		lines += int64(bytes.Count(block, []byte{'\n'}))
+		return nil
+	}); countErr == nil {
+		re.line = lines
+	}
+	return err
+}
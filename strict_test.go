@@ -0,0 +1,54 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// TestStrictLocation counts files with --strict whose first invalid non-empty line lies in
+// the first or the last chunk of several workers, or is the final line without a newline,
+// and checks that the error reports its line number and content. Empty lines are not
+// records and must not fail.
+func TestStrictLocation(t *testing.T) {
+	out := diag
+	diag = io.Discard
+	t.Cleanup(func() { diag = out })
+	var lines []string
+	for i := range 3 * ChunkMinSize / 12 {
+		lines = append(lines, formatIP(uint32(i)))
+		if i%1000 == 0 {
+			lines = append(lines, "")
+		}
+	}
+	dir := t.TempDir()
+	for _, at := range []int{0, 17, len(lines) / 2, len(lines) - 1, len(lines)} {
+		bad := slices.Insert(slices.Clone(lines), at, "1.2.3.400")
+		path := filepath.Join(dir, fmt.Sprintf("strict-%d.txt", at))
+		if err := os.WriteFile(path, []byte(strings.Join(bad, "\n")), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		for _, workers := range []string{"1", "4"} {
+			opts, err := parseFlags([]string{"--strict", "--workers", workers, path})
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = countUniqueIpInFile(path, opts)
+			var re *invalidRecordError
+			if !errors.As(err, &re) || !errors.Is(err, ErrInvalidRecord) {
+				t.Fatalf("line %d, %s worker(s): returned %v, expected an invalid record", at+1, workers, err)
+			}
+			if re.line != int64(at+1) || re.record != "1.2.3.400" || !strings.Contains(err.Error(), fmt.Sprintf("line %d:", at+1)) {
+				t.Errorf("line %d, %s worker(s): reported %v", at+1, workers, err)
+			}
+		}
+	}
+	if _, err := parseFlags([]string{"--strict", "--extract", "ips.txt"}); err == nil {
+		t.Error("--strict --extract accepted")
+	}
+}
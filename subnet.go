@@ -0,0 +1,157 @@
+package main
+
+import "sync/atomic"
+
+// --- Subnet Restriction ---
+// RangeBitSet is a bitset covering a single range of addresses, indexed by the offset of an
+// address within the range. For a /8 it needs 2MB instead of the 512MB of a full bitset.
+// Addresses outside the range are skipped by Set.
+type RangeBitSet struct {
+	r    ipRange
+	bits *AtomicBitSet
+}
+
+// NewRangeBitSet creates an empty RangeBitSet covering r.
+func NewRangeBitSet(r ipRange) *RangeBitSet {
+	return &RangeBitSet{r: r, bits: newAtomicBitSetSize(r.size())}
+}
+
+// Set marks the given IPv4 address if it lies within the range.
+func (rs *RangeBitSet) Set(ip uint32) {
+	if ip >= rs.r.start && ip <= rs.r.end {
+		rs.bits.Set(ip - rs.r.start)
+	}
+}
+
+// SetNew adds the address like Set and reports whether it lies within the range and was
+// not in the set yet.
+func (rs *RangeBitSet) SetNew(ip uint32) bool {
+	return ip >= rs.r.start && ip <= rs.r.end && rs.bits.SetNew(ip-rs.r.start)
+}
+
+// IsSet reports whether the given IPv4 address lies within the range and is in the set.
+func (rs *RangeBitSet) IsSet(ip uint32) bool {
+	return ip >= rs.r.start && ip <= rs.r.end && rs.bits.IsSet(ip-rs.r.start)
+}
+
+// Count returns the number of unique IPv4 addresses within the range.
+func (rs *RangeBitSet) Count() int {
+	return rs.bits.Count()
+}
+
+// CountConcurrent returns the number of addresses in the set like AtomicBitSet.CountConcurrent.
+func (rs *RangeBitSet) CountConcurrent() int {
+	return rs.bits.CountConcurrent()
+}
+
+// clip intersects [start, end] with the range and returns it as offsets into the bitset.
+func (rs *RangeBitSet) clip(start, end uint32) (uint32, uint32, bool) {
+	start, end = max(start, rs.r.start), min(end, rs.r.end)
+	if start > end {
+		return 0, 0, false
+	}
+	return start - rs.r.start, end - rs.r.start, true
+}
+
+// CountRange returns the number of addresses in the inclusive range [start, end] that are in the set.
+func (rs *RangeBitSet) CountRange(start, end uint32) int {
+	start, end, ok := rs.clip(start, end)
+	if !ok {
+		return 0
+	}
+	return rs.bits.CountRange(start, end)
+}
+
+// AnySetInRange reports whether any address in the inclusive range [start, end] is in the set.
+func (rs *RangeBitSet) AnySetInRange(start, end uint32) bool {
+	start, end, ok := rs.clip(start, end)
+	return ok && rs.bits.AnySetInRange(start, end)
+}
+
+// ForEach calls fn for every address in the set, in ascending order.
+func (rs *RangeBitSet) ForEach(fn func(ip uint32)) {
+	rs.bits.ForEach(func(offset uint32) {
+		fn(rs.r.start + offset)
+	})
+}
+
+// BitSet returns a full-size AtomicBitSet holding the same addresses.
+func (rs *RangeBitSet) BitSet() *AtomicBitSet {
+	bs := NewAtomicBitSet()
+	rs.ForEach(bs.Set)
+	return bs
+}
+
+// filteredSet wraps an IPSet and skips addresses outside all of the given ranges.
+type filteredSet struct {
+	IPSet
+	ranges rangeList
+}
+
+// Set adds the address to the underlying set if it lies within one of the ranges.
+func (fs *filteredSet) Set(ip uint32) {
+	if fs.ranges.contains(ip) {
+		fs.IPSet.Set(ip)
+	}
+}
+
+// SetNew adds the address like Set and reports whether it was added and not present yet.
+func (fs *filteredSet) SetNew(ip uint32) bool {
+	return fs.ranges.contains(ip) && setNew(fs.IPSet, ip)
+}
+
+// exclusions holds the ranges given with --exclude-subnet and counts the records they excluded.
+type exclusions struct {
+	ranges   rangeList
+	excluded atomic.Int64
+}
+
+// excludedSet wraps an IPSet and skips addresses within any excluded range.
+type excludedSet struct {
+	IPSet
+	ex *exclusions
+}
+
+// Set adds the address to the underlying set unless it lies within an excluded range.
+func (es *excludedSet) Set(ip uint32) {
+	if es.ex.ranges.contains(ip) {
+		es.ex.excluded.Add(1)
+		return
+	}
+	es.IPSet.Set(ip)
+}
+
+// SetNew adds the address like Set and reports whether it was added and not present yet.
+func (es *excludedSet) SetNew(ip uint32) bool {
+	if es.ex.ranges.contains(ip) {
+		es.ex.excluded.Add(1)
+		return false
+	}
+	return setNew(es.IPSet, ip)
+}
+
+func (es *excludedSet) unwrap() IPSet { return es.IPSet }
+
+// admits reports whether the --subnet and --exclude-subnet wrappers of set, if any, pass
+// the address on to the underlying set.
+func admits(set IPSet, ip uint32) bool {
+	for {
+		switch s := set.(type) {
+		case *filteredSet:
+			if !s.ranges.contains(ip) {
+				return false
+			}
+		case *excludedSet:
+			if s.ex.ranges.contains(ip) {
+				return false
+			}
+		}
+		w, ok := set.(setWrapper)
+		if !ok {
+			return true
+		}
+		set = w.unwrap()
+	}
+}
+
+func (fs *filteredSet) unwrap() IPSet { return fs.IPSet }
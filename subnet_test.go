@@ -0,0 +1,38 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+// TestExcludeSubnet counts addresses around overlapping, nested and adjacent
+// --exclude-subnet ranges, which must merge into the ranges they cover together, and checks
+// the addresses counted and the records excluded.
+func TestExcludeSubnet(t *testing.T) {
+	opts, err := parseFlags([]string{
+		"--exclude-subnet", "10.0.0.0/24", "--exclude-subnet", "10.0.0.128/25",
+		"--exclude-subnet", "10.0.1.0/24", "--exclude-subnet", "192.168.0.0/16",
+		"--exclude-subnet", "192.168.4.0/22", "--exclude-subnet", "172.16.0.0/32", "ips.txt",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := rangeList{{0x0a000000, 0x0a0001ff}, {0xac100000, 0xac100000}, {0xc0a80000, 0xc0a8ffff}}
+	if !slices.Equal(opts.exclude.ranges, want) {
+		t.Errorf("merged the ranges into %v, expected %v", opts.exclude.ranges, want)
+	}
+	data := []byte("9.255.255.255\n10.0.0.0\n10.0.0.200\n10.0.1.255\n10.0.2.0\n172.16.0.0\n172.16.0.1\n" +
+		"192.168.5.5\n192.168.255.255\n192.169.0.0\n10.0.0.0\n")
+	set := newIPSet(opts)
+	if err := processData(data, set, 1, opts); err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	set.ForEach(func(ip uint32) { got = append(got, formatIP(ip)) })
+	if want := []string{"9.255.255.255", "10.0.2.0", "172.16.0.1", "192.169.0.0"}; !slices.Equal(got, want) {
+		t.Errorf("counted %v, expected %v", got, want)
+	}
+	if n := opts.exclude.excluded.Load(); n != 7 {
+		t.Errorf("excluded %d record(s), expected 7", n)
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import "bytes"
+
+// --- Syslog (RFC 5424) Messages ---
+// syslogParam returns the value of the SD-PARAM named param in the structured data of
+// an RFC 5424 syslog message, such as the "1.2.3.4" of
+//
+//	<34>1 2003-10-11T22:14:15.003Z host app - ID47 [origin ip="1.2.3.4"] message
+//
+// Only the elements whose SD-ID is sdID are searched, or every element if sdID is empty,
+// and the first matching parameter wins. The header fields before the structured data
+// are checked only as far as needed to skip them: a priority of 1 to 3 digits in angle
+// brackets, a version, and five fields separated by single spaces. ok is false for a
+// line that does not conform that far, whose structured data is malformed, or that has
+// no such parameter. The value is returned as written, with any escapes left in place.
+func syslogParam(line, sdID, param []byte) (value []byte, ok bool) {
+	rest, ok := syslogHeader(line)
+	if !ok || len(rest) == 0 || rest[0] != '[' {
+		return nil, false
+	}
+	var found []byte
+	for len(rest) > 0 && rest[0] == '[' {
+		end := bytes.IndexAny(rest, " ]")
+		if end <= 1 {
+			return nil, false
+		}
+		id := rest[1:end]
+		match := len(sdID) == 0 || bytes.Equal(id, sdID)
+		rest = rest[end:]
+		for len(rest) > 0 && rest[0] == ' ' {
+			eq := bytes.IndexByte(rest, '=')
+			if eq <= 1 || eq+1 >= len(rest) || rest[eq+1] != '"' {
+				return nil, false
+			}
+			name := rest[1:eq]
+			val, n, ok := syslogParamValue(rest[eq+2:])
+			if !ok {
+				return nil, false
+			}
+			if match && found == nil && bytes.Equal(name, param) {
+				found = val
+			}
+			rest = rest[eq+2+n:]
+		}
+		if len(rest) == 0 || rest[0] != ']' {
+			return nil, false
+		}
+		rest = rest[1:]
+	}
+	if len(rest) > 0 && rest[0] != ' ' && rest[0] != '\r' {
+		return nil, false
+	}
+	return found, found != nil
+}
+
+// syslogHeader skips the header of an RFC 5424 message up to its structured data,
+// returning the rest of line.
+func syslogHeader(line []byte) (rest []byte, ok bool) {
+	end := bytes.IndexByte(line, '>')
+	if len(line) < 3 || line[0] != '<' || end < 2 || end > 4 || !allDigits(line[1:end]) {
+		return nil, false
+	}
+	rest = line[end+1:]
+	// The version, timestamp, hostname, app name, process ID and message ID, each
+	// followed by one space; "-" stands for a missing value.
+	for i := 0; i < 6; i++ {
+		sp := bytes.IndexByte(rest, ' ')
+		if sp <= 0 || i == 0 && (!allDigits(rest[:sp]) || rest[0] == '0' || sp > 2) {
+			return nil, false
+		}
+		rest = rest[sp+1:]
+	}
+	return rest, true
+}
+
+// syslogParamValue returns the value of an SD-PARAM, from s just after its opening quote,
+// and the number of bytes up to and including its closing quote. A backslash escapes the
+// character after it.
+func syslogParamValue(s []byte) (value []byte, n int, ok bool) {
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			i++
+		case '"':
+			return s[:i], i + 1, true
+		}
+	}
+	return nil, 0, false
+}
+
+// allDigits reports whether b is a non-empty run of decimal digits.
+func allDigits(b []byte) bool {
+	for _, c := range b {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return len(b) > 0
+}
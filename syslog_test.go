@@ -0,0 +1,48 @@
+package main
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+// TestSyslog counts representative RFC 5424 messages, conforming and not, with --syslog
+// and --strip-port, and checks that only the "ip" parameters of their "origin" elements
+// count, and that they are found in any element with an empty --syslog-sd-id.
+func TestSyslog(t *testing.T) {
+	data := strings.Join([]string{
+		`<34>1 2003-10-11T22:14:15.003Z mymachine.example.com su - ID47 [origin ip="1.2.3.4"] 'su root' failed`,
+		`<165>1 2003-08-24T05:14:15.000003-07:00 192.0.2.1 myproc 8710 - [exampleSDID@32473 iut="3" eventSource="Application" eventID="1011"][origin ip="10.0.0.1:443" software="x"] BOMAn application event`,
+		`<13>1 - - - - - [origin software="a \"quoted\" [name\]" ip="10.0.0.2"]`,
+		`<13>1 - host app 1 - [origin ip="10.0.0.3"]` + "\r",
+		`<13>1 - host app 1 - [meta ip="10.0.0.4"]`,
+		`<13>1 - host app 1 - - 10.0.0.5`,
+		`<13>1 - host app 1 - [origin ip=10.0.0.6]`,
+		`<13>1 - host app 1 - [origin ip="10.0.0.7"`,
+		`<13>1 - host app 1 - [origin ip="10.0.0.8"]x`,
+		`<13>1  - host app 1 - [origin ip="10.0.0.9"]`,
+		`<1234>1 - host app 1 - [origin ip="10.0.0.10"]`,
+		`<13>0 - host app 1 - [origin ip="10.0.0.11"]`,
+		`Oct 11 22:14:15 mymachine su: [origin ip="10.0.0.12"]`,
+		`<13>1 - host app 1 - [origin ip="10.0.0.256"]`,
+		`7.7.7.7`,
+	}, "\n")
+	for _, c := range []struct {
+		sdID string
+		want []string
+	}{
+		{"origin", []string{"1.2.3.4", "10.0.0.1", "10.0.0.2", "10.0.0.3"}},
+		{"", []string{"1.2.3.4", "10.0.0.1", "10.0.0.2", "10.0.0.3", "10.0.0.4"}},
+	} {
+		set := NewSparseSet()
+		opts := &options{minRecordLen: MinIPLen, syslog: true, syslogSDID: c.sdID, syslogParam: "ip", stripPort: true}
+		if err := processData([]byte(data), set, 1, opts); err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		set.ForEach(func(ip uint32) { got = append(got, formatIP(ip)) })
+		if !slices.Equal(got, c.want) {
+			t.Fatalf("--syslog-sd-id %q: counted %v, expected %v", c.sdID, got, c.want)
+		}
+	}
+}
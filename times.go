@@ -0,0 +1,279 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// --- First/Last Seen Tracking ---
+// ipTimes maps an IPv4 address to the first (min) and last (max) epoch timestamp it was seen at.
+// Unlike the bitset, its memory grows with the number of unique addresses (roughly 40-50 bytes
+// per entry including map overhead), so it is only used when --track-times is given.
+type ipTimes map[uint32][2]int64
+
+// timeColumns holds the zero-based whitespace-separated field positions of timestamped input.
+type timeColumns struct {
+	time int // Field holding the epoch timestamp.
+	ip   int // Field holding the IPv4 address.
+}
+
+// observe records that ip was seen at timestamp ts.
+func (t ipTimes) observe(ip uint32, ts int64) {
+	seen, ok := t[ip]
+	if !ok {
+		t[ip] = [2]int64{ts, ts}
+		return
+	}
+	seen[0] = min(seen[0], ts)
+	seen[1] = max(seen[1], ts)
+	t[ip] = seen
+}
+
+// merge folds the entries of other into t.
+func (t ipTimes) merge(other ipTimes) {
+	for ip, seen := range other {
+		t.observe(ip, seen[0])
+		t.observe(ip, seen[1])
+	}
+}
+
+// isFieldSpace reports whether c separates fields in a line.
+func isFieldSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\r'
+}
+
+// field returns the n-th (zero-based) field of line, where fields are separated by
+// runs of spaces or tabs. Returns nil if the line has fewer fields.
+func field(line []byte, n int) []byte {
+	i := 0
+	for {
+		for i < len(line) && isFieldSpace(line[i]) {
+			i++
+		}
+		if i == len(line) {
+			return nil
+		}
+		start := i
+		for i < len(line) && !isFieldSpace(line[i]) {
+			i++
+		}
+		if n == 0 {
+			return line[start:i]
+		}
+		n--
+	}
+}
+
+// parseEpoch parses a non-negative integer epoch timestamp. A fractional part, if present, is ignored.
+func parseEpoch(b []byte) (int64, bool) {
+	if dot := bytes.IndexByte(b, '.'); dot >= 0 {
+		b = b[:dot]
+	}
+	if len(b) == 0 || len(b) > 18 {
+		return 0, false
+	}
+	var ts int64
+	for _, c := range b {
+		if c < '0' || c > '9' {
+			return 0, false
+		}
+		ts = ts*10 + int64(c-'0')
+	}
+	return ts, true
+}
+
+// timeLayoutEpoch is the --time-layout of integer epoch timestamps, parsed by parseEpoch.
+const timeLayoutEpoch = "epoch"
+
+// timeParser parses the timestamp field of a record into Unix seconds.
+type timeParser func(b []byte) (int64, bool)
+
+// newTimeParser returns the parser for the --time-layout layout: parseEpoch for "epoch",
+// and otherwise a parser of the Go time layout, such as 2006-01-02T15:04:05Z07:00.
+// Timestamps without a zone are taken as UTC.
+func newTimeParser(layout string) timeParser {
+	if layout == timeLayoutEpoch {
+		return parseEpoch
+	}
+	return func(b []byte) (int64, bool) {
+		t, err := time.Parse(layout, string(b))
+		if err != nil {
+			return 0, false
+		}
+		return t.Unix(), true
+	}
+}
+
+// timeExclusion is the --exclude-time range of timestamps whose records are skipped.
+type timeExclusion struct {
+	start, end int64        // Inclusive range of excluded Unix seconds.
+	excluded   atomic.Int64 // Records skipped so far.
+}
+
+// parseTimeExclusion parses an inclusive START..END range for --exclude-time, with both
+// ends in the layout parsed by parse.
+func parseTimeExclusion(s string, parse timeParser) (*timeExclusion, error) {
+	from, to, ok := strings.Cut(s, "..")
+	if !ok {
+		return nil, fmt.Errorf("invalid --exclude-time %q, expected START..END", s)
+	}
+	start, ok := parse([]byte(from))
+	end, ok2 := parse([]byte(to))
+	if !ok || !ok2 {
+		return nil, fmt.Errorf("invalid --exclude-time %q: the timestamps do not match --time-layout", s)
+	}
+	if start > end {
+		return nil, errors.New("--exclude-time must not end before it starts")
+	}
+	return &timeExclusion{start: start, end: end}, nil
+}
+
+// contains reports whether ts lies in the excluded range.
+func (e *timeExclusion) contains(ts int64) bool {
+	return ts >= e.start && ts <= e.end
+}
+
+// printExcludedTimes reports the records skipped by --exclude-time and records their
+// number in res.
+func printExcludedTimes(opts *options, res *Result) {
+	if e := opts.excludeTime; e != nil {
+		res.Excluded = e.excluded.Load()
+		fmt.Fprintf(diag, "Records excluded by --exclude-time: %d\n", res.Excluded)
+	}
+}
+
+// processTimedChunk processes the lines of data from startChunk to endChunk as `timestamp ip`
+// records, adding each address to the set and recording its first/last timestamp in times.
+// Lines with a missing or invalid timestamp or address are skipped, and so are those with
+// a timestamp in exclude, if not nil, which are counted in it, and addresses the set does
+// not take, such as those outside --subnet. If roam is not nil, the
+// identifier of each record is recorded with its address as well, and if buckets is not
+// nil, the address is added to the time bucket of its timestamp. If sessions is not nil,
+// the sessions of the chunk are counted in it.
+func processTimedChunk(data []byte, startChunk, endChunk int, cols timeColumns, parse parseFunc, parseTime timeParser, exclude *timeExclusion, bitSet IPSet, times ipTimes, roam *roamingTracker, buckets *timeBuckets, sessions *ipSessions, wg *sync.WaitGroup) {
+	defer wg.Done()
+	cursor := bucketCursor{tb: buckets}
+	var excluded int64
+	if exclude != nil {
+		defer func() { exclude.excluded.Add(excluded) }()
+	}
+	for lineStart := startChunk; lineStart < endChunk; {
+		lineEnd := bytes.IndexByte(data[lineStart:endChunk], '\n')
+		if lineEnd < 0 {
+			lineEnd = endChunk
+		} else {
+			lineEnd += lineStart
+		}
+		line := data[lineStart:lineEnd]
+		lineStart = lineEnd + 1
+
+		ip, ok := parse(field(line, cols.ip))
+		if !ok {
+			continue
+		}
+		ts, ok := parseTime(field(line, cols.time))
+		if !ok {
+			continue
+		}
+		if exclude != nil && exclude.contains(ts) {
+			excluded++
+			continue
+		}
+		bitSet.Set(ip)
+		// An address dropped by --subnet or --exclude-subnet is not recorded either.
+		if !admits(bitSet, ip) {
+			continue
+		}
+		times.observe(ip, ts)
+		if buckets != nil {
+			cursor.add(ts, ip)
+		}
+		if sessions != nil {
+			sessions.observe(ip, ts)
+		}
+		if roam != nil {
+			if key := field(line, roam.keyColumn); key != nil {
+				roam.observe(key, ip)
+			}
+		}
+	}
+}
+
+// processDataTimed is the --track-times counterpart of processData, parsing the address
+// field with parse and the timestamp field with parseTime. Each worker fills its own map,
+// and the maps are merged once all workers have finished. The exclusion, the roaming
+// tracker and the time buckets, if not nil, are shared by the workers. If sessions is not
+// nil, each worker counts the sessions of its chunk apart, and they are folded into
+// sessions in file order, after those of the data processed before. With safe, a panic of
+// a worker is returned as a *workerPanicError for its chunk.
+func processDataTimed(data []byte, bitSet IPSet, workers int, cols timeColumns, parse parseFunc, parseTime timeParser, exclude *timeExclusion, roam *roamingTracker, buckets *timeBuckets, sessions *ipSessions, safe bool) (ipTimes, error) {
+	chunks := splitChunks(data, workers, false)
+	local := make([]ipTimes, len(chunks))
+	runs := make([]*ipSessions, len(chunks))
+	panics := make([]error, len(chunks))
+
+	var wg sync.WaitGroup
+	wg.Add(len(chunks))
+	pool.grow(len(chunks))
+	for i, c := range chunks {
+		local[i] = make(ipTimes)
+		if sessions != nil {
+			runs[i] = sessions.run()
+		}
+		run := func(wg *sync.WaitGroup) {
+			processTimedChunk(data, c.start, c.end, cols, parse, parseTime, exclude, bitSet, local[i], roam, buckets, runs[i], wg)
+		}
+		task := func() { run(&wg) }
+		if safe {
+			task = guardChunk(i, c, &panics[i], &wg, run)
+		}
+		pool.Go(task)
+	}
+	wg.Wait()
+	if err := firstPanic(panics); err != nil {
+		return nil, err
+	}
+	if sessions != nil {
+		for _, run := range runs {
+			sessions.appendRun(run)
+		}
+	}
+
+	times := local[0]
+	for _, t := range local[1:] {
+		times.merge(t)
+	}
+	return times, nil
+}
+
+// printTimes prints the first/last seen timestamps of the given addresses,
+// or of every tracked address in ascending order if ips is empty, with the number of
+// sessions of each if sessions is not nil.
+func printTimes(times ipTimes, sessions *ipSessions, ips []uint32) {
+	if len(ips) == 0 {
+		ips = make([]uint32, 0, len(times))
+		for ip := range times {
+			ips = append(ips, ip)
+		}
+		slices.Sort(ips)
+	}
+	fmt.Fprintf(diag, "First/last seen (%d tracked address(es)):\n", len(times))
+	for _, ip := range ips {
+		seen, ok := times[ip]
+		if !ok {
+			fmt.Fprintf(diag, "%s not seen\n", formatIP(ip))
+			continue
+		}
+		if sessions != nil {
+			fmt.Fprintf(diag, "%s first=%d last=%d sessions=%d\n", formatIP(ip), seen[0], seen[1], sessions.ips[ip].count)
+			continue
+		}
+		fmt.Fprintf(diag, "%s first=%d last=%d\n", formatIP(ip), seen[0], seen[1])
+	}
+}
@@ -0,0 +1,35 @@
+package main
+
+import "testing"
+
+// TestTimesFilteredSet checks that --track-times records no times for the addresses that
+// --subnet or --exclude-subnet drop.
+func TestTimesFilteredSet(t *testing.T) {
+	data := []byte("100 10.0.0.1\n200 10.0.0.2\n300 192.168.0.1\n400 10.0.0.1\n")
+	for _, tc := range []struct {
+		args []string
+		want map[uint32][2]int64
+	}{
+		{[]string{"--subnet", "10.0.0.0/8"}, map[uint32][2]int64{0x0a000001: {100, 400}, 0x0a000002: {200, 200}}},
+		{[]string{"--exclude-subnet", "10.0.0.2/32"}, map[uint32][2]int64{0x0a000001: {100, 400}, 0xc0a80001: {300, 300}}},
+		{[]string{"--subnet", "10.0.0.0/8", "--subnet", "11.0.0.0/8", "--exclude-subnet", "10.0.0.1/32"}, map[uint32][2]int64{0x0a000002: {200, 200}}},
+	} {
+		opts, err := parseFlags(append(tc.args, "--track-times", "ips.txt"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		set := newIPSet(opts)
+		times, err := processDataTimed(data, set, 2, timeColumns{time: 0, ip: 1}, parseIPFast, parseEpoch, nil, nil, nil, nil, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(times) != len(tc.want) {
+			t.Errorf("%v: times of %d address(es), expected %d", tc.args, len(times), len(tc.want))
+		}
+		for ip, want := range tc.want {
+			if got, ok := times[ip]; !ok || got != want {
+				t.Errorf("%v: %s seen %v, expected %v", tc.args, formatIP(ip), got, want)
+			}
+		}
+	}
+}